@@ -0,0 +1,529 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ganehag/open-modbus-goateway/internal/loadgen"
+	"github.com/ganehag/open-modbus-goateway/internal/vectors"
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+	"github.com/ganehag/open-modbus-goateway/pkg/handlers"
+	"github.com/ganehag/open-modbus-goateway/pkg/mqtt"
+)
+
+// version is the gateway version, set at build time with
+// -ldflags "-X main.version=<version>"
+var version = "dev"
+
+// command is a CLI subcommand
+type command struct {
+	description string
+	run         func(args []string) error
+}
+
+// commands maps CLI subcommands to their implementation. Without a
+// subcommand, the gateway is started.
+var commands = map[string]command{
+	"vectors": {
+		description: "Print request/response conformance test vectors as JSON",
+		run:         runVectors,
+	},
+	"convert": {
+		description: "Convert request/response payloads between the text and JSON formats",
+		run:         runConvert,
+	},
+	"scan": {
+		description: "Probe a Modbus TCP target or serial bus for responding unit IDs",
+		run:         runScan,
+	},
+	"exec": {
+		description: "Execute a single request payload directly, without a broker",
+		run:         runExec,
+	},
+	"simulate": {
+		description: "Serve a simulated device over Modbus TCP, optionally from a register map",
+		run:         runSimulate,
+	},
+	"inventory": {
+		description: "Report the identification of the devices of the registry as CSV or JSON",
+		run:         runInventory,
+	},
+	"schedule": {
+		description: "Print the heartbeat schedule and serial bus utilization of a configuration as JSON",
+		run:         runSchedule,
+	},
+	"loadgen": {
+		description: "Flood a gateway with synthetic requests and report throughput and latency",
+		run:         runLoadgen,
+	},
+	"schema": {
+		description: "Print the JSON Schema of the configuration file",
+		run:         runSchema,
+	},
+	"version": {
+		description: "Print the gateway version",
+		run: func(args []string) error {
+			fmt.Println(version)
+			return nil
+		},
+	},
+}
+
+// runCommand runs a CLI subcommand and returns the process exit code
+func runCommand(name string, args []string) int {
+	cmd, ok := commands[name]
+	if !ok {
+		if name == "help" || name == "-h" || name == "--help" {
+			usage()
+			return 0
+		}
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+		usage()
+		return 2
+	}
+
+	if err := cmd.run(args); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		return 1
+	}
+	return 0
+}
+
+// usage prints the available subcommands
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: open-modbus-goateway [command] [flags]\n\nWithout a command, the gateway is started.\n\nCommands:\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].description)
+	}
+}
+
+// runVectors prints the conformance test vectors of this gateway version
+func runVectors(args []string) error {
+	flags := flag.NewFlagSet("vectors", flag.ContinueOnError)
+	output := flags.String("o", "", "write the vectors to a file instead of stdout")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	// Failing vectors are expected, don't log them
+	log.SetOutput(io.Discard)
+
+	data, err := json.MarshalIndent(vectors.Generate(version), "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if *output == "" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(*output, data, 0644)
+}
+
+// runSchema writes the JSON Schema of the configuration file, e.g. for
+// autocompletion in editors
+func runSchema(args []string) error {
+	flags := flag.NewFlagSet("schema", flag.ContinueOnError)
+	output := flags.String("o", "", "write the schema to a file instead of stdout")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *output == "" {
+		_, err := os.Stdout.Write(config.Schema)
+		return err
+	}
+	return os.WriteFile(*output, config.Schema, 0644)
+}
+
+// runLoadgen publishes synthetic requests to the broker of the configuration
+// and reports the throughput and latency of the responses. Unless -external
+// is given, the requests are answered by a gateway started in process with
+// the dummy handler, which measures the gateway itself without any device.
+func runLoadgen(args []string) error {
+	flags := flag.NewFlagSet("loadgen", flag.ContinueOnError)
+	configPath := flags.String("config", "config/config.yaml", "configuration `file` providing the broker and topics")
+	requests := flags.Int("n", 10000, "number of requests")
+	rate := flags.Float64("rate", 0, "requests per second, 0 for as fast as possible")
+	inFlight := flags.Int("inflight", 100, "maximum number of requests awaiting their response")
+	devices := flags.Int("devices", 10, "number of device names the requests are spread over")
+	payload := flags.String("payload", loadgen.DefaultPayload, "request `payload`, {cookie} is replaced with a unique cookie")
+	timeout := flags.Duration("timeout", 10*time.Second, "time to wait for the responses after the last request")
+	external := flags.Bool("external", false, "load an already running gateway instead of one started with the dummy handler")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		return err
+	}
+
+	if !*external {
+		// The gateway in process must not take over the session, status or
+		// heartbeats of a gateway using the same configuration
+		gwCfg := *cfg
+		gwCfg.MQTT.ClientID += "-loadgen-gateway"
+		gwCfg.MQTT.StatusTopic, gwCfg.MQTT.ControlTopic = "", ""
+		gwCfg.Heartbeats, gwCfg.Routes = nil, nil
+
+		handler := &handlers.JSONHandler{Handler: &handlers.DummyHandler{}}
+		gateway, err := mqtt.NewClient(&gwCfg, handler, nil, nil, nil, gwCfg.Workers.Count)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		gateway.StartWorkers(ctx)
+		defer gateway.Stop()
+	}
+
+	// Stop publishing on Ctrl-C and report what was measured so far
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	report, err := loadgen.Run(ctx, loadgen.Options{
+		MQTT:     cfg.MQTT,
+		Requests: *requests,
+		Rate:     *rate,
+		InFlight: *inFlight,
+		Devices:  *devices,
+		Payload:  *payload,
+		Timeout:  *timeout,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println(report)
+	return nil
+}
+
+// runConvert converts the payloads given as arguments, or read line by line
+// from stdin, between the text and JSON formats
+func runConvert(args []string) error {
+	flags := flag.NewFlagSet("convert", flag.ContinueOnError)
+	dataType := flags.String("type", "", "decode the raw register values of a text response as this type")
+	order := flags.String("order", "", "byte order used with -type (ABCD, CDAB, BADC, DCBA)")
+	pretty := flags.Bool("pretty", false, "indent JSON output")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	convert := func(payload string) error {
+		var out string
+		var err error
+		if *dataType != "" {
+			out, err = handlers.DecodeResponse(payload, *dataType, *order)
+		} else {
+			out, err = handlers.Convert(payload)
+		}
+		if err != nil {
+			return err
+		}
+
+		if *pretty && strings.HasPrefix(out, "{") {
+			var buf bytes.Buffer
+			if json.Indent(&buf, []byte(out), "", "  ") == nil {
+				out = buf.String()
+			}
+		}
+		fmt.Println(out)
+		return nil
+	}
+
+	if flags.NArg() > 0 {
+		return convert(strings.Join(flags.Args(), " "))
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if err := convert(line); err != nil {
+			fmt.Fprintf(os.Stderr, "%q: %v\n", line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// runExec executes a request payload with the handlers of the gateway and
+// prints the response. It fails if the response reports an error.
+func runExec(args []string) error {
+	flags := flag.NewFlagSet("exec", flag.ContinueOnError)
+	configPath := flags.String("config", "", "configuration `file` providing the device registry and serial ports")
+	device := flags.String("device", "", "`name` of the addressed device, as in the request topic")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: open-modbus-goateway exec [flags] <payload>\n\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return fmt.Errorf("missing request payload")
+	}
+
+	cfg := &config.Config{}
+	if *configPath != "" {
+		var err error
+		if cfg, err = config.Load(*configPath); err != nil {
+			return err
+		}
+	}
+	if err := handlers.CheckErrorMessages(cfg.ErrorMessages); err != nil {
+		return err
+	}
+	if err := handlers.CheckPostProcessors(cfg.Devices); err != nil {
+		return err
+	}
+
+	modbusHandler := &handlers.ModbusHandler{Devices: cfg.Devices, Serial: cfg.Serial, Retry: cfg.Retry, TCP: cfg.TCP, DNS: cfg.DNS, Limits: cfg.RequestLimits}
+	defer modbusHandler.Close()
+	var handler handlers.Handler = modbusHandler
+	if cfg.UnknownDevices.Action == config.UnknownDeviceReject {
+		handler = &handlers.RegisteredHandler{Handler: handler, Devices: cfg.Devices}
+	}
+	handler = &handlers.JSONHandler{Handler: handler, Devices: cfg.Devices, Protocol: cfg.Protocol, Messages: cfg.ErrorMessages}
+
+	// Stop waiting for the device on Ctrl-C
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	response := handler.Handle(ctx, *device, strings.Join(flags.Args(), " "))
+	fmt.Println(response)
+	if strings.Contains(response, " ERROR") || strings.Contains(response, `"status":"ERROR"`) {
+		return fmt.Errorf("request failed")
+	}
+	return nil
+}
+
+// runScan probes a range of unit IDs on a Modbus TCP target or serial port
+// and prints the units that respond
+func runScan(args []string) error {
+	flags := flag.NewFlagSet("scan", flag.ContinueOnError)
+	port := flags.Uint("port", config.DefaultModbusPort, "Modbus TCP port")
+	serial := flags.String("serial", "", "scan the serial port `device` instead of a Modbus TCP target")
+	baud := flags.Uint("baud", 0, "serial link speed (default 19200)")
+	parity := flags.String("parity", config.ParityNone, "serial parity: none, even or odd")
+	timeout := flags.Duration("timeout", 500*time.Millisecond, "timeout per unit")
+	first := flags.Uint("from", 1, "first unit ID")
+	last := flags.Uint("to", 247, "last unit ID")
+	function := flags.Uint("function", 3, "read function of the probe (1-4)")
+	register := flags.Uint("register", 1, "register number read by the probe")
+	verbose := flags.Bool("v", false, "print every probed unit ID")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: open-modbus-goateway scan [flags] <ip>\n       open-modbus-goateway scan -serial <device> [flags]\n\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	switch {
+	case *first < 1 || *first > 255 || *last < *first || *last > 255:
+		return fmt.Errorf("invalid unit ID range %d-%d", *first, *last)
+	case *function < 1 || *function > 4:
+		return fmt.Errorf("invalid read function %d", *function)
+	case *register < 1 || *register > 65536:
+		return fmt.Errorf("invalid register number %d", *register)
+	case *port < 1 || *port > 65535:
+		return fmt.Errorf("invalid port %d", *port)
+	}
+
+	var client handlers.ModbusClient
+	var err error
+	target := *serial
+	if *serial != "" {
+		if flags.NArg() > 0 {
+			return fmt.Errorf("-serial and a target IP are mutually exclusive")
+		}
+		client, err = handlers.ConnectSerial(config.SerialConfig{Device: *serial, Baud: *baud, Parity: *parity}, *timeout)
+	} else {
+		if flags.NArg() != 1 {
+			flags.Usage()
+			return fmt.Errorf("missing target IP")
+		}
+		target = net.JoinHostPort(flags.Arg(0), strconv.Itoa(int(*port)))
+		client, err = handlers.ConnectTCP(&handlers.ModbusRequest{IPAddress: flags.Arg(0), Port: uint16(*port), Timeout: *timeout})
+	}
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	var probe func(uint8)
+	if *verbose {
+		probe = func(id uint8) { fmt.Fprintf(os.Stderr, "probing unit %d\n", id) }
+	}
+	results, err := handlers.Scan(client, uint8(*first), uint8(*last), uint8(*function), uint16(*register-1), probe)
+	for _, r := range results {
+		if r.Err != nil {
+			fmt.Printf("unit %d: responding (%v)\n", r.UnitID, r.Err)
+		} else {
+			fmt.Printf("unit %d: responding (value %d)\n", r.UnitID, r.Values[0])
+		}
+	}
+	fmt.Printf("%d of %d units on %s responded\n", len(results), *last-*first+1, target)
+	return err
+}
+
+// runSimulate serves a simulated device over Modbus TCP until interrupted
+func runSimulate(args []string) error {
+	flags := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	listen := flags.String("listen", "127.0.0.1", "`address` to listen on, empty for every interface")
+	port := flags.Uint("port", config.DefaultModbusPort, "Modbus TCP port")
+	mapPath := flags.String("map", "", "YAML register map `file` declaring the values of the device")
+	size := flags.Int("size", 10000, "registers, coils and discrete inputs of each type")
+	clients := flags.Uint("clients", 10, "maximum concurrent client connections")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: open-modbus-goateway simulate [flags]\n\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	switch {
+	case flags.NArg() > 0:
+		flags.Usage()
+		return fmt.Errorf("unexpected arguments %v", flags.Args())
+	case *port < 1 || *port > 65535:
+		return fmt.Errorf("invalid port %d", *port)
+	case *size < 1 || *size > 65536:
+		return fmt.Errorf("invalid size %d", *size)
+	}
+
+	device := handlers.NewSimulatedDevice(*size)
+	if *mapPath != "" {
+		m, err := handlers.LoadRegisterMap(*mapPath)
+		if err != nil {
+			return err
+		}
+		mapped, err := handlers.NewMappedDevice(*size, m)
+		if err != nil {
+			return err
+		}
+		mapped.Start()
+		defer mapped.Stop()
+		device = mapped.SimulatedDevice
+	}
+
+	server, err := handlers.NewSimulatorServer(*listen, uint16(*port), *clients, device)
+	if err != nil {
+		return err
+	}
+	if err := server.Start(); err != nil {
+		return fmt.Errorf("failed to start Modbus server: %w", err)
+	}
+	defer server.Stop()
+	log.Printf("Simulating a Modbus TCP device on %s", net.JoinHostPort(*listen, strconv.Itoa(int(*port))))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	<-ctx.Done()
+	return nil
+}
+
+// runSchedule prints the computed heartbeat schedule of a configuration and
+// the estimated utilization of its serial ports, without starting the gateway
+func runSchedule(args []string) error {
+	flags := flag.NewFlagSet("schedule", flag.ContinueOnError)
+	configPath := flags.String("config", "config/config.yaml", "configuration `file` holding the heartbeats")
+	output := flags.String("o", "", "write the schedule to a file instead of stdout")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(mqtt.NewSchedule(cfg), "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if *output == "" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(*output, data, 0644)
+}
+
+// runInventory queries the devices of the registry and prints an inventory
+// report
+func runInventory(args []string) error {
+	flags := flag.NewFlagSet("inventory", flag.ContinueOnError)
+	configPath := flags.String("config", "config/config.yaml", "configuration `file` holding the device registry")
+	format := flags.String("format", "csv", "report format: csv or json")
+	timeout := flags.Duration("timeout", 2*time.Second, "timeout of devices without one")
+	output := flags.String("o", "", "write the report to a file instead of stdout")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *format != "csv" && *format != "json" {
+		return fmt.Errorf("invalid format %q", *format)
+	}
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		return err
+	}
+	entries := handlers.Inventory(cfg, *timeout)
+
+	var buf bytes.Buffer
+	if *format == "json" {
+		enc := json.NewEncoder(&buf)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(entries); err != nil {
+			return err
+		}
+	} else {
+		w := csv.NewWriter(&buf)
+		w.Write([]string{"device", "target", "unit_id", "reachable", "vendor_name", "product_code", "revision", "signature", "error"})
+		for _, e := range entries {
+			signature := make([]string, len(e.Signature))
+			for i, v := range e.Signature {
+				signature[i] = strconv.Itoa(int(v))
+			}
+			w.Write([]string{e.Device, e.Target, strconv.Itoa(int(e.UnitID)), strconv.FormatBool(e.Reachable),
+				e.VendorName, e.ProductCode, e.Revision, strings.Join(signature, " "), e.Error})
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return err
+		}
+	}
+
+	if *output == "" {
+		_, err = os.Stdout.Write(buf.Bytes())
+		return err
+	}
+	return os.WriteFile(*output, buf.Bytes(), 0644)
+}
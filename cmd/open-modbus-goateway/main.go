@@ -7,56 +7,40 @@ import (
 	"os/signal"
 	"syscall"
 
-	"github.com/ganehag/open-modbus-goateway/internal/config"
-	"github.com/ganehag/open-modbus-goateway/internal/handlers"
-	"github.com/ganehag/open-modbus-goateway/internal/mqtt"
+	"github.com/ganehag/open-modbus-goateway/internal/logging"
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+	"github.com/ganehag/open-modbus-goateway/pkg/gateway"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
+
 	log.Println("Starting Open Modbus Goateway...")
 
 	// Load configuration
-	cfg, err := config.Load("config/config.yaml")
+	cfg, err := config.Load(gateway.DefaultConfigPath)
 	if err != nil {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
-	// Create the Modbus handler
-	handler := &handlers.ModbusHandler{}
-
-	// Create the Dummy handler
-	// handler := &handlers.DummyHandler{}
-
-	// Define the number of workers
-	workerCount := 4 // Adjust this based on expected load and available resources
-
-	// Initialize the MQTT client with the handler and worker count
-	client, err := mqtt.NewClient(cfg.MQTT, handler, workerCount)
+	// Direct the log to the configured destinations
+	logs, err := logging.Setup(cfg.Logging)
 	if err != nil {
-		log.Fatalf("Failed to initialize MQTT client: %v", err)
+		log.Fatalf("Failed to set up logging: %v", err)
 	}
+	defer logs.Close()
 
-	// Create a context to manage shutdown signals
-	ctx, cancel := context.WithCancel(context.Background())
-
-	// Start workers
-	client.StartWorkers(ctx)
-
-	log.Println("Open Modbus Goateway is running. Waiting for messages...")
-
-	// Setup signal handling for graceful shutdown
-	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
-
-	// Wait for termination signal
-	<-signalChan
-	log.Println("Received termination signal. Shutting down...")
-
-	// Cancel the context to stop workers
-	cancel()
-
-	// Stop the client
-	client.Stop()
+	gw, err := gateway.New(gateway.WithConfig(cfg))
+	if err != nil {
+		log.Fatalf("Failed to start: %v", err)
+	}
 
-	log.Println("Open Modbus Goateway stopped gracefully.")
+	// Serve until SIGINT or SIGTERM, then shut down gracefully
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := gw.Run(ctx); err != nil {
+		log.Fatalf("Failed to run: %v", err)
+	}
 }
@@ -1,6 +0,0 @@
-package handlers
-
-// Handler is an interface for processing MQTT messages
-type Handler interface {
-	Handle(device string, payload string) string
-}
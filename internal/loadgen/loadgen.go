@@ -0,0 +1,237 @@
+// Package loadgen floods a gateway with synthetic requests through the broker
+// and measures the throughput and the latency of the responses, so
+// performance regressions of the whole request path are measurable.
+package loadgen
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/ganehag/open-modbus-goateway/internal/tlsutil"
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+)
+
+// DefaultPayload reads 10 holding registers; {cookie} is replaced with the
+// cookie identifying the request
+const DefaultPayload = "0 {cookie} 0 127.0.0.1 502 1 1 3 1 10"
+
+// Options configures a load run
+type Options struct {
+	MQTT     config.MQTTConfig // Broker, credentials and topics of the gateway
+	Requests int               // Number of requests to publish
+	Rate     float64           // Requests published per second, 0 for as fast as possible
+	InFlight int               // Maximum number of requests awaiting their response
+	Devices  int               // Number of device names the requests are spread over
+	Payload  string            // Request payload, DefaultPayload if empty
+	Timeout  time.Duration     // Time to wait for the responses after the last request
+}
+
+// Report summarizes a load run
+type Report struct {
+	Sent     int
+	Received int
+	Errors   int // Responses reporting an error
+	Duration time.Duration
+	P50      time.Duration
+	P90      time.Duration
+	P99      time.Duration
+	Max      time.Duration
+}
+
+// String formats the report for the terminal
+func (r Report) String() string {
+	rate := 0.0
+	if r.Duration > 0 {
+		rate = float64(r.Received) / r.Duration.Seconds()
+	}
+	return fmt.Sprintf("sent %d, received %d (%d errors, %d missing) in %v: %.0f responses/s\nlatency p50 %v, p90 %v, p99 %v, max %v",
+		r.Sent, r.Received, r.Errors, r.Sent-r.Received, r.Duration.Round(time.Millisecond), rate,
+		r.P50, r.P90, r.P99, r.Max)
+}
+
+// run is the state of a load run
+type run struct {
+	mu        sync.Mutex
+	sent      map[uint64]time.Time // Publish time of the requests awaiting their response
+	latencies []time.Duration
+	errors    int
+	slots     chan struct{} // Limits the requests in flight
+	done      chan struct{} // Closed once all requests are answered
+	expected  int
+}
+
+// Run publishes the requests and waits for their responses until all are
+// answered, the timeout after the last request expires, or ctx is canceled
+func Run(ctx context.Context, opts Options) (Report, error) {
+	if opts.Requests <= 0 || opts.Devices <= 0 || opts.InFlight <= 0 {
+		return Report{}, fmt.Errorf("requests, devices and in-flight requests must be greater than zero")
+	}
+	if opts.Payload == "" {
+		opts.Payload = DefaultPayload
+	}
+	if !strings.Contains(opts.Payload, "{cookie}") {
+		return Report{}, fmt.Errorf("payload must contain the {cookie} placeholder")
+	}
+
+	client, err := connect(opts.MQTT)
+	if err != nil {
+		return Report{}, err
+	}
+	defer client.Disconnect(250)
+
+	r := &run{
+		sent:     make(map[uint64]time.Time, opts.InFlight),
+		slots:    make(chan struct{}, opts.InFlight),
+		done:     make(chan struct{}),
+		expected: opts.Requests,
+	}
+
+	responses := strings.ReplaceAll(opts.MQTT.ResponseTopic, "{device}", "+")
+	if token := client.Subscribe(responses, 1, r.onResponse); token.Wait() && token.Error() != nil {
+		return Report{}, fmt.Errorf("failed to subscribe to %s: %w", responses, token.Error())
+	}
+
+	start := time.Now()
+	sent := 0
+publish:
+	for ; sent < opts.Requests; sent++ {
+		if opts.Rate > 0 {
+			due := start.Add(time.Duration(float64(sent) / opts.Rate * float64(time.Second)))
+			time.Sleep(time.Until(due))
+		}
+		select {
+		case r.slots <- struct{}{}:
+		case <-ctx.Done():
+			break publish
+		}
+
+		cookie := uint64(sent + 1)
+		topic := strings.ReplaceAll(opts.MQTT.RequestTopic, "{device}", "load"+strconv.Itoa(sent%opts.Devices))
+		payload := strings.ReplaceAll(opts.Payload, "{cookie}", strconv.FormatUint(cookie, 10))
+
+		r.mu.Lock()
+		r.sent[cookie] = time.Now()
+		r.mu.Unlock()
+		client.Publish(topic, 1, false, payload) // Not waited for, the response acknowledges it
+	}
+
+	r.mu.Lock()
+	r.expected = sent
+	complete := len(r.latencies) >= sent
+	r.mu.Unlock()
+	if !complete {
+		timer := time.NewTimer(opts.Timeout)
+		select {
+		case <-r.done:
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+		timer.Stop()
+	}
+	duration := time.Since(start)
+	client.Unsubscribe(responses).Wait()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.report(sent, duration), nil
+}
+
+// onResponse records the latency of an answered request
+func (r *run) onResponse(_ mqtt.Client, msg mqtt.Message) {
+	cookie, failed, ok := parseResponse(string(msg.Payload()))
+	if !ok {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sent, pending := r.sent[cookie]
+	if !pending {
+		return // Not ours, or a duplicate
+	}
+	delete(r.sent, cookie)
+	r.latencies = append(r.latencies, time.Since(sent))
+	if failed {
+		r.errors++
+	}
+	<-r.slots
+	if len(r.latencies) == r.expected {
+		close(r.done)
+	}
+}
+
+// parseResponse extracts the cookie of a text or JSON response and whether
+// it reports an error
+func parseResponse(payload string) (uint64, bool, bool) {
+	if strings.HasPrefix(payload, "{") {
+		var resp struct {
+			Cookie uint64 `json:"cookie"`
+			Status string `json:"status"`
+		}
+		if err := json.Unmarshal([]byte(payload), &resp); err != nil {
+			return 0, false, false
+		}
+		return resp.Cookie, resp.Status != "OK", true
+	}
+
+	field, rest, _ := strings.Cut(payload, " ")
+	cookie, err := strconv.ParseUint(field, 10, 64)
+	if err != nil {
+		return 0, false, false
+	}
+	return cookie, !strings.HasPrefix(rest, "OK"), true
+}
+
+// report computes the latency percentiles. The run must be locked.
+func (r *run) report(sent int, duration time.Duration) Report {
+	report := Report{Sent: sent, Received: len(r.latencies), Errors: r.errors, Duration: duration}
+	if len(r.latencies) == 0 {
+		return report
+	}
+
+	sort.Slice(r.latencies, func(i, j int) bool { return r.latencies[i] < r.latencies[j] })
+	percentile := func(p float64) time.Duration {
+		return r.latencies[int(p*float64(len(r.latencies)-1))].Round(time.Microsecond)
+	}
+	report.P50, report.P90, report.P99 = percentile(0.50), percentile(0.90), percentile(0.99)
+	report.Max = r.latencies[len(r.latencies)-1].Round(time.Microsecond)
+	return report
+}
+
+// connect connects to the broker of the gateway with a client ID of its own
+func connect(cfg config.MQTTConfig) (mqtt.Client, error) {
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.Broker).
+		SetClientID(cfg.ClientID + "-loadgen").
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password)
+
+	u, err := url.Parse(cfg.Broker)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse broker URL: %w", err)
+	}
+	if u.Scheme == "ssl" {
+		tlsConfig, err := tlsutil.NewTLSConfig(cfg.CACertPath, cfg.CertPath, cfg.KeyPath, u.Hostname())
+		if err != nil {
+			return nil, fmt.Errorf("failed to create TLS configuration: %w", err)
+		}
+		if err := tlsutil.PinPublicKeys(tlsConfig, cfg.PinnedKeys); err != nil {
+			return nil, fmt.Errorf("failed to create TLS configuration: %w", err)
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	client := mqtt.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		return nil, fmt.Errorf("failed to connect to MQTT broker: %w", token.Error())
+	}
+	return client, nil
+}
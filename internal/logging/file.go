@@ -0,0 +1,128 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+)
+
+// defaultMaxSize is the size in MB at which log files are rotated by default
+const defaultMaxSize = 10
+
+// rotatedSuffix is the time format appended to the name of rotated files,
+// sorting in rotation order
+const rotatedSuffix = "20060102T150405.000"
+
+// fileSink writes to a log file, rotating it by size and removing rotated
+// files by age and count
+type fileSink struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+
+	file *os.File
+	size int64
+}
+
+func openFileSink(cfg config.LogSinkConfig) (*fileSink, error) {
+	maxSize := cfg.MaxSize
+	if maxSize == 0 {
+		maxSize = defaultMaxSize
+	}
+
+	s := &fileSink{
+		path:       cfg.Path,
+		maxSize:    int64(maxSize) * 1024 * 1024,
+		maxAge:     cfg.MaxAge,
+		maxBackups: cfg.MaxBackups,
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	s.prune()
+	return s, nil
+}
+
+// open opens the log file for appending
+func (s *fileSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+
+	s.file, s.size = file, info.Size()
+	return nil
+}
+
+func (s *fileSink) write(t time.Time, level Level, msg string) error {
+	line := formatLine(t, level, msg)
+	if s.size > 0 && s.size+int64(len(line)) > s.maxSize {
+		if err := s.rotate(t); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.WriteString(line)
+	s.size += int64(n)
+	return err
+}
+
+// rotate renames the current log file and starts a new one
+func (s *fileSink) rotate(t time.Time) error {
+	if err := s.file.Close(); err != nil {
+		return fmt.Errorf("failed to rotate log file: %w", err)
+	}
+	rotated := s.path + "." + t.Format(rotatedSuffix)
+	for i := 1; fileExists(rotated); i++ {
+		rotated = fmt.Sprintf("%s.%s-%d", s.path, t.Format(rotatedSuffix), i)
+	}
+	if err := os.Rename(s.path, rotated); err != nil {
+		return fmt.Errorf("failed to rotate log file: %w", err)
+	}
+	if err := s.open(); err != nil {
+		return err
+	}
+
+	s.prune()
+	return nil
+}
+
+// prune removes rotated files beyond the maximum count or age
+func (s *fileSink) prune() {
+	rotated, err := filepath.Glob(s.path + ".*")
+	if err != nil {
+		return
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(rotated))) // Newest first
+
+	for i, name := range rotated {
+		expired := false
+		if s.maxAge > 0 {
+			if info, err := os.Stat(name); err == nil && time.Since(info.ModTime()) > s.maxAge {
+				expired = true
+			}
+		}
+		if expired || (s.maxBackups > 0 && i >= s.maxBackups) {
+			os.Remove(name)
+		}
+	}
+}
+
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+func (s *fileSink) Close() error {
+	return s.file.Close()
+}
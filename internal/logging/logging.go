@@ -0,0 +1,178 @@
+// Package logging routes the gateway log, written with the standard log
+// package, to the configured sinks, each with its own level
+package logging
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+)
+
+// Level is the severity of a log message
+type Level int
+
+// Log levels, in increasing severity
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "DEBUG",
+	LevelInfo:  "INFO",
+	LevelWarn:  "WARN",
+	LevelError: "ERROR",
+}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+// parseLevel parses a configured level, info when empty
+func parseLevel(s string) Level {
+	switch s {
+	case config.LogLevelDebug:
+		return LevelDebug
+	case config.LogLevelWarn:
+		return LevelWarn
+	case config.LogLevelError:
+		return LevelError
+	default:
+		return LevelInfo
+	}
+}
+
+// Classify derives the level of a log message from the wording used
+// throughout the gateway: failures are errors, rejected or dropped requests
+// and lost connections are warnings, everything else is informational.
+func Classify(msg string) Level {
+	switch {
+	case strings.HasPrefix(msg, "Failed"), strings.Contains(msg, " failed"):
+		return LevelError
+	case strings.HasPrefix(msg, "Invalid"), strings.HasPrefix(msg, "Rejected"),
+		strings.HasPrefix(msg, "Dropped"), strings.HasPrefix(msg, "Connection lost"),
+		strings.HasPrefix(msg, "Detected"):
+		return LevelWarn
+	default:
+		return LevelInfo
+	}
+}
+
+// sink is a destination of log messages
+type sink interface {
+	write(t time.Time, level Level, msg string) error
+	Close() error
+}
+
+// leveledSink is a sink with the lowest level it receives
+type leveledSink struct {
+	sink
+	level Level
+}
+
+// router dispatches the lines of the standard logger to the sinks
+type router struct {
+	mu    sync.Mutex
+	sinks []leveledSink
+}
+
+// Setup directs the standard logger to the configured sinks and returns a
+// closer for them. Without sinks, the log is left on stderr.
+func Setup(sinks []config.LogSinkConfig) (io.Closer, error) {
+	r := &router{}
+	for i, cfg := range sinks {
+		s, err := openSink(cfg)
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("logging[%d]: %w", i, err)
+		}
+		r.sinks = append(r.sinks, leveledSink{sink: s, level: parseLevel(cfg.Level)})
+	}
+
+	if len(r.sinks) > 0 {
+		log.SetFlags(0) // Sinks add their own timestamps
+		log.SetOutput(r)
+	}
+	return r, nil
+}
+
+// openSink opens the sink described by the configuration
+func openSink(cfg config.LogSinkConfig) (sink, error) {
+	switch cfg.Type {
+	case config.LogSinkStderr:
+		return &streamSink{w: os.Stderr}, nil
+	case config.LogSinkFile:
+		return openFileSink(cfg)
+	case config.LogSinkSyslog, config.LogSinkJournald:
+		return openSyslogSink(cfg)
+	default:
+		return nil, fmt.Errorf("unknown sink type %q", cfg.Type)
+	}
+}
+
+// Write receives a line of the standard logger
+func (r *router) Write(p []byte) (int, error) {
+	msg := strings.TrimSuffix(string(p), "\n")
+	level := Classify(msg)
+	now := time.Now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var errs []error
+	for _, s := range r.sinks {
+		if level >= s.level {
+			if err := s.write(now, level, msg); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		// The log can't report its own failures, fall back to stderr
+		fmt.Fprintf(os.Stderr, "logging: %v\n%s", errors.Join(errs...), p)
+	}
+	return len(p), nil
+}
+
+// Close closes the sinks
+func (r *router) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var errs []error
+	for _, s := range r.sinks {
+		if err := s.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	r.sinks = nil
+	return errors.Join(errs...)
+}
+
+// formatLine formats a message for the text sinks
+func formatLine(t time.Time, level Level, msg string) string {
+	return fmt.Sprintf("%s %-5s %s\n", t.Format("2006/01/02 15:04:05"), level, msg)
+}
+
+// streamSink writes to a stream such as stderr
+type streamSink struct {
+	w io.Writer
+}
+
+func (s *streamSink) write(t time.Time, level Level, msg string) error {
+	_, err := io.WriteString(s.w, formatLine(t, level, msg))
+	return err
+}
+
+func (s *streamSink) Close() error {
+	return nil
+}
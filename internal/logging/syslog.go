@@ -0,0 +1,50 @@
+//go:build !windows && !plan9
+
+package logging
+
+import (
+	"fmt"
+	"log/syslog"
+	"time"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+)
+
+// defaultTag is the syslog tag used when none is configured
+const defaultTag = "open-modbus-goateway"
+
+// syslogSink writes to a syslog daemon. The journald sink uses the local
+// syslog socket, which journald serves on systemd hosts.
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+func openSyslogSink(cfg config.LogSinkConfig) (*syslogSink, error) {
+	tag := cfg.Tag
+	if tag == "" {
+		tag = defaultTag
+	}
+
+	w, err := syslog.Dial(cfg.Network, cfg.Address, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to syslog: %w", err)
+	}
+	return &syslogSink{w: w}, nil
+}
+
+func (s *syslogSink) write(t time.Time, level Level, msg string) error {
+	switch level {
+	case LevelError:
+		return s.w.Err(msg)
+	case LevelWarn:
+		return s.w.Warning(msg)
+	case LevelDebug:
+		return s.w.Debug(msg)
+	default:
+		return s.w.Info(msg)
+	}
+}
+
+func (s *syslogSink) Close() error {
+	return s.w.Close()
+}
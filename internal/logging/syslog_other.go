@@ -0,0 +1,13 @@
+//go:build windows || plan9
+
+package logging
+
+import (
+	"fmt"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+)
+
+func openSyslogSink(cfg config.LogSinkConfig) (sink, error) {
+	return nil, fmt.Errorf("%s is not supported on this platform", cfg.Type)
+}
@@ -0,0 +1,99 @@
+package safemode
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+)
+
+// state is the persisted crash counter: the start times of every run that
+// has not (yet) ended with a clean shutdown
+type state struct {
+	UncleanStarts []time.Time `json:"unclean_starts"`
+}
+
+// Guard tracks restarts across process lifetimes and decides whether the
+// gateway must start in safe mode
+type Guard struct {
+	cfg    config.SafeModeConfig
+	state  state
+	active bool
+}
+
+// Start records the current start in the state file and reports whether the
+// number of unclean starts within the configured window reached the limit.
+// A disabled configuration (no state file) returns an inactive guard.
+func Start(cfg config.SafeModeConfig) (*Guard, error) {
+	g := &Guard{cfg: cfg}
+	if cfg.StateFile == "" {
+		return g, nil
+	}
+
+	data, err := os.ReadFile(cfg.StateFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read safe mode state: %w", err)
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &g.state); err != nil {
+			return nil, fmt.Errorf("failed to parse safe mode state: %w", err)
+		}
+	}
+
+	// Forget unclean starts that fell out of the window
+	now := time.Now()
+	recent := g.state.UncleanStarts[:0]
+	for _, t := range g.state.UncleanStarts {
+		if now.Sub(t) <= cfg.Window {
+			recent = append(recent, t)
+		}
+	}
+
+	g.active = len(recent) >= cfg.MaxRestarts
+	g.state.UncleanStarts = append(recent, now)
+
+	if err := g.save(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// Active reports whether the gateway runs in safe mode
+func (g *Guard) Active() bool {
+	return g.active
+}
+
+// UncleanStarts returns the number of unclean starts within the window,
+// including the current one
+func (g *Guard) UncleanStarts() int {
+	return len(g.state.UncleanStarts)
+}
+
+// Stop marks the current run as cleanly shut down, resetting the crash counter
+func (g *Guard) Stop() error {
+	if g.cfg.StateFile == "" {
+		return nil
+	}
+	g.state.UncleanStarts = nil
+	return g.save()
+}
+
+func (g *Guard) save() error {
+	data, err := json.Marshal(g.state)
+	if err != nil {
+		return fmt.Errorf("failed to encode safe mode state: %w", err)
+	}
+
+	// Write atomically so a crash during the write can't corrupt the counter
+	tmp := g.cfg.StateFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write safe mode state: %w", err)
+	}
+	if err := os.Rename(tmp, g.cfg.StateFile); err != nil {
+		return fmt.Errorf("failed to write safe mode state: %w", err)
+	}
+	return nil
+}
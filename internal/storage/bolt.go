@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Bolt is a Store persisting entries in a bbolt database file. Buckets map
+// to bbolt buckets; expired entries are skipped on read and removed on write.
+type Bolt struct {
+	db *bolt.DB
+}
+
+// OpenBolt opens or creates the database file at path
+func OpenBolt(path string) (*Bolt, error) {
+	if path == "" {
+		return nil, fmt.Errorf("storage path is required for the bolt backend")
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open storage %s: %w", path, err)
+	}
+	return &Bolt{db: db}, nil
+}
+
+func (b *Bolt) Get(bucket, key string) ([]byte, bool, error) {
+	var value []byte
+	var found bool
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(bucket))
+		if bkt == nil {
+			return nil
+		}
+		data := bkt.Get([]byte(key))
+		if data == nil {
+			return nil
+		}
+		v, expiresAt, err := decodeEntry(data)
+		if err != nil {
+			return fmt.Errorf("%s/%s: %w", bucket, key, err)
+		}
+		if !expired(expiresAt, time.Now()) {
+			value, found = v, true
+		}
+		return nil
+	})
+	return value, found, err
+}
+
+func (b *Bolt) Put(bucket, key string, value []byte, ttl time.Duration) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bkt, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		return bkt.Put([]byte(key), encodeEntry(value, expiry(ttl)))
+	})
+}
+
+func (b *Bolt) Delete(bucket, key string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(bucket))
+		if bkt == nil {
+			return nil
+		}
+		return bkt.Delete([]byte(key))
+	})
+}
+
+func (b *Bolt) Iterate(bucket string, fn func(key string, value []byte) error) error {
+	var stale [][]byte
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(bucket))
+		if bkt == nil {
+			return nil
+		}
+		now := time.Now()
+		return bkt.ForEach(func(k, data []byte) error {
+			value, expiresAt, err := decodeEntry(data)
+			if err != nil {
+				return fmt.Errorf("%s/%s: %w", bucket, k, err)
+			}
+			if expired(expiresAt, now) {
+				stale = append(stale, append([]byte{}, k...))
+				return nil
+			}
+			return fn(string(k), value)
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	// Remove the expired entries seen while iterating
+	if len(stale) > 0 {
+		return b.db.Update(func(tx *bolt.Tx) error {
+			bkt := tx.Bucket([]byte(bucket))
+			for _, k := range stale {
+				if err := bkt.Delete(k); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	return nil
+}
+
+func (b *Bolt) Close() error {
+	return b.db.Close()
+}
@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryEntry is a value held by the memory store
+type memoryEntry struct {
+	value     []byte
+	expiresAt int64
+}
+
+// Memory is a Store keeping all entries in memory. Entries are lost when the
+// gateway stops.
+type Memory struct {
+	mu      sync.RWMutex
+	buckets map[string]map[string]memoryEntry
+}
+
+// NewMemory creates an empty memory store
+func NewMemory() *Memory {
+	return &Memory{buckets: make(map[string]map[string]memoryEntry)}
+}
+
+func (m *Memory) Get(bucket, key string) ([]byte, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	entry, ok := m.buckets[bucket][key]
+	if !ok || expired(entry.expiresAt, time.Now()) {
+		return nil, false, nil
+	}
+	return append([]byte{}, entry.value...), true, nil
+}
+
+func (m *Memory) Put(bucket, key string, value []byte, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entries, ok := m.buckets[bucket]
+	if !ok {
+		entries = make(map[string]memoryEntry)
+		m.buckets[bucket] = entries
+	}
+	entries[key] = memoryEntry{value: append([]byte{}, value...), expiresAt: expiry(ttl)}
+	m.purge(entries)
+	return nil
+}
+
+func (m *Memory) Delete(bucket, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.buckets[bucket], key)
+	return nil
+}
+
+func (m *Memory) Iterate(bucket string, fn func(key string, value []byte) error) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	entries := m.buckets[bucket]
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	now := time.Now()
+	for _, key := range keys {
+		entry := entries[key]
+		if expired(entry.expiresAt, now) {
+			continue
+		}
+		if err := fn(key, entry.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
+
+// purge drops the expired entries of a bucket once it has grown, so expired
+// entries that are never read again don't accumulate
+func (m *Memory) purge(entries map[string]memoryEntry) {
+	if len(entries) < 1024 || len(entries)&(len(entries)-1) != 0 {
+		return // Only at powers of two, to amortize the cost
+	}
+
+	now := time.Now()
+	for key, entry := range entries {
+		if expired(entry.expiresAt, now) {
+			delete(entries, key)
+		}
+	}
+}
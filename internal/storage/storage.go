@@ -0,0 +1,73 @@
+// Package storage provides the key/value persistence shared by the gateway
+// subsystems that keep state, such as buffers, logs and caches. Each
+// subsystem uses its own bucket of a common store.
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+)
+
+// Store is a bucketed key/value store with optional per-entry expiry.
+// Expired entries are never returned.
+type Store interface {
+	// Get returns the value of a key, and whether it exists
+	Get(bucket, key string) ([]byte, bool, error)
+	// Put stores a value, expiring after ttl; a ttl of 0 never expires
+	Put(bucket, key string, value []byte, ttl time.Duration) error
+	// Delete removes a key; deleting a missing key is not an error
+	Delete(bucket, key string) error
+	// Iterate calls fn for every entry of a bucket in key order, until fn
+	// returns an error. fn must not modify the store.
+	Iterate(bucket string, fn func(key string, value []byte) error) error
+	// Close releases the store
+	Close() error
+}
+
+// Open creates the store selected by the configuration
+func Open(cfg config.StorageConfig) (Store, error) {
+	switch cfg.Backend {
+	case "", config.StorageMemory:
+		return NewMemory(), nil
+	case config.StorageBolt:
+		return OpenBolt(cfg.Path)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.Backend)
+	}
+}
+
+// expiry returns the expiry time of an entry stored now with the given ttl,
+// as Unix nanoseconds, or 0 if it never expires
+func expiry(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return time.Now().Add(ttl).UnixNano()
+}
+
+// expired reports whether an entry with the given expiry has expired
+func expired(expiresAt int64, now time.Time) bool {
+	return expiresAt != 0 && now.UnixNano() >= expiresAt
+}
+
+// encodeEntry prefixes a value with its expiry for persistent backends
+func encodeEntry(value []byte, expiresAt int64) []byte {
+	data := make([]byte, 8+len(value))
+	binary.BigEndian.PutUint64(data, uint64(expiresAt))
+	copy(data[8:], value)
+	return data
+}
+
+// decodeEntry splits a persisted entry into its value and expiry. The value
+// is copied, as backends may reuse the underlying memory.
+func decodeEntry(data []byte) ([]byte, int64, error) {
+	if len(data) < 8 {
+		return nil, 0, fmt.Errorf("corrupt entry of %d bytes", len(data))
+	}
+	value := make([]byte, len(data)-8)
+	copy(value, data[8:])
+	return value, int64(binary.BigEndian.Uint64(data)), nil
+}
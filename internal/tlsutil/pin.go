@@ -0,0 +1,47 @@
+package tlsutil
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// pinPrefix is the prefix of a public key pin, followed by the base64 SHA-256
+// digest of the certificate's SubjectPublicKeyInfo
+const pinPrefix = "sha256/"
+
+// PinPublicKeys restricts the TLS configuration to servers whose verified
+// certificate chain contains a public key matching one of the pins, so a
+// substituted CA cannot be used to impersonate the server
+func PinPublicKeys(tlsConfig *tls.Config, pins []string) error {
+	if len(pins) == 0 {
+		return nil
+	}
+
+	digests := make(map[[sha256.Size]byte]bool, len(pins))
+	for _, pin := range pins {
+		encoded, ok := strings.CutPrefix(pin, pinPrefix)
+		if !ok {
+			return fmt.Errorf("invalid public key pin %q: must start with %q", pin, pinPrefix)
+		}
+		digest, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(digest) != sha256.Size {
+			return fmt.Errorf("invalid public key pin %q: not a base64 SHA-256 digest", pin)
+		}
+		digests[[sha256.Size]byte(digest)] = true
+	}
+
+	tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+		for _, chain := range state.VerifiedChains {
+			for _, cert := range chain {
+				if digests[sha256.Sum256(cert.RawSubjectPublicKeyInfo)] {
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("server certificate chain does not match any pinned public key")
+	}
+	return nil
+}
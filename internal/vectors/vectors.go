@@ -0,0 +1,152 @@
+// Package vectors generates conformance test vectors for the request
+// payload format, so client implementations in other languages can check
+// their request formatting and response parsing against a gateway version.
+package vectors
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/handlers"
+)
+
+// simulatedSize is the number of registers, coils and inputs of the device
+// the vectors are generated against
+const simulatedSize = 10000
+
+// Set is the machine-readable document of all vectors
+type Set struct {
+	Version string   `json:"version"` // Gateway version the vectors were generated with
+	Device  string   `json:"device"`  // Contents of the simulated device
+	Vectors []Vector `json:"vectors"`
+}
+
+// Vector is a request payload and the response the gateway returns for it
+type Vector struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Request     string `json:"request"`
+	Response    string `json:"response"`
+}
+
+// vectorCase is a request of the vector set
+type vectorCase struct {
+	name        string
+	description string
+	request     string
+}
+
+// header is the request prefix of the text vectors, up to the slave ID
+const header = "0 1 0 192.0.2.10 502 5 1 "
+
+var cases = []vectorCase{
+	// Reads
+	{"read-coils", "Function 1, read 8 coils", header + "1 1 8"},
+	{"read-discrete-inputs", "Function 2, read 4 discrete inputs", header + "2 1 4"},
+	{"read-holding-registers", "Function 3, read 4 holding registers", header + "3 101 4"},
+	{"read-input-registers", "Function 4, read 2 input registers", header + "4 101 2"},
+	{"read-format-bool", "Coils rendered as booleans", header + "1 1 4 format=bool"},
+	{"read-format-hex", "Registers rendered as zero-padded hex", header + "3 4097 2 format=hex"},
+	{"read-type-uint32", "Two registers combined into one uint32", header + "3 2 2 type=uint32"},
+	{"read-type-uint32-cdab", "Word-swapped uint32", header + "3 2 2 type=uint32 order=CDAB"},
+	{"read-scaled", "Scaled to engineering units", header + "3 653 1 scale=0.1 offset=-40"},
+	{"read-bit", "Bits 0-3 of register 6", header + "3 6.0 4"},
+	{"read-bit-bool", "Bit 2 of register 6 as a boolean", header + "3 6.2 1 format=bool"},
+
+	// Writes
+	{"write-coil-on", "Function 5, symbolic value", header + "5 1 on"},
+	{"write-coil-numeric", "Function 5, numeric value", header + "5 1 0"},
+	{"write-register", "Function 6", header + "6 100 1234"},
+	{"write-register-bit", "Function 6 bit write (read-modify-write)", header + "6 100.3 1"},
+	{"write-register-typed", "Function 6 with a typed value", header + "6 100 int16:-5"},
+	{"write-register-scaled", "Function 6 in engineering units", header + "6 100 21.5 scale=0.1"},
+	{"write-coils", "Function 15", header + "15 1 3 on,off,1"},
+	{"write-registers", "Function 16", header + "16 100 3 1,2,3"},
+	{"write-registers-float32", "Function 16 with a typed float32", header + "16 100 2 float32:3.14"},
+	{"write-registers-string", "Function 16 with a string", header + "16 300 4 Hi%20there type=string"},
+	{"write-verified", "Write with read-back verification", header + "6 100 7 verify=1"},
+
+	// Batches
+	{"batch", "Several commands over one connection", header + "16 200 1 int16:-10 ; 3 200 1 type=int16 ; 3 101 2"},
+	{"batch-write-read-float", "Typed write and read-back", header + "16 200 2 float32:2.5 ; 3 200 2 type=float32"},
+	{"batch-write-read-string", "String write and read-back", header + "16 300 4 Hi%20there type=string ; 3 300 4 type=string"},
+	{"batch-partial-failure", "A failing command does not stop the batch", header + "3 101 1 ; 3 20001 1 ; 3 102 1"},
+
+	// Device errors
+	{"error-illegal-data-address", "Register beyond the device", header + "3 20001 1"},
+	{"error-count-zero", "Zero register count", header + "3 101 0"},
+	{"error-count-too-large", "More registers than the request limit", header + "3 1 126"},
+	{"error-coil-count-too-large", "More coils than the request limit", header + "1 1 2001"},
+
+	// Request errors
+	{"error-incomplete", "Too few fields", "0 1 0 192.0.2.10 502 5 1 3"},
+	{"error-cookie", "Non-numeric cookie", "0 abc 0 192.0.2.10 502 5 1 3 101 1"},
+	{"error-port", "Port out of range", "0 1 0 192.0.2.10 70000 5 1 3 101 1"},
+	{"error-timeout", "Timeout out of range", "0 1 0 192.0.2.10 502 0 1 3 101 1"},
+	{"error-slave-id", "Slave ID out of range", "0 1 0 192.0.2.10 502 5 0 3 101 1"},
+	{"error-function", "Unsupported function code", header + "7 101 1"},
+	{"error-register", "Register number 0", header + "3 0 1"},
+	{"error-missing-count", "Read without a count", "0 1 0 192.0.2.10 502 5 1 3 101 format=hex"},
+	{"error-data-mismatch", "Count does not match the data", header + "16 100 3 1,2"},
+	{"error-unknown-option", "Unknown option", header + "3 101 1 color=red"},
+	{"error-type-width", "Count not a multiple of the type width", header + "3 101 3 type=float32"},
+	{"error-bit-function", "Bit addressing on coils", header + "1 1.2 1"},
+	{"error-verify-read", "verify on a read", header + "3 101 1 verify=1"},
+	{"error-batch-command", "Invalid command in a batch", header + "3 101 1 ; 3 abc 1"},
+
+	// JSON requests
+	{"json-read", "JSON read with a typed option",
+		`{"cookie": 1, "ip": "192.0.2.10", "port": 502, "timeout": 5, "slave_id": 1, "function": 3, "register": 2, "count": 2, "options": {"type": "uint32"}}`},
+	{"json-write", "JSON write with typed data",
+		`{"cookie": 2, "ip": "192.0.2.10", "port": 502, "timeout": 5, "slave_id": 1, "function": 16, "register": 100, "data": ["int32:-5000"]}`},
+	{"json-fields", "JSON read returning only the values",
+		`{"cookie": 3, "ip": "192.0.2.10", "port": 502, "timeout": 5, "slave_id": 1, "function": 1, "register": 1, "count": 2, "fields": ["values"]}`},
+	{"json-batch", "JSON batch",
+		`{"cookie": 4, "ip": "192.0.2.10", "port": 502, "timeout": 5, "slave_id": 1, "commands": [{"function": 6, "register": 100, "value": 5}, {"function": 3, "register": 100, "count": 1}]}`},
+	{"json-error", "JSON request failing on the device",
+		`{"cookie": 5, "ip": "192.0.2.10", "port": 502, "timeout": 5, "slave_id": 1, "function": 3, "register": 20001, "count": 1}`},
+	{"json-invalid", "Malformed JSON", `{"cookie": 6, "function": }`},
+}
+
+// Generate runs every vector request through the request pipeline against a
+// fresh simulated device and records the responses
+func Generate(version string) Set {
+	set := Set{
+		Version: version,
+		Device:  "Each request runs against a fresh simulated device with 10000 registers, coils and discrete inputs. Every register holds its own address (register number minus 1), and coils and discrete inputs with odd addresses are set. duration_ms is omitted from JSON responses, as it varies.",
+	}
+
+	for _, c := range cases {
+		device := handlers.NewSimulatedDevice(simulatedSize)
+		handler := &handlers.JSONHandler{Handler: &handlers.ModbusHandler{Connect: device.Connect}}
+
+		set.Vectors = append(set.Vectors, Vector{
+			Name:        c.name,
+			Description: c.description,
+			Request:     c.request,
+			Response:    stripDuration(handler.Handle(context.Background(), "", c.request)),
+		})
+	}
+
+	return set
+}
+
+// stripDuration removes the varying duration from a JSON response
+func stripDuration(response string) string {
+	if !strings.HasPrefix(response, "{") {
+		return response
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(response), &fields); err != nil {
+		return response
+	}
+	delete(fields, "duration_ms")
+
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return response
+	}
+	return string(data)
+}
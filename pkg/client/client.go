@@ -0,0 +1,249 @@
+// Package client is a Go client for the open-modbus-goateway request
+// protocol. It formats requests, publishes them over MQTT and awaits the
+// response correlated by cookie.
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Config holds the MQTT settings of a client
+type Config struct {
+	Broker        string      // MQTT broker URL, e.g. "tcp://localhost:1883"
+	ClientID      string      // MQTT client ID, must be unique on the broker
+	Username      string      // Optional
+	Password      string      // Optional
+	TLSConfig     *tls.Config // Optional, for ssl:// brokers
+	RequestTopic  string      // Request topic of the gateway, e.g. "modbus/{device}/request"
+	ResponseTopic string      // Response topic of the gateway, e.g. "modbus/{device}/response"
+}
+
+// Target addresses a Modbus device through the gateway. Without an IP, the
+// unset fields are taken from the device registry of the gateway.
+type Target struct {
+	Device  string        // Value of the {device} topic placeholder
+	IP      string        // Address of the Modbus TCP server
+	Port    uint16        // Defaults to 502
+	Timeout time.Duration // Gateway-side Modbus timeout, rounded up to whole seconds, defaults to 5s
+	SlaveID uint8         // Defaults to 1
+}
+
+// Request is a single gateway command
+type Request struct {
+	Function uint8             // Modbus function code
+	Register string            // Register number, optionally with a bit suffix ("40010.3")
+	Count    uint16            // Register count for reads and multiple writes
+	Values   []string          // VALUE (functions 5, 6) or DATA (functions 15, 16) fields
+	Options  map[string]string // Request options, e.g. {"type": "float32"}
+}
+
+// Error is a gateway error response
+type Error struct {
+	Cookie uint64
+	Reason string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("gateway error (cookie %d): %s", e.Cookie, e.Reason)
+}
+
+// Client publishes requests to the gateway and correlates the responses
+type Client struct {
+	cfg     Config
+	mqtt    mqtt.Client
+	cookie  uint64
+	mu      sync.Mutex
+	pending map[uint64]chan string
+
+	subscribed atomic.Bool // Subscribed once connected, resubscribing on reconnects
+}
+
+// New connects to the broker and subscribes to the response topic
+func New(cfg Config) (*Client, error) {
+	if !strings.Contains(cfg.RequestTopic, "{device}") || !strings.Contains(cfg.ResponseTopic, "{device}") {
+		return nil, fmt.Errorf("request and response topics must contain {device}")
+	}
+
+	c := &Client{
+		cfg:     cfg,
+		cookie:  uint64(rand.Int63n(1 << 32)), // Random start, so clients sharing a response topic rarely collide
+		pending: make(map[uint64]chan string),
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.Broker).
+		SetClientID(cfg.ClientID).
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password).
+		SetTLSConfig(cfg.TLSConfig).
+		SetOnConnectHandler(func(client mqtt.Client) {
+			// The first subscription is made by New, before any request
+			if !c.subscribed.Load() {
+				return
+			}
+			if err := c.subscribe(); err != nil {
+				log.Printf("Failed to resubscribe to the response topic: %v", err)
+			}
+		})
+
+	c.mqtt = mqtt.NewClient(opts)
+	token := c.mqtt.Connect()
+	if token.Wait() && token.Error() != nil {
+		return nil, fmt.Errorf("failed to connect to MQTT broker: %w", token.Error())
+	}
+
+	// Subscribe before returning, so the responses of the first requests
+	// aren't missed
+	if err := c.subscribe(); err != nil {
+		c.mqtt.Disconnect(0)
+		return nil, fmt.Errorf("failed to subscribe to the response topic: %w", err)
+	}
+	c.subscribed.Store(true)
+
+	return c, nil
+}
+
+// subscribe subscribes to the response topic of every device
+func (c *Client) subscribe() error {
+	topic := strings.ReplaceAll(c.cfg.ResponseTopic, "{device}", "+")
+	token := c.mqtt.Subscribe(topic, 1, func(client mqtt.Client, msg mqtt.Message) {
+		c.dispatch(string(msg.Payload()))
+	})
+	token.Wait()
+	return token.Error()
+}
+
+// Close disconnects from the broker
+func (c *Client) Close() {
+	c.mqtt.Disconnect(250)
+}
+
+// Do sends a request and waits for its response until the context is done
+func (c *Client) Do(ctx context.Context, target Target, req Request) (*Response, error) {
+	cookie := atomic.AddUint64(&c.cookie, 1)
+	payload, err := Format(cookie, target, req)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan string, 1)
+	c.mu.Lock()
+	c.pending[cookie] = ch
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, cookie)
+		c.mu.Unlock()
+	}()
+
+	topic := strings.ReplaceAll(c.cfg.RequestTopic, "{device}", target.Device)
+	token := c.mqtt.Publish(topic, 1, false, payload)
+	if token.Wait() && token.Error() != nil {
+		return nil, fmt.Errorf("failed to publish request: %w", token.Error())
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case text := <-ch:
+		return ParseResponse(text)
+	}
+}
+
+// dispatch delivers a response to the request awaiting its cookie
+func (c *Client) dispatch(text string) {
+	field, _, _ := strings.Cut(text, " ")
+	cookie, err := strconv.ParseUint(field, 10, 64)
+	if err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	ch, ok := c.pending[cookie]
+	c.mu.Unlock()
+	if ok {
+		select {
+		case ch <- text:
+		default: // Duplicate response
+		}
+	}
+}
+
+// ReadRegisters reads holding (function 3) or input (function 4) registers
+// as raw values
+func (c *Client) ReadRegisters(ctx context.Context, target Target, function uint8, register uint16, count uint16) ([]uint16, error) {
+	resp, err := c.Do(ctx, target, Request{Function: function, Register: strconv.Itoa(int(register)), Count: count})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Uint16s()
+}
+
+// ReadFloat32s reads count/2 IEEE754 floats starting at register
+func (c *Client) ReadFloat32s(ctx context.Context, target Target, function uint8, register uint16, count uint16) ([]float64, error) {
+	resp, err := c.Do(ctx, target, Request{
+		Function: function,
+		Register: strconv.Itoa(int(register)),
+		Count:    count,
+		Options:  map[string]string{"type": "float32"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Float64s()
+}
+
+// ReadCoils reads coils (function 1) or discrete inputs (function 2)
+func (c *Client) ReadCoils(ctx context.Context, target Target, function uint8, register uint16, count uint16) ([]bool, error) {
+	resp, err := c.Do(ctx, target, Request{Function: function, Register: strconv.Itoa(int(register)), Count: count})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Bools()
+}
+
+// WriteRegister writes a single holding register (function 6)
+func (c *Client) WriteRegister(ctx context.Context, target Target, register uint16, value uint16) error {
+	_, err := c.Do(ctx, target, Request{
+		Function: 6,
+		Register: strconv.Itoa(int(register)),
+		Values:   []string{strconv.Itoa(int(value))},
+	})
+	return err
+}
+
+// WriteRegisters writes multiple holding registers (function 16)
+func (c *Client) WriteRegisters(ctx context.Context, target Target, register uint16, values []uint16) error {
+	data := make([]string, len(values))
+	for i, v := range values {
+		data[i] = strconv.Itoa(int(v))
+	}
+	_, err := c.Do(ctx, target, Request{
+		Function: 16,
+		Register: strconv.Itoa(int(register)),
+		Count:    uint16(len(values)),
+		Values:   data,
+	})
+	return err
+}
+
+// WriteCoil writes a single coil (function 5)
+func (c *Client) WriteCoil(ctx context.Context, target Target, register uint16, value bool) error {
+	_, err := c.Do(ctx, target, Request{
+		Function: 5,
+		Register: strconv.Itoa(int(register)),
+		Values:   []string{strconv.FormatBool(value)},
+	})
+	return err
+}
@@ -0,0 +1,176 @@
+package client
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Format formats a request in the text request format of the gateway
+func Format(cookie uint64, target Target, req Request) (string, error) {
+	if req.Register == "" {
+		return "", fmt.Errorf("missing register")
+	}
+
+	parts := []string{"0", strconv.FormatUint(cookie, 10), "0", target.IP}
+	defaults := []int{502, 5, 1}
+	if target.IP == "" {
+		parts[3] = "-"
+		defaults = []int{0, 0, 0} // Taken from the device registry
+	}
+	for i, value := range []int{int(target.Port), int((target.Timeout + time.Second - 1) / time.Second), int(target.SlaveID)} {
+		switch {
+		case value != 0:
+			parts = append(parts, strconv.Itoa(value))
+		case defaults[i] != 0:
+			parts = append(parts, strconv.Itoa(defaults[i]))
+		default:
+			parts = append(parts, "-")
+		}
+	}
+	parts = append(parts, strconv.Itoa(int(req.Function)), req.Register)
+
+	switch req.Function {
+	case 1, 2, 3, 4:
+		parts = append(parts, strconv.Itoa(int(req.Count)))
+	case 5, 6:
+		if len(req.Values) != 1 {
+			return "", fmt.Errorf("function %d takes exactly one value", req.Function)
+		}
+		parts = append(parts, req.Values[0])
+	case 15, 16:
+		if len(req.Values) == 0 {
+			return "", fmt.Errorf("function %d requires data", req.Function)
+		}
+		parts = append(parts, strconv.Itoa(int(req.Count)), strings.Join(req.Values, ","))
+	default:
+		return "", fmt.Errorf("unsupported function code: %d", req.Function)
+	}
+
+	keys := make([]string, 0, len(req.Options))
+	for key := range req.Options {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := req.Options[key]
+		if strings.ContainsAny(key+value, " =;") {
+			return "", fmt.Errorf("invalid option %q", key)
+		}
+		parts = append(parts, key+"="+value)
+	}
+
+	for _, part := range parts {
+		if part == "" || strings.ContainsAny(part, " ;") {
+			return "", fmt.Errorf("invalid request field %q", part)
+		}
+	}
+
+	return strings.Join(parts, " "), nil
+}
+
+// Response is a successful gateway response
+type Response struct {
+	Cookie uint64
+	Values []string          // Response values, strings unquoted
+	Stamp  map[string]string // Response stamp (ts, seq) and transaction time (at), when enabled on the gateway
+}
+
+// ParseResponse parses a text response. Error responses are returned as *Error.
+func ParseResponse(text string) (*Response, error) {
+	field, rest, _ := strings.Cut(text, " ")
+	cookie, err := strconv.ParseUint(field, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid response cookie %q", field)
+	}
+
+	if reason, ok := strings.CutPrefix(rest, "ERROR: "); ok {
+		return nil, &Error{Cookie: cookie, Reason: reason}
+	}
+
+	status, values, _ := strings.Cut(rest, " ")
+	if status != "OK" {
+		return nil, fmt.Errorf("invalid response status %q", status)
+	}
+
+	resp := &Response{Cookie: cookie}
+	for values = strings.TrimSpace(values); values != ""; values = strings.TrimSpace(values) {
+		var token string
+		if values[0] == '"' {
+			quoted, err := strconv.QuotedPrefix(values)
+			if err != nil {
+				return nil, fmt.Errorf("invalid quoted value in response: %v", err)
+			}
+			values = values[len(quoted):]
+			token, _ = strconv.Unquote(quoted)
+		} else {
+			token, values, _ = strings.Cut(values, " ")
+			if key, value, ok := strings.Cut(token, "="); ok {
+				if resp.Stamp == nil {
+					resp.Stamp = make(map[string]string)
+				}
+				resp.Stamp[key] = value
+				continue
+			}
+		}
+		resp.Values = append(resp.Values, token)
+	}
+
+	return resp, nil
+}
+
+// Uint16s decodes the response values as raw register values
+func (r *Response) Uint16s() ([]uint16, error) {
+	out := make([]uint16, len(r.Values))
+	for i, v := range r.Values {
+		n, err := strconv.ParseUint(v, 0, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid register value %q", v)
+		}
+		out[i] = uint16(n)
+	}
+	return out, nil
+}
+
+// Int64s decodes the response values as signed integers
+func (r *Response) Int64s() ([]int64, error) {
+	out := make([]int64, len(r.Values))
+	for i, v := range r.Values {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid integer value %q", v)
+		}
+		out[i] = n
+	}
+	return out, nil
+}
+
+// Float64s decodes the response values as floating point numbers
+func (r *Response) Float64s() ([]float64, error) {
+	out := make([]float64, len(r.Values))
+	for i, v := range r.Values {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid numeric value %q", v)
+		}
+		out[i] = f
+	}
+	return out, nil
+}
+
+// Bools decodes the response values as booleans (1/0 or true/false)
+func (r *Response) Bools() ([]bool, error) {
+	out := make([]bool, len(r.Values))
+	for i, v := range r.Values {
+		switch v {
+		case "1", "true":
+			out[i] = true
+		case "0", "false":
+		default:
+			return nil, fmt.Errorf("invalid boolean value %q", v)
+		}
+	}
+	return out, nil
+}
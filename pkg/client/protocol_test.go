@@ -0,0 +1,144 @@
+package client
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormat(t *testing.T) {
+	v1 := Target{IP: "192.0.2.10"}
+	tests := []struct {
+		name    string
+		target  Target
+		request Request
+		payload string
+		err     string
+	}{
+		{"v1 defaults", v1, Request{Function: 3, Register: "101", Count: 2}, "0 7 0 192.0.2.10 502 5 1 3 101 2", ""},
+		{"v1 fields", Target{IP: "192.0.2.10", Port: 5020, Timeout: 2 * time.Second, SlaveID: 3}, Request{Function: 4, Register: "30001", Count: 1}, "0 7 0 192.0.2.10 5020 2 3 4 30001 1", ""},
+		{"timeout rounded up", Target{IP: "192.0.2.10", Timeout: 500 * time.Millisecond}, Request{Function: 3, Register: "101", Count: 1}, "0 7 0 192.0.2.10 502 1 1 3 101 1", ""},
+		{"registry fields", Target{Device: "plc1"}, Request{Function: 3, Register: "101", Count: 2}, "0 7 0 - - - - 3 101 2", ""},
+		{"registry fields overridden", Target{Device: "plc1", SlaveID: 2}, Request{Function: 3, Register: "101", Count: 2}, "0 7 0 - - - 2 3 101 2", ""},
+		{"read coils", v1, Request{Function: 1, Register: "1", Count: 8}, "0 7 0 192.0.2.10 502 5 1 1 1 8", ""},
+		{"read discrete inputs", v1, Request{Function: 2, Register: "10001", Count: 8}, "0 7 0 192.0.2.10 502 5 1 2 10001 8", ""},
+		{"write coil", v1, Request{Function: 5, Register: "1", Values: []string{"1"}}, "0 7 0 192.0.2.10 502 5 1 5 1 1", ""},
+		{"write register", v1, Request{Function: 6, Register: "101", Values: []string{"42"}}, "0 7 0 192.0.2.10 502 5 1 6 101 42", ""},
+		{"write coils", v1, Request{Function: 15, Register: "1", Count: 3, Values: []string{"1", "0", "1"}}, "0 7 0 192.0.2.10 502 5 1 15 1 3 1,0,1", ""},
+		{"write registers", v1, Request{Function: 16, Register: "101", Count: 2, Values: []string{"7", "8"}}, "0 7 0 192.0.2.10 502 5 1 16 101 2 7,8", ""},
+		{"options sorted", v1, Request{Function: 3, Register: "101", Count: 2, Options: map[string]string{"type": "float32", "order": "cdab"}}, "0 7 0 192.0.2.10 502 5 1 3 101 2 order=cdab type=float32", ""},
+		{"bit register", v1, Request{Function: 3, Register: "40010.3", Count: 1}, "0 7 0 192.0.2.10 502 5 1 3 40010.3 1", ""},
+		{"write coil without value", v1, Request{Function: 5, Register: "1"}, "", "function 5 takes exactly one value"},
+		{"write register with two values", v1, Request{Function: 6, Register: "101", Values: []string{"1", "2"}}, "", "function 6 takes exactly one value"},
+		{"write coils without data", v1, Request{Function: 15, Register: "1", Count: 1}, "", "function 15 requires data"},
+		{"write registers without data", v1, Request{Function: 16, Register: "101", Count: 1}, "", "function 16 requires data"},
+		{"unsupported function", v1, Request{Function: 7, Register: "1"}, "", "unsupported function code: 7"},
+		{"missing register", v1, Request{Function: 3, Count: 1}, "", "missing register"},
+		{"invalid option", v1, Request{Function: 3, Register: "101", Count: 1, Options: map[string]string{"type": "a b"}}, "", `invalid option "type"`},
+		{"invalid value", v1, Request{Function: 6, Register: "101", Values: []string{"1;2"}}, "", `invalid request field "1;2"`},
+		{"invalid address", Target{IP: "192.0.2.10 502"}, Request{Function: 3, Register: "101", Count: 1}, "", `invalid request field "192.0.2.10 502"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, err := Format(7, tt.target, tt.request)
+			switch {
+			case tt.err != "":
+				if err == nil || err.Error() != tt.err {
+					t.Errorf("error %v, expected %q", err, tt.err)
+				}
+			case err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case payload != tt.payload:
+				t.Errorf("payload %q, expected %q", payload, tt.payload)
+			}
+		})
+	}
+}
+
+func TestParseResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		response *Response
+		err      string
+	}{
+		{"values", "7 OK 100 101", &Response{Cookie: 7, Values: []string{"100", "101"}}, ""},
+		{"write", "7 OK", &Response{Cookie: 7}, ""},
+		{"quoted string", `7 OK "AB CD" 1`, &Response{Cookie: 7, Values: []string{"AB CD", "1"}}, ""},
+		{"quoted equals sign", `7 OK "a=b"`, &Response{Cookie: 7, Values: []string{"a=b"}}, ""},
+		{"stamp", "7 OK 17 42 ts=2024-05-01T12:00:00.123456789Z seq=1042", &Response{Cookie: 7, Values: []string{"17", "42"}, Stamp: map[string]string{"ts": "2024-05-01T12:00:00.123456789Z", "seq": "1042"}}, ""},
+		{"transaction time", "7 OK 17 at=2024-05-01T12:00:00Z", &Response{Cookie: 7, Values: []string{"17"}, Stamp: map[string]string{"at": "2024-05-01T12:00:00Z"}}, ""},
+		{"error", "7 ERROR: timeout", nil, "gateway error (cookie 7): timeout"},
+		{"invalid cookie", "x OK 1", nil, `invalid response cookie "x"`},
+		{"invalid status", "7 FAIL 1", nil, `invalid response status "FAIL"`},
+		{"invalid quoted value", `7 OK "AB`, nil, "invalid quoted value in response"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := ParseResponse(tt.text)
+			switch {
+			case tt.err != "":
+				if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+					t.Errorf("error %v, expected %q", err, tt.err)
+				}
+			case err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case !reflect.DeepEqual(resp, tt.response):
+				t.Errorf("response %+v, expected %+v", resp, tt.response)
+			}
+		})
+	}
+
+	_, err := ParseResponse("7 ERROR: timeout")
+	var gatewayErr *Error
+	if !errors.As(err, &gatewayErr) || gatewayErr.Cookie != 7 || gatewayErr.Reason != "timeout" {
+		t.Errorf("error %#v, expected *Error with cookie 7", err)
+	}
+}
+
+func TestResponseValues(t *testing.T) {
+	resp := &Response{Values: []string{"1", "0"}}
+	if got, err := resp.Uint16s(); err != nil || !reflect.DeepEqual(got, []uint16{1, 0}) {
+		t.Errorf("Uint16s %v, %v", got, err)
+	}
+	if got, err := resp.Bools(); err != nil || !reflect.DeepEqual(got, []bool{true, false}) {
+		t.Errorf("Bools %v, %v", got, err)
+	}
+	if _, err := (&Response{Values: []string{"70000"}}).Uint16s(); err == nil {
+		t.Error("Uint16s accepted 70000")
+	}
+	if _, err := (&Response{Values: []string{"2"}}).Bools(); err == nil {
+		t.Error("Bools accepted 2")
+	}
+}
+
+func TestDispatch(t *testing.T) {
+	c := &Client{pending: make(map[uint64]chan string)}
+	first, second := make(chan string, 1), make(chan string, 1)
+	c.pending[7] = first
+	c.pending[8] = second
+
+	c.dispatch("8 OK 1")
+	c.dispatch("9 OK 2")  // Not pending, e.g. another client on the topic
+	c.dispatch("garbage") // No cookie
+	c.dispatch("8 OK 3")  // Duplicate, dropped
+	c.dispatch("7 ERROR: timeout")
+
+	for _, tt := range []struct {
+		ch   chan string
+		text string
+	}{{first, "7 ERROR: timeout"}, {second, "8 OK 1"}} {
+		select {
+		case text := <-tt.ch:
+			if text != tt.text {
+				t.Errorf("dispatched %q, expected %q", text, tt.text)
+			}
+		default:
+			t.Errorf("%q not dispatched", tt.text)
+		}
+	}
+}
@@ -0,0 +1,1144 @@
+// Package config loads and validates the configuration of the gateway.
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config represents the structure of the configuration file
+type Config struct {
+	MQTT       MQTTConfig              `yaml:"mqtt"`
+	Workers    WorkersConfig           `yaml:"workers"`    // Worker pool of the default lane
+	Ingest     IngestConfig            `yaml:"ingest"`     // Queueing of received requests
+	Lanes      []LaneConfig            `yaml:"lanes"`      // Named worker pools
+	Handler    string                  `yaml:"handler"`    // Named handler executing the requests: modbus (default), dummy, simulator, record or replay
+	Dummy      DummyConfig             `yaml:"dummy"`      // Latency, faults and values of the dummy handler
+	Simulator  SimulatorConfig         `yaml:"simulator"`  // Simulated device of the simulator handler
+	Recording  RecordingConfig         `yaml:"recording"`  // Recording file of the record and replay handlers
+	Routes     []RouteConfig           `yaml:"routes"`     // Additional request topics with their own handler
+	Plugins    []PluginConfig          `yaml:"plugins"`    // Go plugins adding named handlers
+	WASM       []WASMConfig            `yaml:"wasm"`       // WebAssembly modules adding named handlers
+	Hooks      HooksConfig             `yaml:"hooks"`      // Scripts transforming requests and responses
+	Devices    map[string]DeviceConfig `yaml:"devices"`    // Per-device settings keyed by the {device} topic value
+	Groups     map[string][]string     `yaml:"groups"`     // Registered devices a request addressed to the group name is fanned out to
+	Serial     map[string]SerialConfig `yaml:"serial"`     // Modbus RTU serial ports keyed by name
+	SafeMode   SafeModeConfig          `yaml:"safe_mode"`  // Crash loop protection
+	Trace      TraceConfig             `yaml:"trace"`      // In-memory request tracing
+	Heartbeats []HeartbeatConfig       `yaml:"heartbeats"` // Periodic gateway-generated watchdog writes
+	Signing    SigningConfig           `yaml:"signing"`    // HMAC request signing
+	Storage    StorageConfig           `yaml:"storage"`    // Persistence of gateway state
+	Logging    []LogSinkConfig         `yaml:"logging"`    // Log destinations, stderr when empty
+
+	ConnectionPool ConnectionPoolConfig `yaml:"connection_pool"` // Reuse of Modbus TCP connections
+	Retry          RetryConfig          `yaml:"retry"`           // Default retries of transient failures
+	TCP            TCPConfig            `yaml:"tcp"`             // Default dial options of Modbus TCP connections
+	DNS            DNSConfig            `yaml:"dns"`             // Resolution of target host names
+	ReadCache      ReadCacheConfig      `yaml:"read_cache"`      // Reads kept to answer requests accepting cached values
+
+	UnknownDevices UnknownDeviceConfig `yaml:"unknown_devices"` // Handling of requests for devices missing from devices
+	RequestLimits  RequestLimitsConfig `yaml:"request_limits"`  // Upper bounds on the size of requests and responses
+	Protocol       ProtocolConfig      `yaml:"protocol"`        // Versions of the text request format accepted
+	ErrorMessages  map[string]string   `yaml:"error_messages"`  // Custom error reasons keyed by exception code or error name
+}
+
+// RetryConfig is a retry policy for transient failures, timeouts and
+// connection resets, with exponential backoff. Modbus exceptions are never
+// retried.
+type RetryConfig struct {
+	Count     int           `yaml:"count"`      // Retries after the first attempt, 0 disables retrying
+	BaseDelay time.Duration `yaml:"base_delay"` // Delay before the first retry, doubled for each further one (default 100ms)
+	Jitter    float64       `yaml:"jitter"`     // Fraction of the delay randomly added or removed, 0-1
+}
+
+// validate checks the retry policy found at path
+func (r RetryConfig) validate(path string) error {
+	switch {
+	case r.Count < 0:
+		return fmt.Errorf("%s.count must not be negative", path)
+	case r.BaseDelay < 0:
+		return fmt.Errorf("%s.base_delay must not be negative", path)
+	case r.Jitter < 0 || r.Jitter > 1:
+		return fmt.Errorf("%s.jitter must be between 0 and 1", path)
+	}
+	return nil
+}
+
+// validate checks the distributions, rates and bounds of the dummy handler
+func (d DummyConfig) validate() error {
+	l := d.Latency
+	switch {
+	case l.Distribution != LatencyFixed && l.Distribution != LatencyUniform && l.Distribution != LatencyNormal && l.Distribution != LatencyExponential:
+		return fmt.Errorf("dummy.latency.distribution must be fixed, uniform, normal or exponential")
+	case l.Mean < 0 || l.StdDev < 0 || l.Min < 0 || l.Max < 0:
+		return fmt.Errorf("dummy.latency durations must not be negative")
+	case l.Max > 0 && l.Max < l.Min, l.Distribution == LatencyUniform && l.Max == 0:
+		return fmt.Errorf("dummy.latency.max must be at least min")
+	case d.TimeoutRate < 0 || d.ExceptionRate < 0 || d.TimeoutRate+d.ExceptionRate > 1:
+		return fmt.Errorf("dummy rates must be between 0 and 1, and not exceed 1 together")
+	}
+
+	v := d.Values
+	switch {
+	case v.Pattern != ValuesFixed && v.Pattern != ValuesRamp && v.Pattern != ValuesRandom:
+		return fmt.Errorf("dummy.values.pattern must be fixed, ramp or random")
+	case v.Max < v.Min:
+		return fmt.Errorf("dummy.values.max must be at least min")
+	}
+	return nil
+}
+
+// TCPConfig holds the dial options of Modbus TCP connections, e.g. to reach
+// an OT network through its own interface on a multi-homed router
+type TCPConfig struct {
+	KeepAlive    time.Duration `yaml:"keep_alive"`    // Keepalive probe interval, 0 for the system default, negative to disable
+	LocalAddress string        `yaml:"local_address"` // Local IP address or interface name to bind connections to
+}
+
+// validate checks the dial options found at path
+func (t TCPConfig) validate(path string) error {
+	if t.LocalAddress != "" && net.ParseIP(t.LocalAddress) == nil && strings.ContainsAny(t.LocalAddress, " :/") {
+		return fmt.Errorf("%s.local_address %q is neither an IP address nor an interface name", path, t.LocalAddress)
+	}
+	return nil
+}
+
+// DNSConfig controls the resolution of the host names of Modbus TCP targets
+type DNSConfig struct {
+	CacheTTL time.Duration `yaml:"cache_ttl"` // Time a resolved address is reused (default 60s)
+	Timeout  time.Duration `yaml:"timeout"`   // Upper bound on a lookup (default 2s)
+}
+
+// ConnectionPoolConfig controls the reuse of Modbus TCP connections across
+// requests. Pooling is disabled unless a size is given.
+type ConnectionPoolConfig struct {
+	Size        int           `yaml:"size"`         // Idle connections kept open per host:port
+	IdleTimeout time.Duration `yaml:"idle_timeout"` // Close connections idle for longer, 0 to keep them
+	MaxLifetime time.Duration `yaml:"max_lifetime"` // Close connections open for longer, 0 for no limit
+}
+
+// ReadCacheConfig keeps the results of recent reads, to answer requests with
+// a max_age option from memory. Caching is disabled unless a size is given.
+type ReadCacheConfig struct {
+	Size int `yaml:"size"` // Reads kept, the oldest are evicted first
+}
+
+// RouteConfig is a request topic served in addition to mqtt.request_topic,
+// with its own response topic, handler and worker lane, e.g. to serve a test
+// route with the dummy handler next to the production route
+type RouteConfig struct {
+	Name          string `yaml:"name"`           // Route name, in logs
+	RequestTopic  string `yaml:"request_topic"`  // Topic format of the requests, like mqtt.request_topic
+	ResponseTopic string `yaml:"response_topic"` // Topic format of the responses, like mqtt.response_topic
+	Handler       string `yaml:"handler"`        // Named handler executing the requests (default: handler)
+	Lane          string `yaml:"lane"`           // Worker lane serving the requests (default: the lane of the device)
+}
+
+// PluginConfig is a Go plugin (.so) adding a named handler, selectable with
+// the handler keys like the built-in handlers
+type PluginConfig struct {
+	Name    string            `yaml:"name"`    // Handler name
+	Path    string            `yaml:"path"`    // Path of the plugin file
+	Options map[string]string `yaml:"options"` // Settings passed to the NewHandler function of the plugin
+}
+
+// WASMConfig is a WebAssembly module adding a named handler, selectable with
+// the handler keys like the built-in handlers. The module runs sandboxed,
+// without access to files or the network, and may pass requests on to the
+// next handler.
+type WASMConfig struct {
+	Name    string        `yaml:"name"`    // Handler name
+	Path    string        `yaml:"path"`    // Path of the .wasm file
+	Next    string        `yaml:"next"`    // Named handler executing the requests passed on by the module, if any
+	Timeout time.Duration `yaml:"timeout"` // Upper bound on a request, including the requests passed on (default 10s)
+}
+
+// HooksConfig holds the scripts whose hooks are called before a request is
+// executed and after its response is returned, e.g. to rewrite addresses,
+// compose derived values or block requests with site-specific logic
+type HooksConfig struct {
+	Lua        ScriptConfig `yaml:"lua"`        // Lua script
+	JavaScript ScriptConfig `yaml:"javascript"` // JavaScript script, instead of a Lua script
+}
+
+// ScriptConfig is a script defining hook functions. Hooks are disabled
+// unless a path is given.
+type ScriptConfig struct {
+	Path    string        `yaml:"path"`    // Path of the script file
+	Timeout time.Duration `yaml:"timeout"` // Upper bound on a hook call (default 100ms)
+}
+
+// DummyConfig shapes the answers of the dummy handler, e.g. for load tests
+// and client development without devices. By default every command is
+// answered at once, reads with the value 1.
+type DummyConfig struct {
+	Latency       LatencyConfig `yaml:"latency"`        // Delay of every command
+	TimeoutRate   float64       `yaml:"timeout_rate"`   // Fraction of commands failing with a timeout, 0 to 1
+	ExceptionRate float64       `yaml:"exception_rate"` // Fraction of commands failing with a Modbus exception, 0 to 1
+	Exceptions    []uint8       `yaml:"exceptions"`     // Exception codes drawn from (default 2, illegal data address)
+	Values        ValuesConfig  `yaml:"values"`         // Values of the reads
+	Seed          int64         `yaml:"seed"`           // Seed of the random draws, for reproducible runs (random if 0)
+}
+
+// LatencyConfig is a distribution of delays
+type LatencyConfig struct {
+	Distribution string        `yaml:"distribution"` // fixed (default), uniform, normal or exponential
+	Mean         time.Duration `yaml:"mean"`         // Delay of fixed, mean of normal and exponential
+	StdDev       time.Duration `yaml:"stddev"`       // Standard deviation of normal
+	Min          time.Duration `yaml:"min"`          // Lower bound of uniform, and of the other distributions
+	Max          time.Duration `yaml:"max"`          // Upper bound of uniform, and of normal and exponential if set
+}
+
+// Latency distributions
+const (
+	LatencyFixed       = "fixed"
+	LatencyUniform     = "uniform"
+	LatencyNormal      = "normal"
+	LatencyExponential = "exponential"
+)
+
+// ValuesConfig is the pattern of the values read
+type ValuesConfig struct {
+	Pattern string  `yaml:"pattern"` // fixed (default), ramp or random
+	Value   *uint16 `yaml:"value"`   // Value of fixed (default 1)
+	Min     uint16  `yaml:"min"`     // Lower bound of ramp and random
+	Max     uint16  `yaml:"max"`     // Upper bound of ramp and random (default 65535)
+	Step    uint16  `yaml:"step"`    // Increment of ramp from one command to the next (default 1)
+}
+
+// Value patterns
+const (
+	ValuesFixed  = "fixed"
+	ValuesRamp   = "ramp"
+	ValuesRandom = "random"
+)
+
+// SimulatorConfig is the in-memory device every request of the simulator
+// handler is executed on, whatever its target
+type SimulatorConfig struct {
+	Size int    `yaml:"size"` // Registers, coils and discrete inputs of each type (default 10000)
+	Map  string `yaml:"map"`  // YAML register map declaring the values of the device, optional
+}
+
+// RecordingConfig is the file the record handler appends the results of the
+// commands to, and the replay handler answers commands from
+type RecordingConfig struct {
+	Path    string `yaml:"path"`    // JSON lines file, one result per line
+	Handler string `yaml:"handler"` // Named handler executing the recorded commands (default modbus)
+}
+
+// ProtocolConfig selects the versions of the text request format accepted.
+// Version 2 requests are always accepted.
+type ProtocolConfig struct {
+	RejectV1 bool `yaml:"reject_v1"` // Reject version 1 requests, e.g. once every client sends version 2
+}
+
+// RequestLimitsConfig bounds the number of registers and coils a single
+// request may address, and the size of the request and response payloads.
+// The defaults are the Modbus read limits and unlimited payloads.
+type RequestLimitsConfig struct {
+	MaxRegisters uint16 `yaml:"max_registers"` // Registers per request (default 125)
+	MaxCoils     uint16 `yaml:"max_coils"`     // Coils or discrete inputs per request (default 2000)
+	MaxPayload   int    `yaml:"max_payload"`   // Bytes per request payload; larger requests are rejected unparsed (unlimited if 0)
+	MaxResponse  int    `yaml:"max_response"`  // Bytes per response payload; larger responses are replaced by an error (unlimited if 0)
+}
+
+// Actions for requests whose {device} is not in the device registry
+const (
+	UnknownDeviceAllow   = "allow"   // Execute using the target given in the payload
+	UnknownDeviceReject  = "reject"  // Answer with an UNKNOWN_DEVICE error
+	UnknownDeviceForward = "forward" // Republish to a catch-all topic without executing
+)
+
+// UnknownDeviceConfig selects how requests for unregistered devices are handled
+type UnknownDeviceConfig struct {
+	Action       string `yaml:"action"`        // allow (default), reject or forward
+	ForwardTopic string `yaml:"forward_topic"` // Catch-all topic for forward, may use the request topic placeholders
+}
+
+// Registered reports whether the device has an entry in the device registry
+func (c *Config) Registered(device string) bool {
+	_, ok := c.Devices[device]
+	return ok
+}
+
+// Storage backends
+const (
+	StorageMemory = "memory" // Kept in memory, lost on restart
+	StorageBolt   = "bolt"   // Persisted in a bbolt database file
+)
+
+// StorageConfig selects the store shared by the stateful subsystems
+type StorageConfig struct {
+	Backend string `yaml:"backend"` // memory (default) or bolt
+	Path    string `yaml:"path"`    // Database file of the bolt backend
+}
+
+// Log sink types
+const (
+	LogSinkStderr   = "stderr"
+	LogSinkFile     = "file"
+	LogSinkSyslog   = "syslog"
+	LogSinkJournald = "journald"
+)
+
+// Log levels, in increasing severity
+const (
+	LogLevelDebug = "debug"
+	LogLevelInfo  = "info"
+	LogLevelWarn  = "warn"
+	LogLevelError = "error"
+)
+
+// LogSinkConfig defines a destination of the gateway log
+type LogSinkConfig struct {
+	Type  string `yaml:"type"`  // stderr, file, syslog or journald
+	Level string `yaml:"level"` // Lowest level written: debug, info (default), warn or error
+
+	// file
+	Path       string        `yaml:"path"`        // Log file
+	MaxSize    int           `yaml:"max_size"`    // Size in MB at which the file is rotated (default 10)
+	MaxAge     time.Duration `yaml:"max_age"`     // Age after which rotated files are removed (0 keeps them)
+	MaxBackups int           `yaml:"max_backups"` // Number of rotated files kept (0 keeps all)
+
+	// syslog
+	Network string `yaml:"network"` // udp, tcp or empty for the local syslog daemon
+	Address string `yaml:"address"` // Syslog server address, with network
+	Tag     string `yaml:"tag"`     // Syslog tag (default open-modbus-goateway)
+}
+
+// SigningConfig holds the HMAC request signing settings
+type SigningConfig struct {
+	Required bool         `yaml:"required"` // Reject unsigned requests
+	Keys     []SigningKey `yaml:"keys"`     // Accepted keys; validity windows may overlap during rotation
+}
+
+// SigningKey is a shared secret identified by the "kid=" request option
+type SigningKey struct {
+	ID        string    `yaml:"id"`         // Key ID referenced by requests
+	Secret    string    `yaml:"secret"`     // Shared HMAC-SHA256 secret
+	NotBefore time.Time `yaml:"not_before"` // Start of validity (optional)
+	NotAfter  time.Time `yaml:"not_after"`  // End of validity (optional)
+}
+
+// HeartbeatConfig defines a periodic write issued by the gateway itself, e.g.
+// to keep a PLC watchdog from tripping
+type HeartbeatConfig struct {
+	Name     string        `yaml:"name"`     // Name used in log messages
+	Device   string        `yaml:"device"`   // Device the heartbeat belongs to (selects the lane when queued)
+	Interval time.Duration `yaml:"interval"` // Time between writes
+	Request  string        `yaml:"request"`  // Request payload, in the same format as MQTT requests
+	Queued   bool          `yaml:"queued"`   // Queue on the device's lane instead of bypassing the queues
+}
+
+// MQTTConfig holds MQTT-related settings
+type MQTTConfig struct {
+	Broker        string   `yaml:"broker"`         // MQTT broker address
+	ClientID      string   `yaml:"client_id"`      // MQTT client ID
+	Username      string   `yaml:"username"`       // MQTT username
+	Password      string   `yaml:"password"`       // MQTT password
+	RequestTopic  string   `yaml:"request_topic"`  // Action placeholder for request topics
+	ResponseTopic string   `yaml:"response_topic"` // Action placeholder for response topics
+	CACertPath    string   `yaml:"ca_cert_path"`   // Path to CA certificate
+	CertPath      string   `yaml:"cert_path"`      // Path to client certificate
+	KeyPath       string   `yaml:"key_path"`       // Path to client key
+	PinnedKeys    []string `yaml:"pinned_keys"`    // SHA-256 SPKI pins of the broker certificate chain (sha256/<base64>)
+	StampResponse bool     `yaml:"stamp_response"` // Append publish timestamp and sequence number to responses
+	StatusTopic   string   `yaml:"status_topic"`   // Retained gateway status topic (ONLINE, SAFE_MODE, OFFLINE)
+
+	ControlTopic         string `yaml:"control_topic"`          // Topic receiving gateway control commands
+	ControlResponseTopic string `yaml:"control_response_topic"` // Topic for control replies (default: <control_topic>/response)
+	PersistToggles       bool   `yaml:"persist_toggles"`        // Keep the traffic disabled via the control topic across restarts
+}
+
+// TraceConfig holds the request tracing settings
+type TraceConfig struct {
+	Size int `yaml:"size"` // Number of recent requests kept in memory (0 disables tracing)
+}
+
+// SafeModeConfig holds the crash loop detection settings. Safe mode is
+// disabled unless a state file is configured.
+type SafeModeConfig struct {
+	StateFile   string        `yaml:"state_file"`   // File persisting the crash counter
+	MaxRestarts int           `yaml:"max_restarts"` // Unclean starts within the window that trigger safe mode
+	Window      time.Duration `yaml:"window"`       // Time window for counting unclean starts
+}
+
+// Serial port parities
+const (
+	ParityNone = "none"
+	ParityEven = "even"
+	ParityOdd  = "odd"
+)
+
+// SerialConfig holds the settings of a Modbus RTU serial port. Zero values
+// select the defaults of the Modbus library (19200 baud, 8 data bits, 2 stop
+// bits without parity, 1 with parity).
+type SerialConfig struct {
+	Device   string `yaml:"device"`    // Serial device, e.g. /dev/ttyUSB0
+	Baud     uint   `yaml:"baud"`      // Link speed in bps
+	DataBits uint   `yaml:"data_bits"` // Bits per character
+	Parity   string `yaml:"parity"`    // none (default), even or odd
+	StopBits uint   `yaml:"stop_bits"` // Stop bits per character
+
+	InterFrameDelay time.Duration `yaml:"inter_frame_delay"` // Silence between transactions, on top of the 3.5 character times
+	TurnaroundDelay time.Duration `yaml:"turnaround_delay"`  // Silence after a write before the next transaction
+
+	MaxUtilization float64 `yaml:"max_utilization"` // Highest estimated bus utilization by heartbeats, 0-1 (0 disables the check)
+	RefuseOverload bool    `yaml:"refuse_overload"` // Refuse to start instead of warning when max_utilization is exceeded
+}
+
+// DefaultLane is the name of the worker lane used by devices without a lane
+const DefaultLane = "default"
+
+// DefaultWorkers is the number of workers of the default lane
+const DefaultWorkers = 4
+
+// WorkersConfig sizes the worker pool of the default lane
+type WorkersConfig struct {
+	Count         int             `yaml:"count"`           // Workers of the default lane (default 4), the initial count when autoscaling
+	Autoscale     AutoscaleConfig `yaml:"autoscale"`       // Growing and shrinking of the pool with the load
+	ShardByDevice bool            `yaml:"shard_by_device"` // Execute the requests for a device in order on one worker
+	Watchdog      WatchdogConfig  `yaml:"watchdog"`        // Detection of workers stuck on a request
+}
+
+// WatchdogConfig detects workers executing a request for much longer than
+// its timeout allows, e.g. blocked in a hung Modbus transaction
+type WatchdogConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Factor   float64       `yaml:"factor"`   // Stuck after factor times the request timeout, per batch command (default 5)
+	Interval time.Duration `yaml:"interval"` // Time between checks (default 5s)
+	Restart  bool          `yaml:"restart"`  // Start a replacement worker; the stuck one exits once its request returns
+}
+
+// AutoscaleConfig adjusts the workers of the default lane to the backlog of
+// queued requests and their average execution time
+type AutoscaleConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Min      int           `yaml:"min"`      // Fewest workers (default 1)
+	Max      int           `yaml:"max"`      // Most workers (default 4 times count)
+	Interval time.Duration `yaml:"interval"` // Time between adjustments (default 5s)
+	MaxWait  time.Duration `yaml:"max_wait"` // Estimated queueing time of a new request above which workers are added (default 1s)
+}
+
+// Policies for requests received while the queue of their lane is full
+const (
+	OverflowReject     = "reject"      // Answer the request with an OVERLOADED error
+	OverflowDropNewest = "drop_newest" // Discard the request
+	OverflowDropOldest = "drop_oldest" // Discard the oldest queued request to queue the new one
+)
+
+// DefaultQueueSize is the minimum number of requests queued per lane
+const DefaultQueueSize = 100
+
+// IngestConfig bounds the queues of requests received from the broker. The
+// subscription callback never blocks; requests exceeding a full queue are
+// handled by the overflow policy.
+type IngestConfig struct {
+	QueueSize        int           `yaml:"queue_size"`        // Requests queued per lane, per worker in sharded lanes (default 100 or 10 per worker)
+	Overflow         string        `yaml:"overflow"`          // reject (default), drop_newest or drop_oldest
+	PrioritizeWrites bool          `yaml:"prioritize_writes"` // Serve write requests before the queued reads of their lane
+	MaxAge           time.Duration `yaml:"max_age"`           // Requests queued for longer are answered with an EXPIRED error instead of executed (off if 0)
+	DrainTimeout     time.Duration `yaml:"drain_timeout"`     // Time given to the workers on shutdown to execute the queued requests; the rest are answered with SHUTDOWN errors (0 waits for all)
+	DeadLetterTopic  string        `yaml:"dead_letter_topic"` // Topic receiving dropped and unparseable requests with the reason (off if empty)
+}
+
+// LaneConfig defines a named worker pool with a dedicated size
+type LaneConfig struct {
+	Name          string `yaml:"name"`            // Lane name referenced by devices
+	Workers       int    `yaml:"workers"`         // Number of workers serving the lane
+	ShardByDevice bool   `yaml:"shard_by_device"` // Execute the requests for a device in order on one worker
+}
+
+// DeviceConfig holds per-device settings
+type DeviceConfig struct {
+	Lane          string              `yaml:"lane"`           // Worker lane handling requests for the device
+	Address       string              `yaml:"address"`        // Modbus TCP target (host or host:port) of requests giving "-"
+	Serial        string              `yaml:"serial"`         // Serial port the device is attached to, instead of Modbus TCP
+	UnitID        uint8               `yaml:"unit_id"`        // Unit ID of requests giving "-" as SLAVE_ID
+	Timeout       time.Duration       `yaml:"timeout"`        // Timeout of requests giving "-" as TIMEOUT
+	MinGap        time.Duration       `yaml:"min_gap"`        // Minimum gap between transactions on the target of the device
+	MaxConcurrent int                 `yaml:"max_concurrent"` // Requests executed in parallel on the device (default 1, or pipeline)
+	Pipeline      int                 `yaml:"pipeline"`       // Transactions outstanding at once on one shared connection, 0 disables pipelining
+	ByteOrder     string              `yaml:"byte_order"`     // Default order of multi-register values (ABCD, CDAB, BADC, DCBA)
+	CoalesceGap   *int                `yaml:"coalesce_gap"`   // Max unrequested registers between merged batch reads, unset to disable merging
+	DedupeReads   bool                `yaml:"dedupe_reads"`   // Answer concurrent identical reads with the result of one transaction
+	Interlocks    []InterlockConfig   `yaml:"interlocks"`     // Writes refused depending on last-known values of the device
+	Limits        []WriteLimit        `yaml:"limits"`         // Constraints on values written to holding registers
+	Writable      *WritableConfig     `yaml:"writable"`       // Register ranges that may be written, unset to allow all
+	Timestamp     bool                `yaml:"timestamp"`      // Append the transaction time to every response of the device
+	Quality       bool                `yaml:"quality"`        // Append the quality of the result to every response of the device
+	Diagnostics   bool                `yaml:"diagnostics"`    // Append transaction timings and retries to every response of the device
+	PostProcess   []PostProcessConfig `yaml:"post_process"`   // Fixups applied to register reads before decoding
+	Retry         *RetryConfig        `yaml:"retry"`          // Retries of transient failures, instead of the default policy
+	TCP           *TCPConfig          `yaml:"tcp"`            // Dial options of Modbus TCP connections, instead of the defaults
+	Metadata      map[string]string   `yaml:"metadata"`       // Added to JSON responses, e.g. site, line, asset_id, unit
+	Tags          []string            `yaml:"tags"`           // Labels selecting the device in the device registry of the handlers
+	Signature     *SignatureConfig    `yaml:"signature"`      // Registers identifying the device in inventory reports
+}
+
+// SignatureConfig is a block of registers read by the inventory command to
+// identify a device, e.g. its serial number or firmware version
+type SignatureConfig struct {
+	Function uint8  `yaml:"function"` // Read function, 3 (default) or 4
+	Register uint16 `yaml:"register"` // Number of the first register
+	Count    uint16 `yaml:"count"`    // Number of registers, default 1
+}
+
+// PostProcessConfig attaches a named post-processor to a range of registers
+type PostProcessConfig struct {
+	Name      string            `yaml:"name"`      // Registered post-processor, e.g. swap-words
+	Registers string            `yaml:"registers"` // Register number or inclusive range ("100-103")
+	Args      map[string]string `yaml:"args"`      // Post-processor specific arguments
+}
+
+// WritableConfig lists the ranges of a device that may be written, as
+// register numbers ("100") or inclusive ranges ("100-120"). Writes outside
+// them are denied.
+type WritableConfig struct {
+	Holding []string `yaml:"holding"` // Holding registers (functions 6, 16)
+	Coils   []string `yaml:"coils"`   // Coils (functions 5, 15)
+}
+
+// ParseRange parses a register number or an inclusive range of register
+// numbers, e.g. "100" or "100-120"
+func ParseRange(s string) (uint16, uint16, error) {
+	from, to, isRange := strings.Cut(strings.TrimSpace(s), "-")
+	if !isRange {
+		to = from
+	}
+
+	first, err := strconv.ParseUint(strings.TrimSpace(from), 10, 16)
+	if err != nil || first < 1 {
+		return 0, 0, fmt.Errorf("invalid register range %q", s)
+	}
+	last, err := strconv.ParseUint(strings.TrimSpace(to), 10, 16)
+	if err != nil || last < first {
+		return 0, 0, fmt.Errorf("invalid register range %q", s)
+	}
+
+	return uint16(first), uint16(last), nil
+}
+
+// WriteLimit constrains the values written to a holding register. Values are
+// compared in the units of the request, i.e. after type decoding and scaling.
+type WriteLimit struct {
+	Register uint16    `yaml:"register"` // Register number at which the value starts
+	Min      *float64  `yaml:"min"`      // Lowest accepted value (optional)
+	Max      *float64  `yaml:"max"`      // Highest accepted value (optional)
+	Values   []float64 `yaml:"values"`   // Enumeration of accepted values (optional)
+}
+
+// InterlockConfig refuses writes to the device while a last-known value of
+// one of its registers, as read by earlier requests, is out of bounds. Writes
+// are also refused while the value is unknown or too old.
+type InterlockConfig struct {
+	Name     string         `yaml:"name"`     // Reported in INTERLOCK errors
+	Writes   WritableConfig `yaml:"writes"`   // Guarded holding registers and coils
+	Function uint8          `yaml:"function"` // Read function of the checked register, 3 (default) or 4
+	Register uint16         `yaml:"register"` // Number of the checked register
+	Signed   bool           `yaml:"signed"`   // Interpret the checked value as a signed 16-bit integer
+	Above    *float64       `yaml:"above"`    // Refuse writes while the value is above (optional)
+	Below    *float64       `yaml:"below"`    // Refuse writes while the value is below (optional)
+	MaxAge   time.Duration  `yaml:"max_age"`  // Refuse writes while the value is older, 0 for no limit
+}
+
+// DefaultMaxConcurrent is the number of requests executed in parallel on a
+// device of the registry without max_concurrent
+const DefaultMaxConcurrent = 1
+
+// DefaultModbusPort is the port of device addresses without a port
+const DefaultModbusPort = 502
+
+// SplitAddress splits a device address ("host" or "host:port", IPv6 hosts in
+// brackets) into host and port
+func SplitAddress(address string) (string, uint16, error) {
+	host, portField, err := net.SplitHostPort(address)
+	if err != nil {
+		// No port given
+		host, portField = strings.TrimSuffix(strings.TrimPrefix(address, "["), "]"), strconv.Itoa(DefaultModbusPort)
+	}
+	port, err := strconv.ParseUint(portField, 10, 16)
+	if !ValidHost(host) || err != nil || port == 0 {
+		return "", 0, fmt.Errorf("invalid address %q", address)
+	}
+	return host, uint16(port), nil
+}
+
+// ValidHost reports whether a host is an IP address, possibly with an IPv6
+// zone, or a host name
+func ValidHost(host string) bool {
+	if _, err := netip.ParseAddr(host); err == nil {
+		return true
+	}
+	if host == "" || len(host) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// LaneFor returns the name of the worker lane serving the given device
+func (c *Config) LaneFor(device string) string {
+	if d, ok := c.Devices[device]; ok && d.Lane != "" {
+		return d.Lane
+	}
+	return DefaultLane
+}
+
+// Load loads the configuration from the given YAML file
+func Load(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read config file: %w", err)
+	}
+
+	if err := ValidateSchema(data); err != nil {
+		return nil, fmt.Errorf("invalid config file %s:\n%w", path, err)
+	}
+	return parse(data)
+}
+
+// Parse parses and validates a configuration in YAML, e.g. one embedded in
+// the program running the gateway
+func Parse(data []byte) (*Config, error) {
+	if err := ValidateSchema(data); err != nil {
+		return nil, fmt.Errorf("invalid configuration:\n%w", err)
+	}
+	return parse(data)
+}
+
+// parse decodes a configuration checked against the schema, applying the
+// defaults
+func parse(data []byte) (*Config, error) {
+	var cfg Config
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("unable to parse config file: %w", err)
+	}
+
+	cfg.applyDefaults()
+
+	// Validate required fields
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	return &cfg, nil
+}
+
+// applyDefaults sets default values for optional settings
+func (c *Config) applyDefaults() {
+	if c.Handler == "" {
+		c.Handler = "modbus"
+	}
+	if c.Simulator.Size == 0 {
+		c.Simulator.Size = 10000
+	}
+	if c.Recording.Handler == "" {
+		c.Recording.Handler = "modbus"
+	}
+	if c.Dummy.Latency.Distribution == "" {
+		c.Dummy.Latency.Distribution = LatencyFixed
+	}
+	if len(c.Dummy.Exceptions) == 0 {
+		c.Dummy.Exceptions = []uint8{2}
+	}
+	if c.Dummy.Values.Pattern == "" {
+		c.Dummy.Values.Pattern = ValuesFixed
+	}
+	if c.Dummy.Values.Value == nil {
+		one := uint16(1)
+		c.Dummy.Values.Value = &one
+	}
+	if c.Dummy.Values.Max == 0 {
+		c.Dummy.Values.Max = 65535
+	}
+	if c.Dummy.Values.Step == 0 {
+		c.Dummy.Values.Step = 1
+	}
+	for i := range c.WASM {
+		if c.WASM[i].Timeout == 0 {
+			c.WASM[i].Timeout = 10 * time.Second
+		}
+	}
+	for _, script := range []*ScriptConfig{&c.Hooks.Lua, &c.Hooks.JavaScript} {
+		if script.Timeout == 0 {
+			script.Timeout = 100 * time.Millisecond
+		}
+	}
+	for i := range c.Routes {
+		if c.Routes[i].Handler == "" {
+			c.Routes[i].Handler = c.Handler
+		}
+	}
+	if c.SafeMode.MaxRestarts == 0 {
+		c.SafeMode.MaxRestarts = 3
+	}
+	if c.SafeMode.Window == 0 {
+		c.SafeMode.Window = 10 * time.Minute
+	}
+	if c.RequestLimits.MaxRegisters == 0 {
+		c.RequestLimits.MaxRegisters = 125
+	}
+	if c.RequestLimits.MaxCoils == 0 {
+		c.RequestLimits.MaxCoils = 2000
+	}
+	countSet := c.Workers.Count != 0
+	if !countSet {
+		c.Workers.Count = DefaultWorkers
+	}
+	if a := &c.Workers.Autoscale; a.Enabled {
+		if a.Min == 0 {
+			a.Min = 1
+		}
+		if a.Max == 0 {
+			a.Max = 4 * c.Workers.Count
+		}
+		if !countSet { // Start within the bounds
+			c.Workers.Count = max(a.Min, min(c.Workers.Count, a.Max))
+		}
+		if a.Interval == 0 {
+			a.Interval = 5 * time.Second
+		}
+		if a.MaxWait == 0 {
+			a.MaxWait = time.Second
+		}
+	}
+	if w := &c.Workers.Watchdog; w.Enabled {
+		if w.Factor == 0 {
+			w.Factor = 5
+		}
+		if w.Interval == 0 {
+			w.Interval = 5 * time.Second
+		}
+	}
+}
+
+// validate checks for required fields and logical consistency in the configuration
+func (c *Config) validate() error {
+	if c.MQTT.Broker == "" {
+		return fmt.Errorf("mqtt.broker must be specified")
+	}
+	if c.MQTT.ClientID == "" {
+		return fmt.Errorf("mqtt.client_id must be specified")
+	}
+	if c.MQTT.RequestTopic == "" {
+		return fmt.Errorf("mqtt.request_action must be specified")
+	}
+	if c.MQTT.ResponseTopic == "" {
+		return fmt.Errorf("mqtt.response_action must be specified")
+	}
+	if len(c.MQTT.PinnedKeys) > 0 && !strings.HasPrefix(c.MQTT.Broker, "ssl://") {
+		return fmt.Errorf("mqtt.pinned_keys requires an ssl:// broker")
+	}
+
+	if c.SafeMode.MaxRestarts < 0 {
+		return fmt.Errorf("safe_mode.max_restarts must be greater than zero")
+	}
+	if c.SafeMode.Window < 0 {
+		return fmt.Errorf("safe_mode.window must be positive")
+	}
+
+	if c.Trace.Size < 0 {
+		return fmt.Errorf("trace.size must not be negative")
+	}
+	if c.RequestLimits.MaxPayload < 0 || c.RequestLimits.MaxResponse < 0 {
+		return fmt.Errorf("request_limits payload sizes must not be negative")
+	}
+
+	switch c.UnknownDevices.Action {
+	case "", UnknownDeviceAllow:
+	case UnknownDeviceReject, UnknownDeviceForward:
+		if !strings.Contains(c.MQTT.RequestTopic, "{device}") {
+			return fmt.Errorf("unknown_devices.action %s requires a {device} placeholder in mqtt.request_topic", c.UnknownDevices.Action)
+		}
+		for i, hb := range c.Heartbeats {
+			if !c.Registered(hb.Device) {
+				return fmt.Errorf("heartbeats[%d].device %q must be registered in devices with unknown_devices.action %s", i, hb.Device, c.UnknownDevices.Action)
+			}
+		}
+		if c.UnknownDevices.Action == UnknownDeviceForward {
+			if c.UnknownDevices.ForwardTopic == "" {
+				return fmt.Errorf("unknown_devices.forward_topic must be specified for action forward")
+			}
+			if c.UnknownDevices.ForwardTopic == c.MQTT.RequestTopic {
+				return fmt.Errorf("unknown_devices.forward_topic must differ from mqtt.request_topic")
+			}
+		}
+	default:
+		return fmt.Errorf("unknown_devices.action %q is not one of allow, reject, forward", c.UnknownDevices.Action)
+	}
+
+	for name, members := range c.Groups {
+		switch {
+		case c.Registered(name):
+			return fmt.Errorf("groups.%s must not be named like a device", name)
+		case strings.Contains(name, ","):
+			return fmt.Errorf("groups.%s must not contain a comma", name)
+		case len(members) == 0:
+			return fmt.Errorf("groups.%s must list at least one device", name)
+		}
+		for _, member := range members {
+			if !c.Registered(member) {
+				return fmt.Errorf("groups.%s device %q is not registered in devices", name, member)
+			}
+		}
+	}
+
+	switch c.Storage.Backend {
+	case "", StorageMemory:
+	case StorageBolt:
+		if c.Storage.Path == "" {
+			return fmt.Errorf("storage.path must be specified for the bolt backend")
+		}
+	default:
+		return fmt.Errorf("storage.backend %q is not one of memory, bolt", c.Storage.Backend)
+	}
+
+	for i, hb := range c.Heartbeats {
+		if hb.Interval <= 0 {
+			return fmt.Errorf("heartbeats[%d].interval must be greater than zero", i)
+		}
+		if hb.Request == "" {
+			return fmt.Errorf("heartbeats[%d].request must be specified", i)
+		}
+	}
+
+	if c.Signing.Required && len(c.Signing.Keys) == 0 {
+		return fmt.Errorf("signing.keys must be specified when signing is required")
+	}
+	keyIDs := make(map[string]bool)
+	for i, key := range c.Signing.Keys {
+		if key.ID == "" || key.Secret == "" {
+			return fmt.Errorf("signing.keys[%d] must specify id and secret", i)
+		}
+		if keyIDs[key.ID] {
+			return fmt.Errorf("signing.keys[%d].id %q is already defined", i, key.ID)
+		}
+		if !key.NotBefore.IsZero() && !key.NotAfter.IsZero() && !key.NotAfter.After(key.NotBefore) {
+			return fmt.Errorf("signing.keys[%d].not_after must be after not_before", i)
+		}
+		keyIDs[key.ID] = true
+	}
+
+	if c.Workers.Count < 1 {
+		return fmt.Errorf("workers.count must be at least 1")
+	}
+	if a := c.Workers.Autoscale; a.Enabled {
+		switch {
+		case a.Min < 1 || a.Max < a.Min:
+			return fmt.Errorf("workers.autoscale requires 1 <= min <= max")
+		case c.Workers.Count < a.Min || c.Workers.Count > a.Max:
+			return fmt.Errorf("workers.count must be between workers.autoscale.min and max")
+		case a.Interval < 0 || a.MaxWait < 0:
+			return fmt.Errorf("workers.autoscale durations must not be negative")
+		case c.Workers.ShardByDevice:
+			return fmt.Errorf("workers.autoscale and workers.shard_by_device are mutually exclusive")
+		}
+	}
+	if w := c.Workers.Watchdog; w.Enabled && (w.Factor < 1 || w.Interval < 0) {
+		return fmt.Errorf("workers.watchdog.factor must be at least 1 and interval not negative")
+	}
+
+	if c.Ingest.QueueSize < 0 {
+		return fmt.Errorf("ingest.queue_size must not be negative")
+	}
+	switch c.Ingest.Overflow {
+	case "", OverflowReject, OverflowDropNewest, OverflowDropOldest:
+	default:
+		return fmt.Errorf("ingest.overflow %q is not one of reject, drop_newest, drop_oldest", c.Ingest.Overflow)
+	}
+	if c.Ingest.MaxAge < 0 || c.Ingest.DrainTimeout < 0 {
+		return fmt.Errorf("ingest durations must not be negative")
+	}
+	if strings.ContainsAny(c.Ingest.DeadLetterTopic, "+#{}") {
+		return fmt.Errorf("ingest.dead_letter_topic %q must not contain wildcards or placeholders", c.Ingest.DeadLetterTopic)
+	}
+
+	lanes := map[string]bool{DefaultLane: true}
+	for i, lane := range c.Lanes {
+		if lane.Name == "" {
+			return fmt.Errorf("lanes[%d].name must be specified", i)
+		}
+		if lanes[lane.Name] {
+			return fmt.Errorf("lanes[%d].name %q is reserved or already defined", i, lane.Name)
+		}
+		if lane.Workers <= 0 {
+			return fmt.Errorf("lanes[%d].workers must be greater than zero", i)
+		}
+		lanes[lane.Name] = true
+	}
+
+	plugins := map[string]bool{}
+	for i, p := range c.Plugins {
+		switch {
+		case p.Name == "":
+			return fmt.Errorf("plugins[%d].name must be specified", i)
+		case plugins[p.Name]:
+			return fmt.Errorf("plugins[%d].name %q is already defined", i, p.Name)
+		case p.Path == "":
+			return fmt.Errorf("plugins[%d].path must be specified", i)
+		}
+		plugins[p.Name] = true
+	}
+
+	modules := map[string]string{}
+	for i, w := range c.WASM {
+		switch {
+		case w.Name == "":
+			return fmt.Errorf("wasm[%d].name must be specified", i)
+		case plugins[w.Name] || modules[w.Name] != "":
+			return fmt.Errorf("wasm[%d].name %q is already defined", i, w.Name)
+		case w.Path == "":
+			return fmt.Errorf("wasm[%d].path must be specified", i)
+		case w.Timeout < 0:
+			return fmt.Errorf("wasm[%d].timeout must not be negative", i)
+		}
+		modules[w.Name] = w.Path
+	}
+	nextOf := map[string]string{}
+	for _, w := range c.WASM {
+		nextOf[w.Name] = w.Next
+	}
+	for i, w := range c.WASM {
+		// A module passing requests on to itself, directly or through other modules, never returns
+		seen := map[string]bool{w.Name: true}
+		for next := w.Next; modules[next] != ""; next = nextOf[next] {
+			if seen[next] {
+				return fmt.Errorf("wasm[%d].next %q passes requests back to %q", i, w.Next, next)
+			}
+			seen[next] = true
+		}
+	}
+
+	routes := map[string]bool{}
+	requestTopics := map[string]bool{c.MQTT.RequestTopic: true}
+	for i, route := range c.Routes {
+		switch {
+		case route.Name == "":
+			return fmt.Errorf("routes[%d].name must be specified", i)
+		case routes[route.Name]:
+			return fmt.Errorf("routes[%d].name %q is already defined", i, route.Name)
+		case route.RequestTopic == "" || route.ResponseTopic == "":
+			return fmt.Errorf("routes[%d] request_topic and response_topic must be specified", i)
+		case requestTopics[route.RequestTopic]:
+			return fmt.Errorf("routes[%d].request_topic %q is already served", i, route.RequestTopic)
+		case route.Lane != "" && !lanes[route.Lane]:
+			return fmt.Errorf("routes[%d].lane references unknown lane %q", i, route.Lane)
+		}
+		routes[route.Name] = true
+		requestTopics[route.RequestTopic] = true
+	}
+
+	for i, sink := range c.Logging {
+		switch sink.Type {
+		case LogSinkStderr, LogSinkJournald:
+		case LogSinkFile:
+			if sink.Path == "" {
+				return fmt.Errorf("logging[%d].path must be specified", i)
+			}
+			if sink.MaxSize < 0 || sink.MaxAge < 0 || sink.MaxBackups < 0 {
+				return fmt.Errorf("logging[%d] rotation limits must not be negative", i)
+			}
+		case LogSinkSyslog:
+			if (sink.Network == "") != (sink.Address == "") {
+				return fmt.Errorf("logging[%d]: network and address must be given together", i)
+			}
+		default:
+			return fmt.Errorf("logging[%d].type %q is not one of stderr, file, syslog, journald", i, sink.Type)
+		}
+		switch sink.Level {
+		case "", LogLevelDebug, LogLevelInfo, LogLevelWarn, LogLevelError:
+		default:
+			return fmt.Errorf("logging[%d].level %q is not one of debug, info, warn, error", i, sink.Level)
+		}
+	}
+
+	serialDevices := make(map[string]string)
+	for name, port := range c.Serial {
+		if port.Device == "" {
+			return fmt.Errorf("serial.%s.device must be specified", name)
+		}
+		if other, ok := serialDevices[port.Device]; ok {
+			return fmt.Errorf("serial.%s.device %s is already used by serial.%s", name, port.Device, other)
+		}
+		serialDevices[port.Device] = name
+		switch port.Parity {
+		case "", ParityNone, ParityEven, ParityOdd:
+		default:
+			return fmt.Errorf("serial.%s.parity %q is not one of none, even, odd", name, port.Parity)
+		}
+		if port.InterFrameDelay < 0 || port.TurnaroundDelay < 0 {
+			return fmt.Errorf("serial.%s delays must not be negative", name)
+		}
+		if port.MaxUtilization < 0 || port.MaxUtilization > 1 {
+			return fmt.Errorf("serial.%s.max_utilization must be between 0 and 1", name)
+		}
+	}
+
+	if err := c.Retry.validate("retry"); err != nil {
+		return err
+	}
+	if err := c.TCP.validate("tcp"); err != nil {
+		return err
+	}
+	if c.DNS.CacheTTL < 0 || c.DNS.Timeout < 0 {
+		return fmt.Errorf("dns durations must not be negative")
+	}
+	if c.ConnectionPool.Size < 0 {
+		return fmt.Errorf("connection_pool.size must not be negative")
+	}
+	if c.ConnectionPool.IdleTimeout < 0 || c.ConnectionPool.MaxLifetime < 0 {
+		return fmt.Errorf("connection_pool timeouts must not be negative")
+	}
+	if c.ReadCache.Size < 0 {
+		return fmt.Errorf("read_cache.size must not be negative")
+	}
+	if c.Simulator.Size < 0 {
+		return fmt.Errorf("simulator.size must not be negative")
+	}
+	if err := c.Dummy.validate(); err != nil {
+		return err
+	}
+	if c.Recording.Handler == "record" || c.Recording.Handler == "replay" {
+		return fmt.Errorf("recording.handler must not be %s", c.Recording.Handler)
+	}
+	if c.Hooks.Lua.Timeout < 0 || c.Hooks.JavaScript.Timeout < 0 {
+		return fmt.Errorf("hooks timeouts must not be negative")
+	}
+	if c.Hooks.Lua.Path != "" && c.Hooks.JavaScript.Path != "" {
+		return fmt.Errorf("hooks.lua and hooks.javascript are mutually exclusive")
+	}
+
+	for name, device := range c.Devices {
+		if device.Lane != "" && !lanes[device.Lane] {
+			return fmt.Errorf("devices.%s.lane references unknown lane %q", name, device.Lane)
+		}
+		if _, ok := c.Serial[device.Serial]; device.Serial != "" && !ok {
+			return fmt.Errorf("devices.%s.serial references unknown serial port %q", name, device.Serial)
+		}
+		if device.Address != "" {
+			if _, _, err := SplitAddress(device.Address); err != nil {
+				return fmt.Errorf("devices.%s.address: %w", name, err)
+			}
+			if device.Serial != "" {
+				return fmt.Errorf("devices.%s: address and serial are mutually exclusive", name)
+			}
+		}
+		if device.Timeout < 0 {
+			return fmt.Errorf("devices.%s.timeout must not be negative", name)
+		}
+		if device.Retry != nil {
+			if err := device.Retry.validate("devices." + name + ".retry"); err != nil {
+				return err
+			}
+		}
+		if device.TCP != nil {
+			if err := device.TCP.validate("devices." + name + ".tcp"); err != nil {
+				return err
+			}
+			if device.Serial != "" {
+				return fmt.Errorf("devices.%s: tcp options do not apply to serial devices", name)
+			}
+		}
+		if device.MaxConcurrent < 0 {
+			return fmt.Errorf("devices.%s.max_concurrent must not be negative", name)
+		}
+		if device.Pipeline < 0 {
+			return fmt.Errorf("devices.%s.pipeline must not be negative", name)
+		}
+		if device.Pipeline > 0 && device.Serial != "" {
+			return fmt.Errorf("devices.%s: pipeline does not apply to serial devices", name)
+		}
+		if device.MinGap < 0 {
+			return fmt.Errorf("devices.%s.min_gap must not be negative", name)
+		}
+		switch strings.ToUpper(device.ByteOrder) {
+		case "", "ABCD", "CDAB", "BADC", "DCBA":
+		default:
+			return fmt.Errorf("devices.%s.byte_order %q is not one of ABCD, CDAB, BADC, DCBA", name, device.ByteOrder)
+		}
+		if device.CoalesceGap != nil && (*device.CoalesceGap < 0 || *device.CoalesceGap > 124) {
+			return fmt.Errorf("devices.%s.coalesce_gap must be between 0 and 124", name)
+		}
+		if device.Writable != nil {
+			for _, r := range append(append([]string{}, device.Writable.Holding...), device.Writable.Coils...) {
+				if _, _, err := ParseRange(r); err != nil {
+					return fmt.Errorf("devices.%s.writable: %w", name, err)
+				}
+			}
+		}
+		if sig := device.Signature; sig != nil {
+			if sig.Function != 0 && sig.Function != 3 && sig.Function != 4 {
+				return fmt.Errorf("devices.%s.signature.function must be 3 or 4", name)
+			}
+			if sig.Register == 0 {
+				return fmt.Errorf("devices.%s.signature.register must be specified", name)
+			}
+			if sig.Count > 125 || int(sig.Register)+int(sig.Count) > 65537 {
+				return fmt.Errorf("devices.%s.signature.count must be between 1 and 125 within the register space", name)
+			}
+		}
+		for i, pp := range device.PostProcess {
+			if pp.Name == "" {
+				return fmt.Errorf("devices.%s.post_process[%d].name must be specified", name, i)
+			}
+			if _, _, err := ParseRange(pp.Registers); err != nil {
+				return fmt.Errorf("devices.%s.post_process[%d]: %w", name, i, err)
+			}
+		}
+		for i, il := range device.Interlocks {
+			if il.Name == "" {
+				return fmt.Errorf("devices.%s.interlocks[%d].name must be specified", name, i)
+			}
+			if len(il.Writes.Holding) == 0 && len(il.Writes.Coils) == 0 {
+				return fmt.Errorf("devices.%s.interlocks[%d].writes must list holding registers or coils", name, i)
+			}
+			for _, r := range append(append([]string{}, il.Writes.Holding...), il.Writes.Coils...) {
+				if _, _, err := ParseRange(r); err != nil {
+					return fmt.Errorf("devices.%s.interlocks[%d].writes: %w", name, i, err)
+				}
+			}
+			if il.Function != 0 && il.Function != 3 && il.Function != 4 {
+				return fmt.Errorf("devices.%s.interlocks[%d].function must be 3 or 4", name, i)
+			}
+			if il.Register < 1 {
+				return fmt.Errorf("devices.%s.interlocks[%d].register must be at least 1", name, i)
+			}
+			if il.Above == nil && il.Below == nil {
+				return fmt.Errorf("devices.%s.interlocks[%d] needs above or below", name, i)
+			}
+			if il.MaxAge < 0 {
+				return fmt.Errorf("devices.%s.interlocks[%d].max_age must not be negative", name, i)
+			}
+		}
+		for i, limit := range device.Limits {
+			if limit.Register < 1 {
+				return fmt.Errorf("devices.%s.limits[%d].register must be at least 1", name, i)
+			}
+			if limit.Min != nil && limit.Max != nil && *limit.Min > *limit.Max {
+				return fmt.Errorf("devices.%s.limits[%d]: min is greater than max", name, i)
+			}
+			if limit.Min == nil && limit.Max == nil && len(limit.Values) == 0 {
+				return fmt.Errorf("devices.%s.limits[%d] needs min, max or values", name, i)
+			}
+		}
+	}
+	return nil
+}
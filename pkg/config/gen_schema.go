@@ -0,0 +1,165 @@
+//go:build ignore
+
+// gen_schema generates schema.json, the JSON Schema of the configuration
+// file, from the configuration structs of config.go and their comments. Run
+// it with go generate after changing the configuration.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"log"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+)
+
+// enums lists the accepted values of string fields, keyed by struct and
+// YAML field name
+var enums = map[string][]string{
+	"UnknownDeviceConfig.action": {"", config.UnknownDeviceAllow, config.UnknownDeviceReject, config.UnknownDeviceForward},
+	"StorageConfig.backend":      {"", config.StorageMemory, config.StorageBolt},
+	"LogSinkConfig.type":         {config.LogSinkStderr, config.LogSinkFile, config.LogSinkSyslog, config.LogSinkJournald},
+	"LogSinkConfig.level":        {"", config.LogLevelDebug, config.LogLevelInfo, config.LogLevelWarn, config.LogLevelError},
+	"SerialConfig.parity":        {"", config.ParityNone, config.ParityEven, config.ParityOdd},
+	"IngestConfig.overflow":      {"", config.OverflowReject, config.OverflowDropNewest, config.OverflowDropOldest},
+}
+
+// integerRanges are the bounds of the integer types
+var integerRanges = map[string][2]float64{
+	"uint8":  {0, 255},
+	"uint16": {0, 65535},
+	"uint32": {0, 4294967295},
+	"uint":   {0, 4294967295},
+}
+
+// predefined are the definitions of types not declared in config.go
+var predefined = map[string]map[string]any{
+	"Duration": {
+		"description": "Go duration, e.g. 500ms, 30s or 1h30m, or an integer number of nanoseconds",
+		"type":        []string{"string", "integer"},
+		"pattern":     `^-?(0|([0-9]+(\.[0-9]*)?(ns|us|µs|ms|s|m|h))+)$`,
+	},
+	"Time": {
+		"description": "RFC 3339 timestamp, e.g. 2024-01-31T00:00:00Z",
+		"type":        "string",
+		"format":      "date-time",
+	},
+}
+
+func main() {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "config.go", nil, parser.ParseComments)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	defs := make(map[string]any)
+	for name, def := range predefined {
+		defs[name] = def
+	}
+	for _, decl := range file.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			ts := spec.(*ast.TypeSpec)
+			st, ok := ts.Type.(*ast.StructType)
+			if !ok {
+				continue
+			}
+			defs[ts.Name.Name] = structSchema(ts.Name.Name, gen.Doc, st)
+		}
+	}
+
+	schema := map[string]any{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"$id":     "https://github.com/ganehag/open-modbus-goateway/config.schema.json",
+		"title":   "open-modbus-goateway configuration",
+		"$ref":    "#/$defs/Config",
+		"$defs":   defs,
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(schema); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile("schema.json", buf.Bytes(), 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// structSchema returns the schema of a configuration struct
+func structSchema(name string, doc *ast.CommentGroup, st *ast.StructType) map[string]any {
+	properties := make(map[string]any)
+	for _, field := range st.Fields.List {
+		if field.Tag == nil {
+			continue
+		}
+		tag, _ := strconv.Unquote(field.Tag.Value)
+		key, _, _ := strings.Cut(reflect.StructTag(tag).Get("yaml"), ",")
+		if key == "" || key == "-" {
+			continue
+		}
+
+		prop := typeSchema(field.Type)
+		if field.Comment != nil {
+			prop["description"] = strings.TrimSpace(field.Comment.Text())
+		}
+		if values, ok := enums[name+"."+key]; ok {
+			prop["enum"] = values
+		}
+		properties[key] = prop
+	}
+
+	schema := map[string]any{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+	if doc != nil {
+		schema["description"] = strings.Join(strings.Fields(doc.Text()), " ")
+	}
+	return schema
+}
+
+// typeSchema returns the schema of a field type
+func typeSchema(expr ast.Expr) map[string]any {
+	switch t := expr.(type) {
+	case *ast.StarExpr:
+		return typeSchema(t.X)
+	case *ast.ArrayType:
+		return map[string]any{"type": "array", "items": typeSchema(t.Elt)}
+	case *ast.MapType:
+		return map[string]any{"type": "object", "additionalProperties": typeSchema(t.Value)}
+	case *ast.SelectorExpr: // time.Duration, time.Time
+		return map[string]any{"$ref": "#/$defs/" + t.Sel.Name}
+	case *ast.Ident:
+		switch t.Name {
+		case "string":
+			return map[string]any{"type": "string"}
+		case "bool":
+			return map[string]any{"type": "boolean"}
+		case "float32", "float64":
+			return map[string]any{"type": "number"}
+		case "int", "int8", "int16", "int32", "int64":
+			return map[string]any{"type": "integer"}
+		}
+		if r, ok := integerRanges[t.Name]; ok {
+			return map[string]any{"type": "integer", "minimum": r[0], "maximum": r[1]}
+		}
+		return map[string]any{"$ref": "#/$defs/" + t.Name}
+	}
+	log.Fatalf("unsupported field type %T", expr)
+	return nil
+}
@@ -0,0 +1,245 @@
+package config
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+//go:generate go run gen_schema.go
+
+// Schema is the JSON Schema of the configuration file, generated from the
+// configuration structs
+//
+//go:embed schema.json
+var Schema []byte
+
+// schema is the subset of JSON Schema used by the generated schema
+type schema struct {
+	Ref                  string             `json:"$ref"`
+	Defs                 map[string]*schema `json:"$defs"`
+	Type                 schemaTypes        `json:"type"`
+	Properties           map[string]*schema `json:"properties"`
+	AdditionalProperties *additional        `json:"additionalProperties"`
+	Items                *schema            `json:"items"`
+	Enum                 []string           `json:"enum"`
+	Minimum              *float64           `json:"minimum"`
+	Maximum              *float64           `json:"maximum"`
+	Pattern              string             `json:"pattern"`
+	Format               string             `json:"format"`
+}
+
+// schemaTypes is the type keyword, a single type or a list of types
+type schemaTypes []string
+
+func (t *schemaTypes) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*t = schemaTypes{single}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(t))
+}
+
+// additional is the additionalProperties keyword, false or a schema
+type additional struct {
+	allowed bool
+	schema  *schema
+}
+
+func (a *additional) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &a.allowed); err == nil {
+		return nil
+	}
+	a.allowed = true
+	return json.Unmarshal(data, &a.schema)
+}
+
+// rootSchema returns the parsed embedded schema
+var rootSchema = sync.OnceValues(func() (*schema, error) {
+	var s schema
+	if err := json.Unmarshal(Schema, &s); err != nil {
+		return nil, fmt.Errorf("invalid embedded schema: %w", err)
+	}
+	return &s, nil
+})
+
+// ValidateSchema checks a YAML configuration document against the schema
+// and returns an error listing every violation with its line and column
+func ValidateSchema(data []byte) error {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	if len(doc.Content) == 0 {
+		return nil // Empty document
+	}
+
+	root, err := rootSchema()
+	if err != nil {
+		return err
+	}
+	var errs []error
+	root.check(root, doc.Content[0], "", &errs)
+	return errors.Join(errs...)
+}
+
+// check validates a node against the schema, appending the violations
+func (s *schema) check(root *schema, node *yaml.Node, path string, errs *[]error) {
+	for s.Ref != "" {
+		s = root.Defs[strings.TrimPrefix(s.Ref, "#/$defs/")]
+	}
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	if node.Tag == "!!null" {
+		return // Unset, the zero value
+	}
+
+	fail := func(format string, args ...any) {
+		name := path
+		if name == "" {
+			name = "configuration"
+		}
+		*errs = append(*errs, fmt.Errorf("line %d, column %d: %s: %s", node.Line, node.Column, name, fmt.Sprintf(format, args...)))
+	}
+
+	switch {
+	case s.is("object"):
+		if node.Kind != yaml.MappingNode {
+			fail("expected a mapping")
+			return
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if key.Value == "<<" { // Merged mapping
+				s.check(root, value, path, errs)
+				continue
+			}
+			if prop, ok := s.Properties[key.Value]; ok {
+				prop.check(root, value, join(path, key.Value), errs)
+			} else if a := s.AdditionalProperties; a != nil && a.schema != nil {
+				a.schema.check(root, value, join(path, key.Value), errs)
+			} else if a != nil && !a.allowed {
+				*errs = append(*errs, fmt.Errorf("line %d, column %d: %s: unknown field", key.Line, key.Column, join(path, key.Value)))
+			}
+		}
+	case s.is("array"):
+		if node.Kind != yaml.SequenceNode {
+			fail("expected a list")
+			return
+		}
+		for i, item := range node.Content {
+			s.Items.check(root, item, fmt.Sprintf("%s[%d]", path, i), errs)
+		}
+	default:
+		if node.Kind != yaml.ScalarNode {
+			fail("expected a %s", strings.Join(s.Type, " or "))
+			return
+		}
+		if err := s.checkScalar(node); err != nil {
+			fail("%v", err)
+		}
+	}
+}
+
+// is reports whether the schema accepts a type
+func (s *schema) is(t string) bool {
+	for _, st := range s.Type {
+		if st == t {
+			return true
+		}
+	}
+	return false
+}
+
+// checkScalar validates a scalar node. Strings accept any scalar, as YAML
+// decodes numbers and booleans into string fields.
+func (s *schema) checkScalar(node *yaml.Node) error {
+	switch {
+	case s.is("integer") && node.Tag == "!!int":
+		var i int64
+		if err := node.Decode(&i); err != nil {
+			var u uint64
+			if node.Decode(&u) != nil {
+				return fmt.Errorf("invalid integer %q", node.Value)
+			}
+			return s.checkRange(float64(u))
+		}
+		return s.checkRange(float64(i))
+	case s.is("number") && (node.Tag == "!!int" || node.Tag == "!!float"):
+		var n float64
+		if err := node.Decode(&n); err != nil || math.IsNaN(n) {
+			return fmt.Errorf("invalid number %q", node.Value)
+		}
+		return s.checkRange(n)
+	case s.is("boolean"):
+		var b bool
+		if err := node.Decode(&b); err != nil {
+			return fmt.Errorf("expected true or false, got %q", node.Value)
+		}
+	case s.is("string"):
+		if s.Format == "date-time" {
+			var t time.Time
+			if err := node.Decode(&t); err != nil {
+				return fmt.Errorf("invalid timestamp %q", node.Value)
+			}
+		}
+		if s.Pattern != "" && !regexp.MustCompile(s.Pattern).MatchString(node.Value) {
+			return fmt.Errorf("invalid value %q", node.Value)
+		}
+		if len(s.Enum) > 0 && !contains(s.Enum, node.Value) {
+			return fmt.Errorf("%q is not one of %s", node.Value, strings.Join(nonEmpty(s.Enum), ", "))
+		}
+	default:
+		return fmt.Errorf("expected a %s, got %q", strings.Join(s.Type, " or "), node.Value)
+	}
+	return nil
+}
+
+// checkRange validates a number against the bounds of the schema
+func (s *schema) checkRange(n float64) error {
+	if s.Minimum != nil && n < *s.Minimum {
+		return fmt.Errorf("%v is below the minimum %v", n, *s.Minimum)
+	}
+	if s.Maximum != nil && n > *s.Maximum {
+		return fmt.Errorf("%v is above the maximum %v", n, *s.Maximum)
+	}
+	return nil
+}
+
+// join appends a field name to a path
+func join(path, field string) string {
+	if path == "" {
+		return field
+	}
+	return path + "." + field
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// nonEmpty returns the values except the empty string
+func nonEmpty(values []string) []string {
+	var result []string
+	for _, v := range values {
+		if v != "" {
+			result = append(result, v)
+		}
+	}
+	return result
+}
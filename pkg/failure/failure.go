@@ -0,0 +1,55 @@
+// Package failure defines the classes of request failures of the gateway, so
+// embedders and encoders can map failures to codes with errors.Is and
+// errors.As instead of matching the error messages.
+package failure
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Failure classes
+var (
+	ErrTimeout         = errors.New("timeout")                // The device didn't answer in time
+	ErrIllegalAddress  = errors.New("illegal data address")   // The device rejected the address range, exception 2
+	ErrConnUnreachable = errors.New("connection unreachable") // The device couldn't be connected to
+	ErrParse           = errors.New("parse error")            // The request payload is invalid
+)
+
+// Error is a failure classified by one of the failure classes. Its message
+// is the message of the underlying error, and errors.Is and errors.As match
+// both the class and the underlying error.
+type Error struct {
+	Class error // One of the failure classes, or an ExceptionError
+	Err   error // Underlying error
+}
+
+// Wrap classifies an error, returning nil for a nil error
+func Wrap(class error, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Class: class, Err: err}
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() []error {
+	return []error{e.Class, e.Err}
+}
+
+// ExceptionError is a Modbus exception answered by a device. Exception code
+// 2 also matches ErrIllegalAddress.
+type ExceptionError struct {
+	Code uint8 // Modbus exception code
+}
+
+func (e *ExceptionError) Error() string {
+	return fmt.Sprintf("modbus exception %d", e.Code)
+}
+
+func (e *ExceptionError) Is(target error) bool {
+	return target == ErrIllegalAddress && e.Code == 2
+}
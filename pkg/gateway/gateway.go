@@ -0,0 +1,325 @@
+// Package gateway wires the configuration, the handlers and the MQTT client
+// into a gateway serving requests until its context is canceled.
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/ganehag/open-modbus-goateway/internal/safemode"
+	"github.com/ganehag/open-modbus-goateway/internal/signing"
+	"github.com/ganehag/open-modbus-goateway/internal/storage"
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+	"github.com/ganehag/open-modbus-goateway/pkg/handlers"
+	"github.com/ganehag/open-modbus-goateway/pkg/metrics"
+	"github.com/ganehag/open-modbus-goateway/pkg/mqtt"
+	"github.com/ganehag/open-modbus-goateway/pkg/toggle"
+)
+
+// DefaultConfigPath is the configuration file loaded unless WithConfig or
+// WithConfigFile is given
+const DefaultConfigPath = "config/config.yaml"
+
+// options are the settings of New
+type options struct {
+	cfg          *config.Config
+	configPath   string
+	handler      handlers.Handler
+	workers      int
+	interceptors []handlers.Interceptor
+	metrics      metrics.Sink
+}
+
+// Option configures a Gateway created with New
+type Option func(*options)
+
+// WithConfig runs the gateway with a loaded configuration, e.g. from
+// config.Parse
+func WithConfig(cfg *config.Config) Option {
+	return func(o *options) { o.cfg = cfg }
+}
+
+// WithConfigFile loads the configuration from a YAML file instead of
+// DefaultConfigPath
+func WithConfigFile(path string) Option {
+	return func(o *options) { o.configPath = path }
+}
+
+// WithHandler executes the requests of the mqtt section topics with handler
+// instead of the handler named in the configuration, e.g. a fake in tests.
+// The gateway wraps it like a named handler, passes it the metrics sink and
+// the device registry if it uses them, and doesn't close it.
+func WithHandler(handler handlers.Handler) Option {
+	return func(o *options) { o.handler = handler }
+}
+
+// WithWorkers sizes the default lane instead of workers.count
+func WithWorkers(n int) Option {
+	return func(o *options) { o.workers = n }
+}
+
+// WithInterceptors passes the requests of every topic through interceptors,
+// e.g. for logging, billing or quotas, called in the order given. They see
+// the requests once their signature is verified and before the hooks of the
+// scripts and the checks of the configuration.
+func WithInterceptors(interceptors ...handlers.Interceptor) Option {
+	return func(o *options) { o.interceptors = append(o.interceptors, interceptors...) }
+}
+
+// WithMetrics reports the metrics of the dispatch of the requests and of the
+// handlers implementing handlers.Instrumented to sink instead of dropping
+// them
+func WithMetrics(sink metrics.Sink) Option {
+	return func(o *options) { o.metrics = sink }
+}
+
+// Gateway serves the requests of the configured topics with the configured
+// handlers
+type Gateway struct {
+	cfg           *config.Config
+	workers       int
+	guard         *safemode.Guard
+	store         storage.Store // Persists the toggles, if configured
+	toggles       *toggle.Set
+	status        string
+	interceptors  []handlers.Interceptor      // Interceptors of the requests of every topic
+	metrics       metrics.Sink                // Sink of the metrics of the client and the handlers
+	devices       *handlers.DeviceRegistry    // Device registry shared by the handlers
+	handler       handlers.Handler            // Handler of the mqtt section topics
+	routeHandlers map[string]handlers.Handler // Handlers of the routes by route name
+	bases         map[string]handlers.Handler // Named handlers, shared by the routes naming the same handler
+}
+
+// New creates a gateway from the options, checking the configuration and
+// creating its handlers. It doesn't connect to the broker, Run does.
+func New(opts ...Option) (*Gateway, error) {
+	o := options{configPath: DefaultConfigPath}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	cfg := o.cfg
+	if cfg == nil {
+		var err error
+		if cfg, err = config.Load(o.configPath); err != nil {
+			return nil, fmt.Errorf("failed to load configuration: %w", err)
+		}
+	}
+
+	g := &Gateway{cfg: cfg, workers: o.workers, status: mqtt.StatusOnline, interceptors: o.interceptors, metrics: metrics.OrDiscard(o.metrics), bases: make(map[string]handlers.Handler)}
+	if g.workers == 0 {
+		g.workers = cfg.Workers.Count
+	}
+	if err := g.init(o.handler); err != nil {
+		g.close()
+		return nil, err
+	}
+	return g, nil
+}
+
+// init checks the configuration and creates the handlers
+func (g *Gateway) init(handler handlers.Handler) error {
+	cfg := g.cfg
+
+	// Detect crash loops before touching any equipment
+	var err error
+	if g.guard, err = safemode.Start(cfg.SafeMode); err != nil {
+		return fmt.Errorf("failed to initialize safe mode: %w", err)
+	}
+	if g.guard.Active() {
+		log.Printf("Detected %d unclean starts within %s, starting in safe mode with writes disabled",
+			g.guard.UncleanStarts(), cfg.SafeMode.Window)
+		g.status = mqtt.StatusSafeMode
+	}
+
+	if err := handlers.CheckErrorMessages(cfg.ErrorMessages); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	if err := handlers.CheckPostProcessors(cfg.Devices); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	// Refuse heartbeat schedules the serial buses can't carry, if configured
+	if err := handlers.CheckBusLoad(cfg); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	// Traffic disabled at runtime via the control topic
+	g.toggles = toggle.NewSet()
+	if cfg.MQTT.PersistToggles {
+		if g.store, err = storage.Open(cfg.Storage); err != nil {
+			return fmt.Errorf("failed to open storage: %w", err)
+		}
+		if g.toggles, err = toggle.Open(g.store); err != nil {
+			return fmt.Errorf("failed to initialize toggles: %w", err)
+		}
+		for _, t := range g.toggles.List() {
+			log.Printf("Starting with %s %s disabled", t.Kind, t.Name)
+		}
+	}
+
+	// Register the handlers of the plugins and WebAssembly modules before
+	// creating the named handlers
+	if err := handlers.LoadPlugins(cfg.Plugins); err != nil {
+		return fmt.Errorf("failed to load plugins: %w", err)
+	}
+	if err := handlers.LoadWASM(cfg.WASM); err != nil {
+		return fmt.Errorf("failed to load WebAssembly modules: %w", err)
+	}
+
+	// Pass the requests through the hooks of the scripts, if configured
+	var hooks handlers.RequestHooks
+	switch {
+	case cfg.Hooks.Lua.Path != "":
+		hooks, err = handlers.NewLuaHooks(cfg.Hooks.Lua)
+	case cfg.Hooks.JavaScript.Path != "":
+		hooks, err = handlers.NewJavaScriptHooks(cfg.Hooks.JavaScript)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load hooks: %w", err)
+	}
+
+	// Handlers using the device registry share one
+	g.devices = handlers.NewDeviceRegistry(cfg)
+
+	if handler == nil {
+		if handler, err = g.newHandler(cfg.Handler); err != nil {
+			return err
+		}
+		if cfg.Handler != "modbus" {
+			log.Printf("Executing requests with the %s handler", cfg.Handler)
+		}
+	} else {
+		g.attach(handler)
+	}
+	g.handler = g.wrap(handler, hooks)
+
+	g.routeHandlers = make(map[string]handlers.Handler, len(cfg.Routes))
+	for _, r := range cfg.Routes {
+		base, err := g.newHandler(r.Handler)
+		if err != nil {
+			return err
+		}
+		g.routeHandlers[r.Name] = g.wrap(base, hooks)
+		log.Printf("Serving route %s on %s with the %s handler", r.Name, r.RequestTopic, r.Handler)
+	}
+	return nil
+}
+
+// newHandler returns the named handler, creating it on first use
+func (g *Gateway) newHandler(name string) (handlers.Handler, error) {
+	if base, ok := g.bases[name]; ok {
+		return base, nil
+	}
+	base, err := handlers.NewHandler(name, g.cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create handler: %w", err)
+	}
+	g.attach(base)
+	g.bases[name] = base
+	return base, nil
+}
+
+// attach passes the metrics sink and the device registry to a handler using
+// them
+func (g *Gateway) attach(handler handlers.Handler) {
+	if instrumented, ok := handler.(handlers.Instrumented); ok {
+		instrumented.SetMetrics(g.metrics)
+	}
+	if aware, ok := handler.(handlers.DeviceAware); ok {
+		aware.SetDevices(g.devices)
+	}
+}
+
+// Devices returns the device registry of the configuration, shared by the
+// handlers
+func (g *Gateway) Devices() *handlers.DeviceRegistry {
+	return g.devices
+}
+
+// wrap adds the checks of the configuration to a handler
+func (g *Gateway) wrap(handler handlers.Handler, hooks handlers.RequestHooks) handlers.Handler {
+	cfg := g.cfg
+	if g.status == mqtt.StatusSafeMode {
+		handler = &handlers.ReadOnlyHandler{Handler: handler, Reason: "gateway in safe mode"}
+	}
+
+	// Only serve registered devices, if configured
+	if cfg.UnknownDevices.Action == config.UnknownDeviceReject {
+		handler = &handlers.RegisteredHandler{Handler: handler, Devices: cfg.Devices}
+	}
+
+	// Reject requests for devices disabled at runtime
+	handler = &handlers.ToggledHandler{Handler: handler, Toggles: g.toggles}
+
+	// Rewrite or block the requests before the checks above, so a rewritten
+	// request is checked like any other
+	if hooks != nil {
+		handler = &handlers.HookedHandler{Handler: handler, Hooks: hooks}
+	}
+
+	// Pass the requests through the interceptors of the embedder
+	if len(g.interceptors) > 0 {
+		handler = &handlers.InterceptedHandler{Handler: handler, Interceptors: g.interceptors}
+	}
+
+	// Verify request signatures before anything else sees the payload
+	if cfg.Signing.Required || len(cfg.Signing.Keys) > 0 {
+		handler = &handlers.SignedHandler{Handler: handler, Verifier: signing.NewVerifier(cfg.Signing)}
+	}
+
+	// Accept JSON requests in addition to the text format, and the versions
+	// of the text format enabled in the configuration
+	return &handlers.JSONHandler{Handler: handler, Devices: cfg.Devices, Protocol: cfg.Protocol, Messages: cfg.ErrorMessages}
+}
+
+// Run connects to the broker and serves requests until ctx is canceled, then
+// drains the queued requests, disconnects and releases the handlers. A
+// gateway runs once.
+func (g *Gateway) Run(ctx context.Context) error {
+	defer g.close()
+
+	client, err := mqtt.NewClient(g.cfg, g.handler, g.routeHandlers, g.toggles, g.metrics, g.workers)
+	if err != nil {
+		return fmt.Errorf("failed to initialize MQTT client: %w", err)
+	}
+	client.SetStatus(g.status)
+
+	// The workers outlive ctx, to execute the requests drained by Stop
+	workers, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client.StartWorkers(workers)
+
+	log.Println("Open Modbus Goateway is running. Waiting for messages...")
+	<-ctx.Done()
+	log.Println("Shutting down...")
+
+	// Stop the client, draining the queued requests
+	client.Stop()
+
+	// Record the clean shutdown so it doesn't count as a crash
+	if err := g.guard.Stop(); err != nil {
+		log.Printf("Failed to record clean shutdown: %v", err)
+	}
+
+	log.Println("Open Modbus Goateway stopped gracefully.")
+	return nil
+}
+
+// close releases the named handlers and the storage
+func (g *Gateway) close() {
+	// Close the pooled Modbus connections
+	for _, base := range g.bases {
+		if closer, ok := base.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+	g.bases = nil
+	if g.store != nil {
+		g.store.Close()
+		g.store = nil
+	}
+}
@@ -0,0 +1,176 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+)
+
+// waitTimeout bounds every wait of the integration tests
+const waitTimeout = 5 * time.Second
+
+// harnessConfig is the configuration of the gateway of a harness, with the
+// broker address as its argument
+const harnessConfig = `
+mqtt:
+  broker: "%s"
+  client_id: "gateway"
+  request_topic: "modbus/{device}/request"
+  response_topic: "modbus/{device}/response"
+  status_topic: "modbus/gateway/status"
+handler: "simulator"
+simulator:
+  size: 1000
+`
+
+// harness runs a gateway against an in-process MQTT broker, executing the
+// requests on the simulator unless configured otherwise
+type harness struct {
+	t       *testing.T
+	broker  *mochi.Server
+	address string // Broker URL of the clients
+	cancel  context.CancelFunc
+	done    chan error // Result of Run
+	clients atomic.Int32
+}
+
+// newHarness starts a broker and a gateway connected to it. configure, if
+// not nil, changes the configuration before the gateway is created, and
+// opts are passed to New. The gateway and the broker are stopped at the end
+// of the test.
+func newHarness(t *testing.T, configure func(*config.Config), opts ...Option) *harness {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("integration test")
+	}
+
+	broker := mochi.New(&mochi.Options{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	if err := broker.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatal(err)
+	}
+	tcp := listeners.NewTCP(listeners.Config{ID: "tcp", Address: "127.0.0.1:0"})
+	if err := broker.AddListener(tcp); err != nil {
+		t.Fatal(err)
+	}
+	if err := broker.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { broker.Close() })
+
+	h := &harness{t: t, broker: broker, address: "tcp://" + tcp.Address(), done: make(chan error, 1)}
+	cfg, err := config.Parse([]byte(fmt.Sprintf(harnessConfig, h.address)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if configure != nil {
+		configure(cfg)
+	}
+
+	gw, err := New(append([]Option{WithConfig(cfg)}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	h.cancel = cancel
+	go func() { h.done <- gw.Run(ctx) }()
+	t.Cleanup(func() { h.stop() })
+
+	// The gateway is serving once it announced its status
+	h.expect(h.subscribe(h.client(), "modbus/gateway/status", 1), "ONLINE")
+	return h
+}
+
+// stop stops the gateway and returns the result of Run
+func (h *harness) stop() error {
+	h.t.Helper()
+	if h.cancel == nil {
+		return nil
+	}
+	h.cancel()
+	h.cancel = nil
+	select {
+	case err := <-h.done:
+		return err
+	case <-time.After(waitTimeout):
+		h.t.Fatal("gateway did not stop")
+		return nil
+	}
+}
+
+// client returns a test client connected to the broker, disconnected at the
+// end of the test
+func (h *harness) client() mqtt.Client {
+	h.t.Helper()
+	opts := mqtt.NewClientOptions().
+		AddBroker(h.address).
+		SetClientID(fmt.Sprintf("test-%d", h.clients.Add(1))).
+		SetAutoReconnect(false)
+	c := mqtt.NewClient(opts)
+	if token := c.Connect(); !token.WaitTimeout(waitTimeout) || token.Error() != nil {
+		h.t.Fatalf("failed to connect test client: %v", token.Error())
+	}
+	h.t.Cleanup(func() { c.Disconnect(0) })
+	return c
+}
+
+// subscribe subscribes a client to a topic filter and returns the messages
+// received on it
+func (h *harness) subscribe(c mqtt.Client, filter string, qos byte) <-chan mqtt.Message {
+	h.t.Helper()
+	messages := make(chan mqtt.Message, 100)
+	token := c.Subscribe(filter, qos, func(_ mqtt.Client, m mqtt.Message) { messages <- m })
+	if !token.WaitTimeout(waitTimeout) || token.Error() != nil {
+		h.t.Fatalf("failed to subscribe to %s: %v", filter, token.Error())
+	}
+	return messages
+}
+
+// publish publishes a message and waits for the broker to accept it
+func (h *harness) publish(c mqtt.Client, topic string, qos byte, payload string) {
+	h.t.Helper()
+	if token := c.Publish(topic, qos, false, payload); !token.WaitTimeout(waitTimeout) || token.Error() != nil {
+		h.t.Fatalf("failed to publish to %s: %v", topic, token.Error())
+	}
+}
+
+// receive returns the next message, failing the test if none arrives in time
+func (h *harness) receive(messages <-chan mqtt.Message) mqtt.Message {
+	h.t.Helper()
+	select {
+	case m := <-messages:
+		return m
+	case <-time.After(waitTimeout):
+		h.t.Fatal("no message received")
+		return nil
+	}
+}
+
+// expect receives the next message and checks its payload
+func (h *harness) expect(messages <-chan mqtt.Message, payload string) mqtt.Message {
+	h.t.Helper()
+	m := h.receive(messages)
+	if string(m.Payload()) != payload {
+		h.t.Fatalf("received %q on %s, expected %q", m.Payload(), m.Topic(), payload)
+	}
+	return m
+}
+
+// expectNone checks that no message arrives for a while
+func (h *harness) expectNone(messages <-chan mqtt.Message, wait time.Duration) {
+	h.t.Helper()
+	select {
+	case m := <-messages:
+		h.t.Fatalf("unexpected message %q on %s", m.Payload(), m.Topic())
+	case <-time.After(wait):
+	}
+}
@@ -0,0 +1,404 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ganehag/open-modbus-goateway/internal/signing"
+	"github.com/ganehag/open-modbus-goateway/pkg/client"
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+	"github.com/ganehag/open-modbus-goateway/pkg/handlers"
+	"github.com/ganehag/open-modbus-goateway/pkg/metrics"
+)
+
+// request is a request to the simulator and its response. Every register of
+// the simulator holds its own address.
+const (
+	request  = "0 1 0 192.0.2.10 502 5 1 3 101 2"
+	response = "1 OK 100 101"
+)
+
+func TestRoundTrip(t *testing.T) {
+	h := newHarness(t, nil)
+	c := h.client()
+	responses := h.subscribe(c, "modbus/+/response", 1)
+
+	h.publish(c, "modbus/plc1/request", 1, request)
+	if m := h.expect(responses, response); m.Topic() != "modbus/plc1/response" {
+		t.Errorf("response published on %s", m.Topic())
+	}
+
+	// Writes change the simulator for the following requests
+	h.publish(c, "modbus/plc1/request", 1, "0 2 0 192.0.2.10 502 5 1 16 101 2 7,8 ; 3 101 2")
+	h.expect(responses, "2 OK 0 OK; 1 OK 7 8")
+
+	h.publish(c, "modbus/plc1/request", 1, "v2 3 192.0.2.10 502 5 1 3 1 1")
+	h.expect(responses, "3 OK 0")
+
+	h.publish(c, "modbus/plc1/request", 1, `{"cookie": 4, "ip": "192.0.2.10", "port": 502, "timeout": 5, "slave_id": 1, "function": 4, "register": 11, "count": 2}`)
+	var resp struct {
+		Cookie uint64 `json:"cookie"`
+		Status string `json:"status"`
+		Values []int  `json:"values"`
+	}
+	if m := h.receive(responses); json.Unmarshal(m.Payload(), &resp) != nil || resp.Cookie != 4 || resp.Status != "OK" || fmt.Sprint(resp.Values) != "[10 11]" {
+		t.Errorf("JSON response %s", m.Payload())
+	}
+
+	h.publish(c, "modbus/plc1/request", 1, "0 5 0 192.0.2.10 502 5 1 3 1001 1")
+	h.expect(responses, "5 ERROR: failed to read holding registers: illegal data address")
+}
+
+func TestTopics(t *testing.T) {
+	h := newHarness(t, func(cfg *config.Config) {
+		cfg.MQTT.RequestTopic = "site/{site}/modbus/{device}/request"
+		cfg.MQTT.ResponseTopic = "site/{site}/modbus/{device}/reply"
+		cfg.Routes = []config.RouteConfig{{
+			Name:          "test",
+			RequestTopic:  "test/{device}/request",
+			ResponseTopic: "test/{device}/response",
+			Handler:       "dummy",
+		}}
+	})
+	c := h.client()
+	replies := h.subscribe(c, "site/+/modbus/+/reply", 1)
+	routed := h.subscribe(c, "test/+/response", 1)
+
+	// Placeholders are carried over to the response topic
+	h.publish(c, "site/north/modbus/meter7/request", 1, request)
+	if m := h.expect(replies, response); m.Topic() != "site/north/modbus/meter7/reply" {
+		t.Errorf("response published on %s", m.Topic())
+	}
+
+	// Routes are served by their own handler
+	h.publish(c, "test/meter7/request", 1, "0 2 0 192.0.2.10 502 5 1 3 101 2")
+	if m := h.expect(routed, "2 OK 1 1"); m.Topic() != "test/meter7/response" {
+		t.Errorf("route response published on %s", m.Topic())
+	}
+
+	// Topics not matching a request topic are ignored
+	for _, topic := range []string{"site/north/modbus/meter7/extra/request", "site/north/modbus/request", "modbus/meter7/request"} {
+		h.publish(c, topic, 1, request)
+	}
+	h.expectNone(replies, 200*time.Millisecond)
+	h.expectNone(routed, 0)
+}
+
+func TestQoS(t *testing.T) {
+	h := newHarness(t, nil)
+	c := h.client()
+
+	// The status is retained with QoS 1, so late subscribers see it
+	status := h.receive(h.subscribe(c, "modbus/gateway/status", 1))
+	if string(status.Payload()) != "ONLINE" || !status.Retained() || status.Qos() != 1 {
+		t.Errorf("status %q, retained %t, QoS %d", status.Payload(), status.Retained(), status.Qos())
+	}
+
+	// Requests of every QoS are answered, with QoS 0 responses
+	responses := h.subscribe(c, "modbus/+/response", 2)
+	for qos := byte(0); qos <= 2; qos++ {
+		h.publish(c, "modbus/plc1/request", qos, fmt.Sprintf("0 %d 0 192.0.2.10 502 5 1 3 101 2", qos))
+		m := h.expect(responses, fmt.Sprintf("%d OK 100 101", qos))
+		if m.Qos() != 0 || m.Retained() {
+			t.Errorf("request QoS %d: response QoS %d, retained %t", qos, m.Qos(), m.Retained())
+		}
+	}
+}
+
+// blockingHandler holds the requests until released
+type blockingHandler struct {
+	received chan string
+	release  chan struct{}
+}
+
+func (b *blockingHandler) Handle(ctx context.Context, device string, payload string) string {
+	b.received <- payload
+	<-b.release
+	return handlers.TextEncoder{}.Encode(&handlers.Response{Status: handlers.StatusOK})
+}
+
+func TestShutdown(t *testing.T) {
+	blocking := &blockingHandler{received: make(chan string, 10), release: make(chan struct{})}
+	h := newHarness(t, func(cfg *config.Config) { cfg.Workers.Count = 3 }, WithHandler(blocking))
+	c := h.client()
+	responses := h.subscribe(c, "modbus/+/response", 1)
+	status := h.subscribe(c, "modbus/gateway/status", 1)
+	h.receive(status) // Retained ONLINE
+
+	// Requests being executed when the gateway stops are answered
+	for i := 1; i <= 3; i++ {
+		h.publish(c, fmt.Sprintf("modbus/plc%d/request", i), 1, request)
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-blocking.received:
+		case <-time.After(waitTimeout):
+			t.Fatal("request not executed")
+		}
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond) // Stopping waits for the requests
+		close(blocking.release)
+	}()
+	if err := h.stop(); err != nil {
+		t.Errorf("Run: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		h.expect(responses, "0 OK")
+	}
+
+	// OFFLINE is announced on a clean shutdown, and no request is served
+	h.expect(status, "OFFLINE")
+	h.publish(c, "modbus/plc1/request", 1, request)
+	h.expectNone(responses, 200*time.Millisecond)
+}
+
+func TestConnectionLoss(t *testing.T) {
+	h := newHarness(t, nil)
+	c := h.client()
+	status := h.subscribe(c, "modbus/gateway/status", 1)
+	h.expect(status, "ONLINE")
+
+	// The broker publishes the will of a gateway losing its connection, and
+	// the gateway resubscribes once reconnected
+	gateway, ok := h.broker.Clients.Get("gateway")
+	if !ok {
+		t.Fatal("gateway not connected")
+	}
+	gateway.Stop(fmt.Errorf("connection lost"))
+	h.expect(status, "OFFLINE")
+	h.expect(status, "ONLINE")
+
+	responses := h.subscribe(c, "modbus/+/response", 1)
+	h.publish(c, "modbus/plc1/request", 1, request)
+	h.expect(responses, response)
+}
+
+// quotaInterceptor records the requests and refuses writes
+type quotaInterceptor struct {
+	calls chan string
+}
+
+func (q *quotaInterceptor) Before(ctx context.Context, req *handlers.InterceptedRequest) error {
+	if req.ParseErr != nil {
+		return nil
+	}
+	for _, r := range req.Requests {
+		if r.FunctionCode == 16 {
+			return fmt.Errorf("QUOTA: no writes left")
+		}
+	}
+	return nil
+}
+
+func (q *quotaInterceptor) After(ctx context.Context, req *handlers.InterceptedRequest, resp *handlers.Response, duration time.Duration) {
+	functions := []uint8{}
+	for _, r := range req.Requests {
+		functions = append(functions, r.FunctionCode)
+	}
+	q.calls <- fmt.Sprintf("%s %v %s %t", req.Device, functions, resp.Status, duration > 0)
+}
+
+func TestInterceptors(t *testing.T) {
+	quota := &quotaInterceptor{calls: make(chan string, 10)}
+	h := newHarness(t, nil, WithInterceptors(quota))
+	c := h.client()
+	responses := h.subscribe(c, "modbus/+/response", 1)
+
+	expectCall := func(expected string) {
+		t.Helper()
+		select {
+		case call := <-quota.calls:
+			if call != expected {
+				t.Errorf("intercepted %q, expected %q", call, expected)
+			}
+		case <-time.After(waitTimeout):
+			t.Fatal("request not intercepted")
+		}
+	}
+
+	h.publish(c, "modbus/plc1/request", 1, request)
+	h.expect(responses, response)
+	expectCall("plc1 [3] OK true")
+
+	// JSON requests are intercepted in the text format
+	h.publish(c, "modbus/plc2/request", 1, `{"cookie": 2, "ip": "192.0.2.10", "port": 502, "timeout": 5, "slave_id": 1, "function": 4, "register": 11, "count": 1}`)
+	h.receive(responses)
+	expectCall("plc2 [4] OK true")
+
+	// Refused requests are answered with the reason, and not seen after by
+	// the refusing interceptor
+	h.publish(c, "modbus/plc1/request", 1, "0 3 0 192.0.2.10 502 5 1 3 1 1 ; 16 1 1 7")
+	h.expect(responses, "3 ERROR: QUOTA: no writes left")
+
+	// Invalid requests are intercepted without parsed commands
+	h.publish(c, "modbus/plc1/request", 1, "0 4 0 192.0.2.10 502 5 1 3 101")
+	h.receive(responses)
+	expectCall("plc1 [] ERROR true")
+}
+
+// recordingSink records the counters and the number of observations of the
+// histograms by name and labels
+type recordingSink struct {
+	mu      sync.Mutex
+	metrics map[string]float64
+}
+
+func (r *recordingSink) key(name string, labels metrics.Labels) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	key := name
+	for _, name := range names {
+		key += fmt.Sprintf(" %s=%s", name, labels[name])
+	}
+	return key
+}
+
+func (r *recordingSink) Add(name string, delta float64, labels metrics.Labels) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics[r.key(name, labels)] += delta
+}
+
+func (r *recordingSink) Observe(name string, value float64, labels metrics.Labels) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics[r.key(name, labels)]++
+}
+
+func (r *recordingSink) get(key string) float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.metrics[key]
+}
+
+func TestMetrics(t *testing.T) {
+	sink := &recordingSink{metrics: make(map[string]float64)}
+	h := newHarness(t, nil, WithMetrics(sink))
+	c := h.client()
+	responses := h.subscribe(c, "modbus/+/response", 1)
+
+	h.publish(c, "modbus/plc1/request", 1, request)
+	h.expect(responses, response)
+	h.publish(c, "modbus/plc1/request", 1, "0 2 0 192.0.2.10 502 5 1 16 101 2 7,8 ; 3 1001 1")
+	h.expect(responses, "2 OK 0 OK; 1 ERROR: failed to read holding registers: illegal data address")
+	if err := h.stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, expected := range map[string]float64{
+		"ingest_requests_total outcome=accepted":                    2,
+		"requests_total lane=default route= status=OK":              1,
+		"requests_total lane=default route= status=ERROR":           1,
+		"request_duration_seconds lane=default route=":              2,
+		"queue_wait_seconds lane=default":                           2,
+		"modbus_commands_total device=plc1 function=3 status=OK":    1,
+		"modbus_commands_total device=plc1 function=3 status=ERROR": 1,
+		"modbus_commands_total device=plc1 function=16 status=OK":   1,
+		"modbus_turnaround_seconds device=plc1 function=3":          2,
+		"modbus_turnaround_seconds device=plc1 function=16":         1,
+		"modbus_connect_seconds device=plc1":                        2,
+	} {
+		if actual := sink.get(key); actual != expected {
+			t.Errorf("%s: %v, expected %v", key, actual, expected)
+		}
+	}
+}
+
+func TestHandlerSettingsPerGateway(t *testing.T) {
+	strict := newHarness(t, func(cfg *config.Config) {
+		cfg.RequestLimits.MaxRegisters = 2
+		cfg.Protocol.RejectV1 = true
+		cfg.ErrorMessages = map[string]string{"2": "no such register"}
+	})
+	lenient := newHarness(t, nil)
+
+	tests := []struct {
+		h        *harness
+		request  string
+		response string
+	}{
+		{strict, "v2 1 192.0.2.10 502 5 1 3 101 3", "1 ERROR: request spans 3 registers, exceeding the maximum of 2"},
+		{strict, request, "1 ERROR: UNSUPPORTED_VERSION: version 1 requests are rejected, use version 2"},
+		{strict, "v2 2 192.0.2.10 502 5 1 3 1001 1", "2 ERROR: no such register"},
+		{lenient, "v2 1 192.0.2.10 502 5 1 3 101 3", "1 OK 100 101 102"},
+		{lenient, request, response},
+		{lenient, "v2 2 192.0.2.10 502 5 1 3 1001 1", "2 ERROR: failed to read holding registers: illegal data address"},
+	}
+	for _, tt := range tests {
+		c := tt.h.client()
+		responses := tt.h.subscribe(c, "modbus/+/response", 1)
+		tt.h.publish(c, "modbus/plc1/request", 1, tt.request)
+		tt.h.expect(responses, tt.response)
+	}
+}
+
+func TestSigning(t *testing.T) {
+	h := newHarness(t, func(cfg *config.Config) {
+		cfg.Signing = config.SigningConfig{Required: true, Keys: []config.SigningKey{{ID: "k1", Secret: "secret"}}}
+	})
+	c := h.client()
+	responses := h.subscribe(c, "modbus/+/response", 1)
+
+	h.publish(c, "modbus/plc1/request", 1, signing.Sign(request, "k1", "secret"))
+	h.expect(responses, response)
+
+	unsigned := `{"cookie": 2, "ip": "192.0.2.10", "port": 502, "timeout": 5, "slave_id": 1, "function": 4, "register": 11, "count": 2, "options": {"format": "hex", "order": "ABCD"}}`
+	signed := signing.SignJSON(unsigned, "k1", "secret")
+	tests := []struct {
+		payload string
+		status  string
+		err     string
+	}{
+		{signed, "OK", ""},
+		{unsigned, "ERROR", "request signature required"},
+		{strings.Replace(signed, `"register": 11`, `"register": 12`, 1), "ERROR", "invalid request signature"},
+		{strings.Replace(signed, `"kid": "k1"`, `"kid": "k2"`, 1), "ERROR", `unknown signing key "k2"`},
+	}
+	for _, tt := range tests {
+		h.publish(c, "modbus/plc1/request", 1, tt.payload)
+		var resp struct {
+			Cookie uint64 `json:"cookie"`
+			Status string `json:"status"`
+			Error  string `json:"error"`
+		}
+		m := h.receive(responses)
+		if json.Unmarshal(m.Payload(), &resp) != nil || resp.Cookie != 2 || resp.Status != tt.status || resp.Error != tt.err {
+			t.Errorf("response %s to %s, expected status %s and error %q", m.Payload(), tt.payload, tt.status, tt.err)
+		}
+	}
+}
+
+func TestClient(t *testing.T) {
+	h := newHarness(t, nil)
+
+	// Requests sent right after New get their response
+	for i := 0; i < 10; i++ {
+		c, err := client.New(client.Config{
+			Broker:        h.address,
+			ClientID:      fmt.Sprintf("client-%d", i),
+			RequestTopic:  "modbus/{device}/request",
+			ResponseTopic: "modbus/{device}/response",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), waitTimeout)
+		values, err := c.ReadRegisters(ctx, client.Target{Device: "plc1", IP: "192.0.2.10"}, 3, 101, 2)
+		cancel()
+		c.Close()
+		if err != nil || fmt.Sprint(values) != "[100 101]" {
+			t.Fatalf("values %v: %v", values, err)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/protocol"
+)
+
+// maxBatchCommands limits the number of commands in a batch request
+const maxBatchCommands = 64
+
+// parseBatch parses a request payload that may contain several commands
+// separated by ';'. The first command is a complete request; every following
+// command consists of "<FUNCTION> <REGISTER_NUMBER> <REGISTER_COUNT|VALUE>
+// [<DATA>] [options]" and shares the cookie, target and slave ID of the
+// first one.
+func parseBatch(payload string) ([]*ModbusRequest, error) {
+	if strings.Count(payload, ";") >= maxBatchCommands {
+		return nil, fmt.Errorf("batch exceeds %d commands", maxBatchCommands)
+	}
+
+	head, rest, isBatch := strings.Cut(payload, ";")
+	first, err := parseRequest(head)
+	if err != nil {
+		return nil, err
+	}
+	requests := []*ModbusRequest{first}
+	if !isBatch {
+		return requests, nil
+	}
+
+	fields := strings.Fields(head)
+	header := strings.Join(fields[:protocol.VersionOf(fields[0]).HeaderFields()], " ")
+	for i, segment := range strings.Split(rest, ";") {
+		if strings.TrimSpace(segment) == "" {
+			return nil, fmt.Errorf("command %d: empty command", i+1)
+		}
+		request, err := parseRequest(header + " " + segment)
+		if err != nil {
+			return nil, fmt.Errorf("command %d: %v", i+1, err)
+		}
+		requests = append(requests, request)
+	}
+
+	return requests, nil
+}
+
+// formatResponse formats the outcome of a request as "<ID> OK [values...]"
+// or "<ID> ERROR: <reason>", where ID is the cookie or the batch sub-index
+func formatResponse(id uint64, values []string, err error) string {
+	return TextEncoder{}.Encode(newResponse(id, values, err))
+}
+
+// executeBatch runs every command of a batch and combines the results,
+// keyed by sub-index. A failing command does not stop the following ones.
+func executeBatch(requests []*ModbusRequest, execute func(*ModbusRequest) ([]string, error)) *Response {
+	results := make([]*Response, len(requests))
+	for i, req := range requests {
+		start := time.Now()
+		values, err := execute(req)
+		req.turnaround = time.Since(start)
+		results[i] = newResult(uint64(i), req, values, err)
+	}
+
+	return &Response{Cookie: requests[0].Cookie, Status: StatusOK, Results: results}
+}
+
+// RequestTimeout extracts the TIMEOUT of a text or JSON request payload on a
+// best-effort basis. It returns 0 if the payload gives none, e.g. "-" for the
+// timeout of the device.
+func RequestTimeout(payload string) time.Duration {
+	var seconds int
+	if strings.HasPrefix(strings.TrimSpace(payload), "{") {
+		var req struct {
+			Timeout int `json:"timeout"`
+		}
+		json.Unmarshal([]byte(payload), &req) // Partial results are fine
+		seconds = req.Timeout
+	} else if fields := strings.Fields(payload); len(fields) > 0 {
+		if index := protocol.VersionOf(fields[0]).HeaderFields() - 2; len(fields) > index {
+			seconds, _ = strconv.Atoi(fields[index])
+		}
+	}
+	return time.Duration(max(seconds, 0)) * time.Second
+}
+
+// Summarize extracts the cookie and the function codes of a text or JSON
+// request payload on a best-effort basis, for diagnostics. Fields that cannot
+// be parsed are left out.
+func Summarize(payload string) (uint64, []uint8) {
+	if strings.HasPrefix(strings.TrimSpace(payload), "{") {
+		return summarizeJSON(payload)
+	}
+
+	functions := []uint8{}
+	for i, segment := range strings.Split(payload, ";") {
+		parts := strings.Fields(segment)
+		if len(parts) == 0 {
+			continue
+		}
+		index := 0
+		if i == 0 {
+			index = protocol.VersionOf(parts[0]).HeaderFields() // Function field of the first command
+		}
+		if len(parts) <= index {
+			continue
+		}
+		if function, err := strconv.ParseUint(parts[index], 10, 8); err == nil {
+			functions = append(functions, uint8(function))
+		}
+	}
+	return payloadCookie(payload), functions
+}
@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+)
+
+func BenchmarkParseRequest(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := parseBatch("0 1234 0 192.168.1.10 502 5 1 3 100 10"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseWrite(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := parseBatch("0 1234 0 192.168.1.10 502 5 1 16 100 5 1,2,3,4,5 order=CDAB"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseBatch(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := parseBatch("0 1234 0 192.168.1.10 502 5 1 3 100 10; 4 200 2 type=float32; 1 1 16"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFormatResult(b *testing.B) {
+	req, err := parseRequest("0 1234 0 192.168.1.10 502 5 1 3 100 10 quality=true")
+	if err != nil {
+		b.Fatal(err)
+	}
+	registers := []uint16{1, 2, 3, 4, 5, 600, 700, 800, 900, 1000}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		values, err := formatResults(req, registers)
+		if err != nil {
+			b.Fatal(err)
+		}
+		TextEncoder{}.Encode(newResult(req.Cookie, req, values, nil))
+	}
+}
+
+func BenchmarkJSONHandler(b *testing.B) {
+	handler := &JSONHandler{Handler: &DummyHandler{}}
+	payload := `{"cookie":1234,"ip":"192.168.1.10","port":502,"function":3,"register":100,"count":10}`
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		handler.Handle(context.Background(), "meter1", payload)
+	}
+}
@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+)
+
+// BusLoad is the estimated utilization of a serial port by the scheduled
+// traffic of its devices
+type BusLoad struct {
+	Port        string  `json:"port"`
+	Utilization float64 `json:"utilization"`             // Share of the bus time, 1 when the bus is never idle
+	PerSecond   float64 `json:"transactions_per_second"` // Transactions per second
+}
+
+// EstimateBusLoad estimates the utilization of every serial port by the
+// heartbeats of the devices attached to it, from the frame sizes of their
+// requests and responses, the character time of the port and the silent
+// intervals between frames. The response time of the devices is unknown and
+// not included.
+func EstimateBusLoad(cfg *config.Config) []BusLoad {
+	loads := make(map[string]*BusLoad)
+	for _, hb := range cfg.Heartbeats {
+		name := cfg.Devices[hb.Device].Serial
+		port, ok := cfg.Serial[name]
+		if !ok || hb.Interval <= 0 {
+			continue
+		}
+		requests, err := parseBatch(hb.Request)
+		if err != nil {
+			continue
+		}
+
+		load, ok := loads[name]
+		if !ok {
+			load = &BusLoad{Port: name}
+			loads[name] = load
+		}
+		perSecond := float64(time.Second) / float64(hb.Interval)
+		for _, req := range requests {
+			busy, transactions := busTime(port, req)
+			load.Utilization += busy.Seconds() * perSecond
+			load.PerSecond += float64(transactions) * perSecond
+		}
+	}
+
+	result := make([]BusLoad, 0, len(loads))
+	for _, load := range loads {
+		result = append(result, *load)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Port < result[j].Port })
+	return result
+}
+
+// CheckBusLoad logs the estimated utilization of the serial ports and warns
+// about those above their max_utilization, or fails for ports refusing an
+// overload
+func CheckBusLoad(cfg *config.Config) error {
+	for _, load := range EstimateBusLoad(cfg) {
+		port := cfg.Serial[load.Port]
+		log.Printf("Serial port %s: estimated utilization %.1f%% (%.2f transactions/s)", load.Port, load.Utilization*100, load.PerSecond)
+		if port.MaxUtilization <= 0 || load.Utilization <= port.MaxUtilization {
+			continue
+		}
+
+		err := fmt.Errorf("serial port %s: estimated utilization %.1f%% exceeds max_utilization %.1f%%",
+			load.Port, load.Utilization*100, port.MaxUtilization*100)
+		if port.RefuseOverload {
+			return err
+		}
+		log.Printf("Warning: %v", err)
+	}
+	return nil
+}
+
+// busTime estimates the time a request occupies the bus of a serial port and
+// the number of transactions it takes
+func busTime(port config.SerialConfig, req *ModbusRequest) (time.Duration, int) {
+	char := characterTime(port)
+	silence := 7 * char / 2 // Silent interval of 3.5 characters after every frame
+	if port.Baud > 19200 {
+		silence = 1750 * time.Microsecond
+	}
+
+	frames := rtuFrames(req)
+	var busy time.Duration
+	for _, f := range frames {
+		delay := port.InterFrameDelay
+		if f.write && port.TurnaroundDelay > delay {
+			delay = port.TurnaroundDelay
+		}
+		busy += time.Duration(f.request+f.response)*char + 2*silence + delay
+	}
+	return busy, len(frames)
+}
+
+// characterTime returns the time to transmit a character on a serial port,
+// using the defaults of the Modbus library for unset parameters
+func characterTime(port config.SerialConfig) time.Duration {
+	baud, dataBits, stopBits := port.Baud, port.DataBits, port.StopBits
+	if baud == 0 {
+		baud = 19200
+	}
+	if dataBits == 0 {
+		dataBits = 8
+	}
+	parityBits := uint(1)
+	if port.Parity == "" || port.Parity == config.ParityNone {
+		parityBits = 0
+	}
+	if stopBits == 0 {
+		stopBits = 2 - parityBits // Two stop bits without parity
+	}
+
+	bits := 1 + dataBits + parityBits + stopBits
+	return time.Duration(bits) * time.Second / time.Duration(baud)
+}
+
+// rtuTransaction is the size in bytes of the RTU frames of a transaction
+type rtuTransaction struct {
+	request, response int
+	write             bool
+}
+
+// rtuFrames returns the transactions of a request. A bit write is a
+// read-modify-write of the register.
+func rtuFrames(req *ModbusRequest) []rtuTransaction {
+	n := int(req.RegisterCount)
+	switch req.FunctionCode {
+	case 1, 2:
+		return []rtuTransaction{{request: 8, response: 5 + (n+7)/8}}
+	case 3, 4:
+		if req.HasBit {
+			n = (int(req.Bit) + n + 15) / 16
+		}
+		return []rtuTransaction{{request: 8, response: 5 + 2*n}}
+	case 5:
+		return []rtuTransaction{{request: 8, response: 8, write: true}}
+	case 6:
+		write := rtuTransaction{request: 8, response: 8, write: true}
+		if req.HasBit {
+			return []rtuTransaction{{request: 8, response: 7}, write}
+		}
+		return []rtuTransaction{write}
+	case 15:
+		return []rtuTransaction{{request: 9 + (n+7)/8, response: 8, write: true}}
+	case 16:
+		return []rtuTransaction{{request: 9 + 2*n, response: 8, write: true}}
+	default:
+		return nil
+	}
+}
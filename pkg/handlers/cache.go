@@ -0,0 +1,242 @@
+package handlers
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ganehag/open-modbus-goateway/internal/storage"
+	"github.com/simonvetter/modbus"
+)
+
+// cacheBucket is the storage bucket of the cached reads, keyed by cacheKey
+const cacheBucket = "reads"
+
+// cacheKey identifies a read of a target: the same function and range of
+// the same unit, whichever device name it was read under
+type cacheKey struct {
+	target   string
+	unit     uint8
+	function uint8
+	address  uint16
+	count    uint16
+}
+
+// String returns the storage key of a read, the target last as it may
+// contain any character
+func (k cacheKey) String() string {
+	return fmt.Sprintf("%d/%d/%d/%d/%s", k.unit, k.function, k.address, k.count, k.target)
+}
+
+// parseCacheKey parses the storage key of a read
+func parseCacheKey(s string) (cacheKey, bool) {
+	var k cacheKey
+	fields := strings.SplitN(s, "/", 5)
+	if len(fields) != 5 {
+		return k, false
+	}
+	unit, err1 := strconv.ParseUint(fields[0], 10, 8)
+	function, err2 := strconv.ParseUint(fields[1], 10, 8)
+	address, err3 := strconv.ParseUint(fields[2], 10, 16)
+	count, err4 := strconv.ParseUint(fields[3], 10, 16)
+	if err := errors.Join(err1, err2, err3, err4); err != nil {
+		return k, false
+	}
+	return cacheKey{target: fields[4], unit: uint8(unit), function: uint8(function), address: uint16(address), count: uint16(count)}, true
+}
+
+// encodeRead encodes the raw result of a read with the time it was read
+func encodeRead(words []uint16, at time.Time) []byte {
+	data := make([]byte, 8+2*len(words))
+	binary.BigEndian.PutUint64(data, uint64(at.UnixNano()))
+	for i, word := range words {
+		binary.BigEndian.PutUint16(data[8+2*i:], word)
+	}
+	return data
+}
+
+// decodeRead decodes a read encoded by encodeRead
+func decodeRead(data []byte) ([]uint16, time.Time) {
+	at := time.Unix(0, int64(binary.BigEndian.Uint64(data)))
+	words := make([]uint16, (len(data)-8)/2)
+	for i := range words {
+		words[i] = binary.BigEndian.Uint16(data[8+2*i:])
+	}
+	return words, at
+}
+
+// readCache returns the store of the cached reads, creating it on first use.
+// h.mu must be held.
+func (h *ModbusHandler) readCache() storage.Store {
+	if h.cache == nil {
+		h.cache = storage.NewMemory()
+	}
+	return h.cache
+}
+
+// cachedWords returns the cached raw result of a read with a max_age
+// option, if its range was read within max_age, and whether it was
+func (h *ModbusHandler) cachedWords(device string, req *ModbusRequest) ([]uint16, bool) {
+	if h.Cache.Size <= 0 || req.MaxAge <= 0 || req.FunctionCode < 1 || req.FunctionCode > 4 {
+		return nil, false
+	}
+
+	key := cacheKey{
+		target:   targetKey(h.Devices[device].Serial, req),
+		unit:     req.SlaveID,
+		function: req.FunctionCode,
+		address:  req.RegisterAddress,
+		count:    uint16(req.span()),
+	}
+	h.mu.Lock()
+	data, ok, err := h.readCache().Get(cacheBucket, key.String())
+	h.mu.Unlock()
+	if err != nil {
+		log.Printf("Failed to look up cached read: %v", err)
+	}
+	if !ok || err != nil {
+		return nil, false
+	}
+	words, at := decodeRead(data)
+	age := time.Since(at)
+	if age > req.MaxAge {
+		return nil, false
+	}
+
+	req.cached, req.cacheAge = true, age
+	return words, true
+}
+
+// storeRead caches the raw result of a read, evicting the oldest read when
+// the cache is full
+func (h *ModbusHandler) storeRead(key cacheKey, words []uint16) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	store := h.readCache()
+	stored, replaced := 0, false
+	var oldest string
+	var oldestAt time.Time
+	err := store.Iterate(cacheBucket, func(k string, value []byte) error {
+		stored++
+		replaced = replaced || k == key.String()
+		if _, at := decodeRead(value); oldestAt.IsZero() || at.Before(oldestAt) {
+			oldest, oldestAt = k, at
+		}
+		return nil
+	})
+	if err == nil && !replaced && stored >= h.Cache.Size {
+		err = store.Delete(cacheBucket, oldest)
+	}
+	if err == nil {
+		err = store.Put(cacheBucket, key.String(), encodeRead(words, time.Now()), 0)
+	}
+	if err != nil {
+		log.Printf("Failed to cache read: %v", err)
+	}
+}
+
+// invalidate drops the cached reads of a unit of a target overlapping a
+// written range, whichever device names they were read and written under
+func (h *ModbusHandler) invalidate(target string, unit, function uint8, addr uint16, count int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	store := h.readCache()
+	end := uint32(addr) + uint32(count)
+	var stale []string
+	err := store.Iterate(cacheBucket, func(s string, value []byte) error {
+		k, ok := parseCacheKey(s)
+		if ok && k.target == target && k.unit == unit && k.function == function &&
+			uint32(k.address) < end && uint32(addr) < uint32(k.address)+uint32(k.count) {
+			stale = append(stale, s)
+		}
+		return nil
+	})
+	for _, s := range stale {
+		if err == nil {
+			err = store.Delete(cacheBucket, s) // Not while iterating, which must not modify the store
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to invalidate cached reads: %v", err)
+	}
+}
+
+// cachingClient caches the reads of a device, including the reads of batches,
+// and drops the cached reads overlapping its writes, failed or not
+type cachingClient struct {
+	ModbusClient
+	handler *ModbusHandler
+	target  string
+	unit    uint8
+}
+
+func (c *cachingClient) SetUnitId(id uint8) error {
+	c.unit = id
+	return c.ModbusClient.SetUnitId(id)
+}
+
+func (c *cachingClient) store(function uint8, addr uint16, words []uint16) {
+	key := cacheKey{target: c.target, unit: c.unit, function: function, address: addr, count: uint16(len(words))}
+	c.handler.storeRead(key, words)
+}
+
+func (c *cachingClient) ReadCoils(addr uint16, quantity uint16) ([]bool, error) {
+	bits, err := c.ModbusClient.ReadCoils(addr, quantity)
+	if err == nil && len(bits) == int(quantity) {
+		c.store(1, addr, bitWords(bits))
+	}
+	return bits, err
+}
+
+func (c *cachingClient) ReadDiscreteInputs(addr uint16, quantity uint16) ([]bool, error) {
+	bits, err := c.ModbusClient.ReadDiscreteInputs(addr, quantity)
+	if err == nil && len(bits) == int(quantity) {
+		c.store(2, addr, bitWords(bits))
+	}
+	return bits, err
+}
+
+func (c *cachingClient) ReadRegisters(addr uint16, quantity uint16, regType modbus.RegType) ([]uint16, error) {
+	values, err := c.ModbusClient.ReadRegisters(addr, quantity, regType)
+	if err == nil && len(values) == int(quantity) {
+		c.store(registerFunction(regType), addr, append([]uint16{}, values...))
+	}
+	return values, err
+}
+
+func (c *cachingClient) WriteCoil(addr uint16, value bool) error {
+	defer c.handler.invalidate(c.target, c.unit, 1, addr, 1)
+	return c.ModbusClient.WriteCoil(addr, value)
+}
+
+func (c *cachingClient) WriteCoils(addr uint16, values []bool) error {
+	defer c.handler.invalidate(c.target, c.unit, 1, addr, len(values))
+	return c.ModbusClient.WriteCoils(addr, values)
+}
+
+func (c *cachingClient) WriteRegister(addr uint16, value uint16) error {
+	defer c.handler.invalidate(c.target, c.unit, 3, addr, 1)
+	return c.ModbusClient.WriteRegister(addr, value)
+}
+
+func (c *cachingClient) WriteRegisters(addr uint16, values []uint16) error {
+	defer c.handler.invalidate(c.target, c.unit, 3, addr, len(values))
+	return c.ModbusClient.WriteRegisters(addr, values)
+}
+
+// bitWords converts coils or discrete inputs to 1 or 0
+func bitWords(bits []bool) []uint16 {
+	words := make([]uint16, len(bits))
+	for i, bit := range bits {
+		if bit {
+			words[i] = 1
+		}
+	}
+	return words
+}
@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+)
+
+func TestModbusHandlerCacheByTarget(t *testing.T) {
+	h := &ModbusHandler{
+		Connect: NewSimulatedDevice(1000).Connect,
+		Devices: map[string]config.DeviceConfig{
+			"plc":   {Address: "192.0.2.10", UnitID: 1, Timeout: time.Second},
+			"alias": {Address: "192.0.2.10", UnitID: 1, Timeout: time.Second},
+		},
+		Cache: config.ReadCacheConfig{Size: 10},
+	}
+	handle := func(device, payload string) string {
+		return h.Handle(context.Background(), device, payload)
+	}
+
+	if response := handle("plc", "0 1 0 - - - - 6 100 7"); response != "1 OK" {
+		t.Fatalf("write %q", response)
+	}
+	if response := handle("plc", "0 1 0 - - - - 3 100 1"); response != "1 OK 7" {
+		t.Fatalf("read %q", response)
+	}
+
+	// Reads under another device name of the target are answered from the cache
+	if response := handle("alias", "0 1 0 - - - - 3 100 1 max_age=1m"); !strings.HasPrefix(response, "1 OK 7 cached=") {
+		t.Errorf("cached read %q", response)
+	}
+
+	// Writes under another device name drop the cached reads of the target
+	if response := handle("alias", "0 1 0 - - - - 6 100 8"); response != "1 OK" {
+		t.Fatalf("write %q", response)
+	}
+	if response := handle("plc", "0 1 0 - - - - 3 100 1 max_age=1m"); response != "1 OK 8" {
+		t.Errorf("read after write %q", response)
+	}
+
+	// Writes to another unit don't
+	if response := handle("plc", "0 1 0 192.0.2.10 502 5 2 6 100 9"); response != "1 OK" {
+		t.Fatalf("write %q", response)
+	}
+	if response := handle("alias", "0 1 0 - - - - 3 100 1 max_age=1m"); !strings.HasPrefix(response, "1 OK 8 cached=") {
+		t.Errorf("cached read %q", response)
+	}
+}
@@ -0,0 +1,109 @@
+package handlers
+
+import "log"
+
+// Protocol limits of a single transaction
+const (
+	maxReadRegisters  = 125
+	maxReadBits       = 2000
+	maxWriteRegisters = 123
+	maxWriteBits      = 1968
+)
+
+// readSpan is a read covering the ranges of several commands of a batch
+type readSpan struct {
+	function uint8
+	start    uint32 // First register, coil or input
+	end      uint32 // One past the last register, coil or input
+	members  int
+	done     bool
+	results  []uint16
+	err      error
+}
+
+// coalescer executes the commands of a batch on an open client, merging
+// reads of adjacent or overlapping ranges into fewer transactions and
+// splitting the results afterwards
+type coalescer struct {
+	client ModbusClient
+	spans  map[*ModbusRequest]*readSpan
+}
+
+// newCoalescer plans the merged reads of a batch. Reads are only merged with
+// other reads of the same function that are not separated by a write, and
+// at most maxGap unrequested registers apart.
+func newCoalescer(client ModbusClient, requests []*ModbusRequest, maxGap int) *coalescer {
+	c := &coalescer{client: client, spans: make(map[*ModbusRequest]*readSpan)}
+
+	open := make(map[uint8]*readSpan) // Span currently accepting reads, per function
+	for _, req := range requests {
+		if isWriteFunction(req.FunctionCode) {
+			open = make(map[uint8]*readSpan)
+			continue
+		}
+		if req.FunctionCode < 1 || req.FunctionCode > 4 {
+			continue
+		}
+
+		limit := uint32(maxReadRegisters)
+		if req.FunctionCode == 1 || req.FunctionCode == 2 {
+			limit = maxReadBits
+		}
+
+		start := uint32(req.RegisterAddress)
+		end := start + req.span()
+		gap := uint32(maxGap)
+
+		s := open[req.FunctionCode]
+		if s != nil && start <= s.end+gap && s.start <= end+gap &&
+			max(end, s.end)-min(start, s.start) <= limit {
+			s.start, s.end = min(start, s.start), max(end, s.end)
+			s.members++
+		} else {
+			s = &readSpan{function: req.FunctionCode, start: start, end: end, members: 1}
+			open[req.FunctionCode] = s
+		}
+		c.spans[req] = s
+	}
+
+	return c
+}
+
+// execute performs a command of the batch, using the merged read of its span
+// when there is one. If a merged read fails, e.g. because the gap holds
+// unmapped registers, the command is read on its own.
+func (c *coalescer) execute(req *ModbusRequest) ([]string, error) {
+	s := c.spans[req]
+	if s == nil || s.members < 2 {
+		return executeOn(c.client, req)
+	}
+
+	if !s.done {
+		c.client.SetUnitId(req.SlaveID)
+		s.results, s.err = readRaw(c.client, s.function, uint16(s.start), uint16(s.end-s.start))
+		s.done = true
+		if s.err != nil {
+			log.Printf("Merged read of %d-%d failed, reading separately: %v", s.start, s.end-1, s.err)
+		}
+	}
+	if s.err != nil {
+		return executeOn(c.client, req)
+	}
+
+	offset := uint32(req.RegisterAddress) - s.start
+	words := append([]uint16{}, s.results[offset:offset+req.span()]...) // Other commands share the results
+	return decodeWords(req, words)
+}
+
+// decodeWords post-processes and formats the raw result of a read performed
+// for the request, e.g. as part of a larger read
+func decodeWords(req *ModbusRequest, words []uint16) ([]string, error) {
+	if err := postProcess(req, words); err != nil {
+		return nil, err
+	}
+	if req.HasBit {
+		words = extractBits(words, req)
+	}
+
+	return formatResults(req, words)
+}
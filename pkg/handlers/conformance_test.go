@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+)
+
+// The conformance suite is the compatibility contract of the request format:
+// testdata/conformance.json lists request payloads of every supported
+// function code, option and error case, with the response the gateway
+// returns for each. A change failing the suite changes what clients see;
+// if it is intended, rewrite the responses with
+//
+//	go test ./pkg/handlers -run TestConformance -update
+//
+// and review the diff of the fixture like an API change.
+var update = flag.Bool("update", false, "rewrite the responses of the conformance fixture")
+
+// conformanceFixture is the fixture of the conformance suite
+const conformanceFixture = "testdata/conformance.json"
+
+// conformanceSize is the number of registers, coils and discrete inputs of
+// the simulated device the cases run against
+const conformanceSize = 10000
+
+// conformanceDevices is the device registry of the cases giving a device
+var conformanceDevices = map[string]config.DeviceConfig{
+	"plc": {Address: "192.0.2.20:502", UnitID: 3, Timeout: 2 * time.Second},
+}
+
+// conformanceSuite is the document of the fixture
+type conformanceSuite struct {
+	Device string            `json:"device"` // Contents of the simulated device
+	Cases  []conformanceCase `json:"cases"`
+}
+
+// conformanceCase is a request and the response the gateway returns for it
+type conformanceCase struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Device      string `json:"device,omitempty"` // Device of the request topic
+	Request     string `json:"request"`
+	Response    string `json:"response"`
+}
+
+func TestConformance(t *testing.T) {
+	data, err := os.ReadFile(conformanceFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var suite conformanceSuite
+	if err := json.Unmarshal(data, &suite); err != nil {
+		t.Fatalf("invalid fixture: %v", err)
+	}
+
+	names := make(map[string]bool)
+	for i := range suite.Cases {
+		c := &suite.Cases[i]
+		if names[c.Name] {
+			t.Fatalf("duplicate case %q", c.Name)
+		}
+		names[c.Name] = true
+
+		t.Run(c.Name, func(t *testing.T) {
+			got := conformanceResponse(c.Device, c.Request)
+			if *update {
+				c.Response = got
+				return
+			}
+			if got != c.Response {
+				t.Errorf("%s\nrequest:  %s\nresponse: %s\nexpected: %s", c.Description, c.Request, got, c.Response)
+			}
+		})
+	}
+
+	if *update {
+		suite.Device = "Each request runs against a fresh simulated device with 10000 registers, coils and discrete inputs. Every register holds its own address (register number minus 1), and coils and discrete inputs with odd addresses are set. The device plc of the registry has the address 192.0.2.20:502, unit ID 3 and a 2s timeout. duration_ms is omitted from JSON responses, as it varies."
+		var buf bytes.Buffer
+		encoder := json.NewEncoder(&buf)
+		encoder.SetEscapeHTML(false)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(suite); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(conformanceFixture, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestConformanceFunctions checks that the suite covers every supported
+// function code, as a read or write and as an error
+func TestConformanceFunctions(t *testing.T) {
+	data, err := os.ReadFile(conformanceFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var suite conformanceSuite
+	if err := json.Unmarshal(data, &suite); err != nil {
+		t.Fatalf("invalid fixture: %v", err)
+	}
+
+	ok, failed := make(map[uint8]bool), make(map[uint8]bool)
+	for _, c := range suite.Cases {
+		requests, err := parseBatch(c.Request)
+		if err != nil {
+			continue // JSON and invalid requests
+		}
+		for _, req := range requests {
+			if strings.Contains(c.Response, "ERROR") {
+				failed[req.FunctionCode] = true
+			} else {
+				ok[req.FunctionCode] = true
+			}
+		}
+	}
+	for _, code := range []uint8{1, 2, 3, 4, 5, 6, 15, 16} {
+		if !ok[code] || !failed[code] {
+			t.Errorf("function %d: succeeding case %t, failing case %t", code, ok[code], failed[code])
+		}
+	}
+}
+
+// conformanceResponse returns the response to a request executed on a fresh
+// simulated device, without the varying duration of JSON responses
+func conformanceResponse(device string, request string) string {
+	simulated := NewSimulatedDevice(conformanceSize)
+	handler := &JSONHandler{
+		Handler: &ModbusHandler{Connect: simulated.Connect, Devices: conformanceDevices},
+		Devices: conformanceDevices,
+	}
+	response := handler.Handle(context.Background(), device, request)
+	if !strings.HasPrefix(response, "{") {
+		return response
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(response), &fields); err != nil {
+		return response
+	}
+	delete(fields, "duration_ms")
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return response
+	}
+	return string(data)
+}
@@ -0,0 +1,258 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/protocol"
+)
+
+// Convert translates a request or response payload between the text and JSON
+// formats, detecting the kind and format of the payload
+func Convert(payload string) (string, error) {
+	trimmed := strings.TrimSpace(payload)
+	if strings.HasPrefix(trimmed, "{") {
+		var probe map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(trimmed), &probe); err != nil {
+			return "", fmt.Errorf("invalid JSON payload: %v", err)
+		}
+		if _, ok := probe["status"]; ok {
+			return jsonResponseToText(trimmed)
+		}
+		return jsonRequestToText(trimmed)
+	}
+
+	if isTextResponse(trimmed) {
+		resp, err := parseAnyTextResponse(trimmed)
+		if err != nil {
+			return "", err
+		}
+		return encodeJSONResponse(resp, nil), nil
+	}
+	return textRequestToJSON(trimmed)
+}
+
+// DecodeResponse decodes the raw register values of a text response as the
+// given type and byte order, like the "type=" and "order=" options would
+func DecodeResponse(payload string, dataType string, order string) (string, error) {
+	resp, err := parseTextResponse(strings.TrimSpace(payload))
+	if err != nil {
+		return "", err
+	}
+	if resp.Status != "OK" {
+		return "", fmt.Errorf("not a successful response")
+	}
+
+	req := &ModbusRequest{Format: FormatDecimal, Scale: 1}
+	if req.DataType, err = parseDataType(dataType); err != nil {
+		return "", err
+	}
+	if order != "" {
+		if req.ByteOrder, err = parseByteOrder(order); err != nil {
+			return "", err
+		}
+	}
+
+	registers := make([]uint16, len(resp.Values))
+	for i, v := range resp.Values {
+		n, err := strconv.ParseUint(fmt.Sprint(v), 0, 16)
+		if err != nil {
+			return "", fmt.Errorf("value %v is not a raw register value", v)
+		}
+		registers[i] = uint16(n)
+	}
+
+	values, err := formatResults(req, registers)
+	if err != nil {
+		return "", err
+	}
+	return formatResponse(*resp.Cookie, values, nil), nil
+}
+
+// isTextResponse reports whether a text payload is a response rather than a
+// request
+func isTextResponse(payload string) bool {
+	fields := strings.Fields(payload)
+	return len(fields) >= 2 && (fields[1] == "OK" || fields[1] == "ERROR:")
+}
+
+// parseAnyTextResponse parses a plain or batch text response. Batch responses
+// are recognized by their first result: a sub-index followed by a status.
+func parseAnyTextResponse(text string) (jsonResponse, error) {
+	fields := strings.Fields(text)
+	if len(fields) >= 4 && fields[1] == "OK" {
+		status := strings.TrimSuffix(fields[3], ";")
+		_, err := strconv.ParseUint(fields[2], 10, 64)
+		if err == nil && (status == "OK" || status == "ERROR:") {
+			return parseBatchResponse(text, 0)
+		}
+	}
+	return parseTextResponse(text)
+}
+
+// textRequestToJSON converts a text request into the JSON request format
+func textRequestToJSON(payload string) (string, error) {
+	if _, err := parseBatch(payload); err != nil {
+		return "", err
+	}
+
+	segments := strings.Split(payload, ";")
+	header, parts, _ := protocol.ParseHeader(strings.Fields(segments[0]))
+	req := jsonRequest{
+		Cookie:  header.Cookie,
+		IP:      header.IP,
+		Port:    header.Port,
+		Timeout: int(header.Timeout / time.Second),
+		SlaveID: header.SlaveID,
+	}
+
+	commands := []jsonCommand{textCommandToJSON(strings.Join(parts, " "))}
+	for _, segment := range segments[1:] {
+		commands = append(commands, textCommandToJSON(segment))
+	}
+	if len(commands) == 1 {
+		req.jsonCommand = commands[0]
+	} else {
+		req.Commands = commands
+	}
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// textCommandToJSON converts the fields of a text command, starting at the
+// function, into a JSON command. The command has been validated.
+func textCommandToJSON(command string) jsonCommand {
+	split := protocol.SplitOptions(strings.Fields(command))
+	fields, options := split.Fields, split.Options
+	function, _ := strconv.ParseUint(fields[0], 10, 8)
+
+	c := jsonCommand{Function: uint8(function), Register: jsonToken(fields[1])}
+	if strings.Contains(fields[1], ".") {
+		c.Register = json.RawMessage(strconv.Quote(fields[1])) // Bit suffix
+	}
+	if len(options) > 0 {
+		c.Options = options
+	}
+
+	switch c.Function {
+	case 5, 6:
+		c.Value = jsonToken(fields[2])
+	case 15, 16:
+		count, _ := strconv.ParseUint(fields[2], 10, 16)
+		c.Count = uint16(count)
+		prefix, _, _ := strings.Cut(fields[3], ":")
+		if options["type"] == string(TypeString) || prefix == string(TypeString) {
+			text, err := url.PathUnescape(fields[3])
+			if err != nil {
+				text = fields[3]
+			}
+			c.Data = []json.RawMessage{jsonToken(strconv.Quote(text))}
+			break
+		}
+		for _, v := range strings.Split(fields[3], ",") {
+			c.Data = append(c.Data, jsonToken(v))
+		}
+	default:
+		count, _ := strconv.ParseUint(fields[2], 10, 16)
+		c.Count = uint16(count)
+	}
+	return c
+}
+
+// jsonToken converts a text field into a JSON number if it is one, or into
+// a JSON string
+func jsonToken(field string) json.RawMessage {
+	if strings.HasPrefix(field, `"`) {
+		return json.RawMessage(field)
+	}
+	if _, err := strconv.ParseFloat(field, 64); err == nil && !strings.ContainsAny(field, "xXnN") {
+		return json.RawMessage(field)
+	}
+	return json.RawMessage(strconv.Quote(field))
+}
+
+// jsonRequestToText converts a JSON request into the text request format
+func jsonRequestToText(payload string) (string, error) {
+	var req jsonRequest
+	decoder := json.NewDecoder(strings.NewReader(payload))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		return "", fmt.Errorf("invalid JSON request: %v", err)
+	}
+	return req.toText()
+}
+
+// jsonResponseToText converts a JSON response into the text response format
+func jsonResponseToText(payload string) (string, error) {
+	var resp jsonResponse
+	decoder := json.NewDecoder(strings.NewReader(payload))
+	decoder.UseNumber() // Keep numbers as formatted by the gateway
+	if err := decoder.Decode(&resp); err != nil {
+		return "", fmt.Errorf("invalid JSON response: %v", err)
+	}
+	if resp.Cookie == nil {
+		return "", fmt.Errorf("response has no cookie")
+	}
+
+	if len(resp.Results) > 0 {
+		results := make([]string, len(resp.Results))
+		for i, result := range resp.Results {
+			index := uint64(i)
+			if result.Index != nil {
+				index = *result.Index
+			}
+			results[i] = textResult(index, result)
+		}
+		return fmt.Sprintf("%d OK %s", *resp.Cookie, strings.Join(results, "; ")), nil
+	}
+	return textResult(*resp.Cookie, resp), nil
+}
+
+// textResult formats a JSON response or batch result as a text response
+func textResult(id uint64, resp jsonResponse) string {
+	var annotations string
+	if resp.At != "" {
+		annotations += " at=" + resp.At
+	}
+	if resp.Diag != nil {
+		annotations += " diag=" + resp.Diag.text()
+	}
+	if resp.CachedMs != nil {
+		annotations += " cached=" + strconv.FormatFloat(*resp.CachedMs, 'f', 3, 64)
+	}
+	if resp.Quality != "" {
+		annotations += " quality=" + resp.Quality
+	}
+
+	if resp.Status == "ERROR" {
+		return fmt.Sprintf("%d ERROR: %s%s", id, resp.Error, annotations)
+	}
+
+	values := make([]string, len(resp.Values))
+	for i, v := range resp.Values {
+		if s, ok := v.(string); ok && !bareToken(s) {
+			values[i] = strconv.Quote(s)
+		} else {
+			values[i] = fmt.Sprint(v)
+		}
+	}
+	return formatResponse(id, values, nil) + annotations
+}
+
+// bareToken reports whether a JSON string value is an unquoted token of the
+// text response rather than a string register value
+func bareToken(s string) bool {
+	switch s {
+	case verifiedResult, "NaN", "+Inf", "-Inf":
+		return true
+	}
+	return strings.HasPrefix(s, "0x")
+}
@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+)
+
+// sharedReads counts the reads answered with the result of an identical read
+// executing for another request
+var sharedReads uint64
+
+// SharedReads returns the number of reads that shared the transaction of an
+// identical concurrent read instead of executing their own
+func SharedReads() uint64 {
+	return atomic.LoadUint64(&sharedReads)
+}
+
+// errSharedReadAborted is reported to the followers of a read that didn't complete
+var errSharedReadAborted = errors.New("INTERNAL: shared read aborted")
+
+// sharedRead is a read executing for the first of concurrent identical
+// requests, whose result is handed to the others once done is closed
+type sharedRead struct {
+	done    chan struct{}
+	req     *ModbusRequest // Request of the executing read, carrying its timings
+	results []string
+	err     error
+}
+
+// readKey identifies the reads of a device that are answered with the same
+// result: the payloads without their cookie. Requests differing in any other
+// field, e.g. the type or the timeout, are executed separately.
+func readKey(device string, payload string) string {
+	fields := strings.Fields(payload)
+	if len(fields) > 1 {
+		fields[1] = ""
+	}
+	return device + " " + strings.Join(fields, " ")
+}
+
+// isDedupable reports whether a single request may share its transaction
+func isDedupable(req *ModbusRequest) bool {
+	return req.FunctionCode >= 1 && req.FunctionCode <= 4 && !req.Verify
+}
+
+// executeShared executes a read, or waits for the identical read already
+// executing for another request and shares its result. A follower whose
+// leader was canceled executes the read itself.
+func (h *ModbusHandler) executeShared(ctx context.Context, device string, key string, req *ModbusRequest) ([]string, error) {
+	h.mu.Lock()
+	if s := h.reads[key]; s != nil {
+		h.mu.Unlock()
+		select {
+		case <-s.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if errors.Is(s.err, context.Canceled) || errors.Is(s.err, context.DeadlineExceeded) {
+			return h.executeShared(ctx, device, key, req)
+		}
+
+		atomic.AddUint64(&sharedReads, 1)
+		req.connectTime, req.turnaround, req.retries = s.req.connectTime, s.req.turnaround, s.req.retries
+		return s.results, s.err
+	}
+
+	// The error stands if the read panics, so the followers don't report an
+	// empty result
+	s := &sharedRead{done: make(chan struct{}), req: req, err: errSharedReadAborted}
+	if h.reads == nil {
+		h.reads = make(map[string]*sharedRead)
+	}
+	h.reads[key] = s
+	h.mu.Unlock()
+	defer func() {
+		h.mu.Lock()
+		delete(h.reads, key)
+		h.mu.Unlock()
+		close(s.done)
+	}()
+
+	s.results, s.err = h.executeModbusQuery(ctx, device, req)
+	return s.results, s.err
+}
@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"sort"
+	"time"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+)
+
+// DeviceRegistry is the device registry of the configuration as a service of
+// the handlers. It looks the devices up by name, tag or group and resolves
+// their connection settings and the request fields they default, so custom
+// handlers address the devices like the Modbus handler does. It doesn't
+// change once created and is safe for concurrent use.
+type DeviceRegistry struct {
+	devices map[string]*Device
+	groups  map[string][]string
+	names   []string // Names of the devices, sorted
+}
+
+// Device is a registered device with its connection settings resolved from
+// the configuration
+type Device struct {
+	Name    string
+	Host    string               // Host of the Modbus TCP target, empty for serial devices and devices without address
+	Port    uint16               // Port of the Modbus TCP target, 502 unless given in the address
+	Serial  *config.SerialConfig // Serial port of the device, nil for Modbus TCP
+	UnitID  uint8                // Unit ID, 0 if requests must give it
+	Timeout time.Duration        // Timeout of the requests, 0 if requests must give it
+	TCP     config.TCPConfig     // Dial options of Modbus TCP connections, the device's or the defaults
+	Retry   config.RetryConfig   // Retries of transient failures, the device's or the default policy
+	Tags    []string             // Labels of the device, selecting it with Tagged
+	Config  config.DeviceConfig  // Complete configuration of the device, e.g. its metadata and lane
+}
+
+// NewDeviceRegistry creates the device registry of a configuration checked
+// by config.Load or config.Parse
+func NewDeviceRegistry(cfg *config.Config) *DeviceRegistry {
+	r := &DeviceRegistry{devices: make(map[string]*Device, len(cfg.Devices)), groups: cfg.Groups}
+	for name, d := range cfg.Devices {
+		device := &Device{
+			Name:    name,
+			UnitID:  d.UnitID,
+			Timeout: d.Timeout,
+			TCP:     tcpOptions(cfg.TCP, d),
+			Retry:   cfg.Retry,
+			Tags:    d.Tags,
+			Config:  d,
+		}
+		if d.Retry != nil {
+			device.Retry = *d.Retry
+		}
+		if d.Serial != "" {
+			serial := cfg.Serial[d.Serial]
+			device.Serial = &serial
+		} else if d.Address != "" {
+			device.Host, device.Port, _ = config.SplitAddress(d.Address) // Checked by the configuration
+		}
+		r.devices[name] = device
+		r.names = append(r.names, name)
+	}
+	sort.Strings(r.names)
+	return r
+}
+
+// Lookup returns the registered device of a name, and whether there is one
+func (r *DeviceRegistry) Lookup(name string) (*Device, bool) {
+	d, ok := r.devices[name]
+	return d, ok
+}
+
+// Names returns the names of the registered devices, sorted
+func (r *DeviceRegistry) Names() []string {
+	return append([]string{}, r.names...)
+}
+
+// Tagged returns the devices with a tag, sorted by name
+func (r *DeviceRegistry) Tagged(tag string) []*Device {
+	var devices []*Device
+	for _, name := range r.names {
+		d := r.devices[name]
+		for _, t := range d.Tags {
+			if t == tag {
+				devices = append(devices, d)
+				break
+			}
+		}
+	}
+	return devices
+}
+
+// Group returns the devices of a group of the configuration, in the order of
+// the configuration, and whether there is such a group
+func (r *DeviceRegistry) Group(name string) ([]*Device, bool) {
+	members, ok := r.groups[name]
+	if !ok {
+		return nil, false
+	}
+	devices := make([]*Device, len(members))
+	for i, member := range members {
+		devices[i] = r.devices[member]
+	}
+	return devices, true
+}
+
+// Resolve fills in the fields of a parsed request given as "-" and the
+// options set for the device, like the Modbus handler does, rejecting
+// requests whose target remains unset. Requests for unregistered devices
+// must give their target.
+func (r *DeviceRegistry) Resolve(device string, req *ModbusRequest) error {
+	var d config.DeviceConfig
+	if registered, ok := r.devices[device]; ok {
+		d = registered.Config
+	}
+	return applyDeviceDefaults(device, d, req)
+}
+
+// ParseRequest parses a text request payload, a batch giving one request
+// per command, and resolves the requests for the device like Resolve
+func (r *DeviceRegistry) ParseRequest(device string, payload string) ([]*ModbusRequest, error) {
+	requests, err := parseBatch(payload)
+	if err != nil {
+		return nil, err
+	}
+	for _, req := range requests {
+		if err := r.Resolve(device, req); err != nil {
+			return nil, err
+		}
+	}
+	return requests, nil
+}
+
+// DeviceAware is implemented by handlers using the device registry. The
+// gateway passes its registry, shared by all handlers, to the named handlers
+// it creates.
+type DeviceAware interface {
+	SetDevices(devices *DeviceRegistry)
+}
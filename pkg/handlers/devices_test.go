@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+)
+
+// registryConfig is the configuration of the device registry tests
+const registryConfig = `
+mqtt:
+  broker: "tcp://127.0.0.1:1883"
+  client_id: "gateway"
+  request_topic: "modbus/{device}/request"
+  response_topic: "modbus/{device}/response"
+retry:
+  count: 2
+tcp:
+  keep_alive: 10s
+serial:
+  bus:
+    device: /dev/ttyUSB0
+    baud: 9600
+devices:
+  meter1:
+    address: "192.0.2.21"
+    unit_id: 1
+    timeout: 2s
+    byte_order: CDAB
+    tags: [meter, north]
+  meter2:
+    address: "192.0.2.22:1502"
+    unit_id: 2
+    timeout: 3s
+    retry:
+      count: 0
+    tags: [meter]
+  drive:
+    serial: bus
+    unit_id: 7
+    timeout: 1s
+groups:
+  meters: [meter2, meter1]
+`
+
+func TestDeviceRegistry(t *testing.T) {
+	cfg, err := config.Parse([]byte(registryConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewDeviceRegistry(cfg)
+
+	if names := r.Names(); !reflect.DeepEqual(names, []string{"drive", "meter1", "meter2"}) {
+		t.Errorf("names %v", names)
+	}
+	if _, ok := r.Lookup("plc"); ok {
+		t.Error("unregistered device found")
+	}
+
+	meter1, _ := r.Lookup("meter1")
+	if meter1.Host != "192.0.2.21" || meter1.Port != 502 || meter1.Serial != nil || meter1.UnitID != 1 || meter1.Timeout != 2*time.Second {
+		t.Errorf("meter1 target %+v", meter1)
+	}
+	if meter1.TCP.KeepAlive != 10*time.Second || meter1.Retry.Count != 2 {
+		t.Errorf("meter1 dial options %+v, retry %+v", meter1.TCP, meter1.Retry)
+	}
+	meter2, _ := r.Lookup("meter2")
+	if meter2.Port != 1502 || meter2.Retry.Count != 0 {
+		t.Errorf("meter2 port %d, retry %+v", meter2.Port, meter2.Retry)
+	}
+	drive, _ := r.Lookup("drive")
+	if drive.Host != "" || drive.Serial == nil || drive.Serial.Device != "/dev/ttyUSB0" || drive.Serial.Baud != 9600 {
+		t.Errorf("drive target %+v", drive)
+	}
+
+	names := func(devices []*Device) []string {
+		var names []string
+		for _, d := range devices {
+			names = append(names, d.Name)
+		}
+		return names
+	}
+	if tagged := names(r.Tagged("meter")); !reflect.DeepEqual(tagged, []string{"meter1", "meter2"}) {
+		t.Errorf("tagged meter %v", tagged)
+	}
+	if tagged := r.Tagged("south"); tagged != nil {
+		t.Errorf("tagged south %v", names(tagged))
+	}
+	if members, ok := r.Group("meters"); !ok || !reflect.DeepEqual(names(members), []string{"meter2", "meter1"}) {
+		t.Errorf("group meters %v, %t", names(members), ok)
+	}
+	if _, ok := r.Group("meter1"); ok {
+		t.Error("device found as a group")
+	}
+}
+
+func TestDeviceRegistryParseRequest(t *testing.T) {
+	cfg, err := config.Parse([]byte(registryConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewDeviceRegistry(cfg)
+
+	requests, err := r.ParseRequest("meter1", "0 1 0 - - - - 3 101 2 type=float32 ; 4 1 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, req := range requests {
+		if req.IPAddress != "192.0.2.21" || req.Port != 502 || req.SlaveID != 1 || req.Timeout != 2*time.Second || req.ByteOrder != "CDAB" {
+			t.Errorf("resolved request %+v", req)
+		}
+	}
+
+	// Fields given in the request are kept
+	requests, err = r.ParseRequest("meter2", "0 1 0 192.0.2.30 - 5 - 3 101 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req := requests[0]; req.IPAddress != "192.0.2.30" || req.Port != 1502 || req.Timeout != 5*time.Second || req.SlaveID != 2 {
+		t.Errorf("resolved request %+v", req)
+	}
+
+	// Unregistered devices must give their target
+	if _, err := r.ParseRequest("plc", "0 1 0 - 502 5 1 3 101 1"); err == nil {
+		t.Error("request without target accepted")
+	}
+	if _, err := r.ParseRequest("plc", "0 1 0 192.0.2.10 502 5 1 3 101 1"); err != nil {
+		t.Errorf("request for unregistered device: %v", err)
+	}
+}
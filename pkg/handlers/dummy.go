@@ -0,0 +1,192 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+	"github.com/ganehag/open-modbus-goateway/pkg/failure"
+	"github.com/simonvetter/modbus"
+)
+
+// DummyHandler implements the Handler interface without any device. Its
+// configuration adds latency, timeouts and exceptions to the commands and
+// selects the values read; the zero value answers every command at once,
+// reads with the value 1.
+type DummyHandler struct {
+	Config config.DummyConfig
+
+	once  sync.Once
+	mu    sync.Mutex // Guards rng
+	rng   *rand.Rand // Seeded source of the random draws, nil for the global source
+	reads atomic.Uint64
+}
+
+// newDummyHandler creates a dummy handler with the configuration, checking
+// its exception codes
+func newDummyHandler(cfg config.DummyConfig) (*DummyHandler, error) {
+	for _, code := range cfg.Exceptions {
+		if exceptionCode(exceptionError(code)) == 0 {
+			return nil, fmt.Errorf("dummy.exceptions: unsupported exception code %d", code)
+		}
+	}
+	return &DummyHandler{Config: cfg}, nil
+}
+
+// Handle processes the incoming payload, performs Modbus operations, and returns a response
+func (h *DummyHandler) Handle(ctx context.Context, device string, payload string) string {
+	return TextEncoder{}.Encode(h.HandleResponse(ctx, device, payload))
+}
+
+// HandleResponse processes the incoming payload like Handle and returns the
+// structured response
+func (h *DummyHandler) HandleResponse(ctx context.Context, device string, payload string) *Response {
+	// Parse and validate the request payload
+	requests, err := parseBatch(payload)
+	if err != nil {
+		log.Printf("Invalid request: %v", err)
+		return newResponse(0, nil, failure.Wrap(failure.ErrParse, err)) // If cookie is invalid, default to 0
+	}
+
+	execute := func(req *ModbusRequest) ([]string, error) {
+		return h.executeDummyQuery(ctx, req)
+	}
+	if len(requests) > 1 {
+		return executeBatch(requests, execute)
+	}
+
+	// Perform Modbus query
+	// response, err := h.executeModbusQuery(request)
+	response, err := execute(requests[0])
+	if err != nil {
+		log.Printf("Modbus query failed: %v", err)
+	}
+	// Construct the response
+	return newResult(requests[0].Cookie, requests[0], response, err)
+}
+
+func (h *DummyHandler) executeDummyQuery(ctx context.Context, req *ModbusRequest) ([]string, error) {
+	if err := h.delay(ctx); err != nil {
+		return nil, err
+	}
+	if err := h.fault(); err != nil {
+		return nil, err
+	}
+
+	var results []uint16
+	switch req.FunctionCode {
+	case 1, 2, 3, 4:
+		value := h.value()
+		if req.FunctionCode <= 2 {
+			value &= 1 // Coils and discrete inputs take the lowest bit
+		}
+		for i := uint16(0); i < req.RegisterCount; i++ {
+			results = append(results, value)
+		}
+	}
+
+	if req.Verify {
+		return []string{verifiedResult}, nil
+	}
+
+	// Decode and format results into strings
+	return formatResults(req, results)
+}
+
+// float64 draws a random number in [0, 1)
+func (h *DummyHandler) float64() float64 {
+	h.once.Do(func() {
+		if h.Config.Seed != 0 {
+			h.rng = rand.New(rand.NewPCG(uint64(h.Config.Seed), 0))
+		}
+	})
+	if h.rng == nil {
+		return rand.Float64()
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.rng.Float64()
+}
+
+// delay waits for a latency drawn from the configured distribution, unless
+// the request is canceled first
+func (h *DummyHandler) delay(ctx context.Context) error {
+	l := h.Config.Latency
+	var d time.Duration
+	switch l.Distribution {
+	case config.LatencyUniform:
+		d = l.Min + time.Duration(h.float64()*float64(l.Max-l.Min))
+	case config.LatencyNormal:
+		// Box-Muller transform of two uniform draws
+		z := math.Sqrt(-2*math.Log(1-h.float64())) * math.Cos(2*math.Pi*h.float64())
+		d = l.Mean + time.Duration(z*float64(l.StdDev))
+	case config.LatencyExponential:
+		d = time.Duration(-math.Log(1-h.float64()) * float64(l.Mean))
+	default:
+		d = l.Mean
+	}
+	d = max(d, l.Min)
+	if l.Max > 0 {
+		d = min(d, l.Max)
+	}
+	if d <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// fault draws whether a command fails with a timeout or an exception
+func (h *DummyHandler) fault() error {
+	if h.Config.TimeoutRate == 0 && h.Config.ExceptionRate == 0 {
+		return nil
+	}
+	draw := h.float64()
+	switch {
+	case draw < h.Config.TimeoutRate:
+		return modbus.ErrRequestTimedOut
+	case draw < h.Config.TimeoutRate+h.Config.ExceptionRate:
+		codes := h.Config.Exceptions
+		if len(codes) == 0 {
+			return modbus.ErrIllegalDataAddress
+		}
+		return exceptionError(codes[int(h.float64()*float64(len(codes)))])
+	}
+	return nil
+}
+
+// value returns the value of the next read in the configured pattern
+func (h *DummyHandler) value() uint16 {
+	v := h.Config.Values
+	high := uint64(v.Max)
+	if high == 0 {
+		high = math.MaxUint16
+	}
+	span := high - uint64(min(v.Min, uint16(high))) + 1
+
+	switch v.Pattern {
+	case config.ValuesRamp:
+		step := uint64(max(v.Step, 1))
+		n := h.reads.Add(1) - 1
+		return v.Min + uint16(n*step%span)
+	case config.ValuesRandom:
+		return v.Min + uint16(h.float64()*float64(span))
+	}
+	if v.Value != nil {
+		return *v.Value
+	}
+	return 1
+}
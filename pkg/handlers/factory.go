@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+)
+
+// HandlerFactory creates a handler from the configuration
+type HandlerFactory func(cfg *config.Config) (Handler, error)
+
+// handlerFactories are the handlers selectable by name with the handler
+// configuration key
+var handlerFactories = map[string]HandlerFactory{
+	"modbus": func(cfg *config.Config) (Handler, error) {
+		return newModbusHandler(cfg), nil
+	},
+	"dummy": func(cfg *config.Config) (Handler, error) {
+		return newDummyHandler(cfg.Dummy)
+	},
+	"simulator": newSimulatorHandler,
+}
+
+// newModbusHandler creates a Modbus handler with the devices and connection
+// settings of the configuration
+func newModbusHandler(cfg *config.Config) *ModbusHandler {
+	return &ModbusHandler{Devices: cfg.Devices, Serial: cfg.Serial, Pool: cfg.ConnectionPool, Retry: cfg.Retry, TCP: cfg.TCP, DNS: cfg.DNS, Cache: cfg.ReadCache, Limits: cfg.RequestLimits}
+}
+
+// RegisterHandler makes a handler selectable by name with the handler
+// configuration key, replacing the handler of the same name if any. It must
+// be called before NewHandler, e.g. from an init function.
+func RegisterHandler(name string, factory HandlerFactory) {
+	handlerFactories[name] = factory
+}
+
+// HandlerNames returns the names of the selectable handlers, sorted
+func HandlerNames() []string {
+	names := make([]string, 0, len(handlerFactories))
+	for name := range handlerFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewHandler creates the named handler, e.g. the one of the handler
+// configuration key. Handlers holding resources, e.g. pooled connections,
+// implement io.Closer.
+func NewHandler(name string, cfg *config.Config) (Handler, error) {
+	factory, ok := handlerFactories[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown handler %q, expected one of %s", name, strings.Join(HandlerNames(), ", "))
+	}
+	return factory(cfg)
+}
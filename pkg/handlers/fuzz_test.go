@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/protocol"
+)
+
+// FuzzParseRequest checks that payloads published by any client are parsed
+// without panicking, and that an accepted request formats back into the
+// same request
+func FuzzParseRequest(f *testing.F) {
+	for _, payload := range []string{
+		"0 1 0 192.0.2.10 502 5 1 3 101 4",
+		"v2 1 192.0.2.10 502 5 1 3 101 4",
+		"0 1 0 - - - - 3 101 1",
+		"0 1 0 [2001:db8::1] 502 5 1 4 1 2 type=float32 order=CDAB",
+		"0 1 0 192.0.2.10 502 5 1 3 6.2 1 format=bool",
+		"0 1 0 192.0.2.10 502 5 1 6 100.3 1",
+		"0 1 0 192.0.2.10 502 5 1 6 100 int16:-5",
+		"0 1 0 192.0.2.10 502 5 1 16 100 2 float32:3.14 verify=1",
+		"0 1 0 192.0.2.10 502 5 1 16 300 4 Hi%20there type=string",
+		"0 1 0 192.0.2.10 502 5 1 15 1 3 on,off,1",
+		"0 1 0 192.0.2.10 502 5 1 3 653 1 scale=0.1 offset=-40 quality=1",
+		"0 18446744073709551616 0 192.0.2.10 502 5 1 3 101 1",
+		"0 1 0 192.0.2.10 502 5 1 3 101",
+		"0 1 0 192.0.2.10 502 5 1 3 1 126",
+		"0 1 0 192.0.2.10 502 5 1 3 101 1 =",
+		"0 1 0 192.0.2.10 502 5 1 3 101 1 ; 4 1 2 ; ; 6 1 abc",
+		"0 1 0 ☃.example 502 5 1 3 101 1 type=\xff",
+	} {
+		f.Add(payload)
+	}
+
+	f.Fuzz(func(t *testing.T, payload string) {
+		parseBatch(payload) // Must not panic either
+
+		if strings.Contains(payload, ";") {
+			return // parseBatch splits batches before parseRequest sees them
+		}
+		req, err := parseRequest(payload)
+		if err != nil {
+			return
+		}
+		parsed, err := protocol.Parse(payload)
+		if err != nil {
+			t.Fatalf("parseRequest accepts %q, protocol.Parse fails: %v", payload, err)
+		}
+		formatted := parsed.String()
+		again, err := parseRequest(formatted)
+		if err != nil {
+			t.Fatalf("parseRequest accepts %q, but not its formatting %q: %v", payload, formatted, err)
+		}
+		if !reflect.DeepEqual(req, again) {
+			t.Fatalf("%q and its formatting %q parse differently:\n%+v\n%+v", payload, formatted, req, again)
+		}
+	})
+}
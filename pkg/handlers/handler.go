@@ -0,0 +1,14 @@
+// Package handlers executes the requests of the gateway: the Modbus handler,
+// the built-in and plugin handlers selectable by name, and the wrappers adding
+// JSON requests, signatures, hooks, interceptors and the device checks.
+package handlers
+
+import "context"
+
+// Handler is an interface for processing MQTT messages. The device argument is
+// the value of the {device} placeholder of the request topic, if any. Once ctx
+// is canceled, e.g. when the gateway stops, the handler stops waiting for the
+// device and answers with an error.
+type Handler interface {
+	Handle(ctx context.Context, device string, payload string) string
+}
@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"context"
+	"log"
+)
+
+// RequestHooks transform the text requests before and their responses after
+// the wrapped handler, e.g. the hook functions of a script. An error of
+// Before blocks the request, and an error of After replaces the response;
+// either is reported as the error reason of the request.
+type RequestHooks interface {
+	Before(ctx context.Context, device string, payload string) (string, error)
+	After(ctx context.Context, device string, payload string, response string) (string, error)
+}
+
+// HookedHandler wraps a Handler and passes the requests and responses
+// through hooks
+type HookedHandler struct {
+	Handler Handler
+	Hooks   RequestHooks
+}
+
+// Handle executes the request returned by the before hook and returns the
+// response returned by the after hook, which is passed the executed request
+func (h *HookedHandler) Handle(ctx context.Context, device string, payload string) string {
+	request, err := h.Hooks.Before(ctx, device, payload)
+	if err != nil {
+		log.Printf("Hook refused request for device %q: %v", device, err)
+		return TextEncoder{}.Encode(errorResponse(payloadCookie(payload), err.Error()))
+	}
+
+	response := h.Handler.Handle(ctx, device, request)
+	response, err = h.Hooks.After(ctx, device, request, response)
+	if err != nil {
+		log.Printf("Hook failed on response for device %q: %v", device, err)
+		return TextEncoder{}.Encode(errorResponse(payloadCookie(payload), err.Error()))
+	}
+	return response
+}
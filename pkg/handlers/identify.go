@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+	"github.com/ganehag/open-modbus-goateway/pkg/failure"
+	"github.com/simonvetter/modbus"
+)
+
+// Read Device Identification (function 43, MEI type 14) is not implemented
+// by the Modbus library, so it is sent on a connection of its own.
+const (
+	fcEncapsulatedInterface = 0x2B
+	meiDeviceIdentification = 0x0E
+	readDeviceIDBasic       = 0x01
+)
+
+// DeviceIdentification holds the basic device identification objects
+type DeviceIdentification struct {
+	VendorName  string `json:"vendor_name"`  // Object 0x00
+	ProductCode string `json:"product_code"` // Object 0x01
+	Revision    string `json:"revision"`     // Object 0x02, major.minor revision
+}
+
+// ReadDeviceIdentification reads the basic device identification of a unit
+// behind a Modbus TCP target with function 43 / MEI type 14, dialing with
+// the given options
+func ReadDeviceIdentification(host string, port uint16, unitID uint8, timeout time.Duration, opts config.TCPConfig) (*DeviceIdentification, error) {
+	d, err := dialer(opts)
+	if err != nil {
+		return nil, err
+	}
+	d.Timeout = timeout
+
+	conn, err := d.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+	if err != nil {
+		return nil, failure.Wrap(failure.ErrConnUnreachable, fmt.Errorf("failed to connect to Modbus server: %w", err))
+	}
+	defer conn.Close()
+
+	id := &DeviceIdentification{}
+	objects := map[byte]*string{0x00: &id.VendorName, 0x01: &id.ProductCode, 0x02: &id.Revision}
+
+	// A unit may spread the objects over several responses
+	next := byte(0x00)
+	for txID := uint16(1); txID <= 3; txID++ {
+		if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+			return nil, err
+		}
+		pdu, err := identificationTransaction(conn, txID, unitID, next)
+		if err != nil {
+			return nil, err
+		}
+
+		more, nextID, err := parseIdentification(pdu, objects)
+		if err != nil {
+			return nil, err
+		}
+		if !more {
+			return id, nil
+		}
+		next = nextID
+	}
+
+	return id, nil
+}
+
+// identificationTransaction sends a basic device identification request
+// starting at an object and returns the PDU of the response
+func identificationTransaction(conn io.ReadWriter, txID uint16, unitID uint8, object byte) ([]byte, error) {
+	return mbapTransaction(conn, txID, unitID, []byte{fcEncapsulatedInterface, meiDeviceIdentification, readDeviceIDBasic, object})
+}
+
+// parseIdentification stores the objects of a device identification response
+// and reports whether more objects follow, starting at the returned object
+func parseIdentification(pdu []byte, objects map[byte]*string) (bool, byte, error) {
+	if len(pdu) < 7 || pdu[0] != fcEncapsulatedInterface || pdu[1] != meiDeviceIdentification {
+		return false, 0, modbus.ErrProtocolError
+	}
+
+	more, next, count := pdu[4] == 0xFF, pdu[5], int(pdu[6])
+	rest := pdu[7:]
+	for i := 0; i < count; i++ {
+		if len(rest) < 2 || len(rest) < 2+int(rest[1]) {
+			return false, 0, modbus.ErrShortFrame
+		}
+		if value, ok := objects[rest[0]]; ok {
+			*value = string(rest[2 : 2+int(rest[1])])
+		}
+		rest = rest[2+int(rest[1]):]
+	}
+
+	return more, next, nil
+}
@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"strconv"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/metrics"
+)
+
+// Instrumented is implemented by handlers reporting metrics. The gateway
+// passes its metrics sink to the named handlers it creates, including those
+// of plugins.
+type Instrumented interface {
+	SetMetrics(sink metrics.Sink)
+}
+
+// Metrics reported by the Modbus handler
+const (
+	metricModbusCommands   = "modbus_commands_total"     // Executed commands by device, function and status
+	metricModbusConnect    = "modbus_connect_seconds"    // Time taken to open the connection of a request
+	metricModbusTurnaround = "modbus_turnaround_seconds" // Time taken to execute a command on the open connection
+	metricModbusCacheHits  = "modbus_cache_hits_total"   // Reads answered from the read cache
+	metricModbusRetries    = "modbus_retries_total"      // Retries of transient failures
+)
+
+// SetMetrics implements Instrumented, setting the Metrics of the handler
+func (h *ModbusHandler) SetMetrics(sink metrics.Sink) {
+	h.Metrics = sink
+}
+
+// sink returns the sink of the metrics of the handler
+func (h *ModbusHandler) sink() metrics.Sink {
+	return metrics.OrDiscard(h.Metrics)
+}
+
+// observe reports the commands of a request executed with the response. A
+// batch failing to connect reports every command with the response.
+func (h *ModbusHandler) observe(device string, requests []*ModbusRequest, resp *Response) {
+	sink := h.sink()
+	for i, req := range requests {
+		result := resp
+		if len(resp.Results) == len(requests) {
+			result = resp.Results[i]
+		}
+		function := strconv.Itoa(int(req.FunctionCode))
+		sink.Add(metricModbusCommands, 1, metrics.Labels{"device": device, "function": function, "status": result.Status})
+
+		if req.cached {
+			sink.Add(metricModbusCacheHits, 1, metrics.Labels{"device": device})
+		} else if req.turnaround > 0 {
+			sink.Observe(metricModbusTurnaround, req.turnaround.Seconds(), metrics.Labels{"device": device, "function": function})
+		}
+	}
+	if connect := requests[0].connectTime; connect > 0 {
+		sink.Observe(metricModbusConnect, connect.Seconds(), metrics.Labels{"device": device})
+	}
+}
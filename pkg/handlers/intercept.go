@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Interceptor observes the requests of an InterceptedHandler, e.g. to log,
+// bill or limit them. An error of Before refuses the request and is reported
+// as its error reason. After is called once the request is answered, also
+// when it was refused or failed, with the response and the time taken.
+type Interceptor interface {
+	Before(ctx context.Context, req *InterceptedRequest) error
+	After(ctx context.Context, req *InterceptedRequest, resp *Response, duration time.Duration)
+}
+
+// InterceptedRequest is a request passed to the interceptors. Requests are
+// parsed for the interceptors only: changing them has no effect on the
+// executed request.
+type InterceptedRequest struct {
+	Device   string           // Value of the {device} placeholder of the request topic
+	Payload  string           // Text request payload, JSON requests converted
+	Requests []*ModbusRequest // Parsed commands, one unless a batch, nil if the payload is invalid
+	ParseErr error            // Reason the payload is invalid, which the handler reports too
+}
+
+// InterceptedHandler wraps a Handler and passes every request through
+// interceptors, called in order before the request and in reverse order
+// after it
+type InterceptedHandler struct {
+	Handler      Handler
+	Interceptors []Interceptor
+}
+
+// Handle passes the request through the interceptors and delegates it
+func (h *InterceptedHandler) Handle(ctx context.Context, device string, payload string) string {
+	return TextEncoder{}.Encode(h.HandleResponse(ctx, device, payload))
+}
+
+// HandleResponse passes the request through the interceptors like Handle
+// and returns the structured response. Only the interceptors whose Before
+// accepted the request see its response.
+func (h *InterceptedHandler) HandleResponse(ctx context.Context, device string, payload string) *Response {
+	start := time.Now()
+	req := &InterceptedRequest{Device: device, Payload: payload}
+	req.Requests, req.ParseErr = parseBatch(payload)
+
+	var resp *Response
+	accepted := 0
+	for _, interceptor := range h.Interceptors {
+		if err := interceptor.Before(ctx, req); err != nil {
+			log.Printf("Interceptor refused request for device %q: %v", device, err)
+			resp = errorResponse(payloadCookie(payload), err.Error())
+			break
+		}
+		accepted++
+	}
+	if resp == nil {
+		resp = respond(ctx, h.Handler, device, payload)
+	}
+
+	duration := time.Since(start)
+	for i := accepted - 1; i >= 0; i-- {
+		h.Interceptors[i].After(ctx, req, resp, duration)
+	}
+	return resp
+}
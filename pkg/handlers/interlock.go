@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+	"github.com/simonvetter/modbus"
+)
+
+// valueKey identifies a register of a target and unit, so the values read
+// under the name of any device reaching it are known
+type valueKey struct {
+	target   string // targetKey of the request
+	unit     uint8
+	function uint8 // 3 for holding, 4 for input registers
+	address  uint16
+}
+
+// knownValue is the last value read from a register
+type knownValue struct {
+	value uint16
+	at    time.Time
+}
+
+// recordValues stores the values of a register read of a target and unit
+func (h *ModbusHandler) recordValues(target string, unit uint8, function uint8, address uint16, values []uint16) {
+	now := time.Now()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.values == nil {
+		h.values = make(map[valueKey]knownValue)
+	}
+	for i, v := range values {
+		h.values[valueKey{target, unit, function, address + uint16(i)}] = knownValue{v, now}
+	}
+}
+
+// lastValue returns the last value read from a register of a target and unit
+func (h *ModbusHandler) lastValue(target string, unit uint8, function uint8, address uint16) (knownValue, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	v, ok := h.values[valueKey{target, unit, function, address}]
+	return v, ok
+}
+
+// checkInterlocks refuses a write to guarded registers or coils of the device
+// while the checked value of one of its interlocks is out of bounds, unknown
+// or older than allowed. The values are those of the target and unit of the
+// request.
+func (h *ModbusHandler) checkInterlocks(device string, req *ModbusRequest) error {
+	d := h.Devices[device]
+	if len(d.Interlocks) == 0 || !isWriteFunction(req.FunctionCode) {
+		return nil
+	}
+
+	target := targetKey(d.Serial, req)
+	for _, il := range d.Interlocks {
+		if !guards(il, req) {
+			continue
+		}
+
+		function := il.Function
+		if function == 0 {
+			function = 3
+		}
+		known, ok := h.lastValue(target, req.SlaveID, function, il.Register-1)
+		if !ok {
+			return fmt.Errorf("INTERLOCK: %s: value of register %d is unknown", il.Name, il.Register)
+		}
+		if il.MaxAge > 0 && time.Since(known.at) > il.MaxAge {
+			return fmt.Errorf("INTERLOCK: %s: value of register %d is older than %s", il.Name, il.Register, il.MaxAge)
+		}
+
+		value := float64(known.value)
+		if il.Signed {
+			value = float64(int16(known.value))
+		}
+		if il.Above != nil && value > *il.Above {
+			return fmt.Errorf("INTERLOCK: %s: register %d is %g, above %g", il.Name, il.Register, value, *il.Above)
+		}
+		if il.Below != nil && value < *il.Below {
+			return fmt.Errorf("INTERLOCK: %s: register %d is %g, below %g", il.Name, il.Register, value, *il.Below)
+		}
+	}
+	return nil
+}
+
+// guards reports whether a write touches a register or coil guarded by the
+// interlock
+func guards(il config.InterlockConfig, req *ModbusRequest) bool {
+	ranges := il.Writes.Holding
+	if req.FunctionCode == 5 || req.FunctionCode == 15 {
+		ranges = il.Writes.Coils
+	}
+
+	first := uint32(req.RegisterAddress) + 1
+	last := first + uint32(req.RegisterCount) - 1
+	for number := first; number <= last; number++ {
+		if inRanges(ranges, number) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordingClient records the register reads of a target and unit for the
+// interlocks of the devices reaching it
+type recordingClient struct {
+	ModbusClient
+	handler *ModbusHandler
+	target  string
+	unit    uint8
+}
+
+// hasInterlocks reports whether a device protecting the target and unit of a
+// request for device has interlocks, so its reads must be recorded
+func (h *ModbusHandler) hasInterlocks(device string, req *ModbusRequest) bool {
+	for _, name := range h.protectingDevices(device, req) {
+		if len(h.Devices[name].Interlocks) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *recordingClient) ReadRegisters(addr uint16, quantity uint16, regType modbus.RegType) ([]uint16, error) {
+	values, err := c.ModbusClient.ReadRegisters(addr, quantity, regType)
+	if err == nil && len(values) == int(quantity) {
+		c.handler.recordValues(c.target, c.unit, registerFunction(regType), addr, values)
+	}
+	return values, err
+}
+
+func (c *recordingClient) ReadRegister(addr uint16, regType modbus.RegType) (uint16, error) {
+	value, err := c.ModbusClient.ReadRegister(addr, regType)
+	if err == nil {
+		c.handler.recordValues(c.target, c.unit, registerFunction(regType), addr, []uint16{value})
+	}
+	return value, err
+}
+
+// registerFunction returns the read function of a register type
+func registerFunction(regType modbus.RegType) uint8 {
+	if regType == modbus.INPUT_REGISTER {
+		return 4
+	}
+	return 3
+}
@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+)
+
+func TestModbusHandlerInterlockValues(t *testing.T) {
+	above := 80.0
+	newHandler := func() *ModbusHandler {
+		return &ModbusHandler{
+			Connect: NewSimulatedDevice(1000).Connect,
+			Devices: map[string]config.DeviceConfig{
+				"plc": {Address: "192.0.2.10", UnitID: 1, Timeout: time.Second, Interlocks: []config.InterlockConfig{{
+					Name:     "hot",
+					Writes:   config.WritableConfig{Holding: []string{"100"}},
+					Register: 200,
+					Above:    &above,
+				}}},
+				"meter": {Address: "192.0.2.20"},
+			},
+		}
+	}
+	handle := func(h *ModbusHandler, device, payload string) string {
+		return h.Handle(context.Background(), device, payload)
+	}
+
+	// Values read under the name of another device count for the target
+	h := newHandler()
+	if response := handle(h, "plc", "0 1 0 - - - - 6 200 50"); response != "1 OK" {
+		t.Fatalf("write %q", response)
+	}
+	if response := handle(h, "meter", "0 1 0 192.0.2.10 502 5 1 3 200 1"); response != "1 OK 50" {
+		t.Fatalf("read %q", response)
+	}
+	if response := handle(h, "plc", "0 1 0 - - - - 6 100 1"); response != "1 OK" {
+		t.Errorf("guarded write %q", response)
+	}
+
+	// Values of another unit don't
+	h = newHandler()
+	handle(h, "plc", "0 1 0 192.0.2.10 502 5 2 3 200 1")
+	if response := handle(h, "plc", "0 1 0 - - - - 6 100 1"); response != "1 ERROR: INTERLOCK: hot: value of register 200 is unknown" {
+		t.Errorf("guarded write %q", response)
+	}
+}
@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+)
+
+// InventoryEntry describes a device of the registry in an inventory report
+type InventoryEntry struct {
+	Device    string `json:"device"`
+	Target    string `json:"target"` // Modbus TCP address or serial port
+	UnitID    uint8  `json:"unit_id"`
+	Reachable bool   `json:"reachable"`
+	DeviceIdentification
+	Signature []uint16 `json:"signature,omitempty"` // Values of the signature registers
+	Error     string   `json:"error,omitempty"`
+}
+
+// Inventory queries the device identification and the signature registers
+// of every device of the registry with an address or a serial port, in the
+// order of their names. A device is reachable if it answered any query, even
+// with a Modbus exception. Devices without a timeout use the given one.
+func Inventory(cfg *config.Config, timeout time.Duration) []InventoryEntry {
+	names := make([]string, 0, len(cfg.Devices))
+	for name := range cfg.Devices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	entries := make([]InventoryEntry, 0, len(names))
+	for _, name := range names {
+		d := cfg.Devices[name]
+		if d.Address == "" && d.Serial == "" {
+			continue
+		}
+		deviceTimeout := timeout
+		if d.Timeout > 0 {
+			deviceTimeout = d.Timeout
+		}
+		entries = append(entries, inventoryEntry(name, d, cfg.Serial[d.Serial], tcpOptions(cfg.TCP, d), deviceTimeout))
+	}
+
+	return entries
+}
+
+// inventoryEntry queries a single device
+func inventoryEntry(name string, d config.DeviceConfig, serial config.SerialConfig, opts config.TCPConfig, timeout time.Duration) InventoryEntry {
+	entry := InventoryEntry{Device: name, Target: d.Address, UnitID: d.UnitID}
+	if entry.UnitID == 0 {
+		entry.UnitID = 1
+	}
+
+	var errs []string
+	answered := func(err error) bool {
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+		return err == nil || !noResponse(err)
+	}
+
+	var host string
+	var port uint16
+	if d.Serial != "" {
+		entry.Target = serial.Device
+		errs = append(errs, "device identification: not supported on serial ports")
+	} else {
+		var err error
+		if host, port, err = config.SplitAddress(d.Address); err != nil {
+			errs = append(errs, err.Error())
+			entry.Error = strings.Join(errs, "; ")
+			return entry
+		}
+		id, err := ReadDeviceIdentification(host, port, entry.UnitID, timeout, opts)
+		if id != nil {
+			entry.DeviceIdentification = *id
+		}
+		entry.Reachable = answered(wrapError("device identification", err))
+	}
+
+	if sig := d.Signature; sig != nil {
+		var client ModbusClient
+		var err error
+		if d.Serial != "" {
+			client, err = ConnectSerial(serial, timeout)
+		} else {
+			client, err = connectTCPWith(context.Background(), OpenClient, &ModbusRequest{IPAddress: host, Port: port, Timeout: timeout}, opts)
+		}
+		if err == nil {
+			entry.Signature, err = readSignature(client, entry.UnitID, sig)
+			client.Close()
+		}
+		if answered(wrapError("signature", err)) {
+			entry.Reachable = true
+		}
+	}
+
+	entry.Error = strings.Join(errs, "; ")
+	return entry
+}
+
+// readSignature reads the signature registers of a unit
+func readSignature(client ModbusClient, unitID uint8, sig *config.SignatureConfig) ([]uint16, error) {
+	function, count := sig.Function, sig.Count
+	if function == 0 {
+		function = 3
+	}
+	if count == 0 {
+		count = 1
+	}
+
+	if err := client.SetUnitId(unitID); err != nil {
+		return nil, err
+	}
+	return readRaw(client, function, sig.Register-1, count)
+}
+
+// wrapError prefixes an error with the query that failed
+func wrapError(query string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("%s: %w", query, err)
+}
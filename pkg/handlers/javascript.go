@@ -0,0 +1,219 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dop251/goja"
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+)
+
+// JavaScriptHooks implements RequestHooks with the functions of a JavaScript
+// script:
+//
+//	function before(device, request) // undefined to execute the request as is,
+//	                                 // the request to execute, or {block: reason} to block it
+//	function after(device, request, response) // undefined or the response to return
+//
+// Requests and responses are passed as objects in the JSON formats, with the
+// values of responses as numbers where they are, and may be returned as
+// objects or as text payloads. Both functions are optional. Each concurrent
+// request runs in its own interpreter, so globals must not be used to share
+// state between requests.
+type JavaScriptHooks struct {
+	program *goja.Program
+	timeout time.Duration
+	vms     sync.Pool // Idle interpreters with the script loaded
+}
+
+// jsVM is an interpreter with the script loaded
+type jsVM struct {
+	vm        *goja.Runtime
+	hooks     map[string]goja.Callable // Hook functions defined by the script
+	parse     goja.Callable            // JSON.parse
+	stringify goja.Callable            // JSON.stringify
+}
+
+// NewJavaScriptHooks compiles and loads the JavaScript script of the
+// configuration
+func NewJavaScriptHooks(cfg config.ScriptConfig) (*JavaScriptHooks, error) {
+	source, err := os.ReadFile(cfg.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read JavaScript script: %w", err)
+	}
+	program, err := goja.Compile(cfg.Path, string(source), true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile JavaScript script: %w", err)
+	}
+
+	h := &JavaScriptHooks{program: program, timeout: cfg.Timeout}
+	if h.timeout <= 0 {
+		h.timeout = 100 * time.Millisecond
+	}
+	vm, err := h.newVM() // Report errors of the script body now rather than on the first request
+	if err != nil {
+		return nil, fmt.Errorf("failed to load JavaScript script: %w", err)
+	}
+	h.vms.Put(vm)
+	return h, nil
+}
+
+// newVM creates an interpreter and runs the script in it
+func (h *JavaScriptHooks) newVM() (*jsVM, error) {
+	vm := goja.New()
+	timer := time.AfterFunc(h.timeout, func() { vm.Interrupt("timeout") })
+	_, err := vm.RunProgram(h.program)
+	timer.Stop()
+	if err != nil {
+		return nil, err
+	}
+
+	v := &jsVM{vm: vm, hooks: make(map[string]goja.Callable)}
+	for _, name := range []string{"before", "after"} {
+		if fn, ok := goja.AssertFunction(vm.Get(name)); ok {
+			v.hooks[name] = fn
+		}
+	}
+	jsonObject := vm.Get("JSON").ToObject(vm)
+	v.parse, _ = goja.AssertFunction(jsonObject.Get("parse"))
+	v.stringify, _ = goja.AssertFunction(jsonObject.Get("stringify"))
+	return v, nil
+}
+
+// jsResult is the value returned by a hook function
+type jsResult struct {
+	defined bool   // Set unless the function returned undefined or null
+	text    string // The returned string, or the returned value as JSON
+	json    bool   // Set when text is the returned value as JSON
+}
+
+// call calls a function of the script, if defined, with the device and the
+// arguments given as JSON. An interpreter whose call failed or was
+// interrupted is discarded.
+func (h *JavaScriptHooks) call(ctx context.Context, name string, device string, args ...string) (jsResult, error) {
+	v, _ := h.vms.Get().(*jsVM)
+	if v == nil {
+		var err error
+		if v, err = h.newVM(); err != nil {
+			return jsResult{}, fmt.Errorf("SCRIPT_ERROR: %v", err)
+		}
+	}
+
+	fn := v.hooks[name]
+	if fn == nil {
+		h.vms.Put(v)
+		return jsResult{}, nil
+	}
+
+	timer := time.AfterFunc(h.timeout, func() { v.vm.Interrupt("timeout") })
+	stop := context.AfterFunc(ctx, func() { v.vm.Interrupt(ctx.Err()) })
+	result, err := v.invoke(fn, device, args)
+	// An interpreter whose interrupt fired may be interrupted later, even if
+	// the call completed
+	if !timer.Stop() {
+		stop()
+		return jsResult{}, fmt.Errorf("SCRIPT_ERROR: %s: timed out after %v", name, h.timeout)
+	}
+	if !stop() {
+		return jsResult{}, fmt.Errorf("SCRIPT_ERROR: %s: %v", name, ctx.Err())
+	}
+	if err != nil {
+		if ex, ok := err.(*goja.Exception); ok {
+			err = fmt.Errorf("%s", ex.Value()) // Without the stack trace
+		}
+		return jsResult{}, fmt.Errorf("SCRIPT_ERROR: %s: %v", name, err)
+	}
+
+	h.vms.Put(v)
+	return result, nil
+}
+
+// invoke calls a hook function in the interpreter, parsing the arguments from
+// JSON and converting the returned value
+func (v *jsVM) invoke(fn goja.Callable, device string, args []string) (jsResult, error) {
+	values := []goja.Value{v.vm.ToValue(device)}
+	for _, arg := range args {
+		value, err := v.parse(goja.Undefined(), v.vm.ToValue(arg))
+		if err != nil {
+			return jsResult{}, err
+		}
+		values = append(values, value)
+	}
+
+	result, err := fn(goja.Undefined(), values...)
+	if err != nil {
+		return jsResult{}, err
+	}
+	if goja.IsUndefined(result) || goja.IsNull(result) {
+		return jsResult{}, nil
+	}
+	if s, ok := result.Export().(string); ok {
+		return jsResult{defined: true, text: s}, nil
+	}
+
+	text, err := v.stringify(goja.Undefined(), result)
+	if err != nil {
+		return jsResult{}, err
+	}
+	return jsResult{defined: true, text: text.String(), json: true}, nil
+}
+
+// jsRequest returns a text request in the JSON request format, or as a JSON
+// string if it isn't a valid request
+func jsRequest(payload string) string {
+	if request, err := textRequestToJSON(payload); err == nil {
+		return request
+	}
+	quoted, _ := json.Marshal(payload)
+	return string(quoted)
+}
+
+// Before calls the before function of the script
+func (h *JavaScriptHooks) Before(ctx context.Context, device string, payload string) (string, error) {
+	result, err := h.call(ctx, "before", device, jsRequest(payload))
+	if err != nil || !result.defined {
+		return payload, err
+	}
+	if !result.json {
+		return result.text, nil
+	}
+
+	var block struct {
+		Block *string `json:"block"`
+	}
+	if json.Unmarshal([]byte(result.text), &block) == nil && block.Block != nil {
+		return "", fmt.Errorf("BLOCKED: %s", *block.Block)
+	}
+	request, err := jsonRequestToText(result.text)
+	if err != nil {
+		return "", fmt.Errorf("SCRIPT_ERROR: before: %v", err)
+	}
+	return request, nil
+}
+
+// After calls the after function of the script
+func (h *JavaScriptHooks) After(ctx context.Context, device string, payload string, response string) (string, error) {
+	jsResponse, _ := json.Marshal(response)
+	if isTextResponse(response) {
+		if resp, err := parseAnyTextResponse(response); err == nil {
+			jsResponse = []byte(encodeJSONResponse(resp, nil))
+		}
+	}
+
+	result, err := h.call(ctx, "after", device, jsRequest(payload), string(jsResponse))
+	if err != nil || !result.defined {
+		return response, err
+	}
+	if !result.json {
+		return result.text, nil
+	}
+	text, err := jsonResponseToText(result.text)
+	if err != nil {
+		return "", fmt.Errorf("SCRIPT_ERROR: after: %v", err)
+	}
+	return text, nil
+}
@@ -0,0 +1,556 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+	"github.com/ganehag/open-modbus-goateway/pkg/protocol"
+)
+
+// JSONHandler wraps a Handler and adds a JSON request mode. Payloads that
+// start with '{' are translated into the text request format for the wrapped
+// handler, and its response is encoded as a JSON object. The responses to
+// text payloads are encoded by the Text encoder. Responses of devices with
+// metadata in the registry carry it as the metadata field.
+//
+// As the handler facing the clients, it also rejects text requests in a
+// version of the request format that isn't accepted, and reports the custom
+// messages of errors, keyed by exception code or library error name (see
+// CheckErrorMessages). The placeholder {error} in a message is replaced by
+// the original reason.
+type JSONHandler struct {
+	Handler  Handler
+	Devices  map[string]config.DeviceConfig // Registry metadata added to the responses of a device
+	Text     Encoder                        // Encoder of the responses to text requests, TextEncoder if nil
+	Protocol config.ProtocolConfig          // Versions of the text request format accepted
+	Messages map[string]string              // Custom messages reported in place of error reasons
+}
+
+// jsonRequest is the JSON form of a request
+type jsonRequest struct {
+	Cookie      uint64        `json:"cookie"`
+	IP          string        `json:"ip,omitempty"` // Omitted fields are taken from the device registry
+	Port        uint16        `json:"port,omitempty"`
+	Timeout     int           `json:"timeout,omitempty"`
+	SlaveID     uint8         `json:"slave_id,omitempty"`
+	jsonCommand               // Single command, unless commands is given
+	Commands    []jsonCommand `json:"commands,omitempty"` // Batch of commands executed over one connection
+	Fields      []string      `json:"fields,omitempty"`   // Response fields to include, all when empty
+	KeyID       string        `json:"kid,omitempty"`      // Signing key of the request, verified by the SignedHandler
+	Sig         string        `json:"sig,omitempty"`      // Signature of the request as published
+}
+
+// jsonPayloadKey is the context key of the JSON payload a text request was
+// converted from
+type jsonPayloadKey struct{}
+
+// jsonCommand is the JSON form of a single command of a request
+type jsonCommand struct {
+	Function uint8             `json:"function,omitempty"`
+	Register json.RawMessage   `json:"register,omitempty"` // Number, or string with a bit suffix ("40010.3")
+	Count    uint16            `json:"count,omitempty"`
+	Value    json.RawMessage   `json:"value,omitempty"` // Single write value (functions 5, 6)
+	Data     []json.RawMessage `json:"data,omitempty"`  // Multiple write values (functions 15, 16)
+	Options  map[string]string `json:"options,omitempty"`
+}
+
+// jsonResponse is the JSON form of a response
+type jsonResponse struct {
+	Cookie    *uint64        `json:"cookie,omitempty"`
+	Index     *uint64        `json:"index,omitempty"` // Sub-index of a batch result
+	Status    string         `json:"status,omitempty"`
+	Values    []interface{}  `json:"values,omitempty"`
+	Error     string         `json:"error,omitempty"`
+	Exception uint8          `json:"exception,omitempty"` // Modbus exception code of a failed request
+	Results   []jsonResponse `json:"results,omitempty"`   // Per-command results of a batch
+	At        string         `json:"at,omitempty"`        // Transaction time, if requested
+	Quality   string         `json:"quality,omitempty"`   // Quality of the result, if requested
+	Diag      *jsonDiag      `json:"diag,omitempty"`      // Transaction timings, if requested
+	CachedMs  *float64       `json:"cached_ms,omitempty"` // Age of a result served from the read cache
+	Duration  *float64       `json:"duration_ms,omitempty"`
+
+	Metadata map[string]string `json:"metadata,omitempty"` // Registry metadata of the device
+}
+
+// jsonDiag is the JSON form of the transaction timings and retries of a
+// response
+type jsonDiag struct {
+	ConnectMs    float64 `json:"connect_ms"`
+	TurnaroundMs float64 `json:"turnaround_ms"`
+	Retries      int     `json:"retries"`
+}
+
+// parseDiag parses the value of a "diag=" response annotation
+func parseDiag(value string) (*jsonDiag, error) {
+	diag := &jsonDiag{}
+	for _, field := range strings.Split(value, ",") {
+		key, number, _ := strings.Cut(field, ":")
+		ms, err := strconv.ParseFloat(number, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid diagnostics %q", value)
+		}
+		switch key {
+		case "connect_ms":
+			diag.ConnectMs = ms
+		case "turnaround_ms":
+			diag.TurnaroundMs = ms
+		case "retries":
+			diag.Retries = int(ms)
+		}
+	}
+	return diag, nil
+}
+
+// text formats the timings and retries as the value of a "diag=" response
+// annotation
+func (d *jsonDiag) text() string {
+	return fmt.Sprintf("connect_ms:%s,turnaround_ms:%s,retries:%d",
+		strconv.FormatFloat(d.ConnectMs, 'f', 3, 64), strconv.FormatFloat(d.TurnaroundMs, 'f', 3, 64), d.Retries)
+}
+
+// Handle translates JSON requests and responses, delegating the request itself
+func (h *JSONHandler) Handle(ctx context.Context, device string, payload string) string {
+	trimmed := strings.TrimSpace(payload)
+	if !strings.HasPrefix(trimmed, "{") {
+		// Requests converted from JSON keep version 1, the check only applies
+		// to the clients
+		text := h.Text
+		if text == nil {
+			text = TextEncoder{}
+		}
+		if err := checkProtocol(h.Protocol, payload); err != nil {
+			return text.Encode(errorResponse(payloadCookie(payload), err.Error()))
+		}
+		if h.Text == nil && len(h.Messages) == 0 {
+			return h.Handler.Handle(ctx, device, payload)
+		}
+		return text.Encode(withMessages(h.Messages, respond(ctx, h.Handler, device, payload)))
+	}
+
+	var req jsonRequest
+	decoder := json.NewDecoder(strings.NewReader(trimmed))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		log.Printf("Invalid JSON request: %v", err)
+		return encodeJSONResponse(jsonResponse{Status: "ERROR", Error: fmt.Sprintf("invalid JSON request: %v", err)}, nil)
+	}
+
+	text, err := req.toText()
+	if err != nil {
+		log.Printf("Invalid JSON request: %v", err)
+		return encodeJSONResponse(jsonResponse{Cookie: &req.Cookie, Status: "ERROR", Error: err.Error()}, req.Fields)
+	}
+
+	// JSON requests are signed as published, not as the converted text
+	ctx = context.WithValue(ctx, jsonPayloadKey{}, payload)
+
+	start := time.Now()
+	response := withMessages(h.Messages, respond(ctx, h.Handler, device, text))
+	duration := milliseconds(time.Since(start))
+
+	var resp jsonResponse
+	if raw, ok := response.Raw(); !ok {
+		resp = toJSON(response)
+		if len(req.Commands) == 1 {
+			result := resp
+			result.Cookie, result.Index = nil, new(uint64)
+			resp = jsonResponse{Cookie: resp.Cookie, Status: StatusOK, Results: []jsonResponse{result}}
+		}
+	} else {
+		if len(req.Commands) > 0 {
+			resp, err = parseBatchResponse(raw, len(req.Commands))
+		} else {
+			resp, err = parseTextResponse(raw)
+		}
+		if err != nil {
+			log.Printf("Failed to translate response %q: %v", raw, err)
+			resp = jsonResponse{Status: "ERROR", Error: err.Error()}
+		}
+	}
+	resp.Cookie = &req.Cookie // Also known when the text request failed to parse
+	resp.Duration = &duration
+	resp.Metadata = h.Devices[device].Metadata
+
+	return encodeJSONResponse(resp, req.Fields)
+}
+
+// toText converts the JSON request into the text request format
+func (r *jsonRequest) toText() (string, error) {
+	header := protocol.Header{
+		Version: protocol.V1,
+		Cookie:  r.Cookie,
+		IP:      r.IP,
+		Port:    r.Port,
+		Timeout: time.Duration(r.Timeout) * time.Second,
+		SlaveID: r.SlaveID,
+	}.Fields()
+
+	commands := []jsonCommand{r.jsonCommand}
+	if len(r.Commands) > 0 {
+		if r.Function != 0 || len(r.Register) > 0 {
+			return "", fmt.Errorf("function and commands are mutually exclusive")
+		}
+		commands = r.Commands
+	}
+
+	segments := make([]string, len(commands))
+	for i, command := range commands {
+		fields, err := command.toText()
+		if err != nil {
+			if len(r.Commands) > 0 {
+				return "", fmt.Errorf("command %d: %v", i, err)
+			}
+			return "", err
+		}
+		segments[i] = strings.Join(fields, " ")
+	}
+	segments[0] = strings.Join(header, " ") + " " + segments[0]
+
+	return strings.Join(segments, " ; "), nil
+}
+
+// toText converts the JSON command into the function-specific fields and
+// options of the text request format
+func (c *jsonCommand) toText() ([]string, error) {
+	register, err := rawToken(c.Register)
+	if err != nil || register == "" {
+		return nil, fmt.Errorf("invalid register: %s", c.Register)
+	}
+
+	parts := []string{strconv.FormatUint(uint64(c.Function), 10), register}
+
+	switch c.Function {
+	case 5, 6:
+		value, err := rawToken(c.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value: %s", c.Value)
+		}
+		parts = append(parts, value)
+	case 15, 16:
+		values := make([]string, len(c.Data))
+		for i, raw := range c.Data {
+			if values[i], err = rawToken(raw); err != nil {
+				return nil, fmt.Errorf("invalid data: %s", raw)
+			}
+		}
+		data := strings.Join(values, ",")
+		dataType, _ := parseDataType(c.Options["type"])
+		if prefix, _, ok := strings.Cut(data, ":"); ok && c.Function == 16 {
+			dataType, _ = parseDataType(prefix)
+		}
+		count := c.Count
+		if dataType == TypeString {
+			text := strings.Join(values, "")
+			data = url.PathEscape(text)
+			if count == 0 {
+				// Two bytes of the string per register
+				count = uint16((len(text) + 1) / 2)
+			}
+		}
+		if count == 0 {
+			// Default to the registers occupied by the values
+			count = uint16(len(values))
+			if dataType != "" {
+				count *= dataType.Registers()
+			}
+		}
+		parts = append(parts, strconv.FormatUint(uint64(count), 10), data)
+	default:
+		parts = append(parts, strconv.FormatUint(uint64(c.Count), 10))
+	}
+
+	// Options are emitted in a stable order, so the text form is canonical
+	keys := make([]string, 0, len(c.Options))
+	for key := range c.Options {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := c.Options[key]
+		if strings.ContainsAny(key+value, " =;") {
+			return nil, fmt.Errorf("invalid option %q", key)
+		}
+		parts = append(parts, key+"="+value)
+	}
+
+	return parts, nil
+}
+
+// rawToken converts a JSON number, boolean or string into a text request field
+func rawToken(raw json.RawMessage) (string, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 {
+		return "", nil
+	}
+
+	if raw[0] == '"' {
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return "", err
+		}
+		return s, nil
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return "", err
+	}
+	switch v.(type) {
+	case float64, bool:
+		return string(raw), nil
+	default:
+		return "", fmt.Errorf("unsupported value %s", raw)
+	}
+}
+
+// parseTextResponse converts a text response ("<COOKIE> OK [values...]" or
+// "<COOKIE> ERROR: <reason>") into its JSON form
+func parseTextResponse(text string) (jsonResponse, error) {
+	cookieField, rest, _ := strings.Cut(text, " ")
+	cookie, err := strconv.ParseUint(cookieField, 10, 64)
+	if err != nil {
+		return jsonResponse{}, fmt.Errorf("invalid response cookie %q", cookieField)
+	}
+	resp := jsonResponse{Cookie: &cookie}
+
+	if reason, ok := strings.CutPrefix(rest, "ERROR: "); ok {
+		resp.Status = "ERROR"
+		resp.Error = reason
+		if i := strings.LastIndex(resp.Error, " quality="); i >= 0 && !strings.Contains(resp.Error[i+1:], " ") {
+			resp.Error, resp.Quality = resp.Error[:i], resp.Error[i+len(" quality="):]
+		}
+		if i := strings.LastIndex(resp.Error, " diag="); i >= 0 && !strings.Contains(resp.Error[i+1:], " ") {
+			diag, err := parseDiag(resp.Error[i+len(" diag="):])
+			if err != nil {
+				return jsonResponse{}, err
+			}
+			resp.Error, resp.Diag = resp.Error[:i], diag
+		}
+		return resp, nil
+	}
+
+	status, values, _ := strings.Cut(rest, " ")
+	resp.Status = status
+	for values = strings.TrimSpace(values); values != ""; values = strings.TrimSpace(values) {
+		var token string
+		if values[0] == '"' {
+			quoted, err := strconv.QuotedPrefix(values)
+			if err != nil {
+				return jsonResponse{}, fmt.Errorf("invalid quoted value in response: %v", err)
+			}
+			token, values = quoted, values[len(quoted):]
+		} else {
+			token, values, _ = strings.Cut(values, " ")
+			if at, ok := strings.CutPrefix(token, "at="); ok {
+				resp.At = at
+				continue
+			}
+			if quality, ok := strings.CutPrefix(token, "quality="); ok {
+				resp.Quality = quality
+				continue
+			}
+			if value, ok := strings.CutPrefix(token, "diag="); ok {
+				diag, err := parseDiag(value)
+				if err != nil {
+					return jsonResponse{}, err
+				}
+				resp.Diag = diag
+				continue
+			}
+			if value, ok := strings.CutPrefix(token, "cached="); ok {
+				ms, err := strconv.ParseFloat(value, 64)
+				if err != nil {
+					return jsonResponse{}, fmt.Errorf("invalid cache age %q", value)
+				}
+				resp.CachedMs = &ms
+				continue
+			}
+		}
+		resp.Values = append(resp.Values, jsonValue(token))
+	}
+
+	return resp, nil
+}
+
+// parseBatchResponse converts a combined batch response ("<COOKIE> OK 0 OK
+// [values...]; 1 ERROR: <reason>") into its JSON form. A batch of a single
+// command is executed as a plain request, whose response is its only result.
+func parseBatchResponse(text string, commands int) (jsonResponse, error) {
+	header, rest, batch := strings.Cut(text, " OK ")
+	if commands == 1 || !batch || strings.Contains(header, " ") {
+		resp, err := parseTextResponse(text)
+		if err != nil || commands != 1 {
+			return resp, err // Error of the batch as a whole
+		}
+		index := uint64(0)
+		result := resp
+		result.Cookie, result.Index = nil, &index
+		return jsonResponse{Cookie: resp.Cookie, Status: "OK", Results: []jsonResponse{result}}, nil
+	}
+
+	resp, err := parseTextResponse(header + " OK")
+	if err != nil {
+		return resp, err
+	}
+	for _, segment := range splitBatchResponse(rest) {
+		result, err := parseTextResponse(segment)
+		if err != nil {
+			return jsonResponse{}, err
+		}
+		result.Index, result.Cookie = result.Cookie, nil
+		resp.Results = append(resp.Results, result)
+	}
+
+	return resp, nil
+}
+
+// splitBatchResponse splits the sub-responses of a batch response on "; ",
+// ignoring separators inside quoted string values
+func splitBatchResponse(text string) []string {
+	var segments []string
+	for start, i := 0, 0; i <= len(text); {
+		switch {
+		case i == len(text):
+			segments = append(segments, text[start:])
+			i++
+		case text[i] == '"':
+			quoted, err := strconv.QuotedPrefix(text[i:])
+			if err != nil {
+				i++
+				continue
+			}
+			i += len(quoted)
+		case strings.HasPrefix(text[i:], "; "):
+			segments = append(segments, text[start:i])
+			i += 2
+			start = i
+		default:
+			i++
+		}
+	}
+	return segments
+}
+
+// jsonValue converts a text response value into a JSON number, boolean or string
+func jsonValue(token string) interface{} {
+	switch token {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+
+	if token[0] == '"' {
+		if s, err := strconv.Unquote(token); err == nil {
+			return s
+		}
+	}
+
+	if strings.HasPrefix(token, "0x") {
+		return token
+	}
+	if _, err := strconv.ParseFloat(token, 64); err == nil && token != "NaN" && !strings.Contains(token, "Inf") {
+		return json.Number(token)
+	}
+	return token
+}
+
+// ErrorResponse formats an error response to a text or JSON request payload,
+// for requests the gateway refuses without handling them
+func ErrorResponse(payload string, reason string) string {
+	trimmed := strings.TrimSpace(payload)
+	if !strings.HasPrefix(trimmed, "{") {
+		return TextEncoder{}.Encode(errorResponse(payloadCookie(payload), reason))
+	}
+
+	var req struct {
+		Cookie uint64   `json:"cookie"`
+		Fields []string `json:"fields"`
+	}
+	json.Unmarshal([]byte(trimmed), &req) // Best effort, the cookie stays 0
+	return JSONEncoder{Fields: req.Fields}.Encode(errorResponse(req.Cookie, reason))
+}
+
+// encodeJSONResponse serializes a response, keeping only the selected fields.
+// Unknown field names are ignored.
+func encodeJSONResponse(resp jsonResponse, fields []string) string {
+	if len(fields) > 0 {
+		selected := make(map[string]bool, len(fields))
+		for _, f := range fields {
+			selected[strings.ToLower(f)] = true
+		}
+		if !selected["cookie"] {
+			resp.Cookie = nil
+		}
+		if !selected["status"] {
+			resp.Status = ""
+		}
+		if !selected["values"] {
+			resp.Values = nil
+		}
+		if !selected["error"] {
+			resp.Error = ""
+		}
+		if !selected["exception"] {
+			resp.Exception = 0
+		}
+		if !selected["results"] {
+			resp.Results = nil
+		}
+		if !selected["at"] {
+			resp.At = ""
+		}
+		if !selected["quality"] {
+			resp.Quality = ""
+		}
+		if !selected["diag"] {
+			resp.Diag = nil
+		}
+		if !selected["cached"] {
+			resp.CachedMs = nil
+		}
+		if !selected["duration"] {
+			resp.Duration = nil
+		}
+		if !selected["metadata"] {
+			resp.Metadata = nil
+		}
+	}
+
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return fmt.Sprintf(`{"status":"ERROR","error":%q}`, err.Error())
+	}
+	return string(data)
+}
+
+// summarizeJSON extracts the cookie and function codes of a JSON payload on
+// a best-effort basis
+func summarizeJSON(payload string) (uint64, []uint8) {
+	var req struct {
+		Cookie   uint64 `json:"cookie"`
+		Function uint8  `json:"function,omitempty"`
+		Commands []struct {
+			Function uint8 `json:"function,omitempty"`
+		} `json:"commands,omitempty"`
+	}
+	json.Unmarshal([]byte(payload), &req) // Partial results are fine
+
+	functions := []uint8{}
+	if req.Function != 0 {
+		functions = append(functions, req.Function)
+	}
+	for _, command := range req.Commands {
+		functions = append(functions, command.Function)
+	}
+	return req.Cookie, functions
+}
@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+)
+
+// checkWrite checks a write against the writable ranges, limits and
+// interlocks of the devices protecting its target
+func (h *ModbusHandler) checkWrite(device string, req *ModbusRequest) error {
+	for _, name := range h.protectingDevices(device, req) {
+		d := h.Devices[name]
+		if err := checkWritable(d.Writable, req); err != nil {
+			return err
+		}
+		if err := checkLimits(d.Limits, req); err != nil {
+			return err
+		}
+		if err := h.checkInterlocks(name, req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// protectingDevices returns the devices whose write protections apply to a
+// request for device: the device itself, and the registered devices with
+// writable ranges, limits or interlocks at the target and unit the request
+// resolved to. Naming another device, or giving the address of the device in
+// the request, doesn't escape its protections.
+func (h *ModbusHandler) protectingDevices(device string, req *ModbusRequest) []string {
+	names := []string{device}
+	target := targetKey(h.Devices[device].Serial, req)
+	for name, d := range h.Devices {
+		if name == device || (d.Writable == nil && len(d.Limits) == 0 && len(d.Interlocks) == 0) {
+			continue
+		}
+		if (d.UnitID == 0 || d.UnitID == req.SlaveID) && deviceTarget(d) == target {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names[1:]) // Report the same violation first every time
+	return names
+}
+
+// deviceTarget returns the target key of a registered device, like
+// targetKey, or "" if the device has no address
+func deviceTarget(d config.DeviceConfig) string {
+	if d.Serial != "" {
+		return "serial:" + d.Serial
+	}
+	host, port, err := config.SplitAddress(d.Address)
+	if err != nil {
+		return ""
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port)))
+}
+
+// checkWritable denies writes to coils or holding registers outside the
+// writable ranges of the device. Devices without writable ranges may be
+// written anywhere.
+func checkWritable(writable *config.WritableConfig, req *ModbusRequest) error {
+	if writable == nil || !isWriteFunction(req.FunctionCode) {
+		return nil
+	}
+
+	table, ranges := "register", writable.Holding
+	if req.FunctionCode == 5 || req.FunctionCode == 15 {
+		table, ranges = "coil", writable.Coils
+	}
+
+	first := uint32(req.RegisterAddress) + 1
+	last := first + uint32(req.RegisterCount) - 1
+	for number := first; number <= last; number++ {
+		if !inRanges(ranges, number) {
+			return fmt.Errorf("write denied: %s %d is not writable", table, number)
+		}
+	}
+	return nil
+}
+
+// inRanges reports whether a register number is within one of the ranges
+func inRanges(ranges []string, number uint32) bool {
+	for _, r := range ranges {
+		from, to, err := config.ParseRange(r)
+		if err == nil && number >= uint32(from) && number <= uint32(to) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkLimits rejects register writes with values outside the limits
+// configured for the device. Values are checked in the units of the request,
+// after type decoding and scaling, as they would be written to the device.
+func checkLimits(limits []config.WriteLimit, req *ModbusRequest) error {
+	if len(limits) == 0 || (req.FunctionCode != 6 && req.FunctionCode != 16) {
+		return nil
+	}
+
+	byRegister := make(map[uint32]config.WriteLimit, len(limits))
+	for _, limit := range limits {
+		byRegister[uint32(limit.Register)] = limit
+	}
+
+	// The resulting value of a bit write is only known on the device
+	if req.HasBit {
+		if _, ok := byRegister[uint32(req.RegisterAddress)+1]; ok {
+			return fmt.Errorf("register %d: bit writes are not allowed to registers with limits", req.RegisterAddress+1)
+		}
+		return nil
+	}
+
+	// Every limited register written must hold the start of a value, or the
+	// value written to it can't be checked. Strings hold no value to check.
+	data := wireData(req)
+	first := uint32(req.RegisterAddress) + 1
+	last := first + uint32(len(data)) - 1
+	width := uint32(req.DataType.Registers())
+	for register := first; register <= last; register++ {
+		if _, ok := byRegister[register]; !ok {
+			continue
+		}
+		if req.DataType == TypeString {
+			return fmt.Errorf("register %d: string writes are not allowed to registers with limits", register)
+		}
+		if (register-first)%width != 0 {
+			return fmt.Errorf("register %d: writes of values not starting at registers with limits are not allowed", register)
+		}
+	}
+	if req.DataType == TypeString {
+		return nil
+	}
+
+	// Decode the written data like a read of the same registers
+	decoded := *req
+	decoded.Format = FormatDecimal
+	values, err := formatResults(&decoded, data)
+	if err != nil {
+		return err
+	}
+
+	for i, text := range values {
+		register := first + uint32(i)*width
+		limit, ok := byRegister[register]
+		if !ok {
+			continue
+		}
+		value, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return fmt.Errorf("register %d: cannot check value %q against limits", register, text)
+		}
+		if err := checkLimit(limit, value); err != nil {
+			return fmt.Errorf("register %d: %v", register, err)
+		}
+	}
+
+	return nil
+}
+
+// checkLimit checks a single value against a limit
+func checkLimit(limit config.WriteLimit, value float64) error {
+	if limit.Min != nil && value < *limit.Min {
+		return fmt.Errorf("value %g is below the minimum %g", value, *limit.Min)
+	}
+	if limit.Max != nil && value > *limit.Max {
+		return fmt.Errorf("value %g is above the maximum %g", value, *limit.Max)
+	}
+	if len(limit.Values) > 0 {
+		for _, v := range limit.Values {
+			if v == value {
+				return nil
+			}
+		}
+		return fmt.Errorf("value %g is not one of %v", value, limit.Values)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+)
+
+func TestModbusHandlerLimits(t *testing.T) {
+	max := 80.0
+	tests := []struct {
+		name    string
+		device  string
+		request string
+		err     string
+	}{
+		{"within limits", "plc", "0 1 0 192.0.2.10 502 5 1 16 100 2 7,80", ""},
+		{"above the maximum", "plc", "0 1 0 192.0.2.10 502 5 1 16 100 2 7,81", "register 101: value 81 is above the maximum 80"},
+		{"typed value starting at the register", "plc", "0 1 0 192.0.2.10 502 5 1 16 101 2 int32:80", ""},
+		{"string covering the register", "plc", "0 1 0 192.0.2.10 502 5 1 16 101 1 AB type=string", "register 101: string writes are not allowed"},
+		{"string not covering the register", "plc", "0 1 0 192.0.2.10 502 5 1 16 99 2 ABCD type=string", ""},
+		{"typed value inside the register", "plc", "0 1 0 192.0.2.10 502 5 1 16 100 2 int32:16706", "register 101: writes of values not starting"},
+		{"second typed value inside the register", "plc", "0 1 0 192.0.2.10 502 5 1 16 98 4 int32:0,16706", "register 101: writes of values not starting"},
+		{"other device at the target", "meter", "0 1 0 192.0.2.10 502 5 1 16 100 2 7,81", "register 101: value 81 is above the maximum 80"},
+		{"unregistered device at the target", "plc2", "0 1 0 192.0.2.10 502 5 1 16 100 2 7,81", "register 101: value 81 is above the maximum 80"},
+		{"other unit at the target", "meter", "0 1 0 192.0.2.10 502 5 2 16 100 2 7,81", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &ModbusHandler{
+				Connect: NewSimulatedDevice(1000).Connect,
+				Devices: map[string]config.DeviceConfig{
+					"plc":   {Address: "192.0.2.10", UnitID: 1, Limits: []config.WriteLimit{{Register: 101, Max: &max}}},
+					"meter": {Address: "192.0.2.20"},
+				},
+			}
+			resp := h.HandleResponse(context.Background(), tt.device, tt.request)
+			switch {
+			case tt.err == "" && resp.Err != nil:
+				t.Errorf("write rejected: %v", resp.Err)
+			case tt.err != "" && (resp.Err == nil || !strings.Contains(resp.Err.Error(), tt.err)):
+				t.Errorf("error %v, expected %q", resp.Err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// LuaHooks implements RequestHooks with the functions of a Lua script:
+//
+//	function before(device, request) -- nil to execute the request as is, the
+//	                                 -- request to execute, or nil, reason to block it
+//	function after(device, request, response) -- nil or the response to return
+//
+// Both functions are optional. The scripts have the base, table, string and
+// math libraries. Each concurrent request runs in its own interpreter, so
+// globals must not be used to share state between requests.
+type LuaHooks struct {
+	proto   *lua.FunctionProto
+	timeout time.Duration
+	states  sync.Pool // Idle interpreters with the script loaded
+}
+
+// luaLibs are the libraries opened for the scripts
+var luaLibs = []struct {
+	name string
+	open lua.LGFunction
+}{
+	{lua.BaseLibName, lua.OpenBase},
+	{lua.TabLibName, lua.OpenTable},
+	{lua.StringLibName, lua.OpenString},
+	{lua.MathLibName, lua.OpenMath},
+}
+
+// NewLuaHooks compiles and loads the Lua script of the configuration
+func NewLuaHooks(cfg config.ScriptConfig) (*LuaHooks, error) {
+	source, err := os.ReadFile(cfg.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Lua script: %w", err)
+	}
+	chunk, err := parse.Parse(bytes.NewReader(source), cfg.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse Lua script: %w", err)
+	}
+	proto, err := lua.Compile(chunk, cfg.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile Lua script: %w", err)
+	}
+
+	h := &LuaHooks{proto: proto, timeout: cfg.Timeout}
+	if h.timeout <= 0 {
+		h.timeout = 100 * time.Millisecond
+	}
+	L, err := h.newState() // Report errors of the script body now rather than on the first request
+	if err != nil {
+		return nil, fmt.Errorf("failed to load Lua script: %w", err)
+	}
+	h.states.Put(L)
+	return h, nil
+}
+
+// newState creates an interpreter and runs the script in it
+func (h *LuaHooks) newState() (*lua.LState, error) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range luaLibs {
+		if err := L.CallByParam(lua.P{Fn: L.NewFunction(lib.open), Protect: true}, lua.LString(lib.name)); err != nil {
+			L.Close()
+			return nil, err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+	L.SetContext(ctx)
+	defer L.RemoveContext()
+
+	L.Push(L.NewFunctionFromProto(h.proto))
+	if err := L.PCall(0, 0, nil); err != nil {
+		L.Close()
+		return nil, err
+	}
+	return L, nil
+}
+
+// call calls a function of the script, if defined, and returns its first two
+// results. An interpreter whose call failed, e.g. timed out, is discarded.
+func (h *LuaHooks) call(ctx context.Context, name string, args ...string) (lua.LValue, lua.LValue, error) {
+	L, _ := h.states.Get().(*lua.LState)
+	if L == nil {
+		var err error
+		if L, err = h.newState(); err != nil {
+			return lua.LNil, lua.LNil, fmt.Errorf("SCRIPT_ERROR: %v", err)
+		}
+	}
+
+	fn := L.GetGlobal(name)
+	if fn.Type() != lua.LTFunction {
+		h.states.Put(L)
+		return lua.LNil, lua.LNil, nil
+	}
+
+	values := make([]lua.LValue, len(args))
+	for i, arg := range args {
+		values[i] = lua.LString(arg)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+	L.SetContext(ctx)
+	err := L.CallByParam(lua.P{Fn: fn, NRet: 2, Protect: true}, values...)
+	L.RemoveContext()
+	if err != nil {
+		L.Close()
+		if apiErr, ok := err.(*lua.ApiError); ok {
+			return lua.LNil, lua.LNil, fmt.Errorf("SCRIPT_ERROR: %s: %s", name, apiErr.Object) // Without the stack traceback
+		}
+		return lua.LNil, lua.LNil, fmt.Errorf("SCRIPT_ERROR: %s: %v", name, err)
+	}
+
+	first, second := L.Get(-2), L.Get(-1)
+	L.Pop(2)
+	h.states.Put(L)
+	return first, second, nil
+}
+
+// Before calls the before function of the script
+func (h *LuaHooks) Before(ctx context.Context, device string, payload string) (string, error) {
+	request, reason, err := h.call(ctx, "before", device, payload)
+	switch {
+	case err != nil:
+		return "", err
+	case request.Type() == lua.LTString:
+		return request.String(), nil
+	case reason != lua.LNil:
+		return "", fmt.Errorf("BLOCKED: %s", reason.String())
+	case request == lua.LFalse:
+		return "", fmt.Errorf("BLOCKED: by the before hook")
+	}
+	return payload, nil
+}
+
+// After calls the after function of the script
+func (h *LuaHooks) After(ctx context.Context, device string, payload string, response string) (string, error) {
+	result, _, err := h.call(ctx, "after", device, payload, response)
+	if err != nil {
+		return "", err
+	}
+	if result.Type() == lua.LTString {
+		return result.String(), nil
+	}
+	return response, nil
+}
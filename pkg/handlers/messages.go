@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/simonvetter/modbus"
+)
+
+// mappableError is an error condition that can be reported with a custom
+// message
+type mappableError struct {
+	key string
+	err error
+}
+
+// mappableErrors are the error conditions accepted as error_messages keys,
+// Modbus exceptions by their exception code and library errors by name.
+// Timeouts also cover network timeouts, see resultQuality.
+var mappableErrors = []mappableError{
+	{"1", modbus.ErrIllegalFunction},
+	{"2", modbus.ErrIllegalDataAddress},
+	{"3", modbus.ErrIllegalDataValue},
+	{"4", modbus.ErrServerDeviceFailure},
+	{"5", modbus.ErrAcknowledge},
+	{"6", modbus.ErrServerDeviceBusy},
+	{"8", modbus.ErrMemoryParityError},
+	{"10", modbus.ErrGWPathUnavailable},
+	{"11", modbus.ErrGWTargetFailedToRespond},
+	{"timeout", modbus.ErrRequestTimedOut},
+	{"bad-crc", modbus.ErrBadCRC},
+	{"short-frame", modbus.ErrShortFrame},
+	{"protocol-error", modbus.ErrProtocolError},
+	{"bad-unit-id", modbus.ErrBadUnitId},
+	{"bad-transaction-id", modbus.ErrBadTransactionId},
+	{"unknown-protocol-id", modbus.ErrUnknownProtocolId},
+	{"unexpected-parameters", modbus.ErrUnexpectedParameters},
+	{"configuration-error", modbus.ErrConfigurationError},
+	{"protocol-mismatch", ErrProtocolMismatch},
+}
+
+// CheckErrorMessages checks the keys of custom messages reported in place of
+// error reasons, see JSONHandler.Messages
+func CheckErrorMessages(messages map[string]string) error {
+	for key := range messages {
+		known := false
+		for _, m := range mappableErrors {
+			if m.key == key {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("error_messages: unknown error %q", key)
+		}
+	}
+
+	return nil
+}
+
+// customMessage returns the custom message of an error reported with a
+// reason, and whether there is one. The placeholder {error} in a message is
+// replaced by the reason.
+func customMessage(messages map[string]string, err error, reason string) (string, bool) {
+	for _, m := range mappableErrors {
+		matched := errors.Is(err, m.err)
+		if m.key == "timeout" {
+			matched = resultQuality(err) == QualityTimeout
+		}
+		if !matched {
+			continue
+		}
+		if message, ok := messages[m.key]; ok {
+			return strings.ReplaceAll(message, "{error}", reason), true
+		}
+		return "", false
+	}
+	return "", false
+}
+
+// withMessages returns a response, and the results of a batch, with the
+// custom messages reported in place of the error reasons
+func withMessages(messages map[string]string, resp *Response) *Response {
+	if len(messages) == 0 || resp == nil {
+		return resp
+	}
+
+	mapped := *resp
+	if resp.Err != nil {
+		if message, ok := customMessage(messages, resp.Err, resp.Error); ok {
+			mapped.Error = message
+		}
+	}
+	if resp.Results != nil {
+		mapped.Results = make([]*Response, len(resp.Results))
+		for i, result := range resp.Results {
+			mapped.Results[i] = withMessages(messages, result)
+		}
+	}
+	return &mapped
+}
@@ -0,0 +1,34 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// ErrProtocolMismatch is reported when a device returns more or fewer values
+// than requested, e.g. a buggy device silently truncating a read
+var ErrProtocolMismatch = errors.New("PROTOCOL_MISMATCH")
+
+// protocolMismatches counts the responses rejected with ErrProtocolMismatch
+var protocolMismatches uint64
+
+// ProtocolMismatches returns the number of responses rejected because their
+// value count did not match the request
+func ProtocolMismatches() uint64 {
+	return atomic.LoadUint64(&protocolMismatches)
+}
+
+// checkCount verifies that a read returned the requested number of values
+func checkCount(values int, count uint16) error {
+	if values == int(count) {
+		return nil
+	}
+
+	atomic.AddUint64(&protocolMismatches, 1)
+	kind := "short"
+	if values > int(count) {
+		kind = "long"
+	}
+	return fmt.Errorf("%w: %s response with %d values, requested %d", ErrProtocolMismatch, kind, values, count)
+}
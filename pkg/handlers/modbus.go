@@ -0,0 +1,582 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ganehag/open-modbus-goateway/internal/storage"
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+	"github.com/ganehag/open-modbus-goateway/pkg/failure"
+	"github.com/ganehag/open-modbus-goateway/pkg/metrics"
+	"github.com/simonvetter/modbus"
+)
+
+// ModbusHandler implements the Handler interface for Modbus devices
+type ModbusHandler struct {
+	Devices map[string]config.DeviceConfig // Per-device settings keyed by device name
+	Serial  map[string]config.SerialConfig // Serial ports referenced by devices
+	Connect ConnectFunc                    // Opens the connection for a request, defaults to Modbus TCP
+	Open    OpenFunc                       // Creates the Modbus TCP and RTU clients, defaults to OpenClient
+	Pool    config.ConnectionPoolConfig    // Reuse of Modbus TCP connections across requests
+	Retry   config.RetryConfig             // Retries of transient failures, unless set for the device
+	TCP     config.TCPConfig               // Dial options of Modbus TCP connections, unless set for the device
+	DNS     config.DNSConfig               // Resolution of the host names of targets
+	Cache   config.ReadCacheConfig         // Recent reads answering requests with a max_age option
+	Metrics metrics.Sink                   // Sink of the metrics of the executed commands, dropped if nil
+	Limits  config.RequestLimitsConfig     // Bounds on the registers and coils of a request, the Modbus read limits where unset
+
+	mu          sync.Mutex
+	pool        *connPool               // Open Modbus TCP connections, if pooling is enabled
+	resolver    *resolver               // Cached addresses of the host names of targets
+	pipelines   map[string]*pipeline    // Shared connections of devices with pipelining
+	serialLines map[string]*serialLine  // Timing state of the serial ports in use
+	pacers      map[string]*targetPacer // Transaction pacing keyed by target
+	queues      map[string]*deviceQueue // Concurrency limits keyed by target
+	values      map[valueKey]knownValue // Last-known register values of devices with interlocks
+	reads       map[string]*sharedRead  // Executing reads of devices with dedupe_reads, keyed by readKey
+	cache       storage.Store           // Recent reads keyed by cacheKey, if caching is enabled
+}
+
+// ModbusClient is the subset of the Modbus client operations used to execute
+// requests, implemented by *modbus.ModbusClient and simulated devices
+type ModbusClient interface {
+	SetUnitId(id uint8) error
+	ReadCoils(addr uint16, quantity uint16) ([]bool, error)
+	ReadDiscreteInputs(addr uint16, quantity uint16) ([]bool, error)
+	ReadRegisters(addr uint16, quantity uint16, regType modbus.RegType) ([]uint16, error)
+	ReadRegister(addr uint16, regType modbus.RegType) (uint16, error)
+	WriteCoil(addr uint16, value bool) error
+	WriteCoils(addr uint16, values []bool) error
+	WriteRegister(addr uint16, value uint16) error
+	WriteRegisters(addr uint16, values []uint16) error
+	Close() error
+}
+
+// ConnectFunc opens a client connection to the target of a request
+type ConnectFunc func(req *ModbusRequest) (ModbusClient, error)
+
+// ClientConfig is the target of a Modbus client created by an OpenFunc
+type ClientConfig struct {
+	URL     string               // tcp://host:port, or rtu:// followed by the serial device
+	Timeout time.Duration        // Timeout of each transaction
+	Serial  *config.SerialConfig // Line settings of rtu:// targets
+}
+
+// OpenFunc creates a Modbus client for a target and opens its connection.
+// Unlike a ConnectFunc, it leaves the pooling, queueing and pacing of the
+// connections to the handler, so another Modbus library, or a fake recording
+// the calls in tests, can replace the default one. Targets with dial options
+// or pipelining are reached by the Modbus TCP client of the gateway instead.
+type OpenFunc func(cfg ClientConfig) (ModbusClient, error)
+
+// verifiedResult is the response value of a write verified by read-back
+const verifiedResult = "VERIFIED"
+
+// Handle processes the incoming payload, performs Modbus operations, and returns a response
+func (h *ModbusHandler) Handle(ctx context.Context, device string, payload string) string {
+	return TextEncoder{}.Encode(h.HandleResponse(ctx, device, payload))
+}
+
+// HandleResponse processes the incoming payload like Handle and returns the
+// structured response
+func (h *ModbusHandler) HandleResponse(ctx context.Context, device string, payload string) *Response {
+	// Parse and validate the request payload
+	requests, err := parseBatch(payload)
+	if err != nil {
+		log.Printf("Invalid request: %v", err)
+		return newResponse(0, nil, failure.Wrap(failure.ErrParse, err)) // If cookie is invalid, default to 0
+	}
+	for i, r := range requests {
+		if err := checkRequestLimits(h.Limits, r); err != nil {
+			if i > 0 {
+				err = fmt.Errorf("command %d: %v", i, err)
+			}
+			log.Printf("Invalid request: %v", err)
+			return newResponse(requests[0].Cookie, nil, failure.Wrap(failure.ErrParse, err))
+		}
+	}
+	request := requests[0]
+
+	// Apply per-device defaults for settings not given in the request
+	for _, r := range requests {
+		if err := h.applyDeviceDefaults(device, r); err != nil {
+			log.Printf("Invalid request for device %s: %v", device, err)
+			return newResponse(request.Cookie, nil, err)
+		}
+		if err := h.checkWrite(device, r); err != nil {
+			log.Printf("Rejected write: %v", err)
+			return newResponse(request.Cookie, nil, err)
+		}
+	}
+
+	// Execute all commands of a batch over one connection. Only connecting is
+	// retried, as the commands may have been executed in part. Each command
+	// adds its timeout to the deadline of the batch.
+	if len(requests) > 1 {
+		ctx, cancel := context.WithTimeout(ctx, time.Duration(len(requests))*request.Timeout)
+		defer cancel()
+
+		start := time.Now()
+		var client ModbusClient
+		err := h.withRetry(ctx, device, request, func() error {
+			var err error
+			client, err = h.connect(ctx, device, request)
+			return err
+		})
+		connectTime := time.Since(start)
+		for _, r := range requests {
+			r.connectTime, r.retries = connectTime, request.retries
+		}
+		if err != nil {
+			log.Printf("Modbus batch failed: %v", err)
+			resp := newResult(request.Cookie, request, nil, err)
+			h.observe(device, requests, resp)
+			return resp
+		}
+		defer client.Close()
+
+		execute := func(r *ModbusRequest) ([]string, error) {
+			return executeOn(client, r)
+		}
+		if gap := h.Devices[device].CoalesceGap; gap != nil {
+			execute = newCoalescer(client, requests, *gap).execute
+		}
+		resp := executeBatch(requests, func(r *ModbusRequest) ([]string, error) {
+			if err := ctx.Err(); err != nil {
+				return nil, err // Don't start the remaining commands
+			}
+			return execute(r)
+		})
+		h.observe(device, requests, resp)
+		return resp
+	}
+
+	// Perform Modbus query, unless a cached result is young enough for the
+	// request, sharing the transaction of an identical read executing
+	// concurrently if enabled for the device
+	var response []string
+	if words, ok := h.cachedWords(device, request); ok {
+		response, err = decodeWords(request, words)
+	} else if h.Devices[device].DedupeReads && isDedupable(request) {
+		response, err = h.executeShared(ctx, device, readKey(device, payload), request)
+	} else {
+		response, err = h.executeModbusQuery(ctx, device, request)
+	}
+	if err != nil {
+		log.Printf("Modbus query failed: %v", err)
+	}
+	// Construct the response
+	resp := newResult(request.Cookie, request, response, err)
+	h.observe(device, requests, resp)
+	return resp
+}
+
+// applyDeviceDefaults fills in request settings that were not given in the
+// payload from the configuration of the addressed device
+func (h *ModbusHandler) applyDeviceDefaults(device string, req *ModbusRequest) error {
+	return applyDeviceDefaults(device, h.Devices[device], req)
+}
+
+// applyDeviceDefaults fills in request settings that were not given in the
+// payload from the configuration d of the device
+func applyDeviceDefaults(device string, d config.DeviceConfig, req *ModbusRequest) error {
+	if err := applyDeviceTarget(device, d, req); err != nil {
+		return err
+	}
+
+	if req.ByteOrder == "" && d.ByteOrder != "" {
+		order, err := parseByteOrder(d.ByteOrder)
+		if err != nil {
+			return fmt.Errorf("device %s: %v", device, err)
+		}
+		req.ByteOrder = order
+	}
+
+	if d.Timestamp {
+		req.Timestamp = true
+	}
+	if d.Quality {
+		req.Quality = true
+	}
+	if d.Diagnostics {
+		req.Diagnostics = true
+	}
+	req.PostProcess = d.PostProcess
+
+	return nil
+}
+
+// applyDeviceTarget fills in the transport fields given as "-" from the
+// device registry, and rejects requests for which they remain unset
+func applyDeviceTarget(device string, d config.DeviceConfig, req *ModbusRequest) error {
+	if d.Address != "" && (req.IPAddress == "" || req.Port == 0) {
+		host, port, err := config.SplitAddress(d.Address)
+		if err != nil {
+			return fmt.Errorf("device %s: %v", device, err)
+		}
+		if req.IPAddress == "" {
+			req.IPAddress = host
+		}
+		if req.Port == 0 {
+			req.Port = port
+		}
+	}
+	if req.Timeout == 0 {
+		req.Timeout = d.Timeout
+	}
+	if req.SlaveID == 0 {
+		req.SlaveID = d.UnitID
+	}
+
+	switch {
+	case d.Serial == "" && req.IPAddress == "":
+		return fmt.Errorf("invalid IP value: not given and device %q has no address", device)
+	case d.Serial == "" && req.Port == 0:
+		return fmt.Errorf("invalid PORT value: not given and device %q has no address", device)
+	case req.Timeout == 0:
+		return fmt.Errorf("invalid TIMEOUT value: not given and device %q has no timeout", device)
+	case req.SlaveID == 0:
+		return fmt.Errorf("invalid SLAVE_ID value: not given and device %q has no unit_id", device)
+	}
+	return nil
+}
+
+// executeModbusQuery executes a single request, retrying transient failures
+// as configured for the device
+func (h *ModbusHandler) executeModbusQuery(ctx context.Context, device string, req *ModbusRequest) ([]string, error) {
+	var results []string
+	err := h.withRetry(ctx, device, req, func() error {
+		var err error
+		results, err = h.executeOnce(ctx, device, req)
+		return err
+	})
+	return results, err
+}
+
+// executeOnce executes a single request over a new connection, within the
+// timeout of the request
+func (h *ModbusHandler) executeOnce(ctx context.Context, device string, req *ModbusRequest) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, req.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	client, err := h.connect(ctx, device, req)
+	req.connectTime = time.Since(start)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	start = time.Now()
+	defer func() { req.turnaround = time.Since(start) }()
+	return executeOn(client, req)
+}
+
+// connect opens the connection for a request to the device, over its serial
+// port if it has one, limited by the queue of its target and paced as
+// configured for the device
+func (h *ModbusHandler) connect(ctx context.Context, device string, req *ModbusRequest) (ModbusClient, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	connect := h.Connect
+	if connect == nil {
+		connect = func(req *ModbusRequest) (ModbusClient, error) { return h.connectTCP(ctx, device, req) }
+	}
+
+	var client ModbusClient
+	var err error
+	d := h.Devices[device]
+	if h.Connect == nil && d.Serial != "" {
+		client, err = h.connectSerial(d.Serial, req)
+	} else {
+		client, err = h.connectQueued(ctx, d, req, connect)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	client = h.pace(device, req, client)
+	if h.hasInterlocks(device, req) {
+		client = &recordingClient{ModbusClient: client, handler: h, target: targetKey(d.Serial, req), unit: req.SlaveID}
+	}
+	if h.Cache.Size > 0 {
+		client = &cachingClient{ModbusClient: client, handler: h, target: targetKey(d.Serial, req), unit: req.SlaveID}
+	}
+	return client, nil
+}
+
+// targetKey identifies the physical target of a request: the serial port of
+// the device, or the address given in the request
+func targetKey(serial string, req *ModbusRequest) string {
+	if serial != "" {
+		return "serial:" + serial
+	}
+	return net.JoinHostPort(req.IPAddress, strconv.Itoa(int(req.Port)))
+}
+
+// ConnectTCP creates a Modbus TCP client for the target of the request and
+// opens the connection
+func ConnectTCP(req *ModbusRequest) (ModbusClient, error) {
+	return openTCP(OpenClient, req)
+}
+
+// openTCP opens a Modbus TCP client for the target of the request
+func openTCP(open OpenFunc, req *ModbusRequest) (ModbusClient, error) {
+	client, err := open(ClientConfig{
+		URL:     "tcp://" + net.JoinHostPort(req.IPAddress, strconv.Itoa(int(req.Port))),
+		Timeout: req.Timeout,
+	})
+	if err != nil {
+		return nil, failure.Wrap(failure.ErrConnUnreachable, fmt.Errorf("failed to connect to Modbus server: %w", err))
+	}
+	return client, nil
+}
+
+// OpenClient implements OpenFunc with the simonvetter/modbus library
+func OpenClient(cfg ClientConfig) (ModbusClient, error) {
+	mc := &modbus.ClientConfiguration{URL: cfg.URL, Timeout: cfg.Timeout}
+	if s := cfg.Serial; s != nil {
+		mc.Speed = s.Baud
+		mc.DataBits = s.DataBits
+		mc.Parity = serialParities[s.Parity]
+		mc.StopBits = s.StopBits
+	}
+
+	// Create the Modbus client
+	client, err := modbus.NewClient(mc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Modbus client: %w", err)
+	}
+
+	// Open the connection to the Modbus device
+	if err := client.Open(); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// open returns the OpenFunc of the handler
+func (h *ModbusHandler) open() OpenFunc {
+	if h.Open != nil {
+		return h.Open
+	}
+	return OpenClient
+}
+
+// executeOn performs the request on an open Modbus client
+func executeOn(client ModbusClient, req *ModbusRequest) ([]string, error) {
+	var err error
+
+	// Set the Slave ID (Unit ID)
+	client.SetUnitId(req.SlaveID)
+
+	// Variable to store the results
+	var results []uint16
+
+	// Handle each supported function code
+	switch req.FunctionCode {
+	case 1, 2, 3, 4: // Reading functions
+		if req.HasBit {
+			results, err = readRegisterBits(client, req)
+		} else {
+			results, err = readRaw(client, req.FunctionCode, req.RegisterAddress, req.RegisterCount)
+			if err == nil {
+				err = postProcess(req, results)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	case 5: // Write Single Coil (0x05)
+		// Convert uint16 to bool for writing a single coil
+		value := req.Data[0] != 0
+		err = client.WriteCoil(req.RegisterAddress, value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to write single coil: %w", err)
+		}
+	case 6: // Write Single Register (0x06)
+		if req.HasBit {
+			err = writeRegisterBit(client, req)
+		} else {
+			err = client.WriteRegister(req.RegisterAddress, req.Data[0])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to write single register: %w", err)
+		}
+	case 15: // Write Multiple Coils (0x0F)
+		// Convert []uint16 to []bool for writing multiple coils
+		bitValues := make([]bool, len(req.Data))
+		for i, v := range req.Data {
+			bitValues[i] = v != 0
+		}
+		err = client.WriteCoils(req.RegisterAddress, bitValues)
+		if err != nil {
+			return nil, fmt.Errorf("failed to write multiple coils: %w", err)
+		}
+	case 16: // Write Multiple Registers (0x10)
+		err = client.WriteRegisters(req.RegisterAddress, wireData(req))
+		if err != nil {
+			return nil, fmt.Errorf("failed to write multiple registers: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported function code: %d", req.FunctionCode)
+	}
+
+	if req.Verify {
+		if err := verifyWrite(client, req); err != nil {
+			return nil, err
+		}
+		return []string{verifiedResult}, nil
+	}
+
+	// Decode and format results into strings
+	return formatResults(req, results)
+}
+
+// verifyWrite reads the written coils or registers back and compares them
+// with the written values
+func verifyWrite(client ModbusClient, req *ModbusRequest) error {
+	expected := req.Data
+	var function uint8 = 3
+	switch req.FunctionCode {
+	case 5, 15:
+		function = 1
+		expected = make([]uint16, len(req.Data))
+		for i, v := range req.Data {
+			if v != 0 {
+				expected[i] = 1
+			}
+		}
+	case 16:
+		expected = wireData(req)
+	}
+
+	actual, err := readRaw(client, function, req.RegisterAddress, uint16(len(expected)))
+	if err != nil {
+		return fmt.Errorf("verification read failed: %w", err)
+	}
+
+	if req.HasBit {
+		bit := (actual[0] >> req.Bit) & 1
+		if bit != expected[0] {
+			return fmt.Errorf("verification failed: register %d.%d reads %d, wrote %d", req.RegisterAddress+1, req.Bit, bit, expected[0])
+		}
+		return nil
+	}
+
+	for i := range expected {
+		if actual[i] != expected[i] {
+			return fmt.Errorf("verification failed: register %d reads %d, wrote %d", uint32(req.RegisterAddress)+uint32(i)+1, actual[i], expected[i])
+		}
+	}
+
+	return nil
+}
+
+// readRaw performs a read function and returns the values as uint16,
+// with coils and discrete inputs converted to 1 or 0
+func readRaw(client ModbusClient, function uint8, address uint16, count uint16) ([]uint16, error) {
+	switch function {
+	case 1, 2:
+		var bits []bool
+		var err error
+		if function == 1 {
+			// Read Coils (0x01)
+			bits, err = client.ReadCoils(address, count)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read coils: %w", err)
+			}
+		} else {
+			// Read Discrete Inputs (0x02)
+			bits, err = client.ReadDiscreteInputs(address, count)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read discrete inputs: %w", err)
+			}
+		}
+		if err := checkCount(len(bits), count); err != nil {
+			return nil, err
+		}
+		return bitWords(bits), nil
+	case 3: // Read Holding Registers (0x03)
+		results, err := client.ReadRegisters(address, count, modbus.HOLDING_REGISTER)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read holding registers: %w", err)
+		}
+		if err := checkCount(len(results), count); err != nil {
+			return nil, err
+		}
+		return results, nil
+	case 4: // Read Input Registers (0x04)
+		results, err := client.ReadRegisters(address, count, modbus.INPUT_REGISTER)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read input registers: %w", err)
+		}
+		if err := checkCount(len(results), count); err != nil {
+			return nil, err
+		}
+		return results, nil
+	default:
+		return nil, fmt.Errorf("unsupported read function code: %d", function)
+	}
+}
+
+// readRegisterBits reads RegisterCount consecutive bits starting at the
+// requested bit of the requested register, spanning into the following
+// registers as needed. Each bit is returned as 1 or 0.
+func readRegisterBits(client ModbusClient, req *ModbusRequest) ([]uint16, error) {
+	registers := req.span()
+	if registers > 0xffff {
+		return nil, fmt.Errorf("bit range exceeds register space")
+	}
+
+	words, err := readRaw(client, req.FunctionCode, req.RegisterAddress, uint16(registers))
+	if err != nil {
+		return nil, err
+	}
+	if err := postProcess(req, words); err != nil {
+		return nil, err
+	}
+
+	return extractBits(words, req), nil
+}
+
+// extractBits picks the requested bits of a bit read from the register words
+// starting at the requested register
+func extractBits(words []uint16, req *ModbusRequest) []uint16 {
+	results := make([]uint16, req.RegisterCount)
+	for i := range results {
+		pos := int(req.Bit) + i
+		results[i] = (words[pos/16] >> (pos % 16)) & 1
+	}
+
+	return results
+}
+
+// writeRegisterBit sets or clears a single bit of a holding register using
+// a read-modify-write sequence. The sequence is not atomic: a concurrent
+// writer on the device may change the register in between.
+func writeRegisterBit(client ModbusClient, req *ModbusRequest) error {
+	current, err := client.ReadRegister(req.RegisterAddress, modbus.HOLDING_REGISTER)
+	if err != nil {
+		return fmt.Errorf("read-modify-write read failed: %w", err)
+	}
+
+	mask := uint16(1) << req.Bit
+	updated := current &^ mask
+	if req.Data[0] != 0 {
+		updated |= mask
+	}
+
+	if updated == current {
+		return nil // Bit already has the requested value
+	}
+
+	return client.WriteRegister(req.RegisterAddress, updated)
+}
@@ -0,0 +1,244 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+	"github.com/simonvetter/modbus"
+)
+
+// fakeClient records the calls made on a simulated device
+type fakeClient struct {
+	device *SimulatedDevice
+	calls  *[]string
+}
+
+// fakeOpen returns an OpenFunc of fake clients of one simulated device,
+// recording the opened targets and the calls
+func fakeOpen(device *SimulatedDevice, calls *[]string) OpenFunc {
+	return func(cfg ClientConfig) (ModbusClient, error) {
+		open := fmt.Sprintf("Open %s %v", cfg.URL, cfg.Timeout)
+		if cfg.Serial != nil {
+			open += fmt.Sprintf(" %d %s", cfg.Serial.Baud, cfg.Serial.Parity)
+		}
+		*calls = append(*calls, open)
+		return &fakeClient{device: device, calls: calls}, nil
+	}
+}
+
+func (c *fakeClient) record(format string, args ...any) {
+	*c.calls = append(*c.calls, fmt.Sprintf(format, args...))
+}
+
+func regTypeName(regType modbus.RegType) string {
+	if regType == modbus.INPUT_REGISTER {
+		return "input"
+	}
+	return "holding"
+}
+
+func (c *fakeClient) SetUnitId(id uint8) error {
+	c.record("SetUnitId %d", id)
+	return c.device.SetUnitId(id)
+}
+
+func (c *fakeClient) ReadCoils(addr uint16, quantity uint16) ([]bool, error) {
+	c.record("ReadCoils %d %d", addr, quantity)
+	return c.device.ReadCoils(addr, quantity)
+}
+
+func (c *fakeClient) ReadDiscreteInputs(addr uint16, quantity uint16) ([]bool, error) {
+	c.record("ReadDiscreteInputs %d %d", addr, quantity)
+	return c.device.ReadDiscreteInputs(addr, quantity)
+}
+
+func (c *fakeClient) ReadRegisters(addr uint16, quantity uint16, regType modbus.RegType) ([]uint16, error) {
+	c.record("ReadRegisters %d %d %s", addr, quantity, regTypeName(regType))
+	return c.device.ReadRegisters(addr, quantity, regType)
+}
+
+func (c *fakeClient) ReadRegister(addr uint16, regType modbus.RegType) (uint16, error) {
+	c.record("ReadRegister %d %s", addr, regTypeName(regType))
+	return c.device.ReadRegister(addr, regType)
+}
+
+func (c *fakeClient) WriteCoil(addr uint16, value bool) error {
+	c.record("WriteCoil %d %t", addr, value)
+	return c.device.WriteCoil(addr, value)
+}
+
+func (c *fakeClient) WriteCoils(addr uint16, values []bool) error {
+	c.record("WriteCoils %d %v", addr, values)
+	return c.device.WriteCoils(addr, values)
+}
+
+func (c *fakeClient) WriteRegister(addr uint16, value uint16) error {
+	c.record("WriteRegister %d %d", addr, value)
+	return c.device.WriteRegister(addr, value)
+}
+
+func (c *fakeClient) WriteRegisters(addr uint16, values []uint16) error {
+	c.record("WriteRegisters %d %v", addr, values)
+	return c.device.WriteRegisters(addr, values)
+}
+
+func (c *fakeClient) Close() error {
+	c.record("Close")
+	return nil
+}
+
+func TestModbusHandlerCalls(t *testing.T) {
+	tests := []struct {
+		name     string
+		device   string
+		request  string
+		response string
+		calls    []string
+	}{
+		{
+			name:     "read holding registers",
+			request:  "0 1 0 192.0.2.10 502 5 7 3 101 2",
+			response: "1 OK 100 101",
+			calls:    []string{"Open tcp://192.0.2.10:502 5s", "SetUnitId 7", "ReadRegisters 100 2 holding", "Close"},
+		},
+		{
+			name:     "read input registers",
+			request:  "0 1 0 192.0.2.10 502 5 1 4 1 1",
+			response: "1 OK 0",
+			calls:    []string{"Open tcp://192.0.2.10:502 5s", "SetUnitId 1", "ReadRegisters 0 1 input", "Close"},
+		},
+		{
+			name:     "read discrete inputs",
+			request:  "0 1 0 192.0.2.10 502 5 1 2 1 2",
+			response: "1 OK 0 1",
+			calls:    []string{"Open tcp://192.0.2.10:502 5s", "SetUnitId 1", "ReadDiscreteInputs 0 2", "Close"},
+		},
+		{
+			name:     "write single coil",
+			request:  "0 1 0 192.0.2.10 502 5 1 5 10 on",
+			response: "1 OK",
+			calls:    []string{"Open tcp://192.0.2.10:502 5s", "SetUnitId 1", "WriteCoil 9 true", "Close"},
+		},
+		{
+			name:     "write multiple coils",
+			request:  "0 1 0 192.0.2.10 502 5 1 15 1 3 on,off,1",
+			response: "1 OK",
+			calls:    []string{"Open tcp://192.0.2.10:502 5s", "SetUnitId 1", "WriteCoils 0 [true false true]", "Close"},
+		},
+		{
+			name:     "write multiple registers",
+			request:  "0 1 0 192.0.2.10 502 5 1 16 101 2 7,8",
+			response: "1 OK",
+			calls:    []string{"Open tcp://192.0.2.10:502 5s", "SetUnitId 1", "WriteRegisters 100 [7 8]", "Close"},
+		},
+		{
+			name:     "write register bit",
+			request:  "0 1 0 192.0.2.10 502 5 1 6 6.1 1",
+			response: "1 OK",
+			calls:    []string{"Open tcp://192.0.2.10:502 5s", "SetUnitId 1", "ReadRegister 5 holding", "WriteRegister 5 7", "Close"},
+		},
+		{
+			name:     "batch over one connection",
+			request:  "0 1 0 192.0.2.10 502 5 1 6 1 9 ; 3 1 1",
+			response: "1 OK 0 OK; 1 OK 9",
+			calls:    []string{"Open tcp://192.0.2.10:502 5s", "SetUnitId 1", "WriteRegister 0 9", "SetUnitId 1", "ReadRegisters 0 1 holding", "Close"},
+		},
+		{
+			name:     "device defaults",
+			device:   "meter",
+			request:  "0 1 0 - - - - 3 1 1",
+			response: "1 OK 0",
+			calls:    []string{"Open tcp://192.0.2.20:1502 2s", "SetUnitId 3", "ReadRegisters 0 1 holding", "Close"},
+		},
+		{
+			name:     "serial device",
+			device:   "rtu",
+			request:  "0 1 0 - - - - 3 1 1",
+			response: "1 OK 0",
+			calls:    []string{"Open rtu:///dev/ttyUSB0 2s 19200 even", "SetUnitId 4", "ReadRegisters 0 1 holding", "Close"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls []string
+			h := &ModbusHandler{
+				Open: fakeOpen(NewSimulatedDevice(1000), &calls),
+				Devices: map[string]config.DeviceConfig{
+					"meter": {Address: "192.0.2.20:1502", UnitID: 3, Timeout: 2 * time.Second},
+					"rtu":   {Serial: "bus", UnitID: 4, Timeout: 2 * time.Second},
+				},
+				Serial: map[string]config.SerialConfig{
+					"bus": {Device: "/dev/ttyUSB0", Baud: 19200, Parity: config.ParityEven},
+				},
+			}
+			if response := h.Handle(context.Background(), tt.device, tt.request); response != tt.response {
+				t.Errorf("response %q, expected %q", response, tt.response)
+			}
+			if !reflect.DeepEqual(calls, tt.calls) {
+				t.Errorf("calls %q, expected %q", calls, tt.calls)
+			}
+		})
+	}
+}
+
+func TestModbusHandlerPooledOpen(t *testing.T) {
+	var calls []string
+	h := &ModbusHandler{Open: fakeOpen(NewSimulatedDevice(1000), &calls), Pool: config.ConnectionPoolConfig{Size: 1}}
+	defer h.Close()
+
+	for i := 0; i < 2; i++ {
+		if response := h.Handle(context.Background(), "", "0 1 0 192.0.2.10 502 5 1 3 1 1"); response != "1 OK 0" {
+			t.Fatalf("response %q", response)
+		}
+	}
+	expected := []string{"Open tcp://192.0.2.10:502 5s", "SetUnitId 1", "ReadRegisters 0 1 holding", "SetUnitId 1", "ReadRegisters 0 1 holding"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("calls %q, expected %q", calls, expected)
+	}
+}
+
+func TestModbusHandlerDrainsMovedTarget(t *testing.T) {
+	var calls []string
+	h := &ModbusHandler{Open: fakeOpen(NewSimulatedDevice(1000), &calls), Pool: config.ConnectionPoolConfig{Size: 1}}
+	defer h.Close()
+
+	// localhost resolved to the address of the pooled connection before
+	h.resolver = &resolver{moved: h.drain, cache: map[string]resolved{"localhost": {ip: "192.0.2.10"}}}
+	for _, request := range []string{"0 1 0 192.0.2.10 502 5 1 3 1 1", "0 1 0 localhost 502 5 1 3 1 1"} {
+		if response := h.Handle(context.Background(), "", request); response != "1 OK 0" {
+			t.Fatalf("response %q", response)
+		}
+	}
+	expected := []string{"Open tcp://192.0.2.10:502 5s", "SetUnitId 1", "ReadRegisters 0 1 holding",
+		"Close", "Open tcp://127.0.0.1:502 5s", "SetUnitId 1", "ReadRegisters 0 1 holding"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("calls %q, expected %q", calls, expected)
+	}
+
+	// Connections in use while their address is drained are closed once returned
+	calls = nil
+	c, err := h.pool.get(context.Background(), &ModbusRequest{IPAddress: "127.0.0.1", Port: 502, Timeout: 5 * time.Second}, config.TCPConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.pool.drain("127.0.0.1")
+	c.Close()
+	if expected := []string{"Close"}; !reflect.DeepEqual(calls, expected) {
+		t.Errorf("calls %q, expected %q", calls, expected)
+	}
+}
+
+func TestModbusHandlerOpenError(t *testing.T) {
+	h := &ModbusHandler{Open: func(cfg ClientConfig) (ModbusClient, error) {
+		return nil, fmt.Errorf("connection refused")
+	}}
+	resp := h.HandleResponse(context.Background(), "", "0 1 0 192.0.2.10 502 5 1 3 1 1")
+	if resp.Err == nil || resp.Err.Error() != "failed to connect to Modbus server: connection refused" {
+		t.Errorf("error %v", resp.Err)
+	}
+}
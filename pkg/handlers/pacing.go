@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+
+	"github.com/simonvetter/modbus"
+)
+
+// pacer delays transactions to respect the timing requirements of a target
+type pacer interface {
+	wait()           // Blocks until the next transaction may start
+	done(write bool) // Records the end of a transaction
+}
+
+// targetPacer enforces a minimum gap between the transactions on a target.
+// Each transaction reserves the next free slot before it starts, so
+// concurrent requests to a target are spaced in turn instead of all waking
+// up at once, and the gap is kept after the end of every transaction.
+type targetPacer struct {
+	mu   sync.Mutex
+	next time.Time // Earliest start of the next transaction
+}
+
+// gapPacer applies the minimum gap of a device to the pacer of its target
+type gapPacer struct {
+	target *targetPacer
+	gap    time.Duration
+}
+
+func (p gapPacer) wait() {
+	p.target.mu.Lock()
+	slot := time.Now()
+	if p.target.next.After(slot) {
+		slot = p.target.next
+	}
+	p.target.next = slot.Add(p.gap)
+	p.target.mu.Unlock()
+
+	time.Sleep(time.Until(slot))
+}
+
+func (p gapPacer) done(bool) {
+	p.target.mu.Lock()
+	if next := time.Now().Add(p.gap); next.After(p.target.next) {
+		p.target.next = next
+	}
+	p.target.mu.Unlock()
+}
+
+// pacedClient runs every transaction through its pacers
+type pacedClient struct {
+	ModbusClient
+	pacers []pacer
+}
+
+func (c *pacedClient) wait() {
+	for _, p := range c.pacers {
+		p.wait()
+	}
+}
+
+func (c *pacedClient) done(write bool) {
+	for _, p := range c.pacers {
+		p.done(write)
+	}
+}
+
+func (c *pacedClient) ReadCoils(addr uint16, quantity uint16) ([]bool, error) {
+	c.wait()
+	defer c.done(false)
+	return c.ModbusClient.ReadCoils(addr, quantity)
+}
+
+func (c *pacedClient) ReadDiscreteInputs(addr uint16, quantity uint16) ([]bool, error) {
+	c.wait()
+	defer c.done(false)
+	return c.ModbusClient.ReadDiscreteInputs(addr, quantity)
+}
+
+func (c *pacedClient) ReadRegisters(addr uint16, quantity uint16, regType modbus.RegType) ([]uint16, error) {
+	c.wait()
+	defer c.done(false)
+	return c.ModbusClient.ReadRegisters(addr, quantity, regType)
+}
+
+func (c *pacedClient) ReadRegister(addr uint16, regType modbus.RegType) (uint16, error) {
+	c.wait()
+	defer c.done(false)
+	return c.ModbusClient.ReadRegister(addr, regType)
+}
+
+func (c *pacedClient) WriteCoil(addr uint16, value bool) error {
+	c.wait()
+	defer c.done(true)
+	return c.ModbusClient.WriteCoil(addr, value)
+}
+
+func (c *pacedClient) WriteCoils(addr uint16, values []bool) error {
+	c.wait()
+	defer c.done(true)
+	return c.ModbusClient.WriteCoils(addr, values)
+}
+
+func (c *pacedClient) WriteRegister(addr uint16, value uint16) error {
+	c.wait()
+	defer c.done(true)
+	return c.ModbusClient.WriteRegister(addr, value)
+}
+
+func (c *pacedClient) WriteRegisters(addr uint16, values []uint16) error {
+	c.wait()
+	defer c.done(true)
+	return c.ModbusClient.WriteRegisters(addr, values)
+}
+
+// pace wraps the client of a device in the pacer of its target, if the device
+// requires a minimum gap between transactions
+func (h *ModbusHandler) pace(device string, req *ModbusRequest, client ModbusClient) ModbusClient {
+	gap := h.Devices[device].MinGap
+	if gap <= 0 {
+		return client
+	}
+
+	h.mu.Lock()
+	if h.pacers == nil {
+		h.pacers = make(map[string]*targetPacer)
+	}
+	target := targetKey(h.Devices[device].Serial, req)
+	p, ok := h.pacers[target]
+	if !ok {
+		p = &targetPacer{}
+		h.pacers[target] = p
+	}
+	h.mu.Unlock()
+
+	if paced, ok := client.(*pacedClient); ok {
+		paced.pacers = append(paced.pacers, gapPacer{target: p, gap: gap})
+		return paced
+	}
+	return &pacedClient{ModbusClient: client, pacers: []pacer{gapPacer{target: p, gap: gap}}}
+}
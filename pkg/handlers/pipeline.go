@@ -0,0 +1,203 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+	"github.com/simonvetter/modbus"
+)
+
+// pipeline is a Modbus TCP connection shared by the requests of a device,
+// with up to depth transactions outstanding at once. Responses are matched
+// to their requests by transaction ID, in any order. A transport failure
+// fails all outstanding transactions and retires the connection.
+type pipeline struct {
+	conn    net.Conn
+	slots   chan struct{} // Outstanding transactions
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	pending map[uint16]chan pipelineResult // Outstanding transactions by ID
+	txID    uint16
+	err     error // Failure that retired the connection
+}
+
+// pipelineResult is the response to an outstanding transaction
+type pipelineResult struct {
+	unitID uint8
+	pdu    []byte
+	err    error
+}
+
+// newPipeline starts reading the responses of a connection
+func newPipeline(conn net.Conn, depth int) *pipeline {
+	p := &pipeline{
+		conn:    conn,
+		slots:   make(chan struct{}, depth),
+		pending: make(map[uint16]chan pipelineResult),
+	}
+	go p.read()
+	return p
+}
+
+// read delivers the responses of the connection until it fails
+func (p *pipeline) read() {
+	for {
+		txID, unitID, pdu, err := readFrame(p.conn)
+		if err != nil {
+			p.fail(err)
+			return
+		}
+
+		p.mu.Lock()
+		ch, ok := p.pending[txID]
+		delete(p.pending, txID)
+		p.mu.Unlock()
+		if ok { // Responses of abandoned transactions are dropped
+			ch <- pipelineResult{unitID: unitID, pdu: pdu}
+		}
+	}
+}
+
+// fail retires the connection, failing the outstanding transactions
+func (p *pipeline) fail(err error) {
+	p.mu.Lock()
+	if p.err == nil {
+		p.err = err
+	}
+	pending := p.pending
+	p.pending = make(map[uint16]chan pipelineResult)
+	p.mu.Unlock()
+
+	p.conn.Close()
+	for _, ch := range pending {
+		ch <- pipelineResult{err: err}
+	}
+}
+
+// failed returns the failure that retired the connection, if any
+func (p *pipeline) failed() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// transaction sends a request PDU once a slot is free and waits for its
+// response until the timeout, or until ctx is done. The shared connection
+// isn't interrupted: the response of an abandoned transaction is dropped.
+func (p *pipeline) transaction(ctx context.Context, unitID uint8, pdu []byte, timeout time.Duration) ([]byte, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case p.slots <- struct{}{}:
+		defer func() { <-p.slots }()
+	case <-timer.C:
+		return nil, modbus.ErrRequestTimedOut
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	ch := make(chan pipelineResult, 1)
+	p.mu.Lock()
+	if p.err != nil {
+		p.mu.Unlock()
+		return nil, p.err
+	}
+	p.txID++
+	for _, taken := p.pending[p.txID]; taken; _, taken = p.pending[p.txID] {
+		p.txID++ // Still awaited after wrapping around
+	}
+	txID := p.txID
+	p.pending[txID] = ch
+	p.mu.Unlock()
+
+	p.writeMu.Lock()
+	p.conn.SetWriteDeadline(time.Now().Add(timeout))
+	_, err := p.conn.Write(mbapFrame(txID, unitID, pdu))
+	p.writeMu.Unlock()
+	if err != nil {
+		err = fmt.Errorf("failed to send request: %w", err)
+		p.fail(err)
+		return nil, err
+	}
+
+	select {
+	case res := <-ch:
+		switch {
+		case res.err != nil:
+			return nil, res.err
+		case res.unitID != unitID:
+			return nil, modbus.ErrBadUnitId
+		}
+		return responsePDU(pdu, res.pdu)
+	case <-timer.C:
+		p.abandon(txID)
+		return nil, modbus.ErrRequestTimedOut
+	case <-ctx.Done():
+		p.abandon(txID)
+		return nil, ctx.Err()
+	}
+}
+
+// abandon stops waiting for the response of a transaction
+func (p *pipeline) abandon(txID uint16) {
+	p.mu.Lock()
+	delete(p.pending, txID)
+	p.mu.Unlock()
+}
+
+// close closes the connection
+func (p *pipeline) close() {
+	p.fail(net.ErrClosed)
+}
+
+// pipelineTransport performs the transactions of a request on a pipeline
+type pipelineTransport struct {
+	pipeline *pipeline
+	timeout  time.Duration
+}
+
+func (t *pipelineTransport) roundTrip(ctx context.Context, unitID uint8, pdu []byte) ([]byte, error) {
+	return t.pipeline.transaction(ctx, unitID, pdu, t.timeout)
+}
+
+// close leaves the shared connection open
+func (t *pipelineTransport) close() error {
+	return nil
+}
+
+// connectPipelined returns a client of the request on the shared connection
+// of the device, dialing it if there is none or it has failed
+func (h *ModbusHandler) connectPipelined(ctx context.Context, device string, depth int, req *ModbusRequest, opts config.TCPConfig) (ModbusClient, error) {
+	key := device + "@" + targetKey("", req)
+
+	h.mu.Lock()
+	p, ok := h.pipelines[key]
+	h.mu.Unlock()
+	if !ok || p.failed() != nil {
+		conn, err := dialConn(ctx, req, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		h.mu.Lock()
+		if current, ok := h.pipelines[key]; ok && current != p && current.failed() == nil {
+			conn.Close() // Dialed concurrently by another request
+			p = current
+		} else {
+			if h.pipelines == nil {
+				h.pipelines = make(map[string]*pipeline)
+			}
+			p = newPipeline(conn, depth)
+			h.pipelines[key] = p
+		}
+		h.mu.Unlock()
+	}
+
+	return &tcpClient{rt: &pipelineTransport{pipeline: p, timeout: req.Timeout}, unitID: 1, ctx: ctx}, nil
+}
@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"fmt"
+	"plugin"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+)
+
+// pluginSymbol is the function a handler plugin exports to create its handler
+// from the options of its configuration. It returns any rather than Handler,
+// so plugins can be built outside of this module, which they can't import
+// the handlers package from.
+const pluginSymbol = "NewHandler"
+
+// pluginFactory is the type of the function exported as pluginSymbol
+type pluginFactory = func(options map[string]string) (any, error)
+
+// LoadPlugins opens the Go plugins of the configuration and registers their
+// handlers under the plugin names. Plugins must be built with the same Go
+// version as the gateway, and can't be unloaded.
+func LoadPlugins(plugins []config.PluginConfig) error {
+	for _, p := range plugins {
+		if _, ok := handlerFactories[p.Name]; ok {
+			return fmt.Errorf("plugin %s: handler %q is already registered", p.Name, p.Name)
+		}
+
+		lib, err := plugin.Open(p.Path)
+		if err != nil {
+			return fmt.Errorf("plugin %s: %w", p.Name, err)
+		}
+		sym, err := lib.Lookup(pluginSymbol)
+		if err != nil {
+			return fmt.Errorf("plugin %s: %w", p.Name, err)
+		}
+		newHandler, ok := sym.(pluginFactory)
+		if !ok {
+			return fmt.Errorf("plugin %s: %s is a %T, not a func(map[string]string) (any, error)", p.Name, pluginSymbol, sym)
+		}
+
+		name, options := p.Name, p.Options
+		RegisterHandler(name, func(*config.Config) (Handler, error) {
+			v, err := newHandler(options)
+			if err != nil {
+				return nil, fmt.Errorf("plugin %s: %w", name, err)
+			}
+			h, ok := v.(Handler)
+			if !ok {
+				return nil, fmt.Errorf("plugin %s: handler %T has no Handle method", name, v)
+			}
+			return h, nil
+		})
+	}
+	return nil
+}
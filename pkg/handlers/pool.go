@@ -0,0 +1,282 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+	"github.com/simonvetter/modbus"
+)
+
+// connPool keeps open Modbus TCP connections for reuse by later requests,
+// keyed by host:port. A connection is used by one request at a time. Idle
+// connections past their idle timeout or lifetime are closed when the pool
+// is next used.
+type connPool struct {
+	cfg     config.ConnectionPoolConfig
+	open    OpenFunc // Opens the connections without dial options
+	mu      sync.Mutex
+	idle    map[string][]*pooledClient // Idle connections per target, oldest first
+	drained map[string]time.Time       // Time the connections to an address were last drained
+	closed  bool
+}
+
+// get returns an idle connection to the target of the request opened with
+// the same timeout and dial options, or opens a new one, bound to ctx
+func (p *connPool) get(ctx context.Context, req *ModbusRequest, opts config.TCPConfig) (ModbusClient, error) {
+	key := targetKey("", req)
+	if opts != (config.TCPConfig{}) {
+		key += fmt.Sprintf(" via %s keepalive %v", opts.LocalAddress, opts.KeepAlive)
+	}
+
+	p.mu.Lock()
+	expired := p.expire(time.Now())
+	idle := p.idle[key]
+	for i := len(idle) - 1; i >= 0; i-- {
+		if c := idle[i]; c.timeout == req.Timeout {
+			p.idle[key] = append(idle[:i:i], idle[i+1:]...)
+			p.mu.Unlock()
+			closeAll(expired)
+			c.bindContext(ctx)
+			return c, nil
+		}
+	}
+	p.mu.Unlock()
+	closeAll(expired)
+
+	client, err := connectTCPWith(ctx, p.open, req, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &pooledClient{ModbusClient: client, pool: p, key: key, ip: req.IPAddress, timeout: req.Timeout, opened: time.Now()}, nil
+}
+
+// expire removes the idle connections past their idle timeout or lifetime
+// and returns them to be closed. The pool must be locked.
+func (p *connPool) expire(now time.Time) []*pooledClient {
+	if p.cfg.IdleTimeout <= 0 && p.cfg.MaxLifetime <= 0 {
+		return nil
+	}
+
+	var expired []*pooledClient
+	for key, idle := range p.idle {
+		kept := idle[:0]
+		for _, c := range idle {
+			if p.expired(c, now) {
+				expired = append(expired, c)
+			} else {
+				kept = append(kept, c)
+			}
+		}
+		if len(kept) == 0 {
+			delete(p.idle, key)
+		} else {
+			p.idle[key] = kept
+		}
+	}
+	return expired
+}
+
+// expired reports whether an idle connection is past its idle timeout or
+// lifetime
+func (p *connPool) expired(c *pooledClient, now time.Time) bool {
+	return (p.cfg.IdleTimeout > 0 && now.Sub(c.idleSince) > p.cfg.IdleTimeout) ||
+		(p.cfg.MaxLifetime > 0 && now.Sub(c.opened) > p.cfg.MaxLifetime)
+}
+
+// closeAll closes pooled connections
+func closeAll(conns []*pooledClient) {
+	for _, c := range conns {
+		c.ModbusClient.Close()
+	}
+}
+
+// drain closes the idle connections to an address, and those in use once
+// they are returned
+func (p *connPool) drain(ip string) {
+	p.mu.Lock()
+	if p.drained == nil {
+		p.drained = make(map[string]time.Time)
+	}
+	p.drained[ip] = time.Now()
+	var drained []*pooledClient
+	for key, idle := range p.idle {
+		if len(idle) > 0 && idle[0].ip == ip {
+			drained = append(drained, idle...)
+			delete(p.idle, key)
+		}
+	}
+	p.mu.Unlock()
+
+	closeAll(drained)
+}
+
+// put returns a connection to the pool, closing the oldest idle connection
+// of the target when the pool is full. Connections past their lifetime or
+// opened before their address was drained are closed instead.
+func (p *connPool) put(c *pooledClient) {
+	now := time.Now()
+	c.idleSince = now
+
+	p.mu.Lock()
+	if p.closed || p.expired(c, now) || !c.opened.After(p.drained[c.ip]) {
+		p.mu.Unlock()
+		c.ModbusClient.Close()
+		return
+	}
+	if p.idle == nil {
+		p.idle = make(map[string][]*pooledClient)
+	}
+	evicted := p.expire(now)
+	idle := append(p.idle[c.key], c)
+	if len(idle) > p.cfg.Size {
+		evicted, idle = append(evicted, idle[0]), idle[1:]
+	}
+	p.idle[c.key] = idle
+	p.mu.Unlock()
+
+	closeAll(evicted)
+}
+
+// close closes all idle connections, and those returned later
+func (p *connPool) close() {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle, p.closed = nil, true
+	p.mu.Unlock()
+
+	for _, conns := range idle {
+		closeAll(conns)
+	}
+}
+
+// pooledClient is a connection of the pool. Closing it returns it to the
+// pool, unless a transaction failed without a Modbus exception, which leaves
+// the state of the connection unknown.
+type pooledClient struct {
+	ModbusClient
+	pool      *connPool
+	key       string
+	ip        string // Address of the target
+	timeout   time.Duration
+	opened    time.Time
+	idleSince time.Time // Return to the pool
+	broken    bool
+}
+
+// check marks the connection as broken after a transport failure
+func (c *pooledClient) check(err error) {
+	if err != nil && resultQuality(err) != QualityException {
+		c.broken = true
+	}
+}
+
+// bindContext binds a connection dialed by the gateway to the context of the
+// request reusing it
+func (c *pooledClient) bindContext(ctx context.Context) {
+	bindContext(ctx, c.ModbusClient)
+}
+
+func (c *pooledClient) Close() error {
+	if c.broken {
+		return c.ModbusClient.Close()
+	}
+	c.pool.put(c)
+	return nil
+}
+
+func (c *pooledClient) ReadCoils(addr uint16, quantity uint16) ([]bool, error) {
+	values, err := c.ModbusClient.ReadCoils(addr, quantity)
+	c.check(err)
+	return values, err
+}
+
+func (c *pooledClient) ReadDiscreteInputs(addr uint16, quantity uint16) ([]bool, error) {
+	values, err := c.ModbusClient.ReadDiscreteInputs(addr, quantity)
+	c.check(err)
+	return values, err
+}
+
+func (c *pooledClient) ReadRegisters(addr uint16, quantity uint16, regType modbus.RegType) ([]uint16, error) {
+	values, err := c.ModbusClient.ReadRegisters(addr, quantity, regType)
+	c.check(err)
+	return values, err
+}
+
+func (c *pooledClient) ReadRegister(addr uint16, regType modbus.RegType) (uint16, error) {
+	value, err := c.ModbusClient.ReadRegister(addr, regType)
+	c.check(err)
+	return value, err
+}
+
+func (c *pooledClient) WriteCoil(addr uint16, value bool) error {
+	err := c.ModbusClient.WriteCoil(addr, value)
+	c.check(err)
+	return err
+}
+
+func (c *pooledClient) WriteCoils(addr uint16, values []bool) error {
+	err := c.ModbusClient.WriteCoils(addr, values)
+	c.check(err)
+	return err
+}
+
+func (c *pooledClient) WriteRegister(addr uint16, value uint16) error {
+	err := c.ModbusClient.WriteRegister(addr, value)
+	c.check(err)
+	return err
+}
+
+func (c *pooledClient) WriteRegisters(addr uint16, values []uint16) error {
+	err := c.ModbusClient.WriteRegisters(addr, values)
+	c.check(err)
+	return err
+}
+
+// connectTCP opens the Modbus TCP connection of a request for a device with
+// its dial options, reusing a connection of the pool if pooling is enabled.
+// Host names are resolved through the DNS cache of the handler. The
+// transactions on connections dialed by the gateway are interrupted once
+// ctx is done.
+func (h *ModbusHandler) connectTCP(ctx context.Context, device string, req *ModbusRequest) (ModbusClient, error) {
+	req, err := h.resolveTarget(req)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := tcpOptions(h.TCP, h.Devices[device])
+	if depth := h.Devices[device].Pipeline; depth > 0 {
+		return h.connectPipelined(ctx, device, depth, req, opts)
+	}
+	if h.Pool.Size <= 0 {
+		return connectTCPWith(ctx, h.open(), req, opts)
+	}
+
+	h.mu.Lock()
+	if h.pool == nil {
+		h.pool = &connPool{cfg: h.Pool, open: h.open()}
+	}
+	pool := h.pool
+	h.mu.Unlock()
+
+	return pool.get(ctx, req, opts)
+}
+
+// Close closes the idle pooled connections and the shared pipelined
+// connections of the handler
+func (h *ModbusHandler) Close() error {
+	h.mu.Lock()
+	pool, pipelines := h.pool, h.pipelines
+	h.pipelines = nil
+	h.mu.Unlock()
+
+	if pool != nil {
+		pool.close()
+	}
+	for _, p := range pipelines {
+		p.close()
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+)
+
+// PostProcessor fixes up the raw values of a register read before they are
+// decoded, e.g. to work around firmware bugs. first is the register number of
+// values[0], and from/to bound the configured range of register numbers;
+// values outside it must be left alone. Values are modified in place.
+type PostProcessor func(first uint32, values []uint16, from, to uint32, args map[string]string) error
+
+var (
+	postProcessorsMu sync.RWMutex
+	postProcessors   = map[string]PostProcessor{
+		"swap-words": swapWords,
+		"swap-bytes": swapBytes,
+	}
+)
+
+// RegisterPostProcessor adds a named post-processor that devices can attach
+// in their post_process configuration
+func RegisterPostProcessor(name string, p PostProcessor) {
+	postProcessorsMu.Lock()
+	defer postProcessorsMu.Unlock()
+
+	postProcessors[name] = p
+}
+
+// PostProcessors returns the names of the registered post-processors
+func PostProcessors() []string {
+	postProcessorsMu.RLock()
+	defer postProcessorsMu.RUnlock()
+
+	names := make([]string, 0, len(postProcessors))
+	for name := range postProcessors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CheckPostProcessors verifies that every post-processor attached to a device
+// is registered
+func CheckPostProcessors(devices map[string]config.DeviceConfig) error {
+	postProcessorsMu.RLock()
+	defer postProcessorsMu.RUnlock()
+
+	for name, device := range devices {
+		for i, pp := range device.PostProcess {
+			if _, ok := postProcessors[pp.Name]; !ok {
+				return fmt.Errorf("devices.%s.post_process[%d]: unknown post-processor %q", name, i, pp.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// postProcess applies the post-processors of the request to the raw values
+// of a holding or input register read starting at the requested register
+func postProcess(req *ModbusRequest, values []uint16) error {
+	if len(req.PostProcess) == 0 || (req.FunctionCode != 3 && req.FunctionCode != 4) {
+		return nil
+	}
+
+	postProcessorsMu.RLock()
+	defer postProcessorsMu.RUnlock()
+
+	first := uint32(req.RegisterAddress) + 1
+	last := first + uint32(len(values)) - 1
+	for _, pp := range req.PostProcess {
+		from, to, err := config.ParseRange(pp.Registers)
+		if err != nil {
+			return err
+		}
+		if uint32(to) < first || uint32(from) > last {
+			continue // Not part of this read
+		}
+		p, ok := postProcessors[pp.Name]
+		if !ok {
+			return fmt.Errorf("unknown post-processor %q", pp.Name)
+		}
+		if err := p(first, values, uint32(from), uint32(to), pp.Args); err != nil {
+			return fmt.Errorf("post-processor %s: %v", pp.Name, err)
+		}
+	}
+	return nil
+}
+
+// swapWords swaps each pair of registers of the range, counted from its
+// start, e.g. for devices reporting some 32-bit values in the wrong word order
+func swapWords(first uint32, values []uint16, from, to uint32, args map[string]string) error {
+	for number := from; number+1 <= to; number += 2 {
+		if number < first || number+1 >= first+uint32(len(values)) {
+			continue // Pair not completely part of this read
+		}
+		i := number - first
+		values[i], values[i+1] = values[i+1], values[i]
+	}
+	return nil
+}
+
+// swapBytes swaps the two bytes of each register of the range
+func swapBytes(first uint32, values []uint16, from, to uint32, args map[string]string) error {
+	for i := range values {
+		if number := first + uint32(i); number >= from && number <= to {
+			values[i] = values[i]<<8 | values[i]>>8
+		}
+	}
+	return nil
+}
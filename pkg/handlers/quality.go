@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"errors"
+	"net"
+
+	"github.com/simonvetter/modbus"
+)
+
+// Result qualities reported with the "quality=" option, letting SCADA-style
+// consumers tell fresh values from degraded ones
+const (
+	QualityGood      = "GOOD"             // Fresh result from the device
+	QualityTimeout   = "TIMEOUT"          // The device did not respond in time
+	QualityException = "EXCEPTION"        // The device answered with a Modbus exception
+	QualityStale     = "STALE-FROM-CACHE" // Served from a cache instead of the device
+	QualityBad       = "BAD"              // Any other failure, e.g. connection or verification errors
+)
+
+// resultQuality classifies the outcome of an executed request
+func resultQuality(err error) string {
+	if err == nil {
+		return QualityGood
+	}
+
+	if errors.Is(err, modbus.ErrRequestTimedOut) {
+		return QualityTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return QualityTimeout
+	}
+
+	if exceptionCode(err) != 0 {
+		return QualityException
+	}
+
+	return QualityBad
+}
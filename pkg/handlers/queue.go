@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+)
+
+// deviceQueue limits the number of requests executed in parallel on a
+// target. Requests waiting for a free slot get it in the order they arrived.
+type deviceQueue struct {
+	limit   int
+	mu      sync.Mutex
+	active  int
+	waiters []chan struct{}
+}
+
+// acquire waits for a free slot, or until ctx is canceled
+func (q *deviceQueue) acquire(ctx context.Context) error {
+	q.mu.Lock()
+	if q.active < q.limit {
+		q.active++
+		q.mu.Unlock()
+		return nil
+	}
+	turn := make(chan struct{})
+	q.waiters = append(q.waiters, turn)
+	q.mu.Unlock()
+
+	select {
+	case <-turn:
+		return nil
+	case <-ctx.Done():
+	}
+
+	q.mu.Lock()
+	for i, waiter := range q.waiters {
+		if waiter == turn {
+			q.waiters = append(q.waiters[:i:i], q.waiters[i+1:]...)
+			q.mu.Unlock()
+			return ctx.Err()
+		}
+	}
+	q.mu.Unlock()
+	q.release() // Handed the slot meanwhile, pass it on
+	return ctx.Err()
+}
+
+// release hands the slot over to the next waiting request
+func (q *deviceQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.waiters) == 0 {
+		q.active--
+		return
+	}
+	close(q.waiters[0])
+	q.waiters = q.waiters[1:]
+}
+
+// queueLimit returns the number of requests executed in parallel on a device
+func queueLimit(d config.DeviceConfig) int {
+	switch {
+	case d.MaxConcurrent > 0:
+		return d.MaxConcurrent
+	case d.Pipeline > 0:
+		return d.Pipeline
+	}
+	return config.DefaultMaxConcurrent
+}
+
+// queue returns the request queue of a target. Its limit is the lowest of
+// the registered devices at the target, or, if there are none, the limit of
+// the device d of the request creating the queue.
+func (h *ModbusHandler) queue(target string, d config.DeviceConfig) *deviceQueue {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.queues == nil {
+		h.queues = make(map[string]*deviceQueue)
+	}
+	q, ok := h.queues[target]
+	if !ok {
+		limit := 0
+		for _, other := range h.Devices {
+			if deviceTarget(other) == target && (limit == 0 || queueLimit(other) < limit) {
+				limit = queueLimit(other)
+			}
+		}
+		if limit == 0 {
+			limit = queueLimit(d)
+		}
+		q = &deviceQueue{limit: limit}
+		h.queues[target] = q
+	}
+	return q
+}
+
+// connectQueued opens the connection of a request once its target has a
+// free slot, waiting behind the requests queued before it unless ctx is
+// canceled. The connection holds the slot until it is closed.
+func (h *ModbusHandler) connectQueued(ctx context.Context, d config.DeviceConfig, req *ModbusRequest, connect ConnectFunc) (ModbusClient, error) {
+	q := h.queue(targetKey(d.Serial, req), d)
+	if err := q.acquire(ctx); err != nil {
+		return nil, err
+	}
+
+	client, err := connect(req)
+	if err != nil {
+		q.release()
+		return nil, err
+	}
+	return &lockedClient{ModbusClient: client, unlock: q.release}, nil
+}
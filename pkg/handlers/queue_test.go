@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+)
+
+func TestModbusHandlerQueueByTarget(t *testing.T) {
+	var mu sync.Mutex
+	active, peak := 0, 0
+	device := NewSimulatedDevice(1000)
+	h := &ModbusHandler{
+		Connect: func(req *ModbusRequest) (ModbusClient, error) {
+			mu.Lock()
+			active++
+			peak = max(peak, active)
+			mu.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			mu.Lock()
+			active--
+			mu.Unlock()
+			return device.Connect(req)
+		},
+		Devices: map[string]config.DeviceConfig{
+			"meter1": {Address: "192.0.2.20", MaxConcurrent: 4},
+			"meter2": {Address: "192.0.2.20:502", MaxConcurrent: 2},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		device  string
+		request string
+		peak    int
+	}{
+		{"lowest limit of the devices at the target", "meter1", "0 1 0 - - 5 1 3 1 1", 2},
+		{"other device name at the target", "plc", "0 1 0 192.0.2.20 502 5 1 3 1 1", 2},
+		{"target without registered devices", "plc", "0 1 0 192.0.2.30 502 5 1 3 1 1", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peak = 0
+			var wg sync.WaitGroup
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if response := h.Handle(context.Background(), tt.device, tt.request); response != "1 OK 0" {
+						t.Errorf("response %q", response)
+					}
+				}()
+			}
+			wg.Wait()
+			if peak != tt.peak {
+				t.Errorf("%d requests in parallel, expected %d", peak, tt.peak)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"context"
+	"log"
+)
+
+// ReadOnlyHandler wraps a Handler and rejects every write request, e.g. while
+// the gateway runs in safe mode
+type ReadOnlyHandler struct {
+	Handler Handler
+	Reason  string // Reason reported in error responses
+}
+
+// Handle rejects write functions and delegates everything else
+func (h *ReadOnlyHandler) Handle(ctx context.Context, device string, payload string) string {
+	return TextEncoder{}.Encode(h.HandleResponse(ctx, device, payload))
+}
+
+// HandleResponse rejects write functions like Handle and returns the
+// structured response
+func (h *ReadOnlyHandler) HandleResponse(ctx context.Context, device string, payload string) *Response {
+	requests, err := parseBatch(payload)
+	if err == nil {
+		for _, request := range requests {
+			if isWriteFunction(request.FunctionCode) {
+				log.Printf("Rejected write request (function %d): %s", request.FunctionCode, h.Reason)
+				return errorResponse(request.Cookie, "writes disabled: "+h.Reason)
+			}
+		}
+	}
+
+	return respond(ctx, h.Handler, device, payload)
+}
+
+// isWriteFunction reports whether the function code modifies device state
+func isWriteFunction(functionCode uint8) bool {
+	switch functionCode {
+	case 5, 6, 15, 16:
+		return true
+	default:
+		return false
+	}
+}
+
+// IsWrite reports whether a text or JSON request payload contains a write
+// function, on a best-effort basis
+func IsWrite(payload string) bool {
+	_, functions := Summarize(payload)
+	for _, function := range functions {
+		if isWriteFunction(function) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,275 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+	"github.com/ganehag/open-modbus-goateway/pkg/failure"
+)
+
+// recording is a line of a recording file: the result of a command executed
+// for a device
+type recording struct {
+	Time      time.Time `json:"time"`
+	Device    string    `json:"device"`
+	Function  uint8     `json:"function"`
+	Register  string    `json:"register"`          // Register number, with the bit suffix of bit addressing
+	Count     uint16    `json:"count"`             // Registers, coils or inputs addressed
+	Options   string    `json:"options,omitempty"` // Options changing the values, e.g. "type=float32"
+	Status    string    `json:"status"`
+	Values    []string  `json:"values,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Exception uint8     `json:"exception,omitempty"`
+	Timeout   bool      `json:"timeout,omitempty"` // The error is a timeout
+}
+
+// recordingKey identifies the commands answered by the same recordings: the
+// device, function, address and count, and the options changing the values
+func recordingKey(device string, req *ModbusRequest) recording {
+	r := recording{Device: device, Function: req.FunctionCode, Register: strconv.Itoa(int(req.RegisterAddress) + 1), Count: req.RegisterCount}
+	if req.HasBit {
+		r.Register += "." + strconv.Itoa(int(req.Bit))
+	}
+
+	var options []string
+	if req.DataType != TypeUint16 {
+		options = append(options, "type="+string(req.DataType))
+	}
+	if req.Format != FormatDecimal {
+		options = append(options, "format="+string(req.Format))
+	}
+	if req.ByteOrder != "" {
+		options = append(options, "order="+string(req.ByteOrder))
+	}
+	if req.Scale != 1 {
+		options = append(options, "scale="+strconv.FormatFloat(req.Scale, 'g', -1, 64))
+	}
+	if req.Offset != 0 {
+		options = append(options, "offset="+strconv.FormatFloat(req.Offset, 'g', -1, 64))
+	}
+	r.Options = strings.Join(options, " ")
+	return r
+}
+
+// key returns the lookup key of a recording
+func (r recording) key() string {
+	return fmt.Sprintf("%s %d %s %d %s", r.Device, r.Function, r.Register, r.Count, r.Options)
+}
+
+// RecordHandler executes requests with the wrapped handler and appends the
+// result of every command to a recording file, for the ReplayHandler
+type RecordHandler struct {
+	Handler ResponseHandler
+
+	mu   sync.Mutex // Serializes the lines written
+	file *os.File
+}
+
+// NewRecordHandler creates a record handler appending to the file at path
+func NewRecordHandler(path string, handler ResponseHandler) (*RecordHandler, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open recording: %w", err)
+	}
+	return &RecordHandler{Handler: handler, file: file}, nil
+}
+
+// Handle executes the request and records its results
+func (h *RecordHandler) Handle(ctx context.Context, device string, payload string) string {
+	return TextEncoder{}.Encode(h.HandleResponse(ctx, device, payload))
+}
+
+// HandleResponse executes the request like Handle and returns the structured
+// response
+func (h *RecordHandler) HandleResponse(ctx context.Context, device string, payload string) *Response {
+	resp := h.Handler.HandleResponse(ctx, device, payload)
+	requests, err := parseBatch(payload)
+	if err != nil {
+		return resp // Nothing executed
+	}
+
+	results := []*Response{resp}
+	if len(requests) > 1 {
+		results = resp.Results
+	}
+	if len(results) != len(requests) {
+		return resp // Rejected as a whole, e.g. by the connection limits
+	}
+
+	var lines []byte
+	now := time.Now().UTC()
+	for i, req := range requests {
+		r := recordingKey(device, req)
+		r.Time, r.Status, r.Values, r.Error, r.Exception = now, results[i].Status, results[i].Values, results[i].Error, results[i].Exception
+		if err := results[i].Err; err != nil {
+			r.Error = err.Error() // Unmapped by the error messages, which replay applies again
+			r.Timeout = errors.Is(err, failure.ErrTimeout)
+		}
+		line, err := json.Marshal(r)
+		if err != nil {
+			log.Printf("Failed to encode recording: %v", err)
+			return resp
+		}
+		lines = append(append(lines, line...), '\n')
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, err := h.file.Write(lines); err != nil {
+		log.Printf("Failed to write recording: %v", err)
+	}
+	return resp
+}
+
+// Close closes the recording file and the wrapped handler, if it holds
+// resources
+func (h *RecordHandler) Close() error {
+	if closer, ok := h.Handler.(io.Closer); ok {
+		closer.Close()
+	}
+	return h.file.Close()
+}
+
+// ReplayHandler answers requests from a recording file without any device.
+// The commands of a key are answered with its recordings in recorded order,
+// starting over after the last one.
+type ReplayHandler struct {
+	mu         sync.Mutex
+	recordings map[string][]recording
+	next       map[string]int // Index of the recording answering the next command of a key
+}
+
+// NewReplayHandler loads the recording file at path
+func NewReplayHandler(path string) (*ReplayHandler, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open recording: %w", err)
+	}
+	defer file.Close()
+
+	h := &ReplayHandler{recordings: make(map[string][]recording), next: make(map[string]int)}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var r recording
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return nil, fmt.Errorf("recording %s, line %d: %w", path, line, err)
+		}
+		h.recordings[r.key()] = append(h.recordings[r.key()], r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read recording: %w", err)
+	}
+	return h, nil
+}
+
+// Handle answers the request from the recordings
+func (h *ReplayHandler) Handle(ctx context.Context, device string, payload string) string {
+	return TextEncoder{}.Encode(h.HandleResponse(ctx, device, payload))
+}
+
+// HandleResponse answers the request like Handle and returns the structured
+// response
+func (h *ReplayHandler) HandleResponse(ctx context.Context, device string, payload string) *Response {
+	requests, err := parseBatch(payload)
+	if err != nil {
+		log.Printf("Invalid request: %v", err)
+		return newResponse(0, nil, failure.Wrap(failure.ErrParse, err))
+	}
+
+	execute := func(req *ModbusRequest) ([]string, error) {
+		return h.replay(device, req)
+	}
+	if len(requests) > 1 {
+		return executeBatch(requests, execute)
+	}
+	values, err := execute(requests[0])
+	return newResult(requests[0].Cookie, requests[0], values, err)
+}
+
+// replay returns the result of the next recording of a command
+func (h *ReplayHandler) replay(device string, req *ModbusRequest) ([]string, error) {
+	key := recordingKey(device, req).key()
+
+	h.mu.Lock()
+	recordings := h.recordings[key]
+	if len(recordings) == 0 {
+		h.mu.Unlock()
+		return nil, fmt.Errorf("NOT_RECORDED: no recording of function %d at %s for device %q", req.FunctionCode, recordingKey(device, req).Register, device)
+	}
+	r := recordings[h.next[key]]
+	h.next[key] = (h.next[key] + 1) % len(recordings)
+	h.mu.Unlock()
+
+	switch {
+	case r.Status != StatusError:
+		return r.Values, nil
+	case r.Exception != 0:
+		return nil, exceptionError(r.Exception)
+	case r.Timeout:
+		return nil, replayedTimeout(r.Error)
+	}
+	return nil, errors.New(r.Error)
+}
+
+// replayedTimeout is a recorded timeout, a net.Error so it is classified like
+// the original one
+type replayedTimeout string
+
+func (e replayedTimeout) Error() string   { return string(e) }
+func (e replayedTimeout) Timeout() bool   { return true }
+func (e replayedTimeout) Temporary() bool { return true }
+
+// The record handler creates the handler it records by name, so it is
+// registered once handlerFactories is initialized
+func init() {
+	RegisterHandler("record", newRecordingHandler)
+	RegisterHandler("replay", func(cfg *config.Config) (Handler, error) {
+		if cfg.Recording.Path == "" {
+			return nil, fmt.Errorf("recording.path must be specified")
+		}
+		return NewReplayHandler(cfg.Recording.Path)
+	})
+}
+
+// newRecordingHandler creates the record handler of the configuration,
+// recording the results of the handler it names
+func newRecordingHandler(cfg *config.Config) (Handler, error) {
+	rec := cfg.Recording
+	if rec.Path == "" {
+		return nil, fmt.Errorf("recording.path must be specified")
+	}
+	next, err := NewHandler(rec.Handler, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("recording: %w", err)
+	}
+	rh, ok := next.(ResponseHandler)
+	if !ok {
+		if closer, ok := next.(io.Closer); ok {
+			closer.Close()
+		}
+		return nil, fmt.Errorf("recording: handler %q returns no structured responses and can't be recorded", rec.Handler)
+	}
+	h, err := NewRecordHandler(rec.Path, rh)
+	if err != nil {
+		if closer, ok := next.(io.Closer); ok {
+			closer.Close()
+		}
+		return nil, err
+	}
+	return h, nil
+}
@@ -0,0 +1,32 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+)
+
+// RegisteredHandler wraps a Handler and rejects requests for devices that are
+// missing from the device registry, making the registry an allow-list
+type RegisteredHandler struct {
+	Handler Handler
+	Devices map[string]config.DeviceConfig
+}
+
+// Handle rejects requests for unknown devices and delegates the others
+func (h *RegisteredHandler) Handle(ctx context.Context, device string, payload string) string {
+	return TextEncoder{}.Encode(h.HandleResponse(ctx, device, payload))
+}
+
+// HandleResponse rejects requests for unknown devices like Handle and returns
+// the structured response
+func (h *RegisteredHandler) HandleResponse(ctx context.Context, device string, payload string) *Response {
+	if _, ok := h.Devices[device]; !ok {
+		log.Printf("Rejected request for unknown device %q", device)
+		return errorResponse(payloadCookie(payload), fmt.Sprintf("UNKNOWN_DEVICE: device %q is not registered", device))
+	}
+
+	return respond(ctx, h.Handler, device, payload)
+}
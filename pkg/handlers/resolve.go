@@ -0,0 +1,174 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+)
+
+// Defaults of the resolution of host names
+const (
+	defaultDNSTTL     = 60 * time.Second
+	defaultDNSTimeout = 2 * time.Second
+	maxCachedHosts    = 256 // Host names kept by the DNS cache
+)
+
+// resolver resolves the host names of Modbus TCP targets with a timeout and
+// caches the results. When a lookup fails, the last address of the host is
+// used until it is replaced, so that an unavailable DNS server does not fail
+// every request to a known target. A host resolving to another address than
+// before is reported to moved, e.g. to drain the connections to the old one.
+type resolver struct {
+	cfg   config.DNSConfig
+	moved func(host, from, to string)
+	mu    sync.Mutex
+	cache map[string]resolved
+}
+
+// resolved is a cached address of a host name
+type resolved struct {
+	ip      string
+	expires time.Time
+}
+
+// resolve returns the address of a host, which is returned as is if it is
+// an IP address already
+func (r *resolver) resolve(host string) (string, error) {
+	if _, err := netip.ParseAddr(host); err == nil {
+		return host, nil
+	}
+
+	now := time.Now()
+	r.mu.Lock()
+	cached, ok := r.cache[host]
+	r.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.ip, nil
+	}
+
+	ip, err := r.lookup(host)
+	if err != nil {
+		if ok {
+			return cached.ip, nil
+		}
+		return "", fmt.Errorf("failed to resolve %s: %w", host, err)
+	}
+
+	r.mu.Lock()
+	if r.cache == nil {
+		r.cache = make(map[string]resolved)
+	}
+	previous, known := r.cache[host]
+	if !known && len(r.cache) >= maxCachedHosts {
+		r.evict(now)
+	}
+	ttl := r.cfg.CacheTTL
+	if ttl == 0 {
+		ttl = defaultDNSTTL
+	}
+	r.cache[host] = resolved{ip: ip, expires: now.Add(ttl)}
+	r.mu.Unlock()
+
+	if known && previous.ip != ip && r.moved != nil {
+		r.moved(host, previous.ip, ip)
+	}
+	return ip, nil
+}
+
+// lookup resolves a host name within the resolution timeout, preferring
+// IPv4 addresses
+func (r *resolver) lookup(host string) (string, error) {
+	timeout := r.cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultDNSTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	if len(addrs) == 0 {
+		return "", fmt.Errorf("no addresses")
+	}
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			return addr.IP.String(), nil
+		}
+	}
+	return addrs[0].String(), nil
+}
+
+// evict removes the expired entries of the full cache, or an arbitrary one
+// if none has expired. The resolver must be locked.
+func (r *resolver) evict(now time.Time) {
+	for host, cached := range r.cache {
+		if now.After(cached.expires) {
+			delete(r.cache, host)
+		}
+	}
+	if len(r.cache) < maxCachedHosts {
+		return
+	}
+	for host := range r.cache {
+		delete(r.cache, host)
+		return
+	}
+}
+
+// resolveTarget returns the request with the host name of its target
+// replaced by its address
+func (h *ModbusHandler) resolveTarget(req *ModbusRequest) (*ModbusRequest, error) {
+	if _, err := netip.ParseAddr(req.IPAddress); err == nil {
+		return req, nil
+	}
+
+	h.mu.Lock()
+	if h.resolver == nil {
+		h.resolver = &resolver{cfg: h.DNS, moved: h.drain}
+	}
+	r := h.resolver
+	h.mu.Unlock()
+
+	ip, err := r.resolve(req.IPAddress)
+	if err != nil {
+		return nil, err
+	}
+	resolved := *req
+	resolved.IPAddress = ip
+	return &resolved, nil
+}
+
+// drain closes the pooled and pipelined connections to the old address of a
+// host that resolved to another one, so later requests connect to the new
+// address. Pooled connections in use are closed when they are returned.
+func (h *ModbusHandler) drain(host, from, to string) {
+	log.Printf("Target %s moved from %s to %s, closing its connections", host, from, to)
+
+	h.mu.Lock()
+	pool := h.pool
+	var moved []*pipeline
+	for key, p := range h.pipelines {
+		target := key[strings.LastIndex(key, "@")+1:]
+		if ip, _, _ := net.SplitHostPort(target); ip == from {
+			moved = append(moved, p)
+			delete(h.pipelines, key)
+		}
+	}
+	h.mu.Unlock()
+
+	if pool != nil {
+		pool.drain(from)
+	}
+	for _, p := range moved {
+		p.close()
+	}
+}
@@ -0,0 +1,299 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/failure"
+	"github.com/simonvetter/modbus"
+)
+
+// Response statuses
+const (
+	StatusOK    = "OK"
+	StatusError = "ERROR"
+)
+
+// Response is the outcome of a request, serialized into a payload format by
+// an Encoder
+type Response struct {
+	Cookie    uint64       // Cookie of the request, or sub-index of a batch result
+	Status    string       // StatusOK or StatusError
+	Values    []string     // Formatted values of a successful request
+	Error     string       // Reason of a failed request
+	Err       error        // Failure of a failed request, classified by the classes of package failure
+	Exception uint8        // Modbus exception code of a failed request, 0 for other failures
+	Results   []*Response  // Results of the commands of a batch, keyed by their sub-index
+	At        time.Time    // Transaction time of a successful request, if requested
+	Diag      *Diagnostics // Transaction timings, if requested
+	Cached    bool         // Served from the read cache instead of the device
+	CacheAge  time.Duration
+	Quality   string // Quality of the result, if requested
+
+	raw string // Payload of a handler only implementing Handler
+}
+
+// Diagnostics are the transaction timings of a request and the retries it
+// took
+type Diagnostics struct {
+	Connect    time.Duration // Time taken to open the connection
+	Turnaround time.Duration // Time taken to execute the request on the open connection
+	Retries    int           // Retries of transient failures, of the connection for the commands of a batch
+}
+
+// Raw returns the payload of a response of a handler that only implements
+// Handler, which encoders pass on as is, and whether there is one
+func (r *Response) Raw() (string, bool) {
+	return r.raw, r.raw != ""
+}
+
+// ResponseHandler is a Handler also returning the structured response of a
+// request, leaving its serialization to the caller
+type ResponseHandler interface {
+	Handler
+	HandleResponse(ctx context.Context, device string, payload string) *Response
+}
+
+// respond handles a request with the wrapped handler, keeping the payload of
+// handlers that only implement Handler as the raw response
+func respond(ctx context.Context, h Handler, device string, payload string) *Response {
+	if rh, ok := h.(ResponseHandler); ok {
+		return rh.HandleResponse(ctx, device, payload)
+	}
+	return &Response{raw: h.Handle(ctx, device, payload)}
+}
+
+// Encoder serializes responses into a payload format
+type Encoder interface {
+	Encode(resp *Response) string
+}
+
+// newResponse returns the outcome of a request, where id is the cookie or the
+// batch sub-index
+func newResponse(id uint64, values []string, err error) *Response {
+	if err != nil {
+		return &Response{Cookie: id, Status: StatusError, Error: err.Error(), Err: classify(err), Exception: exceptionCode(err)}
+	}
+	return &Response{Cookie: id, Status: StatusOK, Values: values}
+}
+
+// errorResponse returns the response to a request refused with a reason
+func errorResponse(id uint64, reason string) *Response {
+	return &Response{Cookie: id, Status: StatusError, Error: reason}
+}
+
+// newResult returns the outcome of an executed request like newResponse,
+// with the annotations the request asked for: the transaction time of
+// successful requests, the transaction timings and the quality of the result
+func newResult(id uint64, req *ModbusRequest, values []string, err error) *Response {
+	resp := newResponse(id, values, err)
+	if err == nil && req.Timestamp {
+		resp.At = time.Now()
+	}
+	if req.Diagnostics {
+		resp.Diag = &Diagnostics{Connect: req.connectTime, Turnaround: req.turnaround, Retries: req.retries}
+	}
+	if err == nil && req.cached {
+		resp.Cached, resp.CacheAge = true, req.cacheAge
+	}
+	if req.Quality {
+		resp.Quality = resultQuality(err)
+		if resp.Cached {
+			resp.Quality = QualityStale
+		}
+	}
+	return resp
+}
+
+// exceptionCodes are the Modbus exception codes of the exception errors
+var exceptionCodes = []struct {
+	err  error
+	code uint8
+}{
+	{modbus.ErrIllegalFunction, 1},
+	{modbus.ErrIllegalDataAddress, 2},
+	{modbus.ErrIllegalDataValue, 3},
+	{modbus.ErrServerDeviceFailure, 4},
+	{modbus.ErrAcknowledge, 5},
+	{modbus.ErrServerDeviceBusy, 6},
+	{modbus.ErrMemoryParityError, 8},
+	{modbus.ErrGWPathUnavailable, 10},
+	{modbus.ErrGWTargetFailedToRespond, 11},
+}
+
+// exceptionCode returns the Modbus exception code of an error, or 0 if the
+// device didn't answer with an exception
+func exceptionCode(err error) uint8 {
+	for _, e := range exceptionCodes {
+		if errors.Is(err, e.err) {
+			return e.code
+		}
+	}
+	return 0
+}
+
+// classify classifies the failure of a request: Modbus exceptions by their
+// exception code and timeouts as reported by resultQuality. Errors already
+// classified where they occurred, e.g. parse and connect errors, are kept.
+func classify(err error) error {
+	var classified *failure.Error
+	if errors.As(err, &classified) {
+		return err
+	}
+	if code := exceptionCode(err); code != 0 {
+		return failure.Wrap(&failure.ExceptionError{Code: code}, err)
+	}
+	if resultQuality(err) == QualityTimeout {
+		return failure.Wrap(failure.ErrTimeout, err)
+	}
+	return err
+}
+
+// TextEncoder serializes responses in the text format: "<COOKIE> OK
+// [values...]" or "<COOKIE> ERROR: <reason>", followed by the annotations
+// "at=<RFC3339 UTC time>", "diag=connect_ms:<ms>,turnaround_ms:<ms>,retries:<n>",
+// "cached=<ms>" and "quality=<QUALITY>". The results of a batch are listed
+// by sub-index: "<COOKIE> OK 0 OK 17 42; 1 OK; 2 ERROR: <reason>".
+type TextEncoder struct{}
+
+// Encode serializes a response in the text format
+func (TextEncoder) Encode(resp *Response) string {
+	if raw, ok := resp.Raw(); ok {
+		return raw
+	}
+
+	var b strings.Builder
+	writeText(&b, resp)
+	return b.String()
+}
+
+// writeText writes a response in the text format to b
+func writeText(b *strings.Builder, resp *Response) {
+	var buf [64]byte
+	cookie := strconv.AppendUint(buf[:0], resp.Cookie, 10)
+
+	if resp.Results != nil {
+		b.Write(cookie)
+		b.WriteString(" OK ")
+		for i, result := range resp.Results {
+			if i > 0 {
+				b.WriteString("; ")
+			}
+			writeText(b, result)
+		}
+		return
+	}
+
+	extra := 0
+	if !resp.At.IsZero() {
+		extra += len(" at=2006-01-02T15:04:05.999999999Z")
+	}
+	if resp.Diag != nil {
+		extra += len(" diag=connect_ms:,turnaround_ms:,retries:") + 2*len("1000.000") + len("10")
+	}
+	if resp.Cached {
+		extra += len(" cached=1000.000")
+	}
+	if resp.Quality != "" {
+		extra += len(" quality=") + len(resp.Quality)
+	}
+
+	if resp.Status == StatusError {
+		b.Grow(len(cookie) + len(" ERROR: ") + len(resp.Error) + extra)
+		b.Write(cookie)
+		b.WriteString(" ERROR: ")
+		b.WriteString(resp.Error)
+	} else {
+		size := len(cookie) + len(" OK") + extra
+		for _, v := range resp.Values {
+			size += 1 + len(v)
+		}
+		b.Grow(size)
+		b.Write(cookie)
+		b.WriteString(" OK")
+		for _, v := range resp.Values {
+			b.WriteByte(' ')
+			b.WriteString(v)
+		}
+	}
+
+	if !resp.At.IsZero() {
+		b.WriteString(" at=")
+		b.Write(resp.At.UTC().AppendFormat(buf[:0], time.RFC3339Nano))
+	}
+	if resp.Diag != nil {
+		b.WriteString(" diag=connect_ms:")
+		b.Write(appendMilliseconds(buf[:0], resp.Diag.Connect))
+		b.WriteString(",turnaround_ms:")
+		b.Write(appendMilliseconds(buf[:0], resp.Diag.Turnaround))
+		b.WriteString(",retries:")
+		b.Write(strconv.AppendInt(buf[:0], int64(resp.Diag.Retries), 10))
+	}
+	if resp.Cached {
+		b.WriteString(" cached=")
+		b.Write(appendMilliseconds(buf[:0], resp.CacheAge))
+	}
+	if resp.Quality != "" {
+		b.WriteString(" quality=")
+		b.WriteString(resp.Quality)
+	}
+}
+
+// appendMilliseconds appends a duration in milliseconds with microsecond
+// precision to dst
+func appendMilliseconds(dst []byte, d time.Duration) []byte {
+	return strconv.AppendFloat(dst, float64(d.Microseconds())/1000, 'f', 3, 64)
+}
+
+// milliseconds converts a duration to milliseconds with microsecond precision
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// JSONEncoder serializes responses in the JSON format, keeping only the
+// selected fields if any
+type JSONEncoder struct {
+	Fields []string
+}
+
+// Encode serializes a response in the JSON format
+func (e JSONEncoder) Encode(resp *Response) string {
+	return encodeJSONResponse(toJSON(resp), e.Fields)
+}
+
+// toJSON converts a response to its JSON form. The raw payload of a handler
+// only implementing Handler is parsed as a text response.
+func toJSON(resp *Response) jsonResponse {
+	if raw, ok := resp.Raw(); ok {
+		jr, err := parseTextResponse(raw)
+		if err != nil {
+			return jsonResponse{Status: StatusError, Error: err.Error()}
+		}
+		return jr
+	}
+
+	cookie := resp.Cookie
+	jr := jsonResponse{Cookie: &cookie, Status: resp.Status, Error: resp.Error, Exception: resp.Exception, Quality: resp.Quality}
+	for _, v := range resp.Values {
+		jr.Values = append(jr.Values, jsonValue(v))
+	}
+	for _, result := range resp.Results {
+		r := toJSON(result)
+		r.Index, r.Cookie = r.Cookie, nil
+		jr.Results = append(jr.Results, r)
+	}
+	if !resp.At.IsZero() {
+		jr.At = resp.At.UTC().Format(time.RFC3339Nano)
+	}
+	if resp.Diag != nil {
+		jr.Diag = &jsonDiag{ConnectMs: milliseconds(resp.Diag.Connect), TurnaroundMs: milliseconds(resp.Diag.Turnaround), Retries: resp.Diag.Retries}
+	}
+	if resp.Cached {
+		ms := milliseconds(resp.CacheAge)
+		jr.CachedMs = &ms
+	}
+	return jr
+}
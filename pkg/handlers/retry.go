@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"syscall"
+	"time"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+	"github.com/ganehag/open-modbus-goateway/pkg/metrics"
+)
+
+// defaultRetryDelay is the delay before the first retry without base_delay
+const defaultRetryDelay = 100 * time.Millisecond
+
+// transient reports whether an error may succeed when retried: timeouts and
+// connections reset by the device. Modbus exceptions are answers of the
+// device and are never retried.
+func transient(err error) bool {
+	if resultQuality(err) == QualityTimeout {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// retryPolicy returns the retry policy of a device, its own or the default
+func (h *ModbusHandler) retryPolicy(device string) config.RetryConfig {
+	if r := h.Devices[device].Retry; r != nil {
+		return *r
+	}
+	return h.Retry
+}
+
+// backoff returns the delay before a retry, doubling the base delay for each
+// previous retry and varying it by the jitter fraction
+func backoff(policy config.RetryConfig, retry int) time.Duration {
+	delay := policy.BaseDelay
+	if delay <= 0 {
+		delay = defaultRetryDelay
+	}
+	delay <<= uint(retry)
+	if policy.Jitter > 0 {
+		delay += time.Duration((rand.Float64()*2 - 1) * policy.Jitter * float64(delay))
+	}
+	return delay
+}
+
+// withRetry runs an attempt of a request to the device, retrying transient
+// failures as configured for the device until ctx is canceled, and records
+// the retries taken on the request
+func (h *ModbusHandler) withRetry(ctx context.Context, device string, req *ModbusRequest, attempt func() error) error {
+	policy := h.retryPolicy(device)
+	for retry := 0; ; retry++ {
+		req.retries = retry
+		err := attempt()
+		if err == nil || retry >= policy.Count || !transient(err) {
+			return err
+		}
+
+		h.sink().Add(metricModbusRetries, 1, metrics.Labels{"device": device})
+		delay := backoff(policy, retry)
+		log.Printf("Retrying request %d for device %s in %s (%d/%d): %v", req.Cookie, device, delay, retry+1, policy.Count, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+)
+
+func TestModbusHandlerRetriesDiagnostics(t *testing.T) {
+	device := NewSimulatedDevice(1000)
+	failures := 0
+	h := &ModbusHandler{
+		Connect: func(req *ModbusRequest) (ModbusClient, error) {
+			if failures > 0 {
+				failures--
+				return nil, io.EOF
+			}
+			return device.Connect(req)
+		},
+		Devices: map[string]config.DeviceConfig{
+			"plc": {Address: "192.0.2.10", UnitID: 1, Timeout: time.Second},
+		},
+		Retry: config.RetryConfig{Count: 3, BaseDelay: time.Millisecond},
+	}
+
+	failures = 2
+	resp := h.HandleResponse(context.Background(), "plc", "0 1 0 - - - - 3 100 1 diag=1")
+	if resp.Status != StatusOK || resp.Diag == nil || resp.Diag.Retries != 2 {
+		t.Fatalf("response %+v, diagnostics %+v", resp, resp.Diag)
+	}
+	if text := (TextEncoder{}).Encode(resp); !strings.HasSuffix(text, ",retries:2") {
+		t.Errorf("text response %q", text)
+	}
+	var decoded jsonResponse
+	if err := json.Unmarshal([]byte(JSONEncoder{}.Encode(resp)), &decoded); err != nil || decoded.Diag == nil || decoded.Diag.Retries != 2 {
+		t.Errorf("JSON response %+v: %v", decoded, err)
+	}
+
+	// Batches report the retries of their connection
+	failures = 1
+	text := h.Handle(context.Background(), "plc", "0 1 0 - - - - 3 100 1 diag=1 ; 3 101 1 diag=1")
+	if strings.Count(text, ",retries:1") != 2 {
+		t.Errorf("batch response %q", text)
+	}
+}
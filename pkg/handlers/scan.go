@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"errors"
+
+	"github.com/simonvetter/modbus"
+)
+
+// ScanResult is the answer of a unit to a discovery probe
+type ScanResult struct {
+	UnitID uint8
+	Values []uint16 // Values read by the probe, nil for an exception
+	Err    error    // Modbus exception returned by the unit, nil on success
+}
+
+// noResponse reports whether a probe error means that no unit answered.
+// Modbus TCP gateways answer for absent serial units with a gateway
+// exception.
+func noResponse(err error) bool {
+	return resultQuality(err) != QualityException ||
+		errors.Is(err, modbus.ErrGWTargetFailedToRespond) ||
+		errors.Is(err, modbus.ErrGWPathUnavailable)
+}
+
+// Scan probes the unit IDs from first to last with a read of one value at
+// the given address using a read function (1-4) and returns the units that
+// answered, including those answering with a Modbus exception. The probe
+// callback, if set, is called before every unit is probed.
+func Scan(client ModbusClient, first, last uint8, function uint8, address uint16, probe func(unitID uint8)) ([]ScanResult, error) {
+	var results []ScanResult
+	for id := int(first); id <= int(last); id++ {
+		if probe != nil {
+			probe(uint8(id))
+		}
+		if err := client.SetUnitId(uint8(id)); err != nil {
+			return results, err
+		}
+
+		values, err := readRaw(client, function, address, 1)
+		switch {
+		case err == nil:
+			results = append(results, ScanResult{UnitID: uint8(id), Values: values})
+		case !noResponse(err):
+			results = append(results, ScanResult{UnitID: uint8(id), Err: err})
+		}
+	}
+
+	return results, nil
+}
@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+	"github.com/ganehag/open-modbus-goateway/pkg/failure"
+	"github.com/simonvetter/modbus"
+)
+
+// serialParities maps the configured parities to the Modbus library values
+var serialParities = map[string]uint{
+	"":                modbus.PARITY_NONE,
+	config.ParityNone: modbus.PARITY_NONE,
+	config.ParityEven: modbus.PARITY_EVEN,
+	config.ParityOdd:  modbus.PARITY_ODD,
+}
+
+// serialLine tracks the timing of a serial port across connections, so the
+// configured delays also apply between requests
+type serialLine struct {
+	cfg   config.SerialConfig
+	bus   sync.Mutex // Held by the open connection, serializing the transactions on the port
+	mu    sync.Mutex
+	ready time.Time // Earliest start of the next transaction
+}
+
+// wait blocks until the line has been silent for the configured delay
+func (l *serialLine) wait() {
+	l.mu.Lock()
+	ready := l.ready
+	l.mu.Unlock()
+
+	time.Sleep(time.Until(ready))
+}
+
+// done records the end of a transaction. Writes are followed by the
+// turnaround delay if it is longer than the inter-frame delay.
+func (l *serialLine) done(write bool) {
+	delay := l.cfg.InterFrameDelay
+	if write && l.cfg.TurnaroundDelay > delay {
+		delay = l.cfg.TurnaroundDelay
+	}
+
+	l.mu.Lock()
+	l.ready = time.Now().Add(delay)
+	l.mu.Unlock()
+}
+
+// serialLine returns the timing state of the named serial port
+func (h *ModbusHandler) serialLine(name string) *serialLine {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.serialLines == nil {
+		h.serialLines = make(map[string]*serialLine)
+	}
+	line, ok := h.serialLines[name]
+	if !ok {
+		line = &serialLine{cfg: h.Serial[name]}
+		h.serialLines[name] = line
+	}
+	return line
+}
+
+// lockedClient holds a lock, e.g. the bus of its serial port, until it is
+// closed
+type lockedClient struct {
+	ModbusClient
+	unlock func()
+	closed sync.Once
+}
+
+func (c *lockedClient) Close() error {
+	err := c.ModbusClient.Close()
+	c.closed.Do(c.unlock)
+	return err
+}
+
+// connectSerial opens a Modbus RTU client on the named serial port. The
+// target address of the request is not used. Several devices may share a
+// port, so the client waits for exclusive use of the bus, which it keeps
+// until it is closed, while other ports proceed in parallel.
+func (h *ModbusHandler) connectSerial(name string, req *ModbusRequest) (ModbusClient, error) {
+	line := h.serialLine(name)
+	line.bus.Lock()
+
+	client, err := openSerial(h.open(), line.cfg, req.Timeout)
+	if err != nil {
+		line.bus.Unlock()
+		return nil, err
+	}
+
+	return &pacedClient{ModbusClient: &lockedClient{ModbusClient: client, unlock: line.bus.Unlock}, pacers: []pacer{line}}, nil
+}
+
+// ConnectSerial creates a Modbus RTU client on a serial port and opens the
+// port. The delays of the port are not applied.
+func ConnectSerial(cfg config.SerialConfig, timeout time.Duration) (ModbusClient, error) {
+	return openSerial(OpenClient, cfg, timeout)
+}
+
+// openSerial opens a Modbus RTU client on a serial port
+func openSerial(open OpenFunc, cfg config.SerialConfig, timeout time.Duration) (ModbusClient, error) {
+	client, err := open(ClientConfig{URL: "rtu://" + cfg.Device, Timeout: timeout, Serial: &cfg})
+	if err != nil {
+		return nil, failure.Wrap(failure.ErrConnUnreachable, fmt.Errorf("failed to open serial port %s: %w", cfg.Device, err))
+	}
+	return client, nil
+}
@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/ganehag/open-modbus-goateway/internal/signing"
+)
+
+// SignedHandler wraps a Handler and verifies request signatures before
+// passing the payload, without its signature options, to the wrapped handler.
+// Requests converted from JSON are verified against the JSON payload, which
+// carries the signature as its "kid" and "sig" members.
+type SignedHandler struct {
+	Handler  Handler
+	Verifier *signing.Verifier
+}
+
+// Handle verifies the payload signature and delegates valid requests
+func (h *SignedHandler) Handle(ctx context.Context, device string, payload string) string {
+	return TextEncoder{}.Encode(h.HandleResponse(ctx, device, payload))
+}
+
+// HandleResponse verifies the payload signature like Handle and returns the
+// structured response
+func (h *SignedHandler) HandleResponse(ctx context.Context, device string, payload string) *Response {
+	var message string
+	var err error
+	if raw, ok := ctx.Value(jsonPayloadKey{}).(string); ok {
+		message, err = payload, h.Verifier.VerifyJSON(raw)
+	} else {
+		message, err = h.Verifier.Verify(payload)
+	}
+	if err != nil {
+		log.Printf("Rejected request: %v", err)
+		return errorResponse(payloadCookie(payload), err.Error())
+	}
+
+	return respond(ctx, h.Handler, device, message)
+}
+
+// payloadCookie extracts the cookie of a payload that may not parse as a
+// whole, defaulting to 0
+func payloadCookie(payload string) uint64 {
+	parts := strings.Fields(payload)
+	if len(parts) < 2 {
+		return 0
+	}
+	cookie, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return cookie
+}
@@ -0,0 +1,422 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dop251/goja"
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+	"gopkg.in/yaml.v3"
+)
+
+// Tables of the registers of a register map
+const (
+	TableHolding  = "holding"
+	TableInput    = "input"
+	TableCoil     = "coil"
+	TableDiscrete = "discrete"
+)
+
+// RegisterMap declares the registers of a simulated device, with their
+// initial values and the expressions updating them
+type RegisterMap struct {
+	Interval  time.Duration    `yaml:"interval"`  // Period of the update expressions (default 1s)
+	Registers []MappedRegister `yaml:"registers"` // Registers set on the device
+}
+
+// MappedRegister is a value of a register map, held by one or more
+// registers, or by a coil or discrete input
+type MappedRegister struct {
+	Name     string    `yaml:"name"`     // Name of the value in the update expressions, optional
+	Table    string    `yaml:"table"`    // holding (default), input, coil or discrete
+	Register uint16    `yaml:"register"` // Register number as in requests, from 1
+	Type     DataType  `yaml:"type"`     // Type of the value of holding and input registers (default uint16)
+	Order    ByteOrder `yaml:"order"`    // Order of multi-register values (default ABCD)
+	Count    uint16    `yaml:"count"`    // Registers of a string (default: fitting the initial value)
+	Value    string    `yaml:"value"`    // Initial value (default 0, false or empty)
+	Update   string    `yaml:"update"`   // JavaScript expression of the value after each interval
+}
+
+// identifier matches the names usable as JavaScript variables
+var identifier = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$]*$`)
+
+// LoadRegisterMap reads a register map from a YAML file
+func LoadRegisterMap(path string) (*RegisterMap, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read register map: %w", err)
+	}
+	m := &RegisterMap{}
+	if err := yaml.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("failed to parse register map: %w", err)
+	}
+	return m, nil
+}
+
+// mappedValue is a register of a register map placed on the device
+type mappedValue struct {
+	MappedRegister
+	addr    uint16        // Address of the first register, coil or discrete input
+	width   int           // Registers holding the value, 1 for coils and discrete inputs
+	program *goja.Program // Compiled update expression, nil if none
+}
+
+// MappedDevice is a simulated device initialized from a register map.
+// Registers, coils and discrete inputs not in the map are 0 and unset. Every
+// interval, the update expressions of the map are evaluated with the values
+// at the start of the interval, and their results are set at once.
+type MappedDevice struct {
+	*SimulatedDevice
+	values   []*mappedValue
+	interval time.Duration
+
+	once sync.Once
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewMappedDevice creates a simulated device with size registers, coils and
+// discrete inputs each, set as declared in the register map. The update
+// expressions are evaluated once Start is called.
+func NewMappedDevice(size int, m *RegisterMap) (*MappedDevice, error) {
+	d := &MappedDevice{
+		SimulatedDevice: &SimulatedDevice{
+			coils:    make([]bool, size),
+			discrete: make([]bool, size),
+			holding:  make([]uint16, size),
+			input:    make([]uint16, size),
+		},
+		interval: m.Interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if d.interval < 0 {
+		return nil, fmt.Errorf("register map: interval must not be negative")
+	}
+	if d.interval == 0 {
+		d.interval = time.Second
+	}
+
+	names := make(map[string]bool)
+	used := make(map[string][]bool) // Addresses taken by the values of each table
+	for i, r := range m.Registers {
+		v, err := newMappedValue(r, size)
+		if err != nil {
+			return nil, fmt.Errorf("register map: entry %d: %w", i+1, err)
+		}
+		if v.Name != "" {
+			if names[v.Name] {
+				return nil, fmt.Errorf("register map: entry %d: duplicate name %q", i+1, v.Name)
+			}
+			names[v.Name] = true
+		}
+		if used[v.Table] == nil {
+			used[v.Table] = make([]bool, size)
+		}
+		for a := int(v.addr); a < int(v.addr)+v.width; a++ {
+			if used[v.Table][a] {
+				return nil, fmt.Errorf("register map: entry %d: overlaps another %s value at register %d", i+1, v.Table, a+1)
+			}
+			used[v.Table][a] = true
+		}
+		if err := d.set(v, v.Value); err != nil {
+			return nil, fmt.Errorf("register map: entry %d: invalid value %q: %w", i+1, v.Value, err)
+		}
+		d.values = append(d.values, v)
+	}
+	return d, nil
+}
+
+// newMappedValue checks a register of a register map and places it on a
+// device of the given size
+func newMappedValue(r MappedRegister, size int) (*mappedValue, error) {
+	v := &mappedValue{MappedRegister: r, width: 1}
+	if v.Name != "" && (!identifier.MatchString(v.Name) || v.Name == "value" || v.Name == "t") {
+		return nil, fmt.Errorf("invalid name %q", v.Name)
+	}
+	if v.Register < 1 {
+		return nil, fmt.Errorf("register must be specified, from 1")
+	}
+	v.addr = v.Register - 1
+
+	switch v.Table {
+	case "":
+		v.Table = TableHolding
+		fallthrough
+	case TableHolding, TableInput:
+		if v.Type == "" {
+			v.Type = TypeUint16
+		}
+		var err error
+		if v.Type, err = parseDataType(string(v.Type)); err != nil {
+			return nil, err
+		}
+		if v.Order != "" {
+			if v.Order, err = parseByteOrder(string(v.Order)); err != nil {
+				return nil, err
+			}
+		}
+		v.width = int(v.Type.Registers())
+		if v.Type == TypeString {
+			v.width = int(max(v.Count, uint16((len(v.Value)+1)/2), 1))
+		}
+	case TableCoil, TableDiscrete:
+		if v.Type != "" || v.Order != "" {
+			return nil, fmt.Errorf("%s values take no type or order", v.Table)
+		}
+	default:
+		return nil, fmt.Errorf("unknown table %q, expected holding, input, coil or discrete", v.Table)
+	}
+	if int(v.addr)+v.width > size {
+		return nil, fmt.Errorf("register %d is beyond the %d registers of the simulator", int(v.addr)+v.width, size)
+	}
+
+	if strings.TrimSpace(v.Update) != "" {
+		var err error
+		if v.program, err = goja.Compile(fmt.Sprintf("register %d", v.Register), v.Update, true); err != nil {
+			return nil, fmt.Errorf("invalid update expression: %w", err)
+		}
+	}
+	return v, nil
+}
+
+// get returns the value of a mapped value as a number, a boolean or a
+// string. The device must be locked.
+func (d *MappedDevice) get(v *mappedValue) any {
+	switch v.Table {
+	case TableCoil:
+		return d.coils[v.addr]
+	case TableDiscrete:
+		return d.discrete[v.addr]
+	}
+
+	bank := d.holding
+	if v.Table == TableInput {
+		bank = d.input
+	}
+	words := bank[v.addr : int(v.addr)+v.width]
+	if v.Type == TypeString {
+		text, _ := strconv.Unquote(decodeString(words, v.Order))
+		return text
+	}
+	text, err := appendValue(nil, v.Type, v.Order.toBigEndian(words))
+	if err != nil {
+		return math.NaN() // Invalid BCD digits
+	}
+	f, _ := strconv.ParseFloat(string(text), 64)
+	return f
+}
+
+// set sets a mapped value from its text. The device must be locked, or not
+// yet shared.
+func (d *MappedDevice) set(v *mappedValue, value string) error {
+	switch v.Table {
+	case TableCoil, TableDiscrete:
+		set := false
+		if value != "" {
+			var err error
+			if set, err = strconv.ParseBool(value); err != nil {
+				return err
+			}
+		}
+		if v.Table == TableCoil {
+			d.coils[v.addr] = set
+		} else {
+			d.discrete[v.addr] = set
+		}
+		return nil
+	}
+
+	var words []uint16
+	if v.Type == TypeString {
+		if len(value) > v.width*2 {
+			return fmt.Errorf("string of %d bytes does not fit in %d registers", len(value), v.width)
+		}
+		buf := make([]byte, v.width*2)
+		copy(buf, value)
+		words = make([]uint16, v.width)
+		for i := range words {
+			words[i] = uint16(buf[2*i])<<8 | uint16(buf[2*i+1])
+		}
+		if v.Order == OrderBADC || v.Order == OrderDCBA {
+			for i, w := range words {
+				words[i] = w<<8 | w>>8
+			}
+		}
+	} else {
+		if value == "" {
+			value = "0"
+		}
+		var err error
+		if words, err = encodeValues(value, &ModbusRequest{DataType: v.Type, Scale: 1}); err != nil {
+			return err
+		}
+		if len(words) != v.width {
+			return fmt.Errorf("expected a single %s value", v.Type)
+		}
+		words = v.Order.toBigEndian(words) // The reordering is its own inverse
+	}
+
+	bank := d.holding
+	if v.Table == TableInput {
+		bank = d.input
+	}
+	copy(bank[v.addr:], words)
+	return nil
+}
+
+// Start evaluates the update expressions every interval until Stop is called
+func (d *MappedDevice) Start() {
+	go d.run()
+}
+
+// Stop stops evaluating the update expressions
+func (d *MappedDevice) Stop() {
+	d.once.Do(func() {
+		close(d.stop)
+		<-d.done
+	})
+}
+
+// run evaluates the update expressions every interval in one interpreter
+func (d *MappedDevice) run() {
+	defer close(d.done)
+
+	var updated bool
+	for _, v := range d.values {
+		updated = updated || v.program != nil
+	}
+	if !updated {
+		<-d.stop
+		return
+	}
+
+	vm := goja.New()
+	start := time.Now()
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case now := <-ticker.C:
+			d.update(vm, now.Sub(start).Seconds())
+		}
+	}
+}
+
+// update evaluates the update expressions with the current values, t seconds
+// after start, and sets their results
+func (d *MappedDevice) update(vm *goja.Runtime, t float64) {
+	d.mu.Lock()
+	current := make([]any, len(d.values))
+	for i, v := range d.values {
+		current[i] = d.get(v)
+	}
+	d.mu.Unlock()
+
+	vm.Set("t", t)
+	for i, v := range d.values {
+		if v.Name != "" {
+			vm.Set(v.Name, current[i])
+		}
+	}
+
+	results := make([]string, len(d.values))
+	for i, v := range d.values {
+		if v.program == nil {
+			continue
+		}
+		vm.Set("value", current[i])
+		timer := time.AfterFunc(d.interval, func() { vm.Interrupt("timeout") })
+		result, err := vm.RunProgram(v.program)
+		if !timer.Stop() {
+			vm.ClearInterrupt()
+		}
+		if err != nil {
+			if ex, ok := err.(*goja.Exception); ok {
+				err = fmt.Errorf("%s", ex.Value()) // Without the stack trace
+			}
+			log.Printf("Failed to update register %d of the register map: %v", v.Register, err)
+			v.program = nil // Keep the value rather than logging the error every interval
+			continue
+		}
+		if results[i], err = v.format(result); err != nil {
+			log.Printf("Failed to update register %d of the register map: %v", v.Register, err)
+			v.program = nil
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i, v := range d.values {
+		if v.program == nil {
+			continue
+		}
+		if err := d.set(v, results[i]); err != nil {
+			log.Printf("Failed to update register %d of the register map: %v", v.Register, err)
+			v.program = nil
+		}
+	}
+}
+
+// format converts the result of an update expression to the text of a value
+func (v *mappedValue) format(result goja.Value) (string, error) {
+	switch {
+	case v.Table == TableCoil || v.Table == TableDiscrete:
+		return strconv.FormatBool(result.ToBoolean()), nil
+	case v.Type == TypeString:
+		return result.String(), nil
+	}
+
+	f := result.ToFloat()
+	if v.Type == TypeFloat32 || v.Type == TypeFloat64 {
+		return strconv.FormatFloat(f, 'g', -1, 64), nil
+	}
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return "", fmt.Errorf("%s is not a %s value", result, v.Type)
+	}
+	return strconv.FormatFloat(math.Round(f), 'f', 0, 64), nil
+}
+
+// simulatorHandler is the Modbus handler of the simulator handler with a
+// register map, updating the registers until closed
+type simulatorHandler struct {
+	*ModbusHandler
+	device *MappedDevice
+}
+
+// Close stops updating the registers and closes the Modbus handler
+func (h *simulatorHandler) Close() error {
+	h.device.Stop()
+	return h.ModbusHandler.Close()
+}
+
+// newSimulatorHandler creates the simulator handler, executing the requests
+// on a device initialized from the register map of the configuration, if any
+func newSimulatorHandler(cfg *config.Config) (Handler, error) {
+	h := newModbusHandler(cfg)
+	if cfg.Simulator.Map == "" {
+		h.Connect = NewSimulatedDevice(cfg.Simulator.Size).Connect
+		return h, nil
+	}
+
+	m, err := LoadRegisterMap(cfg.Simulator.Map)
+	if err != nil {
+		return nil, err
+	}
+	device, err := NewMappedDevice(cfg.Simulator.Size, m)
+	if err != nil {
+		return nil, err
+	}
+	h.Connect = device.Connect
+	device.Start()
+	return &simulatorHandler{ModbusHandler: h, device: device}, nil
+}
@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+
+	"github.com/simonvetter/modbus"
+)
+
+// SimulatorServer serves a simulated device over Modbus TCP, e.g. to test
+// the Modbus handler end to end. The device answers every unit ID.
+type SimulatorServer struct {
+	server *modbus.ModbusServer
+}
+
+// NewSimulatorServer creates a Modbus TCP server of the device listening on
+// host and port, serving up to maxClients connections. It listens once
+// Start is called.
+func NewSimulatorServer(host string, port uint16, maxClients uint, device *SimulatedDevice) (*SimulatorServer, error) {
+	server, err := modbus.NewServer(&modbus.ServerConfiguration{
+		URL:        "tcp://" + net.JoinHostPort(host, strconv.Itoa(int(port))),
+		MaxClients: maxClients,
+		Logger:     log.Default(),
+	}, simulatorRequests{device})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Modbus server: %w", err)
+	}
+	return &SimulatorServer{server: server}, nil
+}
+
+// Start listens for connections
+func (s *SimulatorServer) Start() error {
+	return s.server.Start()
+}
+
+// Stop closes the listener and the client connections
+func (s *SimulatorServer) Stop() error {
+	return s.server.Stop()
+}
+
+// simulatorRequests implements modbus.RequestHandler with a simulated device
+type simulatorRequests struct {
+	device *SimulatedDevice
+}
+
+func (r simulatorRequests) HandleCoils(req *modbus.CoilsRequest) ([]bool, error) {
+	if req.IsWrite {
+		return nil, r.device.WriteCoils(req.Addr, req.Args)
+	}
+	return r.device.ReadCoils(req.Addr, req.Quantity)
+}
+
+func (r simulatorRequests) HandleDiscreteInputs(req *modbus.DiscreteInputsRequest) ([]bool, error) {
+	return r.device.ReadDiscreteInputs(req.Addr, req.Quantity)
+}
+
+func (r simulatorRequests) HandleHoldingRegisters(req *modbus.HoldingRegistersRequest) ([]uint16, error) {
+	if req.IsWrite {
+		return nil, r.device.WriteRegisters(req.Addr, req.Args)
+	}
+	return r.device.ReadRegisters(req.Addr, req.Quantity, modbus.HOLDING_REGISTER)
+}
+
+func (r simulatorRequests) HandleInputRegisters(req *modbus.InputRegistersRequest) ([]uint16, error) {
+	return r.device.ReadRegisters(req.Addr, req.Quantity, modbus.INPUT_REGISTER)
+}
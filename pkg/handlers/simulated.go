@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"sync"
+
+	"github.com/simonvetter/modbus"
+)
+
+// SimulatedDevice is an in-memory Modbus device implementing ModbusClient.
+// Every holding and input register initially holds its own address, and
+// every coil and discrete input with an odd address is set. Accesses beyond
+// the size of the device fail with an illegal data address exception.
+type SimulatedDevice struct {
+	mu       sync.Mutex
+	coils    []bool
+	discrete []bool
+	holding  []uint16
+	input    []uint16
+}
+
+// NewSimulatedDevice creates a simulated device with size registers, coils
+// and discrete inputs each
+func NewSimulatedDevice(size int) *SimulatedDevice {
+	d := &SimulatedDevice{
+		coils:    make([]bool, size),
+		discrete: make([]bool, size),
+		holding:  make([]uint16, size),
+		input:    make([]uint16, size),
+	}
+	for i := 0; i < size; i++ {
+		d.coils[i] = i%2 == 1
+		d.discrete[i] = i%2 == 1
+		d.holding[i] = uint16(i)
+		d.input[i] = uint16(i)
+	}
+	return d
+}
+
+// Connect implements ConnectFunc, connecting every request to the device
+func (d *SimulatedDevice) Connect(req *ModbusRequest) (ModbusClient, error) {
+	return d, nil
+}
+
+// inRange checks that a range of quantity addresses starting at addr is
+// within a bank of the given size, and that the quantity is within the
+// protocol limit of a single transaction, like the Modbus TCP client does
+func inRange(addr uint16, quantity int, limit int, size int) error {
+	if quantity < 1 || quantity > limit {
+		return modbus.ErrUnexpectedParameters
+	}
+	if int(addr)+quantity > size {
+		return modbus.ErrIllegalDataAddress
+	}
+	return nil
+}
+
+func (d *SimulatedDevice) SetUnitId(id uint8) error {
+	return nil
+}
+
+func (d *SimulatedDevice) ReadCoils(addr uint16, quantity uint16) ([]bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := inRange(addr, int(quantity), maxReadBits, len(d.coils)); err != nil {
+		return nil, err
+	}
+	return append([]bool{}, d.coils[addr:int(addr)+int(quantity)]...), nil
+}
+
+func (d *SimulatedDevice) ReadDiscreteInputs(addr uint16, quantity uint16) ([]bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := inRange(addr, int(quantity), maxReadBits, len(d.discrete)); err != nil {
+		return nil, err
+	}
+	return append([]bool{}, d.discrete[addr:int(addr)+int(quantity)]...), nil
+}
+
+func (d *SimulatedDevice) ReadRegisters(addr uint16, quantity uint16, regType modbus.RegType) ([]uint16, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	bank := d.holding
+	if regType == modbus.INPUT_REGISTER {
+		bank = d.input
+	}
+	if err := inRange(addr, int(quantity), maxReadRegisters, len(bank)); err != nil {
+		return nil, err
+	}
+	return append([]uint16{}, bank[addr:int(addr)+int(quantity)]...), nil
+}
+
+func (d *SimulatedDevice) ReadRegister(addr uint16, regType modbus.RegType) (uint16, error) {
+	values, err := d.ReadRegisters(addr, 1, regType)
+	if err != nil {
+		return 0, err
+	}
+	return values[0], nil
+}
+
+func (d *SimulatedDevice) WriteCoil(addr uint16, value bool) error {
+	return d.WriteCoils(addr, []bool{value})
+}
+
+func (d *SimulatedDevice) WriteCoils(addr uint16, values []bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := inRange(addr, len(values), maxWriteBits, len(d.coils)); err != nil {
+		return err
+	}
+	copy(d.coils[addr:], values)
+	return nil
+}
+
+func (d *SimulatedDevice) WriteRegister(addr uint16, value uint16) error {
+	return d.WriteRegisters(addr, []uint16{value})
+}
+
+func (d *SimulatedDevice) WriteRegisters(addr uint16, values []uint16) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := inRange(addr, len(values), maxWriteRegisters, len(d.holding)); err != nil {
+		return err
+	}
+	copy(d.holding[addr:], values)
+	return nil
+}
+
+// Close implements ModbusClient; the device stays available
+func (d *SimulatedDevice) Close() error {
+	return nil
+}
@@ -0,0 +1,441 @@
+package handlers
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+	"github.com/ganehag/open-modbus-goateway/pkg/failure"
+	"github.com/simonvetter/modbus"
+)
+
+// The Modbus library dials its connections itself, without dial options.
+// Targets with dial options are reached by tcpClient instead, implementing
+// the Modbus TCP transactions of the supported function codes on a
+// connection dialed by the gateway.
+
+// dialTimeout is the connect timeout of Modbus TCP connections, as used by
+// the Modbus library
+const dialTimeout = 5 * time.Second
+
+// Function codes of the Modbus TCP transactions
+const (
+	fcReadCoils              = 0x01
+	fcReadDiscreteInputs     = 0x02
+	fcReadHoldingRegisters   = 0x03
+	fcReadInputRegisters     = 0x04
+	fcWriteSingleCoil        = 0x05
+	fcWriteSingleRegister    = 0x06
+	fcWriteMultipleCoils     = 0x0F
+	fcWriteMultipleRegisters = 0x10
+)
+
+// tcpOptions returns the dial options of a device, its own or the defaults
+func tcpOptions(defaults config.TCPConfig, d config.DeviceConfig) config.TCPConfig {
+	if d.TCP != nil {
+		return *d.TCP
+	}
+	return defaults
+}
+
+// connectTCPWith opens the Modbus TCP connection of a request with the dial
+// options, using the Modbus library opened by open when none are set. ctx
+// interrupts the dial and the transactions of connections dialed by the
+// gateway.
+func connectTCPWith(ctx context.Context, open OpenFunc, req *ModbusRequest, opts config.TCPConfig) (ModbusClient, error) {
+	if opts == (config.TCPConfig{}) {
+		return openTCP(open, req)
+	}
+	return dialTCP(ctx, req, opts)
+}
+
+// dialer returns the dialer of Modbus TCP connections with the dial options
+func dialer(opts config.TCPConfig) (*net.Dialer, error) {
+	d := &net.Dialer{Timeout: dialTimeout, KeepAlive: opts.KeepAlive}
+	if opts.LocalAddress == "" {
+		return d, nil
+	}
+
+	ip, err := localIP(opts.LocalAddress)
+	if err != nil {
+		return nil, err
+	}
+	d.LocalAddr = &net.TCPAddr{IP: ip}
+	return d, nil
+}
+
+// localIP returns the local address to bind to, given as an IP address or
+// the name of an interface, whose first IPv4 address is used if it has one
+func localIP(local string) (net.IP, error) {
+	if ip := net.ParseIP(local); ip != nil {
+		return ip, nil
+	}
+
+	iface, err := net.InterfaceByName(local)
+	if err != nil {
+		return nil, fmt.Errorf("invalid local address %q: %w", local, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the addresses of %s: %w", local, err)
+	}
+	var first net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			return ipNet.IP, nil
+		}
+		if first == nil {
+			first = ipNet.IP
+		}
+	}
+	if first == nil {
+		return nil, fmt.Errorf("interface %s has no address", local)
+	}
+	return first, nil
+}
+
+// roundTripper performs the Modbus TCP transactions of a tcpClient. A
+// transaction is abandoned once ctx is done.
+type roundTripper interface {
+	roundTrip(ctx context.Context, unitID uint8, pdu []byte) ([]byte, error)
+	close() error
+}
+
+// tcpClient is a Modbus TCP client on a connection dialed by the gateway
+type tcpClient struct {
+	rt     roundTripper
+	unitID uint8
+	ctx    context.Context // Of the request using the connection
+}
+
+// contextBinder is implemented by the clients on connections dialed by the
+// gateway, whose transactions are interrupted once the context of the
+// request using them is done
+type contextBinder interface {
+	bindContext(ctx context.Context)
+}
+
+// bindContext interrupts the transactions of a client once ctx is done, if
+// the gateway dialed its connection
+func bindContext(ctx context.Context, client ModbusClient) {
+	if b, ok := client.(contextBinder); ok {
+		b.bindContext(ctx)
+	}
+}
+
+// connTransport performs one transaction at a time on its own connection
+type connTransport struct {
+	conn    net.Conn
+	timeout time.Duration
+	txID    uint16
+}
+
+// dialTCP opens a Modbus TCP connection to the target of the request with
+// the dial options
+func dialTCP(ctx context.Context, req *ModbusRequest, opts config.TCPConfig) (ModbusClient, error) {
+	conn, err := dialConn(ctx, req, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &tcpClient{rt: &connTransport{conn: conn, timeout: req.Timeout}, unitID: 1, ctx: ctx}, nil
+}
+
+// dialConn dials the target of the request with the dial options
+func dialConn(ctx context.Context, req *ModbusRequest, opts config.TCPConfig) (net.Conn, error) {
+	d, err := dialer(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(req.IPAddress, strconv.Itoa(int(req.Port))))
+	if err != nil {
+		return nil, failure.Wrap(failure.ErrConnUnreachable, fmt.Errorf("failed to connect to Modbus server: %w", err))
+	}
+	return conn, nil
+}
+
+func (c *tcpClient) SetUnitId(id uint8) error {
+	c.unitID = id
+	return nil
+}
+
+func (c *tcpClient) Close() error {
+	return c.rt.close()
+}
+
+func (c *tcpClient) bindContext(ctx context.Context) {
+	c.ctx = ctx
+}
+
+// transaction sends a request PDU and returns the response PDU
+func (c *tcpClient) transaction(pdu []byte) ([]byte, error) {
+	ctx := c.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return c.rt.roundTrip(ctx, c.unitID, pdu)
+}
+
+func (t *connTransport) roundTrip(ctx context.Context, unitID uint8, pdu []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := t.conn.SetDeadline(time.Now().Add(t.timeout)); err != nil {
+		return nil, err
+	}
+	// A past deadline interrupts the blocked read or write once ctx is done
+	stop := context.AfterFunc(ctx, func() { t.conn.SetDeadline(time.Unix(1, 0)) })
+	defer stop()
+
+	t.txID++
+	res, err := mbapTransaction(t.conn, t.txID, unitID, pdu)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return res, err
+}
+
+func (t *connTransport) close() error {
+	return t.conn.Close()
+}
+
+// mbapTransaction sends a request PDU in a Modbus TCP frame and returns the
+// PDU of the response, mapping exception responses to the errors of the
+// Modbus library
+func mbapTransaction(conn io.ReadWriter, txID uint16, unitID uint8, pdu []byte) ([]byte, error) {
+	if _, err := conn.Write(mbapFrame(txID, unitID, pdu)); err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+
+	resTxID, resUnitID, res, err := readFrame(conn)
+	switch {
+	case err != nil:
+		return nil, err
+	case resTxID != txID:
+		return nil, modbus.ErrBadTransactionId
+	case resUnitID != unitID:
+		return nil, modbus.ErrBadUnitId
+	}
+	return responsePDU(pdu, res)
+}
+
+// mbapFrame frames a request PDU for Modbus TCP
+func mbapFrame(txID uint16, unitID uint8, pdu []byte) []byte {
+	frame := make([]byte, 7, 7+len(pdu))
+	binary.BigEndian.PutUint16(frame[0:], txID)
+	binary.BigEndian.PutUint16(frame[4:], uint16(1+len(pdu))) // Unit ID and PDU
+	frame[6] = unitID
+	return append(frame, pdu...)
+}
+
+// readFrame reads a Modbus TCP frame and returns its transaction ID, unit ID
+// and PDU
+func readFrame(r io.Reader) (uint16, uint8, []byte, error) {
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, 0, nil, readError(err)
+	}
+	length := binary.BigEndian.Uint16(header[4:])
+	switch {
+	case binary.BigEndian.Uint16(header[2:]) != 0:
+		return 0, 0, nil, modbus.ErrUnknownProtocolId
+	case length < 3 || length > 254:
+		return 0, 0, nil, modbus.ErrProtocolError
+	}
+
+	pdu := make([]byte, length-1)
+	if _, err := io.ReadFull(r, pdu); err != nil {
+		return 0, 0, nil, readError(err)
+	}
+	return binary.BigEndian.Uint16(header[0:]), header[6], pdu, nil
+}
+
+// responsePDU checks the function code of a response PDU against the
+// request, mapping exception responses to the errors of the Modbus library
+func responsePDU(req, res []byte) ([]byte, error) {
+	switch res[0] {
+	case req[0]:
+		return res, nil
+	case req[0] | 0x80:
+		return nil, exceptionError(res[1])
+	default:
+		return nil, modbus.ErrProtocolError
+	}
+}
+
+// readError maps network timeouts to the Modbus library error
+func readError(err error) error {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return modbus.ErrRequestTimedOut
+	}
+	if err == io.ErrUnexpectedEOF {
+		return modbus.ErrShortFrame
+	}
+	return err
+}
+
+// exceptionError returns the Modbus library error of an exception code
+func exceptionError(code byte) error {
+	key := strconv.Itoa(int(code))
+	for _, m := range mappableErrors {
+		if m.key == key {
+			return m.err
+		}
+	}
+	return fmt.Errorf("unknown exception code (%d)", code)
+}
+
+// request builds a request PDU of a function code and 16-bit fields
+func request(function byte, fields ...uint16) []byte {
+	pdu := make([]byte, 1+2*len(fields))
+	pdu[0] = function
+	for i, f := range fields {
+		binary.BigEndian.PutUint16(pdu[1+2*i:], f)
+	}
+	return pdu
+}
+
+// checkQuantity validates the quantity of a request like the Modbus library
+func checkQuantity(addr uint16, quantity uint16, max uint16) error {
+	if quantity == 0 || quantity > max || uint32(addr)+uint32(quantity)-1 > 0xFFFF {
+		return modbus.ErrUnexpectedParameters
+	}
+	return nil
+}
+
+func (c *tcpClient) readBits(function byte, addr uint16, quantity uint16) ([]bool, error) {
+	if err := checkQuantity(addr, quantity, 2000); err != nil {
+		return nil, err
+	}
+	res, err := c.transaction(request(function, addr, quantity))
+	if err != nil {
+		return nil, err
+	}
+
+	count := (int(quantity) + 7) / 8
+	if len(res) != 2+count || int(res[1]) != count {
+		return nil, modbus.ErrProtocolError
+	}
+	values := make([]bool, quantity)
+	for i := range values {
+		values[i] = res[2+i/8]&(1<<(i%8)) != 0
+	}
+	return values, nil
+}
+
+func (c *tcpClient) ReadCoils(addr uint16, quantity uint16) ([]bool, error) {
+	return c.readBits(fcReadCoils, addr, quantity)
+}
+
+func (c *tcpClient) ReadDiscreteInputs(addr uint16, quantity uint16) ([]bool, error) {
+	return c.readBits(fcReadDiscreteInputs, addr, quantity)
+}
+
+func (c *tcpClient) ReadRegisters(addr uint16, quantity uint16, regType modbus.RegType) ([]uint16, error) {
+	function := byte(fcReadHoldingRegisters)
+	if regType == modbus.INPUT_REGISTER {
+		function = fcReadInputRegisters
+	}
+	if err := checkQuantity(addr, quantity, 125); err != nil {
+		return nil, err
+	}
+	res, err := c.transaction(request(function, addr, quantity))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(res) != 2+2*int(quantity) || int(res[1]) != 2*int(quantity) {
+		return nil, modbus.ErrProtocolError
+	}
+	values := make([]uint16, quantity)
+	for i := range values {
+		values[i] = binary.BigEndian.Uint16(res[2+2*i:])
+	}
+	return values, nil
+}
+
+func (c *tcpClient) ReadRegister(addr uint16, regType modbus.RegType) (uint16, error) {
+	values, err := c.ReadRegisters(addr, 1, regType)
+	if err != nil {
+		return 0, err
+	}
+	return values[0], nil
+}
+
+// writeSingle performs a write function echoing its request
+func (c *tcpClient) writeSingle(function byte, addr uint16, value uint16) error {
+	pdu := request(function, addr, value)
+	res, err := c.transaction(pdu)
+	if err != nil {
+		return err
+	}
+	if string(res) != string(pdu) {
+		return modbus.ErrProtocolError
+	}
+	return nil
+}
+
+// writeMultiple performs a write function answered with its address and
+// quantity
+func (c *tcpClient) writeMultiple(function byte, addr uint16, quantity uint16, data []byte) error {
+	pdu := append(request(function, addr, quantity), byte(len(data)))
+	res, err := c.transaction(append(pdu, data...))
+	if err != nil {
+		return err
+	}
+	if string(res) != string(pdu[:5]) {
+		return modbus.ErrProtocolError
+	}
+	return nil
+}
+
+func (c *tcpClient) WriteCoil(addr uint16, value bool) error {
+	var v uint16
+	if value {
+		v = 0xFF00
+	}
+	return c.writeSingle(fcWriteSingleCoil, addr, v)
+}
+
+func (c *tcpClient) WriteRegister(addr uint16, value uint16) error {
+	return c.writeSingle(fcWriteSingleRegister, addr, value)
+}
+
+func (c *tcpClient) WriteCoils(addr uint16, values []bool) error {
+	if len(values) > 1968 {
+		return modbus.ErrUnexpectedParameters
+	}
+	if err := checkQuantity(addr, uint16(len(values)), 1968); err != nil {
+		return err
+	}
+	data := make([]byte, (len(values)+7)/8)
+	for i, v := range values {
+		if v {
+			data[i/8] |= 1 << (i % 8)
+		}
+	}
+	return c.writeMultiple(fcWriteMultipleCoils, addr, uint16(len(values)), data)
+}
+
+func (c *tcpClient) WriteRegisters(addr uint16, values []uint16) error {
+	if len(values) > 123 {
+		return modbus.ErrUnexpectedParameters
+	}
+	if err := checkQuantity(addr, uint16(len(values)), 123); err != nil {
+		return err
+	}
+	data := make([]byte, 2*len(values))
+	for i, v := range values {
+		binary.BigEndian.PutUint16(data[2*i:], v)
+	}
+	return c.writeMultiple(fcWriteMultipleRegisters, addr, uint16(len(values)), data)
+}
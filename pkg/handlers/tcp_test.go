@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+)
+
+// silentServer accepts Modbus TCP connections and never answers
+func silentServer(t *testing.T) (string, int) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port
+}
+
+func TestModbusHandlerContextInterruptsTransaction(t *testing.T) {
+	host, port := silentServer(t)
+	request := "0 1 0 " + host + " " + strconv.Itoa(port) + " 30 1 3 1 1"
+
+	for _, tt := range []struct {
+		name     string
+		pipeline int
+	}{{"connection of the request", 0}, {"pipelined connection", 4}} {
+		t.Run(tt.name, func(t *testing.T) {
+			// Dial options have the gateway dial the connection
+			h := &ModbusHandler{
+				TCP:     config.TCPConfig{KeepAlive: time.Minute},
+				Devices: map[string]config.DeviceConfig{"plc": {Pipeline: tt.pipeline}},
+			}
+			defer h.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			start := time.Now()
+			resp := h.HandleResponse(ctx, "plc", request)
+			if !errors.Is(resp.Err, context.DeadlineExceeded) {
+				t.Errorf("error %v", resp.Err)
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("interrupted after %v", elapsed)
+			}
+		})
+	}
+}
@@ -0,0 +1,32 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/toggle"
+)
+
+// ToggledHandler wraps a Handler and rejects requests for devices disabled
+// at runtime
+type ToggledHandler struct {
+	Handler Handler
+	Toggles *toggle.Set
+}
+
+// Handle rejects requests for disabled devices and delegates the others
+func (h *ToggledHandler) Handle(ctx context.Context, device string, payload string) string {
+	return TextEncoder{}.Encode(h.HandleResponse(ctx, device, payload))
+}
+
+// HandleResponse rejects requests for disabled devices like Handle and
+// returns the structured response
+func (h *ToggledHandler) HandleResponse(ctx context.Context, device string, payload string) *Response {
+	if h.Toggles.Disabled(toggle.Device, device) {
+		log.Printf("Rejected request for disabled device %q", device)
+		return errorResponse(payloadCookie(payload), fmt.Sprintf("DISABLED: device %q is disabled", device))
+	}
+
+	return respond(ctx, h.Handler, device, payload)
+}
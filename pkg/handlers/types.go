@@ -0,0 +1,390 @@
+package handlers
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// DataType describes how consecutive registers are combined into a value
+type DataType string
+
+const (
+	TypeUint16  DataType = "uint16" // Raw 16-bit register (default)
+	TypeInt16   DataType = "int16"  // Signed 16-bit register
+	TypeInt32   DataType = "int32"
+	TypeUint32  DataType = "uint32"
+	TypeInt64   DataType = "int64"
+	TypeUint64  DataType = "uint64"
+	TypeFloat32 DataType = "float32"
+	TypeFloat64 DataType = "float64"
+	TypeString  DataType = "string" // Two characters per register, NUL/space padded
+	TypeBCD     DataType = "bcd"    // Four BCD digits in one register
+	TypeBCD32   DataType = "bcd32"  // Eight BCD digits in two registers
+)
+
+// ByteOrder describes the order of the bytes of a multi-register value,
+// where A is the most significant byte of a 32-bit value
+type ByteOrder string
+
+const (
+	OrderABCD ByteOrder = "ABCD" // Big endian, high word first (default)
+	OrderCDAB ByteOrder = "CDAB" // Big endian, low word first
+	OrderBADC ByteOrder = "BADC" // Little endian bytes, high word first
+	OrderDCBA ByteOrder = "DCBA" // Little endian, low word first
+)
+
+// parseByteOrder parses the value of the "order=" request option
+func parseByteOrder(value string) (ByteOrder, error) {
+	switch o := ByteOrder(strings.ToUpper(value)); o {
+	case OrderABCD, OrderCDAB, OrderBADC, OrderDCBA:
+		return o, nil
+	default:
+		return "", fmt.Errorf("unsupported byte order %q", value)
+	}
+}
+
+// toBigEndian reorders the registers of a single value as transferred by the
+// device into big endian, high word first order
+func (o ByteOrder) toBigEndian(words []uint16) []uint16 {
+	ordered := make([]uint16, len(words))
+	copy(ordered, words)
+
+	if o == OrderCDAB || o == OrderDCBA {
+		for i, j := 0, len(ordered)-1; i < j; i, j = i+1, j-1 {
+			ordered[i], ordered[j] = ordered[j], ordered[i]
+		}
+	}
+	if o == OrderBADC || o == OrderDCBA {
+		for i, w := range ordered {
+			ordered[i] = w<<8 | w>>8
+		}
+	}
+
+	return ordered
+}
+
+// ValueFormat describes how response values are rendered
+type ValueFormat string
+
+const (
+	FormatDecimal ValueFormat = "dec"  // Decimal numbers (default)
+	FormatBool    ValueFormat = "bool" // true/false for coils, discrete inputs and bits
+	FormatHex     ValueFormat = "hex"  // Zero-padded raw register contents, e.g. 0x1A2B
+)
+
+// parseValueFormat parses the value of the "format=" request option
+func parseValueFormat(value string) (ValueFormat, error) {
+	switch f := ValueFormat(strings.ToLower(value)); f {
+	case FormatDecimal, FormatBool, FormatHex:
+		return f, nil
+	default:
+		return "", fmt.Errorf("unsupported format %q", value)
+	}
+}
+
+// parseDataType parses the value of the "type=" request option
+func parseDataType(value string) (DataType, error) {
+	switch t := DataType(strings.ToLower(value)); t {
+	case TypeUint16, TypeInt16, TypeInt32, TypeUint32, TypeInt64, TypeUint64, TypeFloat32, TypeFloat64, TypeString, TypeBCD, TypeBCD32:
+		return t, nil
+	default:
+		return "", fmt.Errorf("unsupported type %q", value)
+	}
+}
+
+// Registers returns the number of 16-bit registers holding one value of the type
+func (t DataType) Registers() uint16 {
+	switch t {
+	case TypeInt32, TypeUint32, TypeFloat32, TypeBCD32:
+		return 2
+	case TypeInt64, TypeUint64, TypeFloat64:
+		return 4
+	default:
+		return 1
+	}
+}
+
+// formatResults decodes the raw register values according to the request
+// data type and formats them into strings
+func formatResults(req *ModbusRequest, results []uint16) ([]string, error) {
+	if len(results) == 0 {
+		return nil, nil // Writes have no values
+	}
+
+	if req.DataType == TypeString {
+		return []string{decodeString(results, req.ByteOrder)}, nil
+	}
+
+	if req.Format == FormatBool {
+		response := make([]string, len(results))
+		for i, val := range results {
+			response[i] = strconv.FormatBool(val != 0)
+		}
+		return response, nil
+	}
+
+	width := int(req.DataType.Registers())
+	if len(results)%width != 0 {
+		return nil, fmt.Errorf("received %d registers, not a multiple of %d for type %s", len(results), width, req.DataType)
+	}
+
+	// Format all values into one buffer and slice them out of it, instead of
+	// allocating a string per value
+	count := len(results) / width
+	buf := make([]byte, 0, count*8)
+	var endsBuf [128]int
+	ends := endsBuf[:0]
+	for i := 0; i < len(results); i += width {
+		words := results[i : i+width]
+		if width > 1 {
+			words = req.ByteOrder.toBigEndian(words)
+		}
+		start := len(buf)
+		if req.Format == FormatHex {
+			buf = appendHex(buf, words)
+			ends = append(ends, len(buf))
+			continue
+		}
+		var err error
+		if buf, err = appendValue(buf, req.DataType, words); err != nil {
+			return nil, err
+		}
+		if req.Scaled() {
+			buf = append(buf[:start], scaleValue(string(buf[start:]), req.Scale, req.Offset)...)
+		}
+		ends = append(ends, len(buf))
+	}
+
+	text := string(buf)
+	response := make([]string, count)
+	start := 0
+	for i, end := range ends {
+		response[i] = text[start:end]
+		start = end
+	}
+	return response, nil
+}
+
+// appendValue combines the registers of a single value, in big endian, high
+// word first order, and appends the decoded value to dst
+func appendValue(dst []byte, t DataType, words []uint16) ([]byte, error) {
+	var raw uint64
+	for _, w := range words {
+		raw = raw<<16 | uint64(w)
+	}
+
+	switch t {
+	case TypeInt16:
+		return strconv.AppendInt(dst, int64(int16(raw)), 10), nil
+	case TypeInt32:
+		return strconv.AppendInt(dst, int64(int32(raw)), 10), nil
+	case TypeInt64:
+		return strconv.AppendInt(dst, int64(raw), 10), nil
+	case TypeFloat32:
+		return strconv.AppendFloat(dst, float64(math.Float32frombits(uint32(raw))), 'g', -1, 32), nil
+	case TypeFloat64:
+		return strconv.AppendFloat(dst, math.Float64frombits(raw), 'g', -1, 64), nil
+	case TypeBCD, TypeBCD32:
+		value, err := decodeBCD(raw, len(words)*4)
+		if err != nil {
+			return dst, err
+		}
+		return strconv.AppendUint(dst, value, 10), nil
+	default:
+		return strconv.AppendUint(dst, raw, 10), nil
+	}
+}
+
+// appendHex appends the raw registers of a value as one zero-padded
+// hexadecimal number, e.g. 0x1A2B or 0x0102A0B0
+func appendHex(dst []byte, words []uint16) []byte {
+	const digits = "0123456789ABCDEF"
+	dst = append(dst, "0x"...)
+	for _, w := range words {
+		dst = append(dst, digits[w>>12], digits[w>>8&0xf], digits[w>>4&0xf], digits[w&0xf])
+	}
+	return dst
+}
+
+// scaleValue converts a formatted decimal value to engineering units. The
+// result is limited to 15 significant digits to hide binary rounding noise
+// (e.g. 652 * 0.1 - 40 = 25.2, not 25.200000000000003).
+func scaleValue(value string, scale, offset float64) string {
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return value // NaN and Inf are passed through unchanged
+	}
+	return strconv.FormatFloat(f*scale+offset, 'g', 15, 64)
+}
+
+// decodeBCD converts the given number of packed BCD digits into a decimal value
+func decodeBCD(raw uint64, digits int) (uint64, error) {
+	var value uint64
+	for i := digits - 1; i >= 0; i-- {
+		digit := (raw >> (uint(i) * 4)) & 0xf
+		if digit > 9 {
+			return 0, fmt.Errorf("invalid BCD digit 0x%x in value 0x%0*x", digit, digits, raw)
+		}
+		value = value*10 + digit
+	}
+	return value, nil
+}
+
+// decodeString converts a register span into a quoted string. Each register
+// holds two characters, the first in the high byte unless the byte order
+// swaps bytes (BADC, DCBA). Trailing NUL and space padding is trimmed.
+func decodeString(words []uint16, order ByteOrder) string {
+	swap := order == OrderBADC || order == OrderDCBA
+
+	buf := make([]byte, 0, len(words)*2)
+	for _, w := range words {
+		if swap {
+			w = w<<8 | w>>8
+		}
+		buf = append(buf, byte(w>>8), byte(w))
+	}
+
+	return strconv.Quote(strings.TrimRight(string(buf), "\x00 "))
+}
+
+// encodeString converts the DATA field of a string write into registers,
+// padding with NUL up to the register count. The text is percent-decoded so
+// that spaces can be written as %20. Registers are returned with the first
+// character in the high byte; see wireData.
+func encodeString(data string, count uint16) ([]uint16, error) {
+	text, err := url.PathUnescape(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DATA string: %v", err)
+	}
+	if len(text) > int(count)*2 {
+		return nil, fmt.Errorf("DATA string of %d bytes does not fit in %d registers", len(text), count)
+	}
+
+	buf := make([]byte, int(count)*2)
+	copy(buf, text)
+
+	words := make([]uint16, count)
+	for i := range words {
+		words[i] = uint16(buf[2*i])<<8 | uint16(buf[2*i+1])
+	}
+
+	return words, nil
+}
+
+// wireData returns the registers of a write request in the byte order of the
+// device. Typed DATA is kept in big endian order until the byte order,
+// possibly a device default, is known.
+func wireData(req *ModbusRequest) []uint16 {
+	switch {
+	case req.DataType == TypeString && (req.ByteOrder == OrderBADC || req.ByteOrder == OrderDCBA):
+		words := make([]uint16, len(req.Data))
+		for i, w := range req.Data {
+			words[i] = w<<8 | w>>8
+		}
+		return words
+	case req.DataType != TypeString && req.DataType.Registers() > 1:
+		width := int(req.DataType.Registers())
+		words := make([]uint16, 0, len(req.Data))
+		for i := 0; i+width <= len(req.Data); i += width {
+			// The reordering is its own inverse
+			words = append(words, req.ByteOrder.toBigEndian(req.Data[i:i+width])...)
+		}
+		return words
+	default:
+		return req.Data
+	}
+}
+
+// encodeValues encodes comma-separated typed write values into registers in
+// big endian, high word first order. Values of a scaled request are given in
+// engineering units.
+func encodeValues(field string, req *ModbusRequest) ([]uint16, error) {
+	var words []uint16
+	for _, v := range strings.Split(field, ",") {
+		raw, err := encodeValue(req.DataType, v, req)
+		if err != nil {
+			return nil, err
+		}
+
+		width := int(req.DataType.Registers())
+		for i := width - 1; i >= 0; i-- {
+			words = append(words, uint16(raw>>(uint(i)*16)))
+		}
+	}
+	return words, nil
+}
+
+// encodeValue converts a single typed write value into its raw bits
+func encodeValue(t DataType, value string, req *ModbusRequest) (uint64, error) {
+	switch t {
+	case TypeFloat32, TypeFloat64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return 0, err
+		}
+		f = (f - req.Offset) / req.Scale
+		if t == TypeFloat32 {
+			return uint64(math.Float32bits(float32(f))), nil
+		}
+		return math.Float64bits(f), nil
+	}
+
+	bits := int(t.Registers()) * 16
+	signed := t == TypeInt16 || t == TypeInt32 || t == TypeInt64
+
+	var n int64
+	var u uint64
+	if req.Scaled() {
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return 0, err
+		}
+		f = math.Round((f - req.Offset) / req.Scale)
+		if signed {
+			if f < -math.Ldexp(1, bits-1) || f >= math.Ldexp(1, bits-1) {
+				return 0, fmt.Errorf("scaled value %s is out of range for type %s", value, t)
+			}
+			n = int64(f)
+		} else {
+			if f < 0 || f >= math.Ldexp(1, bits) {
+				return 0, fmt.Errorf("scaled value %s is out of range for type %s", value, t)
+			}
+			u = uint64(f)
+		}
+	} else if signed {
+		var err error
+		if n, err = strconv.ParseInt(value, 10, bits); err != nil {
+			return 0, err
+		}
+	} else {
+		var err error
+		if u, err = strconv.ParseUint(value, 10, bits); err != nil {
+			return 0, err
+		}
+	}
+
+	switch t {
+	case TypeBCD, TypeBCD32:
+		return encodeBCD(u, bits/4)
+	case TypeInt16, TypeInt32, TypeInt64:
+		return uint64(n) & (1<<bits - 1), nil
+	default:
+		return u, nil
+	}
+}
+
+// encodeBCD converts a decimal value into the given number of packed BCD digits
+func encodeBCD(value uint64, digits int) (uint64, error) {
+	var raw uint64
+	for i := 0; i < digits; i++ {
+		raw |= (value % 10) << (uint(i) * 4)
+		value /= 10
+	}
+	if value != 0 {
+		return 0, fmt.Errorf("value does not fit in %d BCD digits", digits)
+	}
+	return raw, nil
+}
@@ -0,0 +1,465 @@
+package handlers
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+	"github.com/ganehag/open-modbus-goateway/pkg/protocol"
+)
+
+// ModbusRequest represents a parsed Modbus query request
+type ModbusRequest struct {
+	Cookie          uint64
+	IPAddress       string
+	Port            uint16
+	Timeout         time.Duration
+	SlaveID         uint8
+	FunctionCode    uint8
+	RegisterAddress uint16
+	RegisterCount   uint16
+	Data            []uint16
+	HasBit          bool                       // Set when the register number carries a bit suffix (e.g. 40010.3)
+	Bit             uint8                      // Bit index within the register (0 = least significant)
+	DataType        DataType                   // Type used to decode register values (option "type=")
+	Format          ValueFormat                // Rendering of response values (option "format=")
+	ByteOrder       ByteOrder                  // Order of multi-register values (option "order="), empty for the device default
+	Scale           float64                    // Factor applied to read values (option "scale="), inverted for writes
+	Offset          float64                    // Offset added to read values after scaling (option "offset=")
+	Verify          bool                       // Read written values back and compare them (option "verify=")
+	Timestamp       bool                       // Append the transaction time to the response (option "timestamp=")
+	Quality         bool                       // Append the quality of the result to the response (option "quality=")
+	Diagnostics     bool                       // Append transaction timings and retries to the response (option "diag=")
+	MaxAge          time.Duration              // Accept a cached result read at most this long ago (option "max_age=")
+	PostProcess     []config.PostProcessConfig // Fixups of the device applied to register reads
+
+	connectTime time.Duration // Time taken to open the connection of the request
+	turnaround  time.Duration // Time taken to execute the request on the open connection
+	retries     int           // Retries of transient failures the request took
+	cached      bool          // Answered from the read cache
+	cacheAge    time.Duration // Age of the cached result
+}
+
+// defaultRequestLimits are the Modbus read limits, bounding the registers
+// and coils of requests without configured limits
+var defaultRequestLimits = config.RequestLimitsConfig{MaxRegisters: 125, MaxCoils: 2000}
+
+// checkProtocol rejects text requests in a version that isn't accepted
+func checkProtocol(accepted config.ProtocolConfig, payload string) error {
+	if !accepted.RejectV1 {
+		return nil
+	}
+	first, _, _ := strings.Cut(strings.TrimSpace(payload), " ")
+	if protocol.VersionOf(first) == protocol.V1 {
+		return fmt.Errorf("UNSUPPORTED_VERSION: version 1 requests are rejected, use version 2")
+	}
+	return nil
+}
+
+// checkRequestLimits rejects requests addressing more registers or coils than
+// allowed by the limits, the Modbus read limits where unset
+func checkRequestLimits(limits config.RequestLimitsConfig, req *ModbusRequest) error {
+	if limits.MaxRegisters == 0 {
+		limits.MaxRegisters = defaultRequestLimits.MaxRegisters
+	}
+	if limits.MaxCoils == 0 {
+		limits.MaxCoils = defaultRequestLimits.MaxCoils
+	}
+
+	switch req.FunctionCode {
+	case 1, 2, 5, 15:
+		if req.RegisterCount > limits.MaxCoils {
+			return fmt.Errorf("REGISTER_COUNT %d exceeds the maximum of %d coils", req.RegisterCount, limits.MaxCoils)
+		}
+	default:
+		if req.span() > uint32(limits.MaxRegisters) {
+			return fmt.Errorf("request spans %d registers, exceeding the maximum of %d", req.span(), limits.MaxRegisters)
+		}
+	}
+	return nil
+}
+
+// Scaled reports whether values are transformed to engineering units
+func (r *ModbusRequest) Scaled() bool {
+	return r.Scale != 1 || r.Offset != 0
+}
+
+// span returns the number of registers, coils or inputs read or written by
+// the request, including all registers touched by a bit read
+func (r *ModbusRequest) span() uint32 {
+	if r.HasBit {
+		return (uint32(r.Bit) + uint32(r.RegisterCount) + 15) / 16
+	}
+	return uint32(r.RegisterCount)
+}
+
+// maxRequestFields is the number of fields of a request, positional fields
+// and options, that are split without allocating
+const maxRequestFields = 16
+
+// parseRequest parses the Modbus request payload into a ModbusRequest struct
+func parseRequest(payload string) (*ModbusRequest, error) {
+	var buf [maxRequestFields]string
+	fields := appendFields(buf[:0], payload)
+	if len(fields) == 0 || len(fields) < protocol.VersionOf(fields[0]).HeaderFields()+2 {
+		return nil, fmt.Errorf("incomplete request payload")
+	}
+	command := protocol.SplitOptions(fields)
+	header, parts, err := protocol.ParseHeader(command.Fields)
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("incomplete request payload")
+	}
+
+	// Parse the command, starting at the function
+	functionCode, err := strconv.ParseUint(parts[0], 10, 8)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MODBUS_FUNCTION value: %v", err)
+	}
+
+	registerAddress, hasBit, bit, err := parseRegisterNumber(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	registerAddress -= 1 // Requests uses RegisterNumbers
+
+	if hasBit && functionCode != 3 && functionCode != 4 && functionCode != 6 {
+		return nil, fmt.Errorf("bit addressing is not supported for function %d", functionCode)
+	}
+
+	request := &ModbusRequest{
+		Cookie:          header.Cookie,
+		IPAddress:       header.IP,
+		Port:            header.Port,
+		Timeout:         header.Timeout,
+		SlaveID:         header.SlaveID,
+		FunctionCode:    uint8(functionCode),
+		RegisterAddress: uint16(registerAddress),
+		Data:            []uint16{},
+		HasBit:          hasBit,
+		Bit:             bit,
+		DataType:        TypeUint16,
+		Format:          FormatDecimal,
+		Scale:           1,
+	}
+
+	// Options are applied first, as they affect how DATA is parsed
+	if err := applyOptions(request, command.Options); err != nil {
+		return nil, err
+	}
+
+	// Parse function-specific values
+	switch functionCode {
+	case 1, 2, 3, 4: // Reading functions
+		if len(parts) < 3 {
+			return nil, fmt.Errorf("missing REGISTER_COUNT for function %d", functionCode)
+		}
+		count, err := strconv.ParseUint(parts[2], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid REGISTER_COUNT value: %v", err)
+		}
+		request.RegisterCount = uint16(count)
+	case 5, 6: // Writing a single coil/register
+		if len(parts) < 3 {
+			return nil, fmt.Errorf("missing VALUE for function %d", functionCode)
+		}
+		request.RegisterCount = 1
+		field, err := typedField(parts[2], request)
+		if err != nil {
+			return nil, err
+		}
+		if request.DataType != TypeUint16 {
+			request.Data, err = encodeValues(field, request)
+			if err != nil {
+				return nil, fmt.Errorf("invalid VALUE value: %v", err)
+			}
+			break
+		}
+		value, err := parseValue(field, request, functionCode == 5)
+		if err != nil {
+			return nil, fmt.Errorf("invalid VALUE value: %v", err)
+		}
+		if hasBit && value > 1 {
+			return nil, fmt.Errorf("invalid VALUE for bit write: must be 0 or 1")
+		}
+		request.Data = append(request.Data, uint16(value))
+	case 15, 16: // Writing multiple registers/coils
+		if len(parts) < 4 {
+			return nil, fmt.Errorf("missing REGISTER_COUNT or DATA for function %d", functionCode)
+		}
+		count, err := strconv.ParseUint(parts[2], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid REGISTER_COUNT value: %v", err)
+		}
+		request.RegisterCount = uint16(count)
+		field := parts[3]
+		if functionCode == 16 {
+			if field, err = typedField(field, request); err != nil {
+				return nil, err
+			}
+		}
+		switch request.DataType {
+		case TypeString:
+			request.Data, err = encodeString(field, request.RegisterCount)
+			if err != nil {
+				return nil, err
+			}
+		case TypeUint16:
+			request.Data = make([]uint16, 0, strings.Count(field, ",")+1)
+			for rest, more := field, true; more; {
+				var v string
+				v, rest, more = strings.Cut(rest, ",")
+				value, err := parseValue(v, request, functionCode == 15)
+				if err != nil {
+					return nil, fmt.Errorf("invalid DATA value: %v", err)
+				}
+				request.Data = append(request.Data, uint16(value))
+			}
+		default:
+			request.Data, err = encodeValues(field, request)
+			if err != nil {
+				return nil, fmt.Errorf("invalid DATA value: %v", err)
+			}
+		}
+		if len(request.Data) != int(request.RegisterCount) {
+			return nil, fmt.Errorf("mismatch between REGISTER_COUNT and DATA length")
+		}
+	}
+
+	if err := validateOptions(request); err != nil {
+		return nil, err
+	}
+
+	return request, nil
+}
+
+// appendFields appends the fields of s separated by white space to dst, like
+// strings.Fields, without allocating while dst has room
+func appendFields(dst []string, s string) []string {
+	start := -1
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= utf8.RuneSelf { // Unicode white space is rare
+			if start < 0 {
+				start = i
+			}
+			return append(dst, strings.Fields(s[start:])...)
+		}
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f' {
+			if start >= 0 {
+				dst = append(dst, s[start:i])
+				start = -1
+			}
+		} else if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		dst = append(dst, s[start:])
+	}
+	return dst
+}
+
+// applyOptions parses the request options and stores them in the request
+func applyOptions(req *ModbusRequest, options map[string]string) error {
+	for key, value := range options {
+		switch key {
+		case "type":
+			dataType, err := parseDataType(value)
+			if err != nil {
+				return err
+			}
+			req.DataType = dataType
+		case "format":
+			format, err := parseValueFormat(value)
+			if err != nil {
+				return err
+			}
+			req.Format = format
+		case "scale":
+			scale, err := strconv.ParseFloat(value, 64)
+			if err != nil || scale == 0 || math.IsInf(scale, 0) || math.IsNaN(scale) {
+				return fmt.Errorf("invalid scale %q", value)
+			}
+			req.Scale = scale
+		case "offset":
+			offset, err := strconv.ParseFloat(value, 64)
+			if err != nil || math.IsInf(offset, 0) || math.IsNaN(offset) {
+				return fmt.Errorf("invalid offset %q", value)
+			}
+			req.Offset = offset
+		case "order":
+			order, err := parseByteOrder(value)
+			if err != nil {
+				return err
+			}
+			req.ByteOrder = order
+		case "verify":
+			verify, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid verify %q", value)
+			}
+			req.Verify = verify
+		case "timestamp":
+			timestamp, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid timestamp %q", value)
+			}
+			req.Timestamp = timestamp
+		case "quality":
+			quality, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid quality %q", value)
+			}
+			req.Quality = quality
+		case "diag":
+			diag, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid diag %q", value)
+			}
+			req.Diagnostics = diag
+		case "max_age":
+			maxAge, err := time.ParseDuration(value)
+			if err != nil || maxAge <= 0 {
+				return fmt.Errorf("invalid max_age %q", value)
+			}
+			req.MaxAge = maxAge
+		default:
+			return fmt.Errorf("unknown option %q", key)
+		}
+	}
+
+	return nil
+}
+
+// validateOptions checks that the request options are consistent with the
+// function and register range of the request
+func validateOptions(req *ModbusRequest) error {
+	if req.Scaled() {
+		switch {
+		case req.FunctionCode != 3 && req.FunctionCode != 4 && req.FunctionCode != 6 && req.FunctionCode != 16:
+			return fmt.Errorf("options scale/offset are not supported for function %d", req.FunctionCode)
+		case req.HasBit, req.DataType == TypeString, req.Format == FormatBool:
+			return fmt.Errorf("options scale/offset require numeric register values")
+		}
+	}
+
+	if req.Format == FormatBool && req.FunctionCode != 1 && req.FunctionCode != 2 && !req.HasBit {
+		return fmt.Errorf("option format=bool requires a coil, discrete input or bit read")
+	}
+	if req.Format == FormatHex {
+		switch {
+		case req.FunctionCode != 3 && req.FunctionCode != 4:
+			return fmt.Errorf("option format=hex is not supported for function %d", req.FunctionCode)
+		case req.HasBit, req.DataType == TypeString, req.Scaled():
+			return fmt.Errorf("option format=hex requires raw register values")
+		}
+	}
+
+	if req.Verify && !isWriteFunction(req.FunctionCode) {
+		return fmt.Errorf("option verify is not supported for function %d", req.FunctionCode)
+	}
+	if req.MaxAge > 0 && (req.FunctionCode < 1 || req.FunctionCode > 4) {
+		return fmt.Errorf("option max_age is not supported for function %d", req.FunctionCode)
+	}
+
+	if req.DataType == TypeString {
+		if req.FunctionCode != 3 && req.FunctionCode != 4 && req.FunctionCode != 16 {
+			return fmt.Errorf("option type=string is not supported for function %d", req.FunctionCode)
+		}
+	} else if req.DataType != TypeUint16 {
+		switch req.FunctionCode {
+		case 3, 4, 16:
+		case 6:
+			if req.DataType.Registers() != 1 {
+				return fmt.Errorf("type %s needs %d registers, use function 16", req.DataType, req.DataType.Registers())
+			}
+		default:
+			return fmt.Errorf("option type is not supported for function %d", req.FunctionCode)
+		}
+		if req.HasBit {
+			return fmt.Errorf("option type cannot be combined with bit addressing")
+		}
+		if req.RegisterCount%req.DataType.Registers() != 0 {
+			return fmt.Errorf("REGISTER_COUNT must be a multiple of %d for type %s", req.DataType.Registers(), req.DataType)
+		}
+	}
+
+	return nil
+}
+
+// typedField strips an optional "<type>:" prefix from a VALUE/DATA field,
+// e.g. "float32:3.14,2.5", and sets the request data type accordingly
+func typedField(field string, req *ModbusRequest) (string, error) {
+	prefix, rest, ok := strings.Cut(field, ":")
+	if !ok {
+		return field, nil
+	}
+
+	dataType, err := parseDataType(prefix)
+	if err != nil {
+		return "", err
+	}
+	if req.DataType != TypeUint16 && req.DataType != dataType {
+		return "", fmt.Errorf("DATA type %s conflicts with option type=%s", dataType, req.DataType)
+	}
+	req.DataType = dataType
+
+	return rest, nil
+}
+
+// parseValue parses a numeric write value. Coil values may also be given
+// symbolically as on/off/true/false. Register values of a scaled request are
+// given in engineering units and converted back to the raw register value.
+func parseValue(field string, req *ModbusRequest, coil bool) (uint64, error) {
+	if coil {
+		switch strings.ToLower(field) {
+		case "on", "true":
+			return 1, nil
+		case "off", "false":
+			return 0, nil
+		}
+	}
+
+	if !coil && req.Scaled() {
+		value, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return 0, err
+		}
+		raw := math.Round((value - req.Offset) / req.Scale)
+		if raw < 0 || raw > math.MaxUint16 {
+			return 0, fmt.Errorf("scaled value %s is out of register range", field)
+		}
+		return uint64(raw), nil
+	}
+
+	return strconv.ParseUint(field, 10, 16)
+}
+
+// parseRegisterNumber parses a REGISTER_NUMBER field with an optional bit
+// suffix, e.g. "40010" or "40010.3".
+func parseRegisterNumber(field string) (uint64, bool, uint8, error) {
+	number, bitPart, hasBit := strings.Cut(field, ".")
+
+	registerNumber, err := strconv.ParseUint(number, 10, 16)
+	if err != nil || registerNumber < 1 {
+		return 0, false, 0, fmt.Errorf("invalid REGISTER_NUMBER value: %v", err)
+	}
+
+	if !hasBit {
+		return registerNumber, false, 0, nil
+	}
+
+	bit, err := strconv.ParseUint(bitPart, 10, 8)
+	if err != nil || bit > 15 {
+		return 0, false, 0, fmt.Errorf("invalid REGISTER_NUMBER bit index: %q", bitPart)
+	}
+
+	return registerNumber, true, uint8(bit), nil
+}
@@ -0,0 +1,261 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// maxIdleInstances bounds the module instances kept for later requests
+const maxIdleInstances = 8
+
+// WASMHandler executes requests with a WebAssembly module, sandboxed from the
+// host: the module has no access to files, the network or the environment.
+// The module exports its memory and the functions
+//
+//	alloc(size i32) i32              // Allocates size bytes, for the arguments of handle
+//	handle(device, payload i32, i32) i64 // Handles a request, returns the response
+//	free(ptr, size i32)              // Optional, releases memory of alloc and handle
+//
+// where strings are passed as pointer and length, and returned packed as
+// pointer << 32 | length. It may pass requests on to the next handler with
+// the imports of the "gateway" module:
+//
+//	execute(device, payload i32, i32) i32 // Executes a request, returns the response length
+//	response(ptr i32)                      // Copies the response of the last execute to ptr
+//
+// Each concurrent request runs in its own instance of the module.
+type WASMHandler struct {
+	runtime wazero.Runtime
+	module  wazero.CompiledModule
+	next    Handler // Executes the requests passed on by the module, may be nil
+	timeout time.Duration
+	idle    chan api.Module // Instances kept for later requests
+}
+
+// wasmCall is the state of a request executed by a module instance
+type wasmCall struct {
+	response []byte // Response of the last request passed on, until copied
+}
+
+// wasmCallKey is the context key of the wasmCall of a request
+type wasmCallKey struct{}
+
+// NewWASMHandler compiles the WebAssembly module of the configuration,
+// passing requests on to next
+func NewWASMHandler(cfg config.WASMConfig, next Handler) (*WASMHandler, error) {
+	binary, err := os.ReadFile(cfg.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read WebAssembly module: %w", err)
+	}
+
+	ctx := context.Background()
+	h := &WASMHandler{
+		runtime: wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCloseOnContextDone(true)),
+		next:    next,
+		timeout: cfg.Timeout,
+		idle:    make(chan api.Module, maxIdleInstances),
+	}
+	if h.timeout <= 0 {
+		h.timeout = 10 * time.Second
+	}
+
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, h.runtime); err != nil {
+		h.runtime.Close(ctx)
+		return nil, fmt.Errorf("failed to instantiate WASI: %w", err)
+	}
+	_, err = h.runtime.NewHostModuleBuilder("gateway").
+		NewFunctionBuilder().WithFunc(h.execute).Export("execute").
+		NewFunctionBuilder().WithFunc(h.response).Export("response").
+		Instantiate(ctx)
+	if err != nil {
+		h.runtime.Close(ctx)
+		return nil, fmt.Errorf("failed to instantiate gateway imports: %w", err)
+	}
+
+	if h.module, err = h.runtime.CompileModule(ctx, binary); err != nil {
+		h.runtime.Close(ctx)
+		return nil, fmt.Errorf("failed to compile WebAssembly module: %w", err)
+	}
+	for _, name := range []string{"alloc", "handle"} {
+		if _, ok := h.module.ExportedFunctions()[name]; !ok {
+			h.runtime.Close(ctx)
+			return nil, fmt.Errorf("WebAssembly module doesn't export %s", name)
+		}
+	}
+
+	// Report errors of the module initialization now rather than on the first request
+	m, err := h.instantiate(ctx)
+	if err != nil {
+		h.runtime.Close(ctx)
+		return nil, fmt.Errorf("failed to instantiate WebAssembly module: %w", err)
+	}
+	h.idle <- m
+	return h, nil
+}
+
+// instantiate creates an instance of the module
+func (h *WASMHandler) instantiate(ctx context.Context) (api.Module, error) {
+	return h.runtime.InstantiateModule(ctx, h.module, wazero.NewModuleConfig().
+		WithName(""). // Anonymous, so the module can be instantiated more than once
+		WithStartFunctions("_initialize").
+		WithStderr(os.Stderr))
+}
+
+// Handle passes the request to the handle function of an instance of the
+// module. An instance whose call failed, e.g. timed out, is discarded.
+func (h *WASMHandler) Handle(ctx context.Context, device string, payload string) string {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+	ctx = context.WithValue(ctx, wasmCallKey{}, &wasmCall{})
+
+	var m api.Module
+	select {
+	case m = <-h.idle:
+	default:
+		var err error
+		if m, err = h.instantiate(context.Background()); err != nil {
+			return TextEncoder{}.Encode(errorResponse(payloadCookie(payload), fmt.Sprintf("WASM_ERROR: %v", err)))
+		}
+	}
+
+	response, err := h.call(ctx, m, device, payload)
+	if err != nil {
+		m.Close(context.Background())
+		log.Printf("WebAssembly handler failed on request for device %q: %v", device, err)
+		return TextEncoder{}.Encode(errorResponse(payloadCookie(payload), fmt.Sprintf("WASM_ERROR: %v", err)))
+	}
+
+	select {
+	case h.idle <- m:
+	default:
+		m.Close(context.Background())
+	}
+	return response
+}
+
+// call calls the handle function of an instance
+func (h *WASMHandler) call(ctx context.Context, m api.Module, device string, payload string) (string, error) {
+	devicePtr, err := writeString(ctx, m, device)
+	if err != nil {
+		return "", err
+	}
+	payloadPtr, err := writeString(ctx, m, payload)
+	if err != nil {
+		return "", err
+	}
+
+	results, err := m.ExportedFunction("handle").Call(ctx, devicePtr, uint64(len(device)), payloadPtr, uint64(len(payload)))
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return "", err
+	}
+	ptr, size := uint32(results[0]>>32), uint32(results[0])
+	response, ok := m.Memory().Read(ptr, size)
+	if !ok {
+		return "", fmt.Errorf("response out of memory bounds")
+	}
+	response = append([]byte(nil), response...) // The view changes with the memory
+
+	if free := m.ExportedFunction("free"); free != nil {
+		for _, s := range [][2]uint64{{devicePtr, uint64(len(device))}, {payloadPtr, uint64(len(payload))}, {uint64(ptr), uint64(size)}} {
+			if _, err := free.Call(ctx, s[0], s[1]); err != nil {
+				return "", err
+			}
+		}
+	}
+	return string(response), nil
+}
+
+// writeString copies a string into memory allocated by the alloc function of
+// an instance and returns its pointer
+func writeString(ctx context.Context, m api.Module, s string) (uint64, error) {
+	results, err := m.ExportedFunction("alloc").Call(ctx, uint64(len(s)))
+	if err != nil {
+		return 0, err
+	}
+	if !m.Memory().WriteString(uint32(results[0]), s) {
+		return 0, fmt.Errorf("allocation out of memory bounds")
+	}
+	return results[0], nil
+}
+
+// execute implements the execute import, passing a request of the module on
+// to the next handler
+func (h *WASMHandler) execute(ctx context.Context, m api.Module, devicePtr, deviceLen, payloadPtr, payloadLen uint32) uint32 {
+	device, ok := m.Memory().Read(devicePtr, deviceLen)
+	payload, ok2 := m.Memory().Read(payloadPtr, payloadLen)
+	var response string
+	switch {
+	case !ok || !ok2:
+		response = "0 ERROR: WASM_ERROR: request out of memory bounds"
+	case h.next == nil:
+		response = TextEncoder{}.Encode(errorResponse(payloadCookie(string(payload)), "WASM_ERROR: no next handler to execute the request"))
+	default:
+		response = h.next.Handle(ctx, string(device), string(payload))
+	}
+
+	call := ctx.Value(wasmCallKey{}).(*wasmCall)
+	call.response = []byte(response)
+	return uint32(len(call.response))
+}
+
+// response implements the response import, copying the response of the last
+// request passed on into the memory of the module
+func (h *WASMHandler) response(ctx context.Context, m api.Module, ptr uint32) {
+	call := ctx.Value(wasmCallKey{}).(*wasmCall)
+	if !m.Memory().Write(ptr, call.response) {
+		panic(fmt.Errorf("response out of memory bounds")) // Fails the call of the module
+	}
+	call.response = nil
+}
+
+// Close releases the module and closes the next handler, if it holds
+// resources
+func (h *WASMHandler) Close() error {
+	if closer, ok := h.next.(io.Closer); ok {
+		closer.Close()
+	}
+	return h.runtime.Close(context.Background())
+}
+
+// LoadWASM registers the handlers of the WebAssembly modules of the
+// configuration under the module names. Modules are compiled when their
+// handler is created.
+func LoadWASM(modules []config.WASMConfig) error {
+	for _, w := range modules {
+		if _, ok := handlerFactories[w.Name]; ok {
+			return fmt.Errorf("wasm %s: handler %q is already registered", w.Name, w.Name)
+		}
+
+		w := w
+		RegisterHandler(w.Name, func(cfg *config.Config) (Handler, error) {
+			var next Handler
+			if w.Next != "" {
+				var err error
+				if next, err = NewHandler(w.Next, cfg); err != nil {
+					return nil, fmt.Errorf("wasm %s: %w", w.Name, err)
+				}
+			}
+			h, err := NewWASMHandler(w, next)
+			if err != nil {
+				if closer, ok := next.(io.Closer); ok {
+					closer.Close()
+				}
+				return nil, fmt.Errorf("wasm %s: %w", w.Name, err)
+			}
+			return h, nil
+		})
+	}
+	return nil
+}
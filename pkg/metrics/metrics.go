@@ -0,0 +1,34 @@
+// Package metrics defines the sink the gateway and its handlers report their
+// metrics to, so an instrumentation backend, e.g. Prometheus or StatsD, can
+// be plugged in without the other packages depending on it.
+package metrics
+
+// Labels are the dimensions of a metric, e.g. the lane or the status of a
+// request. The names of the labels of a metric are always the same.
+type Labels map[string]string
+
+// Sink receives the metrics. Names are in snake case without a namespace,
+// which the sink may add, and durations are in seconds. A sink is called
+// concurrently and must not block.
+type Sink interface {
+	// Add increments the counter name by delta
+	Add(name string, delta float64, labels Labels)
+	// Observe records a value of the histogram name
+	Observe(name string, value float64, labels Labels)
+}
+
+// Discard is the sink of the metrics when none is given, dropping them
+var Discard Sink = discard{}
+
+type discard struct{}
+
+func (discard) Add(name string, delta float64, labels Labels)     {}
+func (discard) Observe(name string, value float64, labels Labels) {}
+
+// OrDiscard returns sink, or Discard if it is nil
+func OrDiscard(sink Sink) Sink {
+	if sink == nil {
+		return Discard
+	}
+	return sink
+}
@@ -0,0 +1,72 @@
+package mqtt
+
+import (
+	"context"
+	"log"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+)
+
+// autoscale resizes the worker pool of a lane at every interval until the
+// client stops. Workers are added when the backlog of the lane, at the
+// average execution time of the last interval, would keep a new request
+// queued for longer than max_wait, and removed one at a time while the lane
+// has no backlog and its workers are mostly idle.
+func (c *Client) autoscale(ctx context.Context, l *lane, cfg config.AutoscaleConfig) {
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		served := atomic.SwapInt64(&l.served, 0)
+		busy := time.Duration(atomic.SwapInt64(&l.busy, 0))
+		workers := int(atomic.LoadInt32(&l.active))
+		target := scaleTarget(l.depth(), workers, served, busy, cfg)
+
+		switch {
+		case target > workers:
+			for i := workers; i < target; i++ {
+				c.startWorker(ctx, l, l.messageCh)
+			}
+		case target < workers:
+			select {
+			case l.retire <- struct{}{}:
+			default: // All workers busy after all
+				continue
+			}
+		default:
+			continue
+		}
+		log.Printf("Autoscaled lane %s from %d to %d workers (backlog %d, %d requests in %v)",
+			l.name, workers, target, l.depth(), served, cfg.Interval)
+	}
+}
+
+// scaleTarget returns the number of workers for a lane with a backlog of
+// queued requests, given the requests served in the last interval and the
+// time spent executing them
+func scaleTarget(backlog, workers int, served int64, busy time.Duration, cfg config.AutoscaleConfig) int {
+	target := workers
+	switch {
+	case backlog > 0 && served == 0:
+		target = workers + 1 // Stalled, no latency known yet
+	case backlog > 0:
+		avg := busy / time.Duration(served)
+		if wait := time.Duration(backlog) * avg / time.Duration(max(workers, 1)); wait > cfg.MaxWait {
+			target = int(math.Ceil(float64(backlog) * float64(avg) / float64(cfg.MaxWait)))
+		}
+	case float64(busy) < 0.5*float64(workers-1)*float64(cfg.Interval):
+		target = workers - 1 // One worker less would still be half idle
+	}
+	return max(cfg.Min, min(target, cfg.Max))
+}
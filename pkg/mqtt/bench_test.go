@@ -0,0 +1,53 @@
+package mqtt
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+	"github.com/ganehag/open-modbus-goateway/pkg/handlers"
+)
+
+// BenchmarkDispatch measures a request from the subscription callback through
+// a lane and the dummy handler to the published response
+func BenchmarkDispatch(b *testing.B) {
+	log.SetOutput(io.Discard) // The client logs its lifecycle
+	defer log.SetOutput(os.Stderr)
+
+	cfg := &config.Config{
+		MQTT: config.MQTTConfig{
+			RequestTopic:  "modbus/{device}/request",
+			ResponseTopic: "modbus/{device}/response",
+		},
+		Ingest: config.IngestConfig{QueueSize: b.N},
+	}
+	broker := &fakeBroker{}
+	c := newClient(cfg, &handlers.JSONHandler{Handler: &handlers.DummyHandler{}}, 4)
+	c.mqttClient = broker
+	c.start()
+	c.StartWorkers(context.Background())
+
+	messages := make([]fakeMessage, b.N)
+	for i := range messages {
+		messages[i] = fakeMessage{
+			topic:   "modbus/meter" + strconv.Itoa(i%8) + "/request",
+			payload: "0 " + strconv.Itoa(i) + " 0 192.168.1.10 502 5 1 3 100 10",
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for _, msg := range messages {
+		c.onRequest(broker, msg)
+	}
+	c.Stop() // Drains the lanes and publishes the responses
+	b.StopTimer()
+
+	if broker.responses != b.N {
+		b.Fatalf("published %d responses, want %d", broker.responses, b.N)
+	}
+}
@@ -0,0 +1,146 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/ganehag/open-modbus-goateway/pkg/handlers"
+	"github.com/ganehag/open-modbus-goateway/pkg/toggle"
+)
+
+// controlCommand handles a control topic command and returns the reply payload
+type controlCommand func(c *Client, args []string) (interface{}, error)
+
+// controlCommands maps control topic commands to their implementation
+var controlCommands = map[string]controlCommand{
+	"trace": func(c *Client, args []string) (interface{}, error) {
+		return c.trace.Snapshot(), nil
+	},
+	"schedule": func(c *Client, args []string) (interface{}, error) {
+		return c.schedule(), nil
+	},
+	"inflight": func(c *Client, args []string) (interface{}, error) {
+		return c.inflight.snapshot(), nil
+	},
+	"enable": func(c *Client, args []string) (interface{}, error) {
+		return c.setToggle(args, false)
+	},
+	"disable": func(c *Client, args []string) (interface{}, error) {
+		return c.setToggle(args, true)
+	},
+	"toggles": func(c *Client, args []string) (interface{}, error) {
+		return c.toggles.List(), nil
+	},
+	"metrics": func(c *Client, args []string) (interface{}, error) {
+		return map[string]interface{}{
+			"protocol_mismatches": handlers.ProtocolMismatches(),
+			"shared_reads":        handlers.SharedReads(),
+			"ingest":              c.ingestMetrics(),
+			"watchdog":            c.watchdogMetrics(),
+			"panics":              atomic.LoadUint64(&c.panics),
+		}, nil
+	},
+}
+
+// setToggle enables or disables the traffic named by the arguments of an
+// enable or disable command: "device <name>" or "heartbeat <name>"
+func (c *Client) setToggle(args []string, disabled bool) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf("expected %q or %q", "device <name>", "heartbeat <name>")
+	}
+
+	kind, name := strings.ToLower(args[0]), args[1]
+	switch kind {
+	case toggle.Device:
+	case toggle.Heartbeat:
+		known := false
+		for _, hb := range c.heartbeats {
+			known = known || hb.cfg.Name == name
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown heartbeat %q", name)
+		}
+	default:
+		return nil, fmt.Errorf("unknown kind %q, expected device or heartbeat", args[0])
+	}
+
+	if err := c.toggles.Set(kind, name, disabled); err != nil {
+		return nil, err
+	}
+	action := "enabled"
+	if disabled {
+		action = "disabled"
+	}
+	log.Printf("Control: %s %s %s", action, kind, name)
+	return c.toggles.List(), nil
+}
+
+// controlReply is the JSON envelope published on the control response topic
+type controlReply struct {
+	Command string      `json:"command"`
+	Result  interface{} `json:"result,omitempty"`
+	Error   string      `json:"error,omitempty"`
+}
+
+// subscribeControl subscribes to the control topic, if configured
+func (c *Client) subscribeControl(client mqtt.Client) {
+	if c.cfg.ControlTopic == "" {
+		return
+	}
+
+	token := client.Subscribe(c.cfg.ControlTopic, 1, func(client mqtt.Client, msg mqtt.Message) {
+		// Replies are published from a separate goroutine to keep the
+		// paho message router unblocked
+		go c.handleControl(string(msg.Payload()))
+	})
+	token.Wait()
+	if token.Error() != nil {
+		log.Printf("Failed to subscribe to control topic %s: %v", c.cfg.ControlTopic, token.Error())
+	} else {
+		log.Printf("Subscribed to control topic: %s", c.cfg.ControlTopic)
+	}
+}
+
+// handleControl executes a control command and publishes the reply
+func (c *Client) handleControl(payload string) {
+	fields := strings.Fields(payload)
+	if len(fields) == 0 {
+		return
+	}
+
+	reply := controlReply{Command: fields[0]}
+	if command, ok := controlCommands[strings.ToLower(fields[0])]; ok {
+		result, err := command(c, fields[1:])
+		if err != nil {
+			reply.Error = err.Error()
+		} else {
+			reply.Result = result
+		}
+	} else {
+		reply.Error = "unknown command"
+	}
+
+	data, err := json.Marshal(reply)
+	if err != nil {
+		log.Printf("Failed to encode control reply: %v", err)
+		return
+	}
+
+	token := c.mqttClient.Publish(c.controlResponseTopic(), 0, false, data)
+	token.Wait()
+	if token.Error() != nil {
+		log.Printf("Failed to publish control reply: %v", token.Error())
+	}
+}
+
+// controlResponseTopic returns the topic control replies are published to
+func (c *Client) controlResponseTopic() string {
+	if c.cfg.ControlResponseTopic != "" {
+		return c.cfg.ControlResponseTopic
+	}
+	return c.cfg.ControlTopic + "/response"
+}
@@ -0,0 +1,42 @@
+package mqtt
+
+import (
+	"maps"
+	"strings"
+)
+
+// fanOutDevices returns the devices a request is fanned out to: the members
+// of the group named by the {device} value, or the devices of a
+// comma-separated list, in order and without duplicates. It returns nil for
+// requests addressing a single device, including registered devices whose
+// name contains a comma.
+func (c *Client) fanOutDevices(device string) []string {
+	if members, ok := c.appCfg.Groups[device]; ok {
+		return members
+	}
+	if !strings.Contains(device, ",") || c.appCfg.Registered(device) {
+		return nil
+	}
+
+	var devices []string
+	seen := make(map[string]bool)
+	for _, d := range strings.Split(device, ",") {
+		if d = strings.TrimSpace(d); d != "" && !seen[d] {
+			seen[d] = true
+			devices = append(devices, d)
+		}
+	}
+	return devices
+}
+
+// forDevice returns a copy of a fanned-out request addressing one of its
+// devices, answered on the response topic of that device
+func (in *inbound) forDevice(device string) *inbound {
+	values := maps.Clone(in.values)
+	values["device"] = device
+
+	out := *in
+	out.values = values
+	out.device = device
+	return &out
+}
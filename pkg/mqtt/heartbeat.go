@@ -0,0 +1,163 @@
+package mqtt
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+	"github.com/ganehag/open-modbus-goateway/pkg/handlers"
+	"github.com/ganehag/open-modbus-goateway/pkg/toggle"
+)
+
+// heartbeat tracks the schedule of a running heartbeat
+type heartbeat struct {
+	cfg config.HeartbeatConfig
+
+	mu   sync.Mutex
+	next time.Time  // Time of the next write
+	last *time.Time // Time of the last write, nil before the first one
+}
+
+// Schedule is the computed schedule of the scheduled device traffic, as
+// reported by the "schedule" control command and CLI subcommand
+type Schedule struct {
+	Heartbeats []ScheduleEntry    `json:"heartbeats"`
+	Buses      []handlers.BusLoad `json:"buses"` // Estimated utilization of the serial ports
+}
+
+// ScheduleEntry describes the computed schedule of a heartbeat
+type ScheduleEntry struct {
+	Name        string     `json:"name"`
+	Device      string     `json:"device"`
+	Lane        string     `json:"lane"`
+	Interval    string     `json:"interval"`
+	PerMinute   float64    `json:"per_minute"`
+	Queued      bool       `json:"queued"`
+	Next        *time.Time `json:"next,omitempty"`    // nil outside of a running gateway
+	Last        *time.Time `json:"last,omitempty"`    // nil until the first write
+	TotalPerMin float64    `json:"device_per_minute"` // Scheduled writes per minute to the same device
+	Disabled    bool       `json:"disabled,omitempty"`
+}
+
+// newHeartbeats creates the schedule state of every configured heartbeat
+func newHeartbeats(cfg *config.Config) []*heartbeat {
+	heartbeats := make([]*heartbeat, 0, len(cfg.Heartbeats))
+	for _, hb := range cfg.Heartbeats {
+		heartbeats = append(heartbeats, &heartbeat{cfg: hb})
+	}
+	return heartbeats
+}
+
+// startHeartbeats starts one goroutine per configured heartbeat. Heartbeat
+// writes are executed directly by default, bypassing the lane queues, so an
+// overload of external requests can't starve the watchdog a PLC relies on.
+func (c *Client) startHeartbeats() {
+	for _, hb := range c.heartbeats {
+		hb.mu.Lock()
+		hb.next = time.Now().Add(hb.cfg.Interval)
+		hb.mu.Unlock()
+
+		c.heartbeatWg.Add(1)
+		go func(hb *heartbeat) {
+			defer c.heartbeatWg.Done()
+			c.runHeartbeat(hb)
+		}(hb)
+	}
+}
+
+func (c *Client) runHeartbeat(hb *heartbeat) {
+	ticker := time.NewTicker(hb.cfg.Interval)
+	defer ticker.Stop()
+
+	log.Printf("Heartbeat %s started (every %s, queued: %v)", hb.cfg.Name, hb.cfg.Interval, hb.cfg.Queued)
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case now := <-ticker.C:
+			if c.toggles.Disabled(toggle.Heartbeat, hb.cfg.Name) {
+				hb.mu.Lock()
+				hb.next = now.Add(hb.cfg.Interval)
+				hb.mu.Unlock()
+				continue
+			}
+
+			hb.mu.Lock()
+			hb.last, hb.next = &now, now.Add(hb.cfg.Interval)
+			hb.mu.Unlock()
+
+			in := &inbound{
+				route:    c.routes[0],
+				device:   hb.cfg.Device,
+				payload:  hb.cfg.Request,
+				received: now,
+			}
+
+			if !hb.cfg.Queued {
+				c.processRequest(in, nil)
+				continue
+			}
+
+			select {
+			case c.laneFor(hb.cfg.Device).queue(in) <- in:
+			case <-c.ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// NewSchedule computes the schedule of the heartbeats of a configuration
+// and the utilization of the serial ports they take. The times of the writes
+// are only known to a running gateway and left out.
+func NewSchedule(cfg *config.Config) Schedule {
+	perDevice := make(map[string]float64)
+	for _, hb := range cfg.Heartbeats {
+		perDevice[hb.Device] += float64(time.Minute) / float64(hb.Interval)
+	}
+
+	s := Schedule{
+		Heartbeats: make([]ScheduleEntry, 0, len(cfg.Heartbeats)),
+		Buses:      handlers.EstimateBusLoad(cfg),
+	}
+	for _, hb := range cfg.Heartbeats {
+		s.Heartbeats = append(s.Heartbeats, ScheduleEntry{
+			Name:        hb.Name,
+			Device:      hb.Device,
+			Lane:        cfg.LaneFor(hb.Device),
+			Interval:    hb.Interval.String(),
+			PerMinute:   float64(time.Minute) / float64(hb.Interval),
+			Queued:      hb.Queued,
+			TotalPerMin: perDevice[hb.Device],
+		})
+	}
+	return s
+}
+
+// schedule returns the computed schedule of every heartbeat, ordered by the
+// time of the next write
+func (c *Client) schedule() Schedule {
+	s := NewSchedule(c.appCfg)
+	for i, hb := range c.heartbeats {
+		entry := &s.Heartbeats[i]
+		entry.Lane = c.laneFor(hb.cfg.Device).name
+		entry.Disabled = c.toggles.Disabled(toggle.Heartbeat, hb.cfg.Name)
+
+		hb.mu.Lock()
+		if !hb.next.IsZero() {
+			next := hb.next
+			entry.Next = &next
+		}
+		entry.Last = hb.last
+		hb.mu.Unlock()
+	}
+
+	sort.SliceStable(s.Heartbeats, func(i, j int) bool {
+		a, b := s.Heartbeats[i].Next, s.Heartbeats[j].Next
+		return a != nil && (b == nil || a.Before(*b))
+	})
+	return s
+}
@@ -0,0 +1,66 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+	"github.com/ganehag/open-modbus-goateway/pkg/handlers"
+)
+
+func TestSchedule(t *testing.T) {
+	cfg, err := config.Parse([]byte(`
+mqtt:
+  broker: "tcp://localhost:1883"
+  client_id: "gw"
+  request_topic: "modbus/{device}/request"
+  response_topic: "modbus/{device}/response"
+serial:
+  rs485-1:
+    device: "/dev/ttyUSB0"
+    baud: 9600
+devices:
+  meter1:
+    serial: "rs485-1"
+  plc1:
+    address: "192.0.2.10"
+heartbeats:
+  - name: "meter1-watchdog"
+    device: "meter1"
+    interval: "1s"
+    request: "0 0 0 - - - - 6 100 1"
+  - name: "plc1-watchdog"
+    device: "plc1"
+    interval: "5s"
+    request: "0 0 0 - - - - 6 100 1"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewSchedule(cfg)
+	if len(s.Buses) != 1 || s.Buses[0].Port != "rs485-1" || s.Buses[0].Utilization <= 0 || s.Buses[0].PerSecond != 1 {
+		t.Errorf("buses %+v, expected the utilization of rs485-1 by one transaction per second", s.Buses)
+	}
+
+	c := newClient(cfg, &handlers.DummyHandler{}, 1)
+	now := time.Now()
+	c.heartbeats[0].next = now.Add(time.Second)
+	c.heartbeats[0].last = &now
+	c.heartbeats[1].next = now.Add(-time.Second)
+
+	s = c.schedule()
+	if names := s.Heartbeats[0].Name + " " + s.Heartbeats[1].Name; names != "plc1-watchdog meter1-watchdog" {
+		t.Errorf("heartbeats ordered %s, expected by the next write", names)
+	}
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(data), `"last"`); n != 1 {
+		t.Errorf("%d last writes in %s, expected only the one written", n, data)
+	}
+}
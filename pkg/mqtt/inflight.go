@@ -0,0 +1,116 @@
+package mqtt
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/handlers"
+)
+
+// inflightRequest is a request currently being executed by a worker
+type inflightRequest struct {
+	in       *inbound
+	worker   *worker // nil for requests bypassing the lanes
+	started  time.Time
+	reported bool // Reported as stuck by the watchdog
+}
+
+// inflightTracker keeps the requests currently being executed
+type inflightTracker struct {
+	mu       sync.Mutex
+	next     uint64
+	requests map[uint64]*inflightRequest
+}
+
+// inflightEntry describes an executing request in the inflight control reply
+type inflightEntry struct {
+	Cookie    uint64  `json:"cookie"`
+	Device    string  `json:"device"`
+	Functions []uint8 `json:"functions"`
+	Lane      string  `json:"lane,omitempty"` // Empty for heartbeats bypassing the lanes
+	Topic     string  `json:"topic,omitempty"`
+	Started   string  `json:"started"`
+	ElapsedMs float64 `json:"elapsed_ms"`
+}
+
+func newInflightTracker() *inflightTracker {
+	return &inflightTracker{requests: make(map[uint64]*inflightRequest)}
+}
+
+// begin registers a request as executing by a worker and returns its
+// tracking ID
+func (t *inflightTracker) begin(in *inbound, w *worker) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.next++
+	t.requests[t.next] = &inflightRequest{in: in, worker: w, started: time.Now()}
+	return t.next
+}
+
+// stuck returns the requests executing for longer than their limit that were
+// not returned before. A limit of 0 means the request is never stuck.
+func (t *inflightTracker) stuck(now time.Time, limit func(*inbound) time.Duration) []inflightRequest {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var stuck []inflightRequest
+	for _, r := range t.requests {
+		if r.reported {
+			continue
+		}
+		if l := limit(r.in); l > 0 && now.Sub(r.started) > l {
+			r.reported = true
+			stuck = append(stuck, *r)
+		}
+	}
+	return stuck
+}
+
+// lane returns the name of the lane executing the request, empty for
+// requests bypassing the lanes
+func (r *inflightRequest) lane() string {
+	if r.worker == nil {
+		return ""
+	}
+	return r.worker.lane.name
+}
+
+// end removes a request once it has completed
+func (t *inflightTracker) end(id uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.requests, id)
+}
+
+// snapshot returns the executing requests, longest running first
+func (t *inflightTracker) snapshot() []inflightEntry {
+	t.mu.Lock()
+	requests := make([]*inflightRequest, 0, len(t.requests))
+	for _, r := range t.requests {
+		requests = append(requests, r)
+	}
+	t.mu.Unlock()
+
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].started.Before(requests[j].started)
+	})
+
+	now := time.Now()
+	entries := make([]inflightEntry, len(requests))
+	for i, r := range requests {
+		cookie, functions := handlers.Summarize(r.in.payload)
+		entries[i] = inflightEntry{
+			Cookie:    cookie,
+			Device:    r.in.device,
+			Functions: functions,
+			Lane:      r.lane(),
+			Topic:     r.in.topic,
+			Started:   r.started.UTC().Format(time.RFC3339Nano),
+			ElapsedMs: float64(now.Sub(r.started).Microseconds()) / 1000,
+		}
+	}
+	return entries
+}
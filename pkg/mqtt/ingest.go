@@ -0,0 +1,167 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+	"github.com/ganehag/open-modbus-goateway/pkg/handlers"
+)
+
+// ingestStats counts the requests received from the broker by outcome
+type ingestStats struct {
+	accepted uint64 // Queued on their lane
+	rejected uint64 // Answered with an OVERLOADED error
+	dropped  uint64 // Discarded, or evicted from the queue by a newer request
+
+	expired      uint64 // Answered with an EXPIRED error instead of executed
+	deadLettered uint64 // Published to the dead-letter topic
+
+	oversized          uint64 // Answered with a TOO_LARGE error without being parsed
+	oversizedResponses uint64 // Responses replaced by a TOO_LARGE error
+}
+
+// overflow applies the overflow policy to a request received while the
+// queue of its lane is full. It never blocks. The intake must be held.
+func (c *Client) overflow(queue chan *inbound, in *inbound) {
+	switch c.appCfg.Ingest.Overflow {
+	case config.OverflowDropNewest:
+		c.countIngest(&c.ingest.dropped, "dropped")
+		c.deadLetter(in.topic, in.payload, "queue full")
+		return
+	case config.OverflowDropOldest:
+		select {
+		case oldest := <-queue:
+			c.countIngest(&c.ingest.dropped, "dropped")
+			c.deadLetter(oldest.topic, oldest.payload, "evicted by a newer request")
+		default: // Drained meanwhile
+		}
+		select {
+		case queue <- in:
+			c.countIngest(&c.ingest.accepted, "accepted")
+		default: // Filled again by a concurrent callback
+			c.countIngest(&c.ingest.dropped, "dropped")
+			c.deadLetter(in.topic, in.payload, "queue full")
+		}
+		return
+	}
+
+	c.countIngest(&c.ingest.rejected, "rejected")
+	lane := c.laneOf(in).name
+	c.respondNow(in, handlers.ErrorResponse(in.payload, fmt.Sprintf("OVERLOADED: queue of lane %s is full", lane)))
+}
+
+// expire returns an EXPIRED error response for a request that waited longer
+// than max_age since it was received, or a SHUTDOWN error response once Stop
+// refuses the queued requests, and whether it did
+func (c *Client) expire(in *inbound) (string, bool) {
+	if atomic.LoadInt32(&c.refusing) != 0 {
+		return handlers.ErrorResponse(in.payload, "SHUTDOWN: gateway stopped before executing the request"), true
+	}
+
+	maxAge := c.appCfg.Ingest.MaxAge
+	age := time.Since(in.received)
+	if maxAge <= 0 || age <= maxAge {
+		return "", false
+	}
+
+	c.countIngest(&c.ingest.expired, "expired")
+	log.Printf("Expired request for device %q after %v in the queue", in.device, age.Round(time.Millisecond))
+	return handlers.ErrorResponse(in.payload, fmt.Sprintf("EXPIRED: queued for %v", age.Round(time.Millisecond))), true
+}
+
+// rejectOversized answers a request whose payload exceeds max_payload with a
+// TOO_LARGE error, without parsing it. The cookie is taken from the start of
+// the payload kept by newInbound. The intake must be held.
+func (c *Client) rejectOversized(in *inbound) {
+	c.countIngest(&c.ingest.oversized, "oversized")
+	limit := c.appCfg.RequestLimits.MaxPayload
+	log.Printf("Rejected request of %d bytes on %s: exceeds max_payload of %d", in.oversize, in.topic, limit)
+	c.respondNow(in, handlers.ErrorResponse(in.payload, fmt.Sprintf("TOO_LARGE: request of %d bytes exceeds %d", in.oversize, limit)))
+}
+
+// limitResponse replaces a response exceeding max_response with a TOO_LARGE
+// error for the request
+func (c *Client) limitResponse(in *inbound, response string) string {
+	limit := c.appCfg.RequestLimits.MaxResponse
+	if limit <= 0 || len(response) <= limit {
+		return response
+	}
+
+	c.countIngest(&c.ingest.oversizedResponses, "oversized_responses")
+	log.Printf("Replaced response of %d bytes for device %q: exceeds max_response of %d", len(response), in.device, limit)
+	return handlers.ErrorResponse(in.payload, fmt.Sprintf("TOO_LARGE: response of %d bytes exceeds %d", len(response), limit))
+}
+
+// respondNow queues the response to a request without waiting for room in
+// the response queue, dropping it if there is none. The intake must be held,
+// so the response queue isn't closed meanwhile.
+func (c *Client) respondNow(in *inbound, payload string) {
+	topic, err := c.responseTopic(in)
+	if err != nil {
+		log.Printf("Failed to build response topic: %v", err)
+		return
+	}
+
+	select {
+	case c.responseCh <- ResponseMessage{Topic: topic, Payload: []byte(payload)}:
+	default:
+		log.Printf("Dropped response on %s: response queue is full", topic)
+	}
+}
+
+// deadLetterMessage is published to the dead-letter topic for a request that is
+// dropped instead of answered
+type deadLetterMessage struct {
+	Topic   string    `json:"topic"`
+	Payload string    `json:"payload"`
+	Reason  string    `json:"reason"`
+	Time    time.Time `json:"time"` // When the request was dropped
+}
+
+// deadLetter publishes a dropped request with the reason to the dead-letter
+// topic, if configured, without waiting for the broker. Gateway-generated
+// requests, which have no topic, are not dead-lettered.
+func (c *Client) deadLetter(topic, payload, reason string) {
+	dlt := c.appCfg.Ingest.DeadLetterTopic
+	if dlt == "" || topic == "" || c.mqttClient == nil {
+		return
+	}
+
+	data, err := json.Marshal(deadLetterMessage{Topic: topic, Payload: payload, Reason: reason, Time: time.Now().UTC()})
+	if err != nil {
+		log.Printf("Failed to encode dead letter for %s: %v", topic, err)
+		return
+	}
+
+	// Don't wait for the token inside the message handler
+	token := c.mqttClient.Publish(dlt, 1, false, data)
+	go func() {
+		token.Wait()
+		if token.Error() != nil {
+			log.Printf("Failed to publish dead letter for %s to %s: %v", topic, dlt, token.Error())
+		}
+	}()
+	c.countIngest(&c.ingest.deadLettered, "dead_lettered")
+}
+
+// ingestMetrics returns the ingest counters and the queue depth of every lane
+func (c *Client) ingestMetrics() map[string]interface{} {
+	depths := make(map[string]int, len(c.lanes))
+	for name, l := range c.lanes {
+		depths[name] = l.depth()
+	}
+	return map[string]interface{}{
+		"accepted":            atomic.LoadUint64(&c.ingest.accepted),
+		"rejected":            atomic.LoadUint64(&c.ingest.rejected),
+		"dropped":             atomic.LoadUint64(&c.ingest.dropped),
+		"expired":             atomic.LoadUint64(&c.ingest.expired),
+		"dead_lettered":       atomic.LoadUint64(&c.ingest.deadLettered),
+		"oversized":           atomic.LoadUint64(&c.ingest.oversized),
+		"oversized_responses": atomic.LoadUint64(&c.ingest.oversizedResponses),
+		"queue_depth":         depths,
+	}
+}
@@ -0,0 +1,181 @@
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+	"github.com/ganehag/open-modbus-goateway/pkg/handlers"
+)
+
+// inbound is a request queued on a lane, either received from the broker or
+// generated by the gateway itself (e.g. heartbeats)
+type inbound struct {
+	topic    string            // Request topic, empty for gateway-generated requests
+	route    *route            // Route of the request topic, the default route for gateway-generated requests
+	values   map[string]string // Placeholder values extracted from the request topic
+	device   string            // Value of the {device} placeholder
+	payload  string
+	received time.Time
+	priority bool // Write request served before the queued reads of its lane
+	oversize int  // Size of a payload exceeding max_payload, of which only the start is kept
+}
+
+// oversizePrefix is the start of an oversized payload kept to answer with its cookie
+const oversizePrefix = 64
+
+// newInbound parses the topic of a broker message into a queued request
+func (c *Client) newInbound(msg mqtt.Message) (*inbound, error) {
+	route, requestTopic, err := c.match(msg.Topic())
+	if err != nil {
+		return nil, err
+	}
+
+	raw := msg.Payload()
+	if limit := c.appCfg.RequestLimits.MaxPayload; limit > 0 && len(raw) > limit {
+		return &inbound{
+			topic:    msg.Topic(),
+			route:    route,
+			values:   requestTopic.Values,
+			device:   requestTopic.Values["device"],
+			payload:  string(raw[:min(len(raw), oversizePrefix)]),
+			received: time.Now(),
+			oversize: len(raw),
+		}, nil
+	}
+
+	payload := string(raw)
+	return &inbound{
+		topic:    msg.Topic(),
+		route:    route,
+		values:   requestTopic.Values,
+		device:   requestTopic.Values["device"],
+		payload:  payload,
+		received: time.Now(),
+		priority: c.appCfg.Ingest.PrioritizeWrites && handlers.IsWrite(payload),
+	}, nil
+}
+
+// lane is a named worker pool with its own message queue, isolating the
+// devices pinned to it from the traffic of other lanes
+type lane struct {
+	name      string
+	workers   int // Initial number of workers
+	messageCh chan *inbound
+	priority  chan *inbound   // Write requests, served before messageCh (nil in sharded lanes)
+	shards    []chan *inbound // Queues of the workers of a lane sharded by device, instead of messageCh
+
+	active int32         // Running workers
+	retire chan struct{} // Asks a worker of an autoscaled lane to exit
+	served int64         // Requests executed, for autoscaling
+	busy   int64         // Nanoseconds spent executing them
+}
+
+// worker is a goroutine of a lane serving one of the queues of the lane
+type worker struct {
+	ctx      context.Context // Stops the worker when canceled
+	lane     *lane
+	queue    <-chan *inbound
+	replaced int32 // Set by the watchdog once a replacement serves the queue
+}
+
+// newLanes creates the default lane plus every lane declared in the configuration
+func newLanes(cfg *config.Config, defaultWorkers int) map[string]*lane {
+	lanes := map[string]*lane{
+		config.DefaultLane: newLane(config.DefaultLane, defaultWorkers, cfg.Workers.ShardByDevice, cfg.Ingest.QueueSize),
+	}
+	for _, l := range cfg.Lanes {
+		lanes[l.Name] = newLane(l.Name, l.Workers, l.ShardByDevice, cfg.Ingest.QueueSize)
+	}
+	return lanes
+}
+
+// newLane creates a lane whose queues hold up to size requests each. If size
+// is 0, the queue of the lane holds at least DefaultQueueSize requests and 10
+// per worker, and the queues of a sharded lane 10 each.
+func newLane(name string, workers int, shard bool, size int) *lane {
+	queueSize, shardSize := size, size
+	if size <= 0 {
+		queueSize, shardSize = max(config.DefaultQueueSize, workers*10), 10
+	}
+
+	l := &lane{
+		name:    name,
+		workers: workers,
+		retire:  make(chan struct{}),
+	}
+	if shard {
+		l.messageCh = make(chan *inbound) // Unused
+		l.shards = make([]chan *inbound, workers)
+		for i := range l.shards {
+			l.shards[i] = make(chan *inbound, shardSize)
+		}
+	} else {
+		l.messageCh = make(chan *inbound, queueSize)
+		l.priority = make(chan *inbound, queueSize)
+	}
+	return l
+}
+
+// depth returns the number of requests queued on the lane
+func (l *lane) depth() int {
+	n := len(l.messageCh) + len(l.priority)
+	for _, shard := range l.shards {
+		n += len(shard)
+	}
+	return n
+}
+
+// queue returns the queue of a request. In a sharded lane, all requests for
+// a device are queued for the same worker, which executes them in the order
+// they arrived; elsewhere, priority requests have a queue of their own.
+func (l *lane) queue(in *inbound) chan *inbound {
+	device := in.device
+	if len(l.shards) == 0 {
+		if in.priority {
+			return l.priority
+		}
+		return l.messageCh
+	}
+	h := fnv.New32a()
+	h.Write([]byte(device))
+	return l.shards[h.Sum32()%uint32(len(l.shards))]
+}
+
+// close closes the queues of the lane
+func (l *lane) close() {
+	close(l.messageCh)
+	if l.priority != nil {
+		close(l.priority)
+	}
+	for _, shard := range l.shards {
+		close(shard)
+	}
+}
+
+// laneOf returns the lane serving a request: the lane of its route, if any,
+// or the lane of its device
+func (c *Client) laneOf(in *inbound) *lane {
+	if l, ok := c.lanes[in.route.lane]; ok {
+		return l
+	}
+	return c.laneFor(in.device)
+}
+
+// laneFor returns the lane serving the given device
+func (c *Client) laneFor(device string) *lane {
+	name := c.appCfg.LaneFor(device)
+	if l, ok := c.lanes[name]; ok {
+		return l
+	}
+	return c.lanes[config.DefaultLane]
+}
+
+// String implements fmt.Stringer for log messages
+func (l *lane) String() string {
+	return fmt.Sprintf("%s (%d workers)", l.name, atomic.LoadInt32(&l.active))
+}
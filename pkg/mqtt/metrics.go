@@ -0,0 +1,48 @@
+package mqtt
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/handlers"
+	"github.com/ganehag/open-modbus-goateway/pkg/metrics"
+)
+
+// Metrics reported by the client to its sink
+const (
+	metricIngest          = "ingest_requests_total"    // Received requests by outcome, like the ingest counters
+	metricRequests        = "requests_total"           // Answered requests by route, lane and status
+	metricRequestDuration = "request_duration_seconds" // Time taken to answer a request once dequeued
+	metricQueueWait       = "queue_wait_seconds"       // Time a request waited on its lane
+	metricPanics          = "handler_panics_total"     // Handler panics recovered
+)
+
+// countIngest increments an ingest counter and reports the outcome
+func (c *Client) countIngest(counter *uint64, outcome string) {
+	atomic.AddUint64(counter, 1)
+	c.metrics.Add(metricIngest, 1, metrics.Labels{"outcome": outcome})
+}
+
+// observeRequest reports an answered request. Expired requests have the
+// status EXPIRED, the others the status of their response.
+func (c *Client) observeRequest(in *inbound, start time.Time, expired bool, response string) {
+	status := responseStatus(response)
+	if expired {
+		status = "EXPIRED"
+	}
+	lane := c.laneOf(in).name
+
+	c.metrics.Add(metricRequests, 1, metrics.Labels{"route": in.route.name, "lane": lane, "status": status})
+	c.metrics.Observe(metricRequestDuration, time.Since(start).Seconds(), metrics.Labels{"route": in.route.name, "lane": lane})
+	c.metrics.Observe(metricQueueWait, start.Sub(in.received).Seconds(), metrics.Labels{"lane": lane})
+}
+
+// responseStatus returns the status of a text or JSON response payload on a
+// best-effort basis: ERROR if the request or a command of a batch failed
+func responseStatus(payload string) string {
+	if strings.Contains(payload, " ERROR") || strings.Contains(payload, `"status":"ERROR"`) {
+		return handlers.StatusError
+	}
+	return handlers.StatusOK
+}
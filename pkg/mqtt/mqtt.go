@@ -0,0 +1,525 @@
+// Package mqtt connects the gateway to the broker, queueing the received
+// requests on worker lanes and publishing the responses of the handlers.
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/ganehag/open-modbus-goateway/internal/tlsutil"
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+	"github.com/ganehag/open-modbus-goateway/pkg/handlers"
+	"github.com/ganehag/open-modbus-goateway/pkg/metrics"
+	"github.com/ganehag/open-modbus-goateway/pkg/toggle"
+	"github.com/ganehag/open-modbus-goateway/pkg/topic"
+	"github.com/ganehag/open-modbus-goateway/pkg/trace"
+)
+
+// convertToWildcard replaces placeholders like {device} with MQTT wildcards (+)
+func convertToWildcard(topic string) string {
+	return strings.ReplaceAll(topic, "{device}", "+")
+}
+
+// Gateway states announced on the status topic
+const (
+	StatusOnline   = "ONLINE"
+	StatusSafeMode = "SAFE_MODE"
+	StatusOffline  = "OFFLINE"
+)
+
+type ResponseMessage struct {
+	Topic   string
+	Payload []byte
+}
+
+// Client wraps the MQTT client, configuration, and worker pool
+type Client struct {
+	mqttClient     mqtt.Client
+	cfg            config.MQTTConfig
+	appCfg         *config.Config // Complete configuration, used for per-device settings
+	routes         []*route       // Request topics with their handlers, the topics of the mqtt section first
+	lanes          map[string]*lane
+	responseCh     chan ResponseMessage
+	responsesDone  chan struct{}  // Closed once the responses are published after responseCh closed
+	wg             sync.WaitGroup // Background routines
+	workerWg       sync.WaitGroup // Lane workers
+	heartbeatWg    sync.WaitGroup // Heartbeats may enqueue requests, so they stop before the lanes close
+	scalerWg       sync.WaitGroup // The autoscaler and the watchdog start workers, so they stop before the lanes close
+	state          int32          // Lifecycle state (stateRunning, stateStopping, stateStopped)
+	refusing       int32          // Set when Stop exceeds the drain timeout; queued requests are refused
+	intakeMu       sync.RWMutex   // Held for reading while a request is admitted
+	intakeClosed   chan struct{}  // Closed when Stop closes the intake
+	stopped        chan struct{}  // Closed when Stop has finished
+	heartbeats     []*heartbeat
+	requestCounter int32
+	sequence       uint64             // Monotonic sequence number of published responses
+	status         atomic.Value       // Gateway status announced on the status topic
+	trace          *trace.Buffer      // Recent requests, dumped via the control topic
+	inflight       *inflightTracker   // Requests currently being executed
+	ingest         ingestStats        // Outcomes of received requests
+	watchdogStats  watchdogStats      // Stuck workers detected by the watchdog
+	panics         uint64             // Handler panics recovered
+	toggles        *toggle.Set        // Traffic disabled at runtime via the control topic
+	metrics        metrics.Sink       // Sink of the dispatch metrics
+	ctx            context.Context    // Context for managing client lifecycle
+	cancelFunc     context.CancelFunc // Cancel function to signal termination
+	execCtx        context.Context    // Passed to the handler, canceled when Stop gives up draining
+	cancelExec     context.CancelFunc
+}
+
+// NewClient initializes and connects an MQTT client based on the provided configuration
+// and sets up concurrent message handling. The workers argument sizes the default lane;
+// additional lanes are taken from the configuration. The requests of the topics of the
+// mqtt section are passed to handler, those of the routes of the configuration to the
+// handler of the route name in routeHandlers. The control commands enable and disable
+// traffic in toggles, which may be nil to keep them in memory. The dispatch metrics are
+// reported to sink, which may be nil to drop them.
+func NewClient(fullCfg *config.Config, handler handlers.Handler, routeHandlers map[string]handlers.Handler, toggles *toggle.Set, sink metrics.Sink, workers int) (*Client, error) {
+	cfg := fullCfg.MQTT
+
+	if handler == nil {
+		return nil, fmt.Errorf("handler cannot be nil")
+	}
+	if workers <= 0 {
+		return nil, fmt.Errorf("workers must be greater than zero")
+	}
+
+	// Parse the broker URL to check if TLS is required
+	u, err := url.Parse(cfg.Broker)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse broker URL: %w", err)
+	}
+
+	c := newClient(fullCfg, handler, workers)
+	if err := c.addRoutes(routeHandlers); err != nil {
+		return nil, err
+	}
+	if toggles != nil {
+		c.toggles = toggles
+	}
+	c.metrics = metrics.OrDiscard(sink)
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.Broker).
+		SetClientID(cfg.ClientID).
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password).
+		SetOnConnectHandler(func(client mqtt.Client) {
+			log.Printf("Connected to MQTT broker: %v", cfg.Broker)
+			if atomic.LoadInt32(&c.state) != stateRunning {
+				return // Reconnected while stopping, don't resubscribe
+			}
+
+			// Announce the current status on connect/reconnect
+			c.publishStatus(client, c.status.Load().(string))
+			c.subscribeControl(client)
+
+			// Subscribe to the request topic of every route on connect/reconnect
+			for _, r := range c.routes {
+				requestTopic := &topic.Topic{Format: r.requestTopic}
+				subscriptionTopic := requestTopic.WithWildcard()
+
+				token := client.Subscribe(subscriptionTopic, 1, c.onRequest)
+				token.Wait()
+				if token.Error() != nil {
+					log.Printf("Failed to subscribe to topic %s: %v", subscriptionTopic, token.Error())
+				} else {
+					log.Printf("Subscribed to topic: %s", subscriptionTopic)
+				}
+			}
+		}).
+		SetConnectionLostHandler(func(client mqtt.Client, err error) {
+			log.Printf("Connection lost: %v", err)
+		})
+
+	if cfg.StatusTopic != "" {
+		opts.SetWill(cfg.StatusTopic, StatusOffline, 1, true)
+	}
+
+	if u.Scheme == "ssl" {
+		// Parse the broker URL to extract the hostname
+		u, err := url.Parse(cfg.Broker)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse broker URL: %w", err)
+		}
+
+		// Extract the hostname
+		hostname := u.Hostname()
+
+		// Create the TLS configuration
+		tlsConfig, err := tlsutil.NewTLSConfig(cfg.CACertPath, cfg.CertPath, cfg.KeyPath, hostname)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create TLS configuration: %w", err)
+		}
+		if err := tlsutil.PinPublicKeys(tlsConfig, cfg.PinnedKeys); err != nil {
+			return nil, fmt.Errorf("failed to create TLS configuration: %w", err)
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	client := mqtt.NewClient(opts)
+	token := client.Connect()
+	if token.Wait() && token.Error() != nil {
+		return nil, fmt.Errorf("failed to connect to MQTT broker: %w", token.Error())
+	}
+	c.mqttClient = client
+
+	c.start()
+
+	return c, nil
+}
+
+// newClient creates a client that is not yet connected
+func newClient(fullCfg *config.Config, handler handlers.Handler, workers int) *Client {
+	c := &Client{
+		cfg:        fullCfg.MQTT,
+		appCfg:     fullCfg,
+		routes:     []*route{defaultRoute(fullCfg, handler)},
+		lanes:      newLanes(fullCfg, workers),
+		responseCh: make(chan ResponseMessage, workers*10),
+		trace:      trace.NewBuffer(fullCfg.Trace.Size),
+		heartbeats: newHeartbeats(fullCfg),
+		inflight:   newInflightTracker(),
+		toggles:    toggle.NewSet(),
+		metrics:    metrics.Discard,
+
+		responsesDone: make(chan struct{}),
+		intakeClosed:  make(chan struct{}),
+		stopped:       make(chan struct{}),
+	}
+	c.execCtx, c.cancelExec = context.WithCancel(context.Background())
+	c.status.Store("") // Announced once the owner calls SetStatus
+	return c
+}
+
+// start starts the background routines of a connected client
+func (c *Client) start() {
+	// Create a cancellable context
+	c.ctx, c.cancelFunc = context.WithCancel(context.Background())
+
+	// Start the background routine for request counting
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		c.startRequestCounterLogger()
+	}()
+
+	go c.processResponse()
+
+	c.startHeartbeats()
+}
+
+// onRequest handles a message received on the request topic
+func (c *Client) onRequest(client mqtt.Client, msg mqtt.Message) {
+	in, err := c.newInbound(msg)
+	if err != nil {
+		log.Printf("Failed to parse topic %q: %v", msg.Topic(), err)
+		c.deadLetter(msg.Topic(), string(msg.Payload()), fmt.Sprintf("unparseable topic: %v", err))
+		return
+	}
+	if in.oversize > 0 {
+		if !c.admit(func() { c.rejectOversized(in) }) {
+			log.Printf("Dropped request on %s for device %q: gateway is stopping", in.topic, in.device)
+		}
+		return
+	}
+	if devices := c.fanOutDevices(in.device); devices != nil {
+		for _, device := range devices {
+			c.dispatch(client, in.forDevice(device))
+		}
+		return
+	}
+	c.dispatch(client, in)
+}
+
+// dispatch forwards or queues a request received from the broker
+func (c *Client) dispatch(client mqtt.Client, in *inbound) {
+	if c.forwardUnknown(client, in) {
+		return
+	}
+	if !c.enqueue(in) {
+		log.Printf("Dropped request on %s for device %q: gateway is stopping", in.topic, in.device)
+	}
+}
+
+// StartWorkers starts a pool of goroutines per lane to process messages
+// concurrently. The workers exit once Stop has drained their lane, or
+// immediately when ctx is canceled. With autoscaling, the pool of the
+// default lane is resized with the load from then on.
+func (c *Client) StartWorkers(ctx context.Context) {
+	for _, l := range c.lanes {
+		for i := 0; i < l.workers; i++ {
+			queue := l.messageCh
+			if len(l.shards) > 0 {
+				queue = l.shards[i]
+			}
+			c.startWorker(ctx, l, queue)
+		}
+		log.Printf("Starting lane %v", l)
+	}
+
+	if a := c.appCfg.Workers.Autoscale; a.Enabled {
+		c.scalerWg.Add(1)
+		go func() {
+			defer c.scalerWg.Done()
+			c.autoscale(ctx, c.lanes[config.DefaultLane], a)
+		}()
+	}
+	if wd := c.appCfg.Workers.Watchdog; wd.Enabled {
+		c.scalerWg.Add(1)
+		go func() {
+			defer c.scalerWg.Done()
+			c.watchdog(ctx, wd)
+		}()
+	}
+}
+
+// startWorker starts a worker of a lane serving a queue of the lane
+func (c *Client) startWorker(ctx context.Context, l *lane, queue <-chan *inbound) {
+	w := &worker{ctx: ctx, lane: l, queue: queue}
+	atomic.AddInt32(&l.active, 1)
+	c.workerWg.Add(1)
+	go func() {
+		defer c.workerWg.Done()
+		defer atomic.AddInt32(&l.active, -1)
+
+		serve := func(in *inbound) {
+			start := time.Now()
+			c.processRequest(in, w)
+			atomic.AddInt64(&l.served, 1)
+			atomic.AddInt64(&l.busy, int64(time.Since(start)))
+		}
+
+		var priority <-chan *inbound = l.priority // nil in sharded lanes
+		for (queue != nil || priority != nil) && atomic.LoadInt32(&w.replaced) == 0 {
+			// Serve the priority requests first
+			select {
+			case in, ok := <-priority:
+				if !ok {
+					priority = nil
+				} else {
+					serve(in)
+				}
+				continue
+			default:
+			}
+
+			select {
+			case <-ctx.Done():
+				fmt.Println("Worker stopped")
+				return // Exit worker on context cancellation
+			case <-l.retire:
+				return // Pool shrunk by the autoscaler
+			case in, ok := <-priority:
+				if !ok {
+					priority = nil
+					continue
+				}
+				serve(in)
+			case in, ok := <-queue:
+				if !ok {
+					queue = nil // Exit worker once both queues are closed and drained
+					continue
+				}
+				serve(in)
+			}
+		}
+	}()
+}
+
+// forwardUnknown republishes a request for a device missing from the device
+// registry to the catch-all topic, if configured, and reports whether it did
+func (c *Client) forwardUnknown(client mqtt.Client, in *inbound) bool {
+	if c.appCfg.UnknownDevices.Action != config.UnknownDeviceForward || c.appCfg.Registered(in.device) {
+		return false
+	}
+
+	forwardTopic := &topic.Topic{Format: c.appCfg.UnknownDevices.ForwardTopic, Values: in.values}
+	topic, err := forwardTopic.Build()
+	if err != nil {
+		log.Printf("Failed to build forward topic for device %q: %v", in.device, err)
+		return true
+	}
+
+	// Don't wait for the token inside the message handler
+	token := client.Publish(topic, 1, false, in.payload)
+	go func() {
+		token.Wait()
+		if token.Error() != nil {
+			log.Printf("Failed to forward request for device %q to %s: %v", in.device, topic, token.Error())
+		}
+	}()
+	return true
+}
+
+// SetStatus changes the gateway status and announces it on the status topic
+func (c *Client) SetStatus(status string) {
+	c.status.Store(status)
+	if c.mqttClient != nil && c.mqttClient.IsConnected() {
+		c.publishStatus(c.mqttClient, status)
+	}
+}
+
+// publishStatus publishes the gateway status as a retained message, if a
+// status topic is configured
+func (c *Client) publishStatus(client mqtt.Client, status string) {
+	if c.cfg.StatusTopic == "" || status == "" {
+		return
+	}
+
+	token := client.Publish(c.cfg.StatusTopic, 1, true, status)
+	token.Wait()
+	if token.Error() != nil {
+		log.Printf("Failed to publish status to topic %s: %v", c.cfg.StatusTopic, token.Error())
+	}
+}
+
+func (c *Client) startRequestCounterLogger() {
+	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
+
+	var reportedOverflows uint64
+
+	for {
+		select {
+		case <-c.ctx.Done(): // Context canceled
+			log.Println("Request counter logger stopped")
+			return
+		case <-ticker.C:
+			// Safely read and reset the counter
+			count := atomic.LoadInt32(&c.requestCounter)
+			atomic.StoreInt32(&c.requestCounter, 0)
+
+			log.Printf("Requests handled in the last minute: %d", count)
+
+			overflowed := atomic.LoadUint64(&c.ingest.rejected) + atomic.LoadUint64(&c.ingest.dropped)
+			if overflowed > reportedOverflows {
+				log.Printf("Requests rejected or dropped by full queues in the last minute: %d", overflowed-reportedOverflows)
+				reportedOverflows = overflowed
+			}
+		}
+	}
+}
+
+// processResponse publishes the queued responses until Stop closes the
+// response channel
+func (c *Client) processResponse() {
+	defer close(c.responsesDone)
+
+	for msg := range c.responseCh {
+		// Increment the counter atomically
+		atomic.AddInt32(&c.requestCounter, 1)
+
+		payload := msg.Payload
+		if c.cfg.StampResponse {
+			payload = c.stamp(payload)
+		}
+
+		token := c.mqttClient.Publish(msg.Topic, 0, false, payload)
+		token.Wait()
+		if token.Error() != nil {
+			log.Printf("Failed to publish response to topic %s: %v", msg.Topic, token.Error())
+		}
+	}
+}
+
+// stamp appends the publish timestamp and the next sequence number to a
+// response payload. Responses are published by a single goroutine, so the
+// sequence follows publication order and lets consumers detect gaps and
+// reordering.
+func (c *Client) stamp(payload []byte) []byte {
+	c.sequence++
+	ts := time.Now().UTC().Format(time.RFC3339Nano)
+
+	// JSON responses carry the stamp as fields of the object
+	if n := len(payload); n > 1 && payload[0] == '{' && payload[n-1] == '}' {
+		stamp := fmt.Sprintf(`"ts":%q,"seq":%d}`, ts, c.sequence)
+		if n > 2 {
+			stamp = "," + stamp
+		}
+		return append(payload[:n-1:n-1], stamp...)
+	}
+
+	stamp := fmt.Sprintf(" ts=%s seq=%d", ts, c.sequence)
+	return append(payload[:len(payload):len(payload)], stamp...)
+}
+
+// processRequest executes a request on behalf of the given worker, nil for
+// requests bypassing the lanes, and queues the response
+func (c *Client) processRequest(in *inbound, w *worker) {
+	// Pass the device placeholder value and payload to the handler, unless
+	// the request waited too long in the queue
+	start := time.Now()
+	responsePayload, expired := c.expire(in)
+	if !expired {
+		responsePayload = c.handle(in, w)
+	}
+	responsePayload = c.limitResponse(in, responsePayload)
+	c.observeRequest(in, start, expired, responsePayload)
+
+	c.trace.Add(trace.Entry{
+		Time:     start,
+		Topic:    in.topic,
+		Device:   in.device,
+		Request:  in.payload,
+		Response: responsePayload,
+		Duration: time.Since(start),
+	})
+
+	// Gateway-generated requests have no response topic
+	if in.topic == "" {
+		if strings.Contains(responsePayload, " ERROR") {
+			log.Printf("Gateway request for device %q failed: %s", in.device, responsePayload)
+		}
+		return
+	}
+
+	responseTopicString, err := c.responseTopic(in)
+	if err != nil {
+		log.Printf("Failed to build response topic: %v", err)
+		return
+	}
+
+	responseMessage := ResponseMessage{
+		Topic:   responseTopicString,
+		Payload: []byte(responsePayload),
+	}
+
+	c.responseCh <- responseMessage
+}
+
+// handle passes a request to the handler. A panic of the handler is logged
+// with its stack and answered with an INTERNAL error, keeping the worker and
+// the process alive.
+func (c *Client) handle(in *inbound, w *worker) (response string) {
+	id := c.inflight.begin(in, w)
+	defer c.inflight.end(id)
+	defer func() {
+		if r := recover(); r != nil {
+			atomic.AddUint64(&c.panics, 1)
+			c.metrics.Add(metricPanics, 1, nil)
+			log.Printf("Handler panicked on request for device %q: %v\n%s", in.device, r, debug.Stack())
+			response = handlers.ErrorResponse(in.payload, fmt.Sprintf("INTERNAL: %v", r))
+		}
+	}()
+
+	return in.route.handler.Handle(c.execCtx, in.device, in.payload)
+}
+
+// responseTopic builds the response topic of a request from the placeholder
+// values of its request topic
+func (c *Client) responseTopic(in *inbound) (string, error) {
+	responseTopic := &topic.Topic{
+		Format: in.route.responseTopic,
+		Values: in.values, // Reuse extracted values
+	}
+	return responseTopic.Build()
+}
@@ -0,0 +1,53 @@
+package mqtt
+
+import (
+	"fmt"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+	"github.com/ganehag/open-modbus-goateway/pkg/handlers"
+	"github.com/ganehag/open-modbus-goateway/pkg/topic"
+)
+
+// route is a request topic with the topic its responses are published to,
+// served by its own handler
+type route struct {
+	name          string // Empty for the topics of the mqtt section
+	requestTopic  string
+	responseTopic string
+	handler       handlers.Handler
+	lane          string // Lane serving the requests of the route, the lane of each device if empty
+}
+
+// defaultRoute returns the route of the topics of the mqtt section
+func defaultRoute(cfg *config.Config, handler handlers.Handler) *route {
+	return &route{requestTopic: cfg.MQTT.RequestTopic, responseTopic: cfg.MQTT.ResponseTopic, handler: handler}
+}
+
+// addRoutes adds the routes declared in the configuration, each served by the
+// handler of the same name in routeHandlers
+func (c *Client) addRoutes(routeHandlers map[string]handlers.Handler) error {
+	for _, r := range c.appCfg.Routes {
+		h := routeHandlers[r.Name]
+		if h == nil {
+			return fmt.Errorf("no handler for route %q", r.Name)
+		}
+		c.routes = append(c.routes, &route{name: r.Name, requestTopic: r.RequestTopic, responseTopic: r.ResponseTopic, handler: h, lane: r.Lane})
+	}
+	return nil
+}
+
+// match returns the route of a topic received from the broker with the
+// placeholder values of the topic, trying the routes in order
+func (c *Client) match(name string) (*route, *topic.Topic, error) {
+	var firstErr error
+	for _, r := range c.routes {
+		t, err := topic.Parse(name, r.requestTopic)
+		if err == nil {
+			return r, t, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, nil, firstErr
+}
@@ -0,0 +1,148 @@
+package mqtt
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/topic"
+)
+
+// Lifecycle states of a Client. A client only moves forward through them.
+const (
+	stateRunning  int32 = iota // Receiving and executing requests
+	stateStopping              // Intake closed, queued requests are drained
+	stateStopped               // Disconnected from the broker
+)
+
+// enqueue queues a request received from the broker on the lane of its
+// device, unless the intake has been closed. It never blocks: a request
+// exceeding a full lane is handled by the overflow policy.
+func (c *Client) enqueue(in *inbound) bool {
+	return c.admit(func() {
+		queue := c.laneOf(in).queue(in)
+		select {
+		case queue <- in:
+			c.countIngest(&c.ingest.accepted, "accepted")
+		default:
+			c.overflow(queue, in)
+		}
+	})
+}
+
+// admit calls f holding the intake, unless the intake has been closed, and
+// reports whether it did. Stop waits for the calls in progress, so the lane
+// channels and the response queue are never sent to after they are closed.
+func (c *Client) admit(f func()) bool {
+	c.intakeMu.RLock()
+	defer c.intakeMu.RUnlock()
+
+	select {
+	case <-c.intakeClosed:
+		return false
+	default:
+	}
+
+	f()
+	return true
+}
+
+// Stop shuts the client down in an order that loses no accepted request:
+//
+//  1. unsubscribe from the request and control topics,
+//  2. close the intake, waiting for callbacks still enqueuing requests,
+//  3. stop the heartbeats, which may enqueue requests too, and the
+//     autoscaler, which starts workers,
+//  4. close the lanes and let the workers drain the queued requests; past
+//     the drain timeout, the requests still queued are answered with a
+//     SHUTDOWN error instead of executed,
+//  5. publish the pending responses,
+//  6. announce OFFLINE and disconnect from the broker.
+//
+// Stop may be called more than once; only the first call has an effect, and
+// later calls return once the client is stopped.
+func (c *Client) Stop() {
+	if !atomic.CompareAndSwapInt32(&c.state, stateRunning, stateStopping) {
+		<-c.stopped
+		return
+	}
+	log.Println("Stopping MQTT client and workers...")
+
+	c.unsubscribe()
+
+	close(c.intakeClosed)
+	c.intakeMu.Lock() // Waits for admit calls in progress
+	c.intakeMu.Unlock()
+
+	if c.cancelFunc != nil {
+		c.cancelFunc() // Stops the heartbeats, the autoscaler and the request counter
+	}
+	c.heartbeatWg.Wait()
+	c.scalerWg.Wait()
+
+	for _, l := range c.lanes {
+		l.close()
+	}
+	c.drain(c.appCfg.Ingest.DrainTimeout)
+	c.cancelExec()
+
+	close(c.responseCh)
+	<-c.responsesDone
+
+	c.publishStatus(c.mqttClient, StatusOffline)
+	c.mqttClient.Disconnect(250)
+	c.wg.Wait()
+
+	atomic.StoreInt32(&c.state, stateStopped)
+	close(c.stopped)
+	log.Println("MQTT client and workers stopped.")
+}
+
+// drain waits for the workers to empty the closed lanes. If they are not done
+// within timeout, the requests still queued are refused and the requests in
+// progress canceled, and drain waits for the workers to return.
+func (c *Client) drain(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		c.workerWg.Wait()
+		close(done)
+	}()
+	if timeout <= 0 {
+		<-done
+		return
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return
+	case <-timer.C:
+	}
+
+	queued := 0
+	for _, l := range c.lanes {
+		queued += l.depth()
+	}
+	log.Printf("Drain timeout of %v exceeded, refusing %d queued requests", timeout, queued)
+	atomic.StoreInt32(&c.refusing, 1)
+	c.cancelExec() // Stops the requests waiting for their device
+	<-done
+}
+
+// unsubscribe stops the delivery of requests and control commands
+func (c *Client) unsubscribe() {
+	var topics []string
+	for _, r := range c.routes {
+		topics = append(topics, (&topic.Topic{Format: r.requestTopic}).WithWildcard())
+	}
+	if c.cfg.ControlTopic != "" {
+		topics = append(topics, c.cfg.ControlTopic)
+	}
+
+	token := c.mqttClient.Unsubscribe(topics...)
+	token.Wait()
+	if token.Error() != nil {
+		log.Printf("Failed to unsubscribe from %v: %v", topics, token.Error())
+	}
+}
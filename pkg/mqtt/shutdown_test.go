@@ -0,0 +1,235 @@
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+)
+
+// doneToken is a completed MQTT token
+type doneToken struct{}
+
+func (doneToken) Wait() bool                     { return true }
+func (doneToken) WaitTimeout(time.Duration) bool { return true }
+func (doneToken) Error() error                   { return nil }
+func (doneToken) Done() <-chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}
+
+// fakeBroker records the calls of the client in order
+type fakeBroker struct {
+	mu           sync.Mutex
+	events       []string
+	responses    int
+	disconnected bool
+	late         int // Publishes after the disconnect
+}
+
+func (b *fakeBroker) record(event string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.events = append(b.events, event)
+}
+
+func (b *fakeBroker) IsConnected() bool      { return true }
+func (b *fakeBroker) IsConnectionOpen() bool { return true }
+func (b *fakeBroker) Connect() mqtt.Token    { return doneToken{} }
+
+func (b *fakeBroker) Disconnect(uint) {
+	b.record("disconnect")
+	b.mu.Lock()
+	b.disconnected = true
+	b.mu.Unlock()
+}
+
+func (b *fakeBroker) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.disconnected {
+		b.late++
+	}
+	if topic == "status" {
+		b.events = append(b.events, fmt.Sprintf("status %s", payload))
+	} else {
+		b.responses++
+	}
+	return doneToken{}
+}
+
+func (b *fakeBroker) Subscribe(string, byte, mqtt.MessageHandler) mqtt.Token { return doneToken{} }
+func (b *fakeBroker) SubscribeMultiple(map[string]byte, mqtt.MessageHandler) mqtt.Token {
+	return doneToken{}
+}
+
+func (b *fakeBroker) Unsubscribe(topics ...string) mqtt.Token {
+	b.record(fmt.Sprintf("unsubscribe %v", topics))
+	return doneToken{}
+}
+
+func (b *fakeBroker) AddRoute(string, mqtt.MessageHandler)    {}
+func (b *fakeBroker) OptionsReader() mqtt.ClientOptionsReader { return mqtt.ClientOptionsReader{} }
+
+// fakeMessage is a request received from the broker
+type fakeMessage struct {
+	topic   string
+	payload string
+}
+
+func (m fakeMessage) Duplicate() bool   { return false }
+func (m fakeMessage) Qos() byte         { return 1 }
+func (m fakeMessage) Retained() bool    { return false }
+func (m fakeMessage) Topic() string     { return m.topic }
+func (m fakeMessage) MessageID() uint16 { return 0 }
+func (m fakeMessage) Payload() []byte   { return []byte(m.payload) }
+func (m fakeMessage) Ack()              {}
+
+// slowHandler answers every request after a delay and counts them
+type slowHandler struct {
+	delay   time.Duration
+	handled int32
+}
+
+func (h *slowHandler) Handle(ctx context.Context, device string, payload string) string {
+	time.Sleep(h.delay)
+	atomic.AddInt32(&h.handled, 1)
+	return "1 OK"
+}
+
+// newTestClient creates a running client connected to a fake broker
+func newTestClient(t *testing.T, handler *slowHandler, workers int) (*Client, *fakeBroker) {
+	t.Helper()
+
+	cfg := &config.Config{MQTT: config.MQTTConfig{
+		RequestTopic:  "modbus/{device}/request",
+		ResponseTopic: "modbus/{device}/response",
+		StatusTopic:   "status",
+		ControlTopic:  "control",
+	}}
+	broker := &fakeBroker{}
+	c := newClient(cfg, handler, workers)
+	c.mqttClient = broker
+	c.start()
+	c.StartWorkers(context.Background())
+
+	return c, broker
+}
+
+func request(i int) fakeMessage {
+	return fakeMessage{
+		topic:   fmt.Sprintf("modbus/dev%d/request", i%3),
+		payload: fmt.Sprintf("0 %d 0 127.0.0.1 502 1 1 3 1 1", i),
+	}
+}
+
+func TestStopDrainsQueuedRequests(t *testing.T) {
+	handler := &slowHandler{delay: 2 * time.Millisecond}
+	c, broker := newTestClient(t, handler, 2)
+
+	const queued = 30
+	for i := 0; i < queued; i++ {
+		c.onRequest(broker, request(i))
+	}
+	c.Stop()
+
+	if handled := atomic.LoadInt32(&handler.handled); handled != queued {
+		t.Errorf("handled %d requests, want %d", handled, queued)
+	}
+	if broker.responses != queued {
+		t.Errorf("published %d responses, want %d", broker.responses, queued)
+	}
+	if broker.late != 0 {
+		t.Errorf("published %d messages after disconnecting", broker.late)
+	}
+}
+
+func TestStopOrder(t *testing.T) {
+	c, broker := newTestClient(t, &slowHandler{}, 1)
+	c.Stop()
+
+	want := []string{
+		"unsubscribe [modbus/+/request control]",
+		"status OFFLINE",
+		"disconnect",
+	}
+	if fmt.Sprint(broker.events) != fmt.Sprint(want) {
+		t.Errorf("events %q, want %q", broker.events, want)
+	}
+	if state := atomic.LoadInt32(&c.state); state != stateStopped {
+		t.Errorf("state %d after Stop, want %d", state, stateStopped)
+	}
+}
+
+func TestStopWhileReceiving(t *testing.T) {
+	handler := &slowHandler{delay: time.Millisecond}
+	c, broker := newTestClient(t, handler, 2)
+	c.appCfg.Ingest.Overflow = config.OverflowDropNewest // Only accepted requests are answered
+
+	// Keep delivering requests, filling the lanes, while the client stops
+	var wg sync.WaitGroup
+	for p := 0; p < 8; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				in, err := c.newInbound(request(p*1000 + i))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if !c.enqueue(in) {
+					return
+				}
+			}
+		}(p)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	c.Stop()
+	wg.Wait()
+
+	accepted := int32(atomic.LoadUint64(&c.ingest.accepted))
+	if handled := atomic.LoadInt32(&handler.handled); handled != accepted {
+		t.Errorf("handled %d of %d accepted requests", handled, accepted)
+	}
+	if int32(broker.responses) != accepted {
+		t.Errorf("published %d responses for %d accepted requests", broker.responses, accepted)
+	}
+
+	// Messages still routed after unsubscribing are dropped, also those
+	// rejected without being queued
+	c.onRequest(broker, request(0))
+	c.appCfg.RequestLimits.MaxPayload = 8
+	c.onRequest(broker, request(0))
+}
+
+func TestStopTwice(t *testing.T) {
+	c, broker := newTestClient(t, &slowHandler{}, 1)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Stop()
+		}()
+	}
+	wg.Wait()
+
+	disconnects := 0
+	for _, event := range broker.events {
+		if event == "disconnect" {
+			disconnects++
+		}
+	}
+	if disconnects != 1 {
+		t.Errorf("disconnected %d times, want once", disconnects)
+	}
+}
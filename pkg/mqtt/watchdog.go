@@ -0,0 +1,78 @@
+package mqtt
+
+import (
+	"context"
+	"log"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+	"github.com/ganehag/open-modbus-goateway/pkg/handlers"
+)
+
+// maxStackDump bounds the goroutine dump logged for stuck workers
+const maxStackDump = 1 << 20
+
+// watchdogStats counts the stuck workers detected by the watchdog
+type watchdogStats struct {
+	stuck    uint64 // Requests executing for longer than their limit
+	replaced uint64 // Workers replaced for being stuck
+}
+
+// watchdog checks the executing requests at every interval until the client
+// stops. A worker executing a request for longer than factor times its
+// timeout is reported with a dump of all goroutines, and with restart
+// replaced, so a hung Modbus transaction doesn't silently take away a
+// worker of its lane.
+func (c *Client) watchdog(ctx context.Context, cfg config.WatchdogConfig) {
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+
+	limit := func(in *inbound) time.Duration {
+		timeout := handlers.RequestTimeout(in.payload)
+		if timeout == 0 {
+			timeout = c.appCfg.Devices[in.device].Timeout
+		}
+		_, functions := handlers.Summarize(in.payload)
+		return time.Duration(cfg.Factor * float64(timeout) * float64(max(len(functions), 1)))
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.ctx.Done():
+			return
+		case now := <-ticker.C:
+			stuck := c.inflight.stuck(now, limit)
+			if len(stuck) == 0 {
+				continue
+			}
+
+			for _, r := range stuck {
+				atomic.AddUint64(&c.watchdogStats.stuck, 1)
+				cookie, _ := handlers.Summarize(r.in.payload)
+				log.Printf("Worker of lane %q stuck for %v on request %d for device %q (limit %v)",
+					r.lane(), now.Sub(r.started).Round(time.Millisecond), cookie, r.in.device, limit(r.in))
+
+				if w := r.worker; cfg.Restart && w != nil && atomic.CompareAndSwapInt32(&w.replaced, 0, 1) {
+					atomic.AddUint64(&c.watchdogStats.replaced, 1)
+					c.startWorker(w.ctx, w.lane, w.queue)
+					log.Printf("Started a replacement worker for lane %v", w.lane)
+				}
+			}
+
+			buf := make([]byte, maxStackDump)
+			log.Printf("Goroutines at stuck worker detection:\n%s", buf[:runtime.Stack(buf, true)])
+		}
+	}
+}
+
+// watchdogMetrics returns the counters of the watchdog
+func (c *Client) watchdogMetrics() map[string]interface{} {
+	return map[string]interface{}{
+		"stuck":    atomic.LoadUint64(&c.watchdogStats.stuck),
+		"replaced": atomic.LoadUint64(&c.watchdogStats.replaced),
+	}
+}
@@ -0,0 +1,237 @@
+// Package protocol defines the versions of the text request format of the
+// gateway, splitting requests into their header and commands and formatting
+// them back.
+//
+// Version 1 requests start with two fields that are not used, given as 0:
+//
+//	0 <COOKIE> 0 <IP> <PORT> <TIMEOUT> <SLAVE_ID> <FUNCTION> <REGISTER_NUMBER> <REGISTER_COUNT|VALUE> [<DATA>] [options]
+//
+// Version 2 requests give the version in the first field and drop the second:
+//
+//	v2 <COOKIE> <IP> <PORT> <TIMEOUT> <SLAVE_ID> <FUNCTION> <REGISTER_NUMBER> <REGISTER_COUNT|VALUE> [<DATA>] [options]
+//
+// In both versions, IP, PORT, TIMEOUT and SLAVE_ID may be given as "-" for
+// the setting of the device registry, and further commands sharing the
+// header follow after ';', starting at the function.
+package protocol
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ganehag/open-modbus-goateway/pkg/config"
+)
+
+// Version is a version of the text request format
+type Version int
+
+const (
+	V1 Version = 1
+	V2 Version = 2
+)
+
+// String returns the version as given in the first field of version 2
+// requests, e.g. "v2"
+func (v Version) String() string {
+	return "v" + strconv.Itoa(int(v))
+}
+
+// HeaderFields returns the number of fields of the header of a request
+func (v Version) HeaderFields() int {
+	if v == V2 {
+		return 6
+	}
+	return 7
+}
+
+// VersionOf returns the version of a request from its first field. Any first
+// field other than a version marker is a version 1 request, which doesn't use
+// the field.
+func VersionOf(first string) Version {
+	if first == V2.String() {
+		return V2
+	}
+	return V1
+}
+
+// RegistryField is given in place of the IP, PORT, TIMEOUT or SLAVE_ID field
+// of a request to use the setting of the device from the device registry
+const RegistryField = "-"
+
+// Header is the part of a request shared by its commands. The transport
+// fields are empty for the settings of the device registry.
+type Header struct {
+	Version Version
+	Cookie  uint64
+	IP      string        // Host name or IP address, IPv6 addresses unbracketed
+	Port    uint16        // TCP port
+	Timeout time.Duration // Timeout of the request, in whole seconds
+	SlaveID uint8         // Modbus unit ID
+}
+
+// ParseHeader parses the header at the start of the fields of a request and
+// returns the fields following it, starting at the function
+func ParseHeader(fields []string) (Header, []string, error) {
+	if len(fields) == 0 {
+		return Header{}, nil, fmt.Errorf("incomplete request payload")
+	}
+	h := Header{Version: VersionOf(fields[0])}
+	n := h.Version.HeaderFields()
+	if len(fields) < n {
+		return Header{}, nil, fmt.Errorf("incomplete request payload")
+	}
+	// The transport fields follow the cookie, and the unused field in version 1
+	cookie, transport := fields[1], fields[n-4:n]
+
+	var err error
+	if h.Cookie, err = strconv.ParseUint(cookie, 10, 64); err != nil {
+		return Header{}, nil, fmt.Errorf("invalid COOKIE value: %v", err)
+	}
+
+	if transport[0] != RegistryField {
+		h.IP = strings.TrimSuffix(strings.TrimPrefix(transport[0], "["), "]") // IPv6 addresses may be bracketed
+		if !config.ValidHost(h.IP) {
+			return Header{}, nil, fmt.Errorf("invalid IP value: %q is neither an IP address nor a host name", transport[0])
+		}
+	}
+
+	if transport[1] != RegistryField {
+		port, err := strconv.ParseUint(transport[1], 10, 16)
+		if err != nil || port < 1 || port > 65535 {
+			return Header{}, nil, fmt.Errorf("invalid PORT value: %v", err)
+		}
+		h.Port = uint16(port)
+	}
+
+	if transport[2] != RegistryField {
+		timeout, err := strconv.Atoi(transport[2])
+		if err != nil || timeout < 1 || timeout > 999 {
+			return Header{}, nil, fmt.Errorf("invalid TIMEOUT value: %v", err)
+		}
+		h.Timeout = time.Duration(timeout) * time.Second
+	}
+
+	if transport[3] != RegistryField {
+		slaveID, err := strconv.ParseUint(transport[3], 10, 8)
+		if err != nil || slaveID < 1 || slaveID > 255 {
+			return Header{}, nil, fmt.Errorf("invalid SLAVE_ID value: %v", err)
+		}
+		h.SlaveID = uint8(slaveID)
+	}
+
+	return h, fields[n:], nil
+}
+
+// Fields returns the fields of the header in its version, giving
+// RegistryField for the empty transport fields
+func (h Header) Fields() []string {
+	fields := []string{V2.String(), strconv.FormatUint(h.Cookie, 10)}
+	if h.Version != V2 {
+		fields = []string{"0", strconv.FormatUint(h.Cookie, 10), "0"}
+	}
+
+	ip := h.IP
+	if ip == "" {
+		ip = RegistryField
+	}
+	fields = append(fields, ip)
+	for _, value := range []uint64{uint64(h.Port), uint64(h.Timeout / time.Second), uint64(h.SlaveID)} {
+		if value == 0 {
+			fields = append(fields, RegistryField)
+		} else {
+			fields = append(fields, strconv.FormatUint(value, 10))
+		}
+	}
+	return fields
+}
+
+// Command is a command of a request
+type Command struct {
+	Fields  []string          // Positional fields, starting at the function
+	Options map[string]string // Trailing "key=value" options, keys lower-cased
+}
+
+// Request is a text request split into its header and commands
+type Request struct {
+	Header
+	Commands []Command
+}
+
+// Parse splits a text request of either version into its header and
+// commands. Only the header fields are validated; the fields of the commands
+// are left to the handlers.
+func Parse(payload string) (*Request, error) {
+	segments := strings.Split(payload, ";")
+	header, fields, err := ParseHeader(strings.Fields(segments[0]))
+	if err != nil {
+		return nil, err
+	}
+
+	req := &Request{Header: header}
+	for i, segment := range segments {
+		if i > 0 {
+			fields = strings.Fields(segment)
+		}
+		command := SplitOptions(fields)
+		if len(command.Fields) == 0 {
+			if i == 0 {
+				return nil, fmt.Errorf("incomplete request payload")
+			}
+			return nil, fmt.Errorf("command %d: empty command", i)
+		}
+		req.Commands = append(req.Commands, command)
+	}
+	return req, nil
+}
+
+// SplitOptions separates the positional fields of a command from its trailing
+// "key=value" options. Positional fields never contain '='.
+func SplitOptions(fields []string) Command {
+	end := len(fields)
+	for end > 0 && strings.Contains(fields[end-1], "=") {
+		end--
+	}
+	if end == len(fields) {
+		return Command{Fields: fields} // Reading a nil map is fine
+	}
+
+	options := make(map[string]string, len(fields)-end)
+	for _, option := range fields[end:] {
+		key, value, _ := strings.Cut(option, "=")
+		options[strings.ToLower(key)] = value
+	}
+	return Command{Fields: fields[:end], Options: options}
+}
+
+// String formats the command, with its options sorted by key
+func (c Command) String() string {
+	keys := make([]string, 0, len(c.Options))
+	for key := range c.Options {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fields := append([]string(nil), c.Fields...)
+	for _, key := range keys {
+		fields = append(fields, key+"="+c.Options[key])
+	}
+	return strings.Join(fields, " ")
+}
+
+// String formats the request in the version of its header, e.g. to convert a
+// version 1 request to version 2
+func (r *Request) String() string {
+	segments := make([]string, len(r.Commands))
+	for i, command := range r.Commands {
+		segments[i] = command.String()
+	}
+	header := strings.Join(r.Header.Fields(), " ")
+	if len(segments) == 0 {
+		return header
+	}
+	segments[0] = header + " " + segments[0]
+	return strings.Join(segments, " ; ")
+}
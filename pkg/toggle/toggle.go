@@ -0,0 +1,118 @@
+// Package toggle keeps the parts of the gateway traffic that operators have
+// disabled at runtime, e.g. to quiesce a device during incident response
+// without a configuration rollout.
+package toggle
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of traffic that can be disabled
+const (
+	Device    = "device"    // Requests received on the request topic of a device
+	Heartbeat = "heartbeat" // Gateway-generated heartbeat writes
+)
+
+// bucket is the storage bucket of persisted toggles, keyed "<kind>/<name>"
+const bucket = "toggles"
+
+// Store persists the toggles, e.g. the storage of the gateway
+type Store interface {
+	Put(bucket, key string, value []byte, ttl time.Duration) error
+	Delete(bucket, key string) error
+	Iterate(bucket string, fn func(key string, value []byte) error) error
+}
+
+// Set is the set of disabled traffic. It is safe for concurrent use.
+type Set struct {
+	mu       sync.RWMutex
+	disabled map[string]bool
+	store    Store // Persists the toggles, nil to keep them in memory
+}
+
+// NewSet creates a set with everything enabled, kept in memory
+func NewSet() *Set {
+	return &Set{disabled: make(map[string]bool)}
+}
+
+// Open creates a set persisted in a store, restoring the toggles of the
+// previous run
+func Open(store Store) (*Set, error) {
+	s := NewSet()
+	s.store = store
+
+	err := store.Iterate(bucket, func(key string, value []byte) error {
+		s.disabled[key] = true
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to restore toggles: %w", err)
+	}
+	return s, nil
+}
+
+// key identifies a toggle
+func key(kind, name string) string {
+	return kind + "/" + name
+}
+
+// Disabled reports whether the named traffic of a kind is disabled
+func (s *Set) Disabled(kind, name string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.disabled[key(kind, name)]
+}
+
+// Set enables or disables the named traffic of a kind
+func (s *Set) Set(kind, name string, disabled bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k := key(kind, name)
+	if s.store != nil {
+		var err error
+		if disabled {
+			err = s.store.Put(bucket, k, []byte{1}, 0)
+		} else {
+			err = s.store.Delete(bucket, k)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to persist toggle %s: %w", k, err)
+		}
+	}
+
+	if disabled {
+		s.disabled[k] = true
+	} else {
+		delete(s.disabled, k)
+	}
+	return nil
+}
+
+// Entry is a disabled part of the traffic
+type Entry struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+// List returns the disabled traffic, ordered by kind and name
+func (s *Set) List() []Entry {
+	s.mu.RLock()
+	keys := make([]string, 0, len(s.disabled))
+	for k := range s.disabled {
+		keys = append(keys, k)
+	}
+	s.mu.RUnlock()
+
+	sort.Strings(keys)
+	entries := make([]Entry, 0, len(keys))
+	for _, k := range keys {
+		kind, name, _ := strings.Cut(k, "/")
+		entries = append(entries, Entry{Kind: kind, Name: name})
+	}
+	return entries
+}
@@ -0,0 +1,23 @@
+package topic
+
+import "testing"
+
+func BenchmarkParse(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := Parse("site/plant1/modbus/meter1/request", "site/{site}/modbus/{device}/request"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkBuildTopic(b *testing.B) {
+	topic := &Topic{Format: "site/{site}/modbus/{device}/response", Values: map[string]string{"site": "plant1", "device": "meter1"}}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := topic.Build(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package topic
+
+import "testing"
+
+// FuzzParse checks that topics published by any client are parsed without
+// panicking, and that a parsed topic builds back into itself
+func FuzzParse(f *testing.F) {
+	f.Add("modbus/meter1/request", "modbus/{device}/request")
+	f.Add("site/plant1/modbus/meter1/request", "$share/gateways/site/{site}/modbus/{device}/request")
+	f.Add("modbus//request", "modbus/{device}/request")
+	f.Add("modbus/a/b/request", "modbus/{device}/request")
+	f.Add("modbus/x/y", "modbus/{a}/{a}")
+	f.Add("modbus/\xff\xfe/request", "modbus/{device}/request")
+	f.Add("modbus/💡/request", "modbus/{dévice}/request")
+	f.Add("", "$share/")
+
+	f.Fuzz(func(t *testing.T, topic, format string) {
+		parsed, err := Parse(topic, format)
+		if err != nil {
+			return
+		}
+		built, err := parsed.Build()
+		if err != nil {
+			t.Fatalf("Parse(%q, %q) = %v, but Build fails: %v", topic, format, parsed.Values, err)
+		}
+		if built != topic {
+			t.Fatalf("Parse(%q, %q) = %v builds %q", topic, format, parsed.Values, built)
+		}
+	})
+}
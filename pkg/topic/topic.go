@@ -1,4 +1,6 @@
-package mqtt
+// Package topic parses and builds the MQTT topics of the gateway from topic
+// formats with placeholders, e.g. "modbus/{device}/request".
+package topic
 
 import (
 	"fmt"
@@ -15,9 +17,9 @@ type Topic struct {
 	Values map[string]string // Placeholder values (e.g., {"device": "device123"})
 }
 
-// ParseTopic parses a topic string based on a format string with placeholders like `{device}`.
+// Parse parses a topic string based on a format string with placeholders like `{device}`.
 // It returns a Topic instance containing the parsed values.
-func ParseTopic(topic, format string) (*Topic, error) {
+func Parse(topic, format string) (*Topic, error) {
 	// Check for $share/<group> prefix in format
 	if strings.HasPrefix(format, "$share/") {
 		parts := strings.SplitN(format, "/", 3) // Split into $share, <group>, and the rest
@@ -38,6 +40,9 @@ func ParseTopic(topic, format string) (*Topic, error) {
 	for i, part := range formatParts {
 		if strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}") {
 			key := strings.Trim(part, "{}")
+			if value, ok := values[key]; ok && value != topicParts[i] {
+				return nil, fmt.Errorf("topic %q has conflicting values for placeholder %q of format %q", topic, key, format)
+			}
 			values[key] = topicParts[i]
 		} else if part != topicParts[i] {
 			return nil, fmt.Errorf("topic %q does not match format %q at part %d", topic, format, i)
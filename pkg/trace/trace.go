@@ -0,0 +1,107 @@
+// Package trace keeps the recent request/response exchanges of the gateway,
+// dumped via the control topic with their secrets redacted.
+package trace
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entry records a single request/response exchange
+type Entry struct {
+	Time     time.Time     `json:"time"`
+	Topic    string        `json:"topic"`
+	Device   string        `json:"device,omitempty"`
+	Request  string        `json:"request"`
+	Response string        `json:"response"`
+	Duration time.Duration `json:"duration_ns"`
+}
+
+// Buffer is a fixed-size ring buffer keeping the most recent entries.
+// A nil or zero-sized Buffer discards everything.
+type Buffer struct {
+	mu      sync.Mutex
+	entries []Entry
+	next    int
+	full    bool
+}
+
+// NewBuffer creates a ring buffer holding up to size entries
+func NewBuffer(size int) *Buffer {
+	if size <= 0 {
+		return nil
+	}
+	return &Buffer{entries: make([]Entry, size)}
+}
+
+// Add records an entry, overwriting the oldest one when the buffer is full.
+// Secrets in the request and response payloads are redacted.
+func (b *Buffer) Add(e Entry) {
+	if b == nil {
+		return
+	}
+
+	e.Request = Redact(e.Request)
+	e.Response = Redact(e.Response)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.entries[b.next] = e
+	b.next = (b.next + 1) % len(b.entries)
+	if b.next == 0 {
+		b.full = true
+	}
+}
+
+// Snapshot returns the buffered entries, oldest first
+func (b *Buffer) Snapshot() []Entry {
+	if b == nil {
+		return []Entry{}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.full {
+		return append([]Entry{}, b.entries[:b.next]...)
+	}
+	return append(append([]Entry{}, b.entries[b.next:]...), b.entries[:b.next]...)
+}
+
+// secretOptions lists request options whose values must never be recorded
+var secretOptions = []string{"sig", "key", "token", "password", "secret"}
+
+// secretMembers matches the secret options as members of a JSON payload, at
+// any depth, with a string or other scalar value
+var secretMembers = regexp.MustCompile(`(?i)("(?:` + strings.Join(secretOptions, "|") + `)"\s*:\s*)("(?:[^"\\]|\\.)*"|[^\s,}\]]+)`)
+
+// Redact replaces the values of secret "key=value" options, or of secret
+// members of JSON payloads, with a placeholder
+func Redact(payload string) string {
+	if strings.HasPrefix(strings.TrimSpace(payload), "{") {
+		return secretMembers.ReplaceAllString(payload, `${1}"REDACTED"`)
+	}
+
+	fields := strings.Fields(payload)
+	redacted := false
+	for i, field := range fields {
+		key, _, ok := strings.Cut(field, "=")
+		if !ok {
+			continue
+		}
+		for _, secret := range secretOptions {
+			if strings.EqualFold(key, secret) {
+				fields[i] = key + "=REDACTED"
+				redacted = true
+			}
+		}
+	}
+
+	if !redacted {
+		return payload
+	}
+	return strings.Join(fields, " ")
+}
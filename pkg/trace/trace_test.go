@@ -0,0 +1,28 @@
+package trace
+
+import "testing"
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		name     string
+		payload  string
+		redacted string
+	}{
+		{"text without secrets", "0 1 0 192.0.2.10 502 5 1 3 101 2 type=float32", "0 1 0 192.0.2.10 502 5 1 3 101 2 type=float32"},
+		{"text signature", "0 1 0 192.0.2.10 502 5 1 3 101 2 kid=k1 sig=3f1a", "0 1 0 192.0.2.10 502 5 1 3 101 2 kid=k1 sig=REDACTED"},
+		{"text option case", "0 1 0 192.0.2.10 502 5 1 3 101 2 Token=abc", "0 1 0 192.0.2.10 502 5 1 3 101 2 Token=REDACTED"},
+		{"JSON without secrets", `{"cookie": 1, "function": 3, "register": 101, "count": 2}`, `{"cookie": 1, "function": 3, "register": 101, "count": 2}`},
+		{"JSON signature", `{"cookie": 1, "function": 3, "kid": "k1", "sig": "3f1a"}`, `{"cookie": 1, "function": 3, "kid": "k1", "sig": "REDACTED"}`},
+		{"JSON options", `{"cookie":1,"options":{"sig":"3f1a","token":"a \"b\"","type":"float32"}}`, `{"cookie":1,"options":{"sig":"REDACTED","token":"REDACTED","type":"float32"}}`},
+		{"JSON batch options", `{"commands": [{"function": 3, "options": {"Password": 1234}}]}`, `{"commands": [{"function": 3, "options": {"Password": "REDACTED"}}]}`},
+		{"JSON secret values only", `{"cookie": 1, "data": ["token"]}`, `{"cookie": 1, "data": ["token"]}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if redacted := Redact(tt.payload); redacted != tt.redacted {
+				t.Errorf("redacted %s, expected %s", redacted, tt.redacted)
+			}
+		})
+	}
+}